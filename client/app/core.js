@@ -19,19 +19,20 @@ function login() {
         type: 'POST',
         data: JSON.stringify({ "username": username }),
         contentType: 'application/json',
+        dataType: 'json',
         success: function (data) {
             console.log(data);
-            parsed = $.parseJSON(data);
             state.username = username;
-            // Parse { "token": "mytoken" } from data and store in state.token
-            state.token = parsed.token;
+            // Store the token from { "token": "mytoken" } in state.token
+            state.token = data.token;
             $('#logout-username').text(username);
             $('#login-form').hide();
             $('#logout-form').show();
 
             // Start websocket connection
             state.ws = connect();
-        }
+        },
+        error: showError
     });
 }
 
@@ -43,6 +44,7 @@ function logout() {
         type: 'POST',
         data: JSON.stringify({ "username": state.username, "token": state.token }),
         contentType: 'application/json',
+        dataType: 'json',
         success: function (data) {
             console.log(data);
             state.username = null;
@@ -53,10 +55,22 @@ function logout() {
             // Close websocket connection
             disconnect(state.ws);
             state.ws = null;
-        }
+        },
+        error: showError
     });
 }
 
+// Errors are returned as { "code": "...", "message": "...", "details": "..." }
+function showError(xhr) {
+    var error = xhr.responseJSON;
+    if (error && error.message) {
+        console.log('Request failed (' + error.code + '): ' + error.message);
+        alert(error.message);
+    } else {
+        console.log('Request failed with status ' + xhr.status);
+    }
+}
+
 function connect() {
     var ws = new WebSocket(WS_URL);
 
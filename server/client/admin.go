@@ -0,0 +1,226 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// AdminUser is a logged in user as reported by the admin API.
+type AdminUser = model.AdminUser
+
+// AdminRoom is an active room as reported by the admin API.
+type AdminRoom = model.AdminRoom
+
+// Ban is a ban enforced by the server.
+type Ban = model.Ban
+
+// BanRequest describes a ban to create with Admin.Ban.
+type BanRequest = model.BanRequest
+
+// AuditEvent is an entry of the audit trail of the server.
+type AuditEvent = model.AuditEvent
+
+// AuditFilter selects the events returned by Admin.Audit.
+type AuditFilter = model.AuditFilter
+
+// FilterConfig configures the filters applied to the messages sent to a room.
+type FilterConfig = model.FilterConfig
+
+// Webhook is a URL receiving the events of a room as signed JSON POST requests.
+type Webhook = model.Webhook
+
+// WebhookRequest describes a webhook to register with Admin.CreateWebhook.
+type WebhookRequest = model.WebhookRequest
+
+// DeadLetter is a webhook delivery given up after failing every attempt.
+type DeadLetter = model.DeadLetter
+
+// IncomingWebhook is a token allowing to post messages to a room as a bot, without a session.
+type IncomingWebhook = model.IncomingWebhook
+
+// Admin is a client for the admin API of the server, authenticated with the admin token.
+type Admin struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewAdmin returns an admin client for the server at baseURL, using the given admin token.
+func NewAdmin(baseURL string, token string) *Admin {
+	return &Admin{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// Users returns the logged in users.
+func (a *Admin) Users(ctx context.Context) ([]AdminUser, error) {
+	var response model.AdminUsersResponse
+	if err := a.do(ctx, http.MethodGet, "/admin/users", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Users, nil
+}
+
+// Logout forcibly logs out a user. If reason is not empty, it is sent to the user before disconnecting it.
+func (a *Admin) Logout(ctx context.Context, username string, reason string) error {
+	var response model.AdminActionResponse
+	return a.do(ctx, http.MethodPost, "/admin/users/"+url.PathEscape(username)+"/logout", model.AdminLogoutRequest{Reason: reason}, &response)
+}
+
+// Announce broadcasts a system announcement to a room, or to every connected user if room is empty.
+func (a *Admin) Announce(ctx context.Context, room string, text string) error {
+	var response model.AdminActionResponse
+	return a.do(ctx, http.MethodPost, "/admin/announcements", model.AdminAnnouncementRequest{Text: text, Room: room}, &response)
+}
+
+// Rooms returns the active rooms and their members.
+func (a *Admin) Rooms(ctx context.Context) ([]AdminRoom, error) {
+	var response model.AdminRoomsResponse
+	if err := a.do(ctx, http.MethodGet, "/admin/rooms", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Rooms, nil
+}
+
+// CloseRoom closes a room, removing all its members.
+func (a *Admin) CloseRoom(ctx context.Context, room string) error {
+	var response model.AdminActionResponse
+	return a.do(ctx, http.MethodPost, "/admin/rooms/"+url.PathEscape(room)+"/close", nil, &response)
+}
+
+// RoomFilters returns the message filters of a room.
+func (a *Admin) RoomFilters(ctx context.Context, room string) (FilterConfig, error) {
+	var response model.RoomFiltersResponse
+	err := a.do(ctx, http.MethodGet, "/admin/rooms/"+url.PathEscape(room)+"/filters", nil, &response)
+	return response.Filters, err
+}
+
+// SetRoomFilters replaces the message filters of a room.
+func (a *Admin) SetRoomFilters(ctx context.Context, room string, config FilterConfig) error {
+	var response model.RoomFiltersResponse
+	return a.do(ctx, http.MethodPut, "/admin/rooms/"+url.PathEscape(room)+"/filters", config, &response)
+}
+
+// ResetRoomFilters makes a room use the default message filters.
+func (a *Admin) ResetRoomFilters(ctx context.Context, room string) error {
+	var response model.RoomFiltersResponse
+	return a.do(ctx, http.MethodDelete, "/admin/rooms/"+url.PathEscape(room)+"/filters", nil, &response)
+}
+
+// Webhooks returns the webhooks of a room, without their secrets.
+func (a *Admin) Webhooks(ctx context.Context, room string) ([]Webhook, error) {
+	var response model.WebhooksResponse
+	if err := a.do(ctx, http.MethodGet, "/admin/rooms/"+url.PathEscape(room)+"/webhooks", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Webhooks, nil
+}
+
+// CreateWebhook registers a webhook for a room. The returned webhook is the only one carrying its secret.
+func (a *Admin) CreateWebhook(ctx context.Context, room string, webhookRequest WebhookRequest) (Webhook, error) {
+	var webhook Webhook
+	err := a.do(ctx, http.MethodPost, "/admin/rooms/"+url.PathEscape(room)+"/webhooks", webhookRequest, &webhook)
+	return webhook, err
+}
+
+// DeleteWebhook removes a webhook of a room.
+func (a *Admin) DeleteWebhook(ctx context.Context, room string, id string) error {
+	var response model.AdminActionResponse
+	return a.do(ctx, http.MethodDelete, "/admin/rooms/"+url.PathEscape(room)+"/webhooks/"+url.PathEscape(id), nil, &response)
+}
+
+// IncomingWebhooks returns the incoming webhooks of a room, without their tokens.
+func (a *Admin) IncomingWebhooks(ctx context.Context, room string) ([]IncomingWebhook, error) {
+	var response model.IncomingWebhooksResponse
+	if err := a.do(ctx, http.MethodGet, "/admin/rooms/"+url.PathEscape(room)+"/incoming-webhooks", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Webhooks, nil
+}
+
+// CreateIncomingWebhook creates an incoming webhook for a room, posting as the bot named username,
+// or "webhook" if it's empty. The returned webhook is the only one carrying its token.
+func (a *Admin) CreateIncomingWebhook(ctx context.Context, room string, username string) (IncomingWebhook, error) {
+	var hook IncomingWebhook
+	err := a.do(ctx, http.MethodPost, "/admin/rooms/"+url.PathEscape(room)+"/incoming-webhooks", model.IncomingWebhookRequest{Username: username}, &hook)
+	return hook, err
+}
+
+// DeleteIncomingWebhook deletes an incoming webhook of a room, revoking its token.
+func (a *Admin) DeleteIncomingWebhook(ctx context.Context, room string, id string) error {
+	var response model.AdminActionResponse
+	return a.do(ctx, http.MethodDelete, "/admin/rooms/"+url.PathEscape(room)+"/incoming-webhooks/"+url.PathEscape(id), nil, &response)
+}
+
+// DeadLetters returns the webhook deliveries given up after failing every attempt, oldest first.
+func (a *Admin) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	var response model.DeadLettersResponse
+	if err := a.do(ctx, http.MethodGet, "/admin/webhooks/dead-letters", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.DeadLetters, nil
+}
+
+// Bans returns the bans currently enforced.
+func (a *Admin) Bans(ctx context.Context) ([]Ban, error) {
+	var response model.BansResponse
+	if err := a.do(ctx, http.MethodGet, "/admin/bans", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Bans, nil
+}
+
+// Ban bans a user by username and optionally by IP, disconnecting it.
+func (a *Admin) Ban(ctx context.Context, banRequest BanRequest) (Ban, error) {
+	var ban Ban
+	err := a.do(ctx, http.MethodPost, "/admin/bans", banRequest, &ban)
+	return ban, err
+}
+
+// Unban lifts the ban of a user.
+func (a *Admin) Unban(ctx context.Context, username string) error {
+	var response model.AdminActionResponse
+	return a.do(ctx, http.MethodDelete, "/admin/bans/"+url.PathEscape(username), nil, &response)
+}
+
+// Audit returns the events of the audit trail selected by the filter, oldest first.
+func (a *Admin) Audit(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	query := url.Values{}
+	if !filter.From.IsZero() {
+		query.Set("from", filter.From.Format(time.RFC3339))
+	}
+	if !filter.To.IsZero() {
+		query.Set("to", filter.To.Format(time.RFC3339))
+	}
+	if filter.User != "" {
+		query.Set("user", filter.User)
+	}
+	if filter.Action != "" {
+		query.Set("action", filter.Action)
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	path := "/admin/audit"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var response model.AuditEventsResponse
+	if err := a.do(ctx, http.MethodGet, path, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Events, nil
+}
+
+func (a *Admin) do(ctx context.Context, method string, path string, request any, response any) error {
+	return doRequest(ctx, a.httpClient, method, a.baseURL+path, a.token, request, response)
+}
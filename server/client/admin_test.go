@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/DaniSancas/go-chat-room/server/internal/routes"
+)
+
+func TestAdminListAndLogoutUsers(t *testing.T) {
+	handler := routes.NewHandler()
+	handler.AdminToken = "secret"
+	server := httptest.NewServer(handler.NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	defer alice.Close()
+	if err := alice.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, alice, EventJoined, "alice")
+
+	admin := NewAdmin(server.URL, "secret")
+	users, err := admin.Users(context.Background())
+	if err != nil {
+		t.Fatalf("Users failed: %v", err)
+	}
+	if len(users) != 1 || users[0].Username != "alice" || !users[0].Connected || len(users[0].Rooms) != 1 {
+		t.Errorf("Unexpected users: %+v", users)
+	}
+
+	if err := admin.Logout(context.Background(), "alice", "Bye"); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	event := expectEvent(t, alice, model.StreamEventSystem, "")
+	if event.Text != "Bye" {
+		t.Errorf("Unexpected system event: %+v", event)
+	}
+}
+
+func TestAdminInvalidToken(t *testing.T) {
+	handler := routes.NewHandler()
+	handler.AdminToken = "secret"
+	server := httptest.NewServer(handler.NewServeMux())
+	defer server.Close()
+
+	_, err := NewAdmin(server.URL, "other").Rooms(context.Background())
+	var apiError *Error
+	if !errors.As(err, &apiError) || apiError.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected an unauthorized error, got %v", err)
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	handler := routes.NewHandler()
+	handler.AdminToken = "secret"
+	server := httptest.NewServer(handler.NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	defer alice.Close()
+	admin := NewAdmin(server.URL, "secret")
+	if err := admin.Logout(context.Background(), "alice", ""); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+
+	events, err := admin.Audit(context.Background(), AuditFilter{User: "alice", Action: model.AuditActionForcedLogout})
+	if err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+	if len(events) != 1 || events[0].Actor != "admin-api" || events[0].Target != "alice" {
+		t.Errorf("Unexpected audit events: %+v", events)
+	}
+}
@@ -0,0 +1,681 @@
+// Package client is a Go SDK for the chat room server, meant for bots and integrations.
+//
+// A Client logs in through the HTTP API, binds a websocket stream to the session and delivers
+// the room activity as typed events. If the stream drops, the client reconnects reusing its token,
+// logs in again if the session was lost, and the server rejoins the user to the rooms it was subscribed to.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/DaniSancas/go-chat-room/server/internal/msgpack"
+	"github.com/gorilla/websocket"
+)
+
+// Event is a frame received from the stream, such as a message or a user joining a room.
+type Event = model.StreamEvent
+
+// Types of Event sent by the server.
+const (
+	EventJoined        = model.StreamEventJoined
+	EventLeft          = model.StreamEventLeft
+	EventMessage       = model.StreamEventMessage
+	EventError         = model.StreamEventError
+	EventSystem        = model.StreamEventSystem
+	EventRoomClosed    = model.StreamEventRoomClosed
+	EventRoleChanged   = model.StreamEventRoleChanged
+	EventKicked        = model.StreamEventKicked
+	EventMuted         = model.StreamEventMuted
+	EventUnmuted       = model.StreamEventUnmuted
+	EventBanned        = model.StreamEventBanned
+	EventAction        = model.StreamEventAction
+	EventRoomUpdated   = model.StreamEventRoomUpdated
+	EventReply         = model.StreamEventReply
+	EventRenamed       = model.StreamEventRenamed
+	EventInvited       = model.StreamEventInvited
+	EventInviteCreated = model.StreamEventInviteCreated
+	EventMembers       = model.StreamEventMembers
+	EventRead          = model.StreamEventRead
+)
+
+// RoomInfo describes a room, sent when joining it and when it's updated.
+type RoomInfo = model.RoomInfo
+
+// RoomUpdate describes the changes made by UpdateRoom.
+type RoomUpdate = model.RoomUpdate
+
+// Invite is a shareable code to join an invite-only room, created with CreateInvite.
+type Invite = model.Invite
+
+// RoomListing describes a room returned by Rooms.
+type RoomListing = model.RoomListing
+
+// RoomMember is a member of a room returned by Members, online or not.
+type RoomMember = model.RoomMember
+
+// UnreadCount is the number of unread messages of a room, returned by Unread.
+type UnreadCount = model.UnreadCount
+
+// RoomRole is the role of a member within a room.
+type RoomRole = model.RoomRole
+
+// Room roles accepted by SetRole.
+const (
+	RoomRoleOwner     = model.RoomRoleOwner
+	RoomRoleModerator = model.RoomRoleModerator
+	RoomRoleMember    = model.RoomRoleMember
+	RoomRoleReadOnly  = model.RoomRoleReadOnly
+)
+
+// EventReconnected is the type of the event emitted by the client itself after the stream
+// was restored. It's followed by the joined events of the rooms rejoined by the server.
+const EventReconnected = "reconnected"
+
+// eventBufferSize is the number of events queued before the client stops reading from the stream.
+const eventBufferSize = 64
+
+// defaultReconnectDelay and maxReconnectDelay bound the exponential backoff between reconnection attempts.
+const (
+	defaultReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay     = 30 * time.Second
+)
+
+// ErrNotLoggedIn is returned when an operation needs a session and the client has none.
+var ErrNotLoggedIn = errors.New("client is not logged in")
+
+// ErrNotConnected is returned when an operation needs the stream and the client is not connected.
+var ErrNotConnected = errors.New("client is not connected")
+
+// ErrAlreadyConnected is returned by Connect when the stream is already open.
+var ErrAlreadyConnected = errors.New("client is already connected")
+
+// Error is returned when the server rejects a request with an error response.
+type Error struct {
+	// StatusCode is the HTTP status of the response, zero for errors received through the stream.
+	StatusCode int
+	Code       string
+	Message    string
+	Details    string
+}
+
+func (err *Error) Error() string {
+	if err.Details != "" {
+		return fmt.Sprintf("%s: %s (%s)", err.Code, err.Message, err.Details)
+	}
+	return fmt.Sprintf("%s: %s", err.Code, err.Message)
+}
+
+// Client is a connection to the chat room server. It is safe for concurrent use.
+type Client struct {
+	baseURL        string
+	httpClient     *http.Client
+	dialer         *websocket.Dialer
+	reconnectDelay time.Duration
+	messagePack    bool
+	compression    bool
+
+	mu       sync.Mutex
+	username string
+	secret   string
+	token    string
+	conn     *websocket.Conn
+	events   chan Event
+	done     chan struct{}
+
+	// writeMu serializes the writes to the websocket, which doesn't support concurrent writers
+	writeMu sync.Mutex
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for the HTTP API.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithDialer sets the dialer used to open the websocket stream.
+func WithDialer(dialer *websocket.Dialer) Option {
+	return func(c *Client) {
+		c.dialer = dialer
+	}
+}
+
+// WithReconnectDelay sets the initial delay between reconnection attempts, doubled after every failure.
+func WithReconnectDelay(delay time.Duration) Option {
+	return func(c *Client) {
+		c.reconnectDelay = delay
+	}
+}
+
+// WithMessagePack makes the stream use MessagePack binary frames instead of JSON text frames, which are smaller.
+// The client falls back to JSON with servers that don't support it.
+func WithMessagePack() Option {
+	return func(c *Client) {
+		c.messagePack = true
+	}
+}
+
+// WithCompression negotiates permessage-deflate compression of the stream, for slow links.
+func WithCompression() Option {
+	return func(c *Client) {
+		c.compression = true
+	}
+}
+
+// WithSession makes the client reuse an existing session instead of logging in.
+func WithSession(username string, token string) Option {
+	return func(c *Client) {
+		c.username = username
+		c.token = token
+	}
+}
+
+// New returns a client for the server at baseURL, e.g. http://localhost:8080.
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		httpClient:     http.DefaultClient,
+		dialer:         websocket.DefaultDialer,
+		reconnectDelay: defaultReconnectDelay,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Session returns the username and token of the current session, empty if the client is not logged in.
+func (c *Client) Session() (username string, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.username, c.token
+}
+
+// Login logs in with the given username and stores the session token.
+func (c *Client) Login(ctx context.Context, username string) error {
+	return c.LoginWithSecret(ctx, username, "")
+}
+
+// LoginWithSecret logs in as a privileged user configured on the server with the given secret.
+// The secret is kept to log in again if the session is lost.
+func (c *Client) LoginWithSecret(ctx context.Context, username string, secret string) error {
+	var response model.UserLoginResponse
+	if err := c.post(ctx, "/login", model.UserLoginRequest{Username: username, Secret: secret}, &response); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username = username
+	c.secret = secret
+	c.token = response.Token
+	return nil
+}
+
+// Logout ends the session, which also closes the stream and the events channel.
+func (c *Client) Logout(ctx context.Context) error {
+	username, token := c.Session()
+	if token == "" {
+		return ErrNotLoggedIn
+	}
+	// Stop reconnecting before the server closes the stream
+	c.stop()
+
+	var response model.UserLogoutResponse
+	if err := c.post(ctx, "/logout", model.UserWithTokenRequest{Username: username, Token: token}, &response); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+	return nil
+}
+
+// Connect opens the websocket stream for the current session.
+// Events are delivered through the channel returned by Events until Close or Logout is called.
+func (c *Client) Connect(ctx context.Context) error {
+	if c.connected() {
+		return ErrAlreadyConnected
+	}
+
+	conn, err := c.handshake(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	c.events = make(chan Event, eventBufferSize)
+	c.done = make(chan struct{})
+	go c.run(conn, c.events, c.done)
+	return nil
+}
+
+// connected reports whether the stream was opened and not stopped yet.
+func (c *Client) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done == nil {
+		return false
+	}
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Events returns the channel of events received from the stream.
+// The channel is closed when the client is closed or logged out.
+func (c *Client) Events() <-chan Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.events
+}
+
+// Subscribe joins the room. The server remembers the subscription, and restores it after a reconnection
+// or a new login, until Unsubscribe is called.
+func (c *Client) Subscribe(room string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestJoin, Room: room})
+}
+
+// SubscribeWithInvite joins an invite-only room with an invite code.
+// Once joined, the user stays invited and the subscription is restored without the code.
+func (c *Client) SubscribeWithInvite(room string, code string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestJoin, Room: room, Code: code})
+}
+
+// Unsubscribe leaves the room.
+func (c *Client) Unsubscribe(room string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestLeave, Room: room})
+}
+
+// Send sends a message to a room the client is subscribed to.
+func (c *Client) Send(room string, text string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestMessage, Room: room, Text: text})
+}
+
+// UpdateRoom changes the topic, description or metadata of a room. Owners and moderators of the room
+// can change the topic, only owners can change the rest.
+func (c *Client) UpdateRoom(room string, update RoomUpdate) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestUpdateRoom, Room: room, Update: &update})
+}
+
+// Invite invites a user to an invite-only room. It requires a permission in the room.
+func (c *Client) Invite(room string, username string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestInvite, Room: room, User: username})
+}
+
+// CreateInvite creates an invite code for a room, valid for the given duration and number of joins,
+// zero meaning unlimited. The code is delivered in an EventInviteCreated event. It requires a permission in the room.
+func (c *Client) CreateInvite(room string, duration time.Duration, maxUses int) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestCreateInvite, Room: room, Duration: int(duration.Seconds()), MaxUses: maxUses})
+}
+
+// Rooms returns the rooms the user can see, which exclude the private rooms it's not in or invited to.
+func (c *Client) Rooms(ctx context.Context) ([]RoomListing, error) {
+	_, token := c.Session()
+	if token == "" {
+		return nil, ErrNotLoggedIn
+	}
+	var response model.RoomsResponse
+	if err := doRequest(ctx, c.httpClient, http.MethodGet, c.baseURL+"/rooms", token, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Rooms, nil
+}
+
+// Members returns the members of a room, online or not, with their room role.
+func (c *Client) Members(ctx context.Context, room string) ([]RoomMember, error) {
+	_, token := c.Session()
+	if token == "" {
+		return nil, ErrNotLoggedIn
+	}
+	var response model.RoomMembersResponse
+	if err := doRequest(ctx, c.httpClient, http.MethodGet, c.baseURL+"/rooms/"+url.PathEscape(room)+"/members", token, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Members, nil
+}
+
+// QueryMembers asks for the members of a room through the stream, delivered in an EventMembers event.
+func (c *Client) QueryMembers(room string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestMembers, Room: room})
+}
+
+// Unread returns the unread counts of the rooms of the user.
+func (c *Client) Unread(ctx context.Context) ([]UnreadCount, error) {
+	_, token := c.Session()
+	if token == "" {
+		return nil, ErrNotLoggedIn
+	}
+	var response model.UnreadResponse
+	if err := doRequest(ctx, c.httpClient, http.MethodGet, c.baseURL+"/me/unread", token, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Rooms, nil
+}
+
+// MarkRead marks the messages of a room as read up to the given message ID, zero meaning all of them.
+// The resulting unread count is delivered in an EventRead event.
+func (c *Client) MarkRead(room string, messageID int64) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestMarkRead, Room: room, MessageID: messageID})
+}
+
+// SetRole changes the room role of a member of the room. It requires a permission in the room.
+func (c *Client) SetRole(room string, username string, role RoomRole) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestSetRole, Room: room, User: username, Role: role})
+}
+
+// Kick removes a user from a room, telling it the reason. It requires a permission in the room.
+func (c *Client) Kick(room string, username string, reason string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestKick, Room: room, User: username, Text: reason})
+}
+
+// Mute prevents a user from sending messages to a room for the given duration, zero meaning until unmuted.
+// It requires a permission in the room.
+func (c *Client) Mute(room string, username string, duration time.Duration, reason string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestMute, Room: room, User: username, Duration: int(duration.Seconds()), Text: reason})
+}
+
+// Unmute lifts the mute of a user in a room. It requires a permission in the room.
+func (c *Client) Unmute(room string, username string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestUnmute, Room: room, User: username})
+}
+
+// Ban bans a user from the server for the given duration, zero meaning until lifted.
+// It requires the global moderator role.
+func (c *Client) Ban(username string, duration time.Duration, reason string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestBan, User: username, Duration: int(duration.Seconds()), Text: reason})
+}
+
+// Rename changes the username of the session. The new username is used once the server confirms it with a renamed event.
+func (c *Client) Rename(nickname string) error {
+	return c.send(model.StreamRequest{Type: model.StreamRequestMessage, Text: "/nick " + nickname})
+}
+
+// renamed updates the username of the session when the server renames it.
+func (c *Client) renamed(event Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if event.From == c.username {
+		c.username = event.NewName
+	}
+}
+
+// Close closes the stream without ending the session, so the token can be reused later.
+func (c *Client) Close() error {
+	c.stop()
+	return nil
+}
+
+// stop closes the stream and prevents any further reconnection.
+func (c *Client) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done == nil {
+		return
+	}
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// send writes a request to the current stream connection.
+func (c *Client) send(request model.StreamRequest) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return c.write(conn, request)
+}
+
+// write marshals a frame and writes it to the connection, in the encoding negotiated with the server.
+func (c *Client) write(conn *websocket.Conn, frame any) error {
+	msg, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	messageType := websocket.TextMessage
+	if conn.Subprotocol() == model.SubprotocolMessagePack {
+		if msg, err = msgpack.FromJSON(msg); err != nil {
+			return err
+		}
+		messageType = websocket.BinaryMessage
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return conn.WriteMessage(messageType, msg)
+}
+
+// decodeFrame converts a frame read from the connection to JSON, if it's encoded as MessagePack.
+func decodeFrame(conn *websocket.Conn, messageType int, message []byte) ([]byte, error) {
+	if messageType != websocket.BinaryMessage || conn.Subprotocol() != model.SubprotocolMessagePack {
+		return message, nil
+	}
+	return msgpack.ToJSON(message)
+}
+
+// handshake dials the stream and binds it to the current session, waiting for the welcome frame.
+func (c *Client) handshake(ctx context.Context) (*websocket.Conn, error) {
+	username, token := c.Session()
+	if token == "" {
+		return nil, ErrNotLoggedIn
+	}
+
+	url := "ws" + strings.TrimPrefix(c.baseURL, "http") + "/stream"
+	dialer := *c.dialer
+	if c.messagePack {
+		dialer.Subprotocols = []string{model.SubprotocolMessagePack}
+	}
+	dialer.EnableCompression = dialer.EnableCompression || c.compression
+	conn, _, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(conn, model.UserWithTokenRequest{Username: username, Token: token}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	messageType, response, err := conn.ReadMessage()
+	if err == nil {
+		response, err = decodeFrame(conn, messageType, response)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var welcome model.WebsocketWelcomeResponse
+	if err := json.Unmarshal(response, &welcome); err == nil && welcome.Welcome == username {
+		return conn, nil
+	}
+	conn.Close()
+	var errorResponse model.ErrorResponse
+	if err := json.Unmarshal(response, &errorResponse); err != nil || errorResponse.Code == "" {
+		return nil, fmt.Errorf("unexpected handshake response: %s", response)
+	}
+	return nil, &Error{Code: errorResponse.Code, Message: errorResponse.Message, Details: errorResponse.Details}
+}
+
+// run reads events from the stream until the client is stopped, reconnecting when the stream drops.
+func (c *Client) run(conn *websocket.Conn, events chan Event, done chan struct{}) {
+	defer close(events)
+	for {
+		c.read(conn, events, done)
+
+		var ok bool
+		if conn, ok = c.reconnect(done); !ok {
+			return
+		}
+		select {
+		case events <- Event{Type: EventReconnected, Timestamp: time.Now().UTC()}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// read delivers the events of the connection until it fails.
+func (c *Client) read(conn *websocket.Conn, events chan Event, done chan struct{}) {
+	defer conn.Close()
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var event Event
+		if message, err = decodeFrame(conn, messageType, message); err != nil {
+			log.Printf("Can't decode event: %v", err)
+			continue
+		}
+		if err := json.Unmarshal(message, &event); err != nil {
+			log.Printf("Can't decode event: %v", err)
+			continue
+		}
+		if event.Type == EventRenamed {
+			c.renamed(event)
+		}
+		select {
+		case events <- event:
+		case <-done:
+			return
+		}
+	}
+}
+
+// reconnect restores the stream with an exponential backoff, logging in again if the session was lost.
+// The server rejoins the user to its rooms once the stream is restored.
+// It returns false if the client was stopped meanwhile or banned.
+func (c *Client) reconnect(done chan struct{}) (*websocket.Conn, bool) {
+	delay := c.reconnectDelay
+	for {
+		select {
+		case <-done:
+			return nil, false
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+
+		conn, err := c.reconnectOnce()
+		var apiError *Error
+		if errors.As(err, &apiError) && apiError.Code == model.ErrorCodeBanned {
+			log.Printf("Not reconnecting: %v", err)
+			return nil, false
+		}
+		if err != nil {
+			log.Printf("Reconnection failed: %v", err)
+			continue
+		}
+
+		c.mu.Lock()
+		select {
+		case <-done:
+			c.mu.Unlock()
+			conn.Close()
+			return nil, false
+		default:
+		}
+		c.conn = conn
+		c.mu.Unlock()
+		return conn, true
+	}
+}
+
+// reconnectOnce tries to bind a new stream to the session, logging in again if the token is no longer valid.
+func (c *Client) reconnectOnce() (*websocket.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := c.handshake(ctx)
+	var apiError *Error
+	if !errors.As(err, &apiError) || (apiError.Code != model.ErrorCodeNotLoggedIn && apiError.Code != model.ErrorCodeInvalidToken) {
+		return conn, err
+	}
+
+	c.mu.Lock()
+	username, secret := c.username, c.secret
+	c.mu.Unlock()
+	if err := c.LoginWithSecret(ctx, username, secret); err != nil {
+		return nil, err
+	}
+	return c.handshake(ctx)
+}
+
+// post sends a JSON request to the HTTP API and decodes the JSON response.
+func (c *Client) post(ctx context.Context, path string, request any, response any) error {
+	return doRequest(ctx, c.httpClient, http.MethodPost, c.baseURL+path, "", request, response)
+}
+
+// doRequest sends a request to the HTTP API, with a JSON body unless request is nil, and decodes the JSON response.
+// The token, if any, is sent as a bearer token. Error responses are returned as *Error.
+func doRequest(ctx context.Context, httpClient *http.Client, method string, url string, token string, request any, response any) error {
+	var body io.Reader
+	if request != nil {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errorResponse model.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
+			return &Error{StatusCode: resp.StatusCode, Code: model.ErrorCodeInternal, Message: resp.Status}
+		}
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Code:       errorResponse.Code,
+			Message:    errorResponse.Message,
+			Details:    errorResponse.Details,
+		}
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
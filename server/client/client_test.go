@@ -0,0 +1,406 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/DaniSancas/go-chat-room/server/internal/routes"
+)
+
+func TestLoginAndLogout(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	c := New(server.URL)
+	if err := c.Login(context.Background(), "alice"); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if username, token := c.Session(); username != "alice" || token == "" {
+		t.Errorf("Unexpected session: %v %v", username, token)
+	}
+
+	if err := c.Logout(context.Background()); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	if _, token := c.Session(); token != "" {
+		t.Errorf("Token should be cleared after logout")
+	}
+}
+
+func TestLoginAlreadyLoggedIn(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	if err := New(server.URL).Login(context.Background(), "alice"); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	err := New(server.URL).Login(context.Background(), "alice")
+	var apiError *Error
+	if !errors.As(err, &apiError) {
+		t.Fatalf("Expected an API error, got %v", err)
+	}
+	if apiError.StatusCode != http.StatusConflict || apiError.Code != model.ErrorCodeAlreadyLoggedIn {
+		t.Errorf("Unexpected error: %+v", apiError)
+	}
+}
+
+func TestConnectInvalidToken(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	if err := New(server.URL).Login(context.Background(), "alice"); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	c := New(server.URL, WithSession("alice", "invalid-token"))
+	err := c.Connect(context.Background())
+	var apiError *Error
+	if !errors.As(err, &apiError) || apiError.Code != model.ErrorCodeInvalidToken {
+		t.Fatalf("Expected an invalid token error, got %v", err)
+	}
+}
+
+func TestSubscribeAndSend(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	defer alice.Close()
+	bob := connectedClient(t, server, "bob")
+	defer bob.Close()
+
+	if err := alice.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, alice, EventJoined, "alice")
+	if err := bob.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, bob, EventJoined, "bob")
+	expectEvent(t, alice, EventJoined, "bob")
+
+	if err := bob.Send("general", "hello"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	event := expectEvent(t, alice, EventMessage, "bob")
+	if event.Room != "general" || event.Text != "hello" {
+		t.Errorf("Unexpected message: %+v", event)
+	}
+}
+
+func TestReconnectReusesToken(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	defer alice.Close()
+	if err := alice.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, alice, EventJoined, "alice")
+
+	// Simulate a network failure by closing the underlying connection
+	alice.mu.Lock()
+	alice.conn.Close()
+	alice.mu.Unlock()
+
+	expectEvent(t, alice, EventReconnected, "")
+	expectEvent(t, alice, EventJoined, "alice")
+
+	if err := alice.Send("general", "still here"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	event := expectEvent(t, alice, EventMessage, "alice")
+	if event.Text != "still here" {
+		t.Errorf("Unexpected message: %+v", event)
+	}
+}
+
+func TestReconnectLogsInAgainWhenSessionIsLost(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	defer alice.Close()
+	if err := alice.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, alice, EventJoined, "alice")
+
+	// End the session behind the client's back, which closes its stream
+	username, token := alice.Session()
+	body, _ := json.Marshal(model.UserWithTokenRequest{Username: username, Token: token})
+	resp, err := http.Post(server.URL+"/logout", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	resp.Body.Close()
+
+	expectEvent(t, alice, EventReconnected, "")
+	expectEvent(t, alice, EventJoined, "alice")
+	if _, newToken := alice.Session(); newToken == token || newToken == "" {
+		t.Errorf("Client should have logged in again with a new token")
+	}
+}
+
+func TestLogoutClosesEvents(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	if err := alice.Logout(context.Background()); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+
+	select {
+	case _, ok := <-alice.Events():
+		if ok {
+			t.Errorf("No event expected after logout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Events channel should be closed after logout")
+	}
+}
+
+// connectedClient returns a client logged in as the user and connected to the stream of the test server.
+func connectedClient(t *testing.T, server *httptest.Server, username string) *Client {
+	t.Helper()
+
+	c := New(server.URL, WithReconnectDelay(10*time.Millisecond))
+	if err := c.Login(context.Background(), username); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	return c
+}
+
+// expectEvent waits for the next event of the client and checks its type and sender.
+func expectEvent(t *testing.T, c *Client, eventType string, from string) Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-c.Events():
+		if !ok {
+			t.Fatalf("Events channel closed while waiting for %s", eventType)
+		}
+		if event.Type != eventType || event.From != from {
+			t.Fatalf("Unexpected event: got %+v want type=%s from=%s", event, eventType, from)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for %s event", eventType)
+	}
+	return Event{}
+}
+
+func TestClientRename(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	c := connectedClient(t, server, "alice")
+	if err := c.Rename("carol"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if event := expectEvent(t, c, EventRenamed, "alice"); event.NewName != "carol" {
+		t.Errorf("Unexpected new name: %v", event.NewName)
+	}
+	if username, _ := c.Session(); username != "carol" {
+		t.Errorf("Session should use the new username, got %v", username)
+	}
+	// Logging out needs the new username
+	if err := c.Logout(context.Background()); err != nil {
+		t.Errorf("Logout failed: %v", err)
+	}
+}
+
+func TestClientInviteAndRooms(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	defer alice.Close()
+	bob := connectedClient(t, server, "bob")
+	defer bob.Close()
+
+	if err := alice.Subscribe("secret"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, alice, EventJoined, "alice")
+	private, inviteOnly := true, true
+	if err := alice.UpdateRoom("secret", RoomUpdate{Private: &private, InviteOnly: &inviteOnly}); err != nil {
+		t.Fatalf("UpdateRoom failed: %v", err)
+	}
+	expectEvent(t, alice, EventRoomUpdated, "alice")
+
+	rooms, err := bob.Rooms(context.Background())
+	if err != nil {
+		t.Fatalf("Rooms failed: %v", err)
+	}
+	if len(rooms) != 0 {
+		t.Errorf("Private rooms should not be listed: %+v", rooms)
+	}
+
+	if err := alice.CreateInvite("secret", time.Hour, 1); err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	invite := expectEvent(t, alice, EventInviteCreated, "alice").Invite
+	if err := bob.SubscribeWithInvite("secret", invite.Code); err != nil {
+		t.Fatalf("SubscribeWithInvite failed: %v", err)
+	}
+	expectEvent(t, bob, EventJoined, "bob")
+
+	rooms, err = bob.Rooms(context.Background())
+	if err != nil {
+		t.Fatalf("Rooms failed: %v", err)
+	}
+	if len(rooms) != 1 || rooms[0].Name != "secret" || rooms[0].Members != 2 {
+		t.Errorf("Members should see private rooms: %+v", rooms)
+	}
+}
+
+func TestClientMembersAndRejoin(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	defer alice.Close()
+	bob := connectedClient(t, server, "bob")
+
+	if err := alice.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, alice, EventJoined, "alice")
+	if err := bob.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, bob, EventJoined, "bob")
+	expectEvent(t, alice, EventJoined, "bob")
+
+	if err := bob.Logout(context.Background()); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	expectEvent(t, alice, EventLeft, "bob")
+
+	members, err := alice.Members(context.Background(), "general")
+	if err != nil {
+		t.Fatalf("Members failed: %v", err)
+	}
+	expected := []RoomMember{
+		{Username: "alice", Online: true, Role: RoomRoleOwner},
+		{Username: "bob", Online: false, Role: RoomRoleMember},
+	}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("Unexpected members: got %+v want %+v", members, expected)
+	}
+
+	// Logging in again rejoins the rooms of the user
+	bob = connectedClient(t, server, "bob")
+	defer bob.Close()
+	if event := expectEvent(t, bob, EventJoined, "bob"); event.Room != "general" {
+		t.Errorf("Unexpected joined event: %+v", event)
+	}
+	expectEvent(t, alice, EventJoined, "bob")
+
+	if err := bob.QueryMembers("general"); err != nil {
+		t.Fatalf("QueryMembers failed: %v", err)
+	}
+	event := expectEvent(t, bob, EventMembers, "")
+	if len(event.RoomMembers) != 2 || !event.RoomMembers[1].Online {
+		t.Errorf("Unexpected members event: %+v", event.RoomMembers)
+	}
+}
+
+func TestClientUnread(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	alice := connectedClient(t, server, "alice")
+	defer alice.Close()
+	bob := connectedClient(t, server, "bob")
+	defer bob.Close()
+
+	if err := alice.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, alice, EventJoined, "alice")
+	if err := bob.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	expectEvent(t, bob, EventJoined, "bob")
+	expectEvent(t, alice, EventJoined, "bob")
+	for _, text := range []string{"one", "two"} {
+		if err := bob.Send("general", text); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		expectEvent(t, alice, EventMessage, "bob")
+	}
+
+	unread, err := alice.Unread(context.Background())
+	if err != nil {
+		t.Fatalf("Unread failed: %v", err)
+	}
+	if len(unread) != 1 || unread[0].Unread != 2 {
+		t.Errorf("Unexpected unread counts: %+v", unread)
+	}
+	if err := alice.MarkRead("general", 0); err != nil {
+		t.Fatalf("MarkRead failed: %v", err)
+	}
+	if event := expectEvent(t, alice, EventRead, ""); event.Unread.Unread != 0 {
+		t.Errorf("Unexpected read event: %+v", event.Unread)
+	}
+}
+
+func TestClientMessagePack(t *testing.T) {
+	server := httptest.NewServer(routes.NewHandler().NewServeMux())
+	defer server.Close()
+
+	alice := New(server.URL, WithMessagePack(), WithCompression())
+	if err := alice.Login(context.Background(), "alice"); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if err := alice.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer alice.Close()
+	alice.mu.Lock()
+	subprotocol := alice.conn.Subprotocol()
+	alice.mu.Unlock()
+	if subprotocol != model.SubprotocolMessagePack {
+		t.Fatalf("Unexpected subprotocol: got %q want %q", subprotocol, model.SubprotocolMessagePack)
+	}
+	bob := connectedClient(t, server, "bob")
+	defer bob.Close()
+
+	alice.Subscribe("general")
+	expectEvent(t, alice, EventJoined, "alice")
+	bob.Subscribe("general")
+	expectEvent(t, bob, EventJoined, "bob")
+	expectEvent(t, alice, EventJoined, "bob")
+
+	// Long messages are compressed too
+	text := strings.Repeat("hello from a slow link ", 20)
+	if err := alice.Send("general", text); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, alice, EventMessage, "alice")
+	if event := expectEvent(t, bob, EventMessage, "alice"); event.Text != text {
+		t.Errorf("Unexpected message: got %q want %q", event.Text, text)
+	}
+	bob.Send("general", "hi")
+	expectEvent(t, bob, EventMessage, "bob")
+	if event := expectEvent(t, alice, EventMessage, "bob"); event.Text != "hi" || event.ID == 0 {
+		t.Errorf("Unexpected message: %+v", event)
+	}
+}
@@ -1,7 +1,13 @@
 package main
 
-import "github.com/DaniSancas/go-chat-room/server/internal/routes"
+import (
+	"log"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/routes"
+)
 
 func main() {
-	routes.HandleRequests()
+	if err := routes.HandleRequests(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,443 @@
+// Command chat is a terminal client for the chat room server.
+//
+// Lines typed on stdin are sent to the current room, lines starting with a slash are commands:
+//
+//	/join <room> [code]  join a room and make it the current one, with an invite code if it's invite-only
+//	/rooms               list the rooms
+//	/unread              count the unread messages of the joined rooms
+//	/invite <user>       invite a user to the current room
+//	/leave [room]        leave a room, the current one by default
+//	/msg <room> <text>   send a message to a room without switching to it
+//	/who [room]          list the members of a room, the current one by default
+//	/members [room]      list the members of a room including the offline ones, with their role
+//	/role <user> <role>  change the role of a member of the current room
+//	/help                show the available commands
+//	/quit                log out and exit
+//
+// Other commands, such as /me or /topic, are sent to the current room to be interpreted by the server.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/client"
+)
+
+func main() {
+	serverURL := flag.String("server", "http://localhost:8080", "URL of the chat server")
+	username := flag.String("user", "", "username to log in with, prompted if empty")
+	secret := flag.String("secret", os.Getenv("CHAT_SECRET"), "secret of a privileged user, defaults to $CHAT_SECRET")
+	rooms := flag.String("rooms", "", "comma separated list of rooms to join on start")
+	flag.Parse()
+
+	// The client SDK logs reconnection attempts, which would clutter the chat
+	log.SetOutput(io.Discard)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	input := bufio.NewScanner(os.Stdin)
+	if *username == "" {
+		fmt.Print("Username: ")
+		if !input.Scan() {
+			os.Exit(1)
+		}
+		*username = strings.TrimSpace(input.Text())
+	}
+
+	chat := newChat(client.New(*serverURL), os.Stdout)
+	if err := chat.start(ctx, *username, *secret); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't connect to %s: %v\n", *serverURL, err)
+		os.Exit(1)
+	}
+	for _, room := range strings.Split(*rooms, ",") {
+		if room = strings.TrimSpace(room); room != "" {
+			chat.join(room, "")
+		}
+	}
+	chat.printf("Logged in as %s, type /help for the list of commands", *username)
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for input.Scan() {
+			lines <- input.Text()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			chat.quit()
+			return
+		case line, ok := <-lines:
+			if !ok || !chat.handleLine(line) {
+				chat.quit()
+				return
+			}
+		}
+	}
+}
+
+// chat keeps the state of the terminal session: the current room and the members of the joined rooms.
+type chat struct {
+	client *client.Client
+	out    io.Writer
+
+	mu      sync.Mutex
+	current string
+	members map[string]map[string]struct{}
+	done    chan struct{}
+}
+
+func newChat(c *client.Client, out io.Writer) *chat {
+	return &chat{
+		client:  c,
+		out:     out,
+		members: make(map[string]map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// start logs in, connects to the stream and starts rendering the incoming events.
+func (chat *chat) start(ctx context.Context, username string, secret string) error {
+	if err := chat.client.LoginWithSecret(ctx, username, secret); err != nil {
+		return err
+	}
+	if err := chat.client.Connect(ctx); err != nil {
+		return err
+	}
+	go chat.render()
+	return nil
+}
+
+// render prints the events received from the stream until it is closed.
+func (chat *chat) render() {
+	defer close(chat.done)
+	for event := range chat.client.Events() {
+		timestamp := event.Timestamp.Local().Format(time.TimeOnly)
+		switch event.Type {
+		case client.EventMessage:
+			from := event.From
+			if event.Bot {
+				// Bots can be named after users
+				from += " [bot]"
+			}
+			chat.printAt(timestamp, "#%s <%s> %s", event.Room, from, event.Text)
+		case client.EventAction:
+			chat.printAt(timestamp, "#%s * %s %s", event.Room, event.From, event.Text)
+		case client.EventRoomUpdated:
+			if event.RoomInfo != nil {
+				chat.printAt(timestamp, "#%s * %s changed the topic to: %s", event.Room, event.From, event.RoomInfo.Topic)
+			}
+		case client.EventRenamed:
+			chat.rename(event)
+			chat.printAt(timestamp, "#%s * %s is now known as %s", event.Room, event.From, event.NewName)
+		case client.EventInvited:
+			chat.printAt(timestamp, "#%s * %s invited %s", event.Room, event.From, event.Text)
+		case client.EventInviteCreated:
+			chat.printAt(timestamp, "#%s * invite code: %s", event.Room, event.Invite.Code)
+		case client.EventReply:
+			for _, line := range strings.Split(event.Text, "\n") {
+				chat.printAt(timestamp, "- %s", line)
+			}
+		case client.EventJoined:
+			chat.track(event)
+			chat.printAt(timestamp, "#%s * %s joined", event.Room, event.From)
+			if event.RoomInfo != nil && event.RoomInfo.Topic != "" {
+				chat.printAt(timestamp, "#%s * topic: %s", event.Room, event.RoomInfo.Topic)
+			}
+		case client.EventLeft:
+			chat.track(event)
+			chat.printAt(timestamp, "#%s * %s left", event.Room, event.From)
+		case client.EventSystem:
+			chat.printAt(timestamp, "*** %s", event.Text)
+		case client.EventRoomClosed:
+			chat.forget(event.Room)
+			chat.printAt(timestamp, "#%s * room closed", event.Room)
+		case client.EventRoleChanged:
+			chat.printAt(timestamp, "#%s * %s is now %s", event.Room, event.From, event.Role)
+		case client.EventReconnected:
+			chat.printAt(timestamp, "* reconnected")
+		case client.EventError:
+			if event.Error != nil {
+				chat.printAt(timestamp, "! %s", event.Error.Message)
+			}
+		default:
+			chat.printAt(timestamp, "* %s event in #%s", event.Type, event.Room)
+		}
+	}
+}
+
+// track updates the known members of a room from a joined or left event.
+func (chat *chat) track(event client.Event) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	username, _ := chat.client.Session()
+	if event.Members != nil {
+		chat.members[event.Room] = make(map[string]struct{})
+		for _, member := range event.Members {
+			chat.members[event.Room][member] = struct{}{}
+		}
+	}
+	members, ok := chat.members[event.Room]
+	if !ok {
+		return
+	}
+	switch {
+	case event.Type == client.EventJoined:
+		members[event.From] = struct{}{}
+		// Rooms rejoined by the server on login become the current one if there's none
+		if event.From == username && chat.current == "" {
+			chat.current = event.Room
+		}
+	case event.From == username:
+		delete(chat.members, event.Room)
+	default:
+		delete(members, event.From)
+	}
+}
+
+// rename updates the known members of a room from a renamed event.
+func (chat *chat) rename(event client.Event) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	if members, ok := chat.members[event.Room]; ok {
+		delete(members, event.From)
+		members[event.NewName] = struct{}{}
+	}
+}
+
+// forget drops a room that the user is no longer in.
+func (chat *chat) forget(room string) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	delete(chat.members, room)
+	if chat.current == room {
+		chat.current = ""
+	}
+}
+
+// handleLine runs a command or sends the line to the current room. It returns false when the user quits.
+func (chat *chat) handleLine(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+	if !strings.HasPrefix(line, "/") {
+		chat.send(chat.room(""), line)
+		return true
+	}
+
+	command, args, _ := strings.Cut(line[1:], " ")
+	args = strings.TrimSpace(args)
+	switch command {
+	case "join", "j":
+		room, code, _ := strings.Cut(args, " ")
+		if room == "" {
+			chat.printf("Usage: /join <room> [code]")
+			break
+		}
+		chat.join(room, strings.TrimSpace(code))
+	case "rooms":
+		chat.rooms()
+	case "unread":
+		chat.unread()
+	case "invite":
+		if args == "" {
+			chat.printf("Usage: /invite <user>")
+			break
+		}
+		if err := chat.client.Invite(chat.room(""), args); err != nil {
+			chat.printf("Can't invite %s: %v", args, err)
+		}
+	case "leave", "part":
+		chat.leave(chat.room(args))
+	case "msg":
+		room, text, _ := strings.Cut(args, " ")
+		if room == "" || strings.TrimSpace(text) == "" {
+			chat.printf("Usage: /msg <room> <text>")
+			break
+		}
+		chat.send(room, text)
+	case "who":
+		chat.who(chat.room(args))
+	case "members":
+		chat.roomMembers(chat.room(args))
+	case "role":
+		username, role, _ := strings.Cut(args, " ")
+		if username == "" || role == "" {
+			chat.printf("Usage: /role <user> <owner|moderator|member|read_only>")
+			break
+		}
+		if err := chat.client.SetRole(chat.room(""), username, client.RoomRole(role)); err != nil {
+			chat.printf("Can't change role: %v", err)
+		}
+	case "help":
+		chat.printf("Commands: /join <room> [code], /rooms, /unread, /invite <user>, /leave [room], /msg <room> <text>, /who [room], /members [room], /role <user> <role>, /help, /quit")
+		// The server replies with the commands it interprets
+		if err := chat.client.Send(chat.room(""), line); err != nil {
+			chat.printf("Can't get the server commands: %v", err)
+		}
+	case "quit", "exit":
+		return false
+	default:
+		// Unknown commands are interpreted by the server
+		if err := chat.client.Send(chat.room(""), line); err != nil {
+			chat.printf("Can't send command: %v", err)
+		}
+	}
+	return true
+}
+
+// room returns the given room, or the current one if it's empty.
+func (chat *chat) room(room string) string {
+	if room != "" {
+		return room
+	}
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	return chat.current
+}
+
+func (chat *chat) join(room string, code string) {
+	subscribe := chat.client.Subscribe
+	if code != "" {
+		subscribe = func(room string) error { return chat.client.SubscribeWithInvite(room, code) }
+	}
+	if err := subscribe(room); err != nil {
+		chat.printf("Can't join #%s: %v", room, err)
+		return
+	}
+	chat.mu.Lock()
+	chat.current = room
+	chat.mu.Unlock()
+}
+
+func (chat *chat) rooms() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rooms, err := chat.client.Rooms(ctx)
+	if err != nil {
+		chat.printf("Can't list rooms: %v", err)
+		return
+	}
+	if len(rooms) == 0 {
+		chat.printf("There are no rooms, use /join <room> to create one")
+	}
+	for _, room := range rooms {
+		chat.printf("#%s (%d members) %s", room.Name, room.Members, room.Topic)
+	}
+}
+
+func (chat *chat) unread() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counts, err := chat.client.Unread(ctx)
+	if err != nil {
+		chat.printf("Can't count unread messages: %v", err)
+		return
+	}
+	for _, count := range counts {
+		chat.printf("#%s %d unread", count.Room, count.Unread)
+	}
+}
+
+func (chat *chat) leave(room string) {
+	if room == "" {
+		chat.printf("You are not in a room, use /join <room>")
+		return
+	}
+	if err := chat.client.Unsubscribe(room); err != nil {
+		chat.printf("Can't leave #%s: %v", room, err)
+		return
+	}
+	chat.mu.Lock()
+	if chat.current == room {
+		chat.current = ""
+	}
+	chat.mu.Unlock()
+}
+
+func (chat *chat) send(room string, text string) {
+	if room == "" {
+		chat.printf("You are not in a room, use /join <room>")
+		return
+	}
+	if err := chat.client.Send(room, text); err != nil {
+		chat.printf("Can't send message: %v", err)
+	}
+}
+
+func (chat *chat) who(room string) {
+	chat.mu.Lock()
+	members, ok := chat.members[room]
+	usernames := make([]string, 0, len(members))
+	for username := range members {
+		usernames = append(usernames, username)
+	}
+	chat.mu.Unlock()
+
+	if !ok {
+		chat.printf("You are not in #%s", room)
+		return
+	}
+	sort.Strings(usernames)
+	chat.printf("Members of #%s: %s", room, strings.Join(usernames, ", "))
+}
+
+func (chat *chat) roomMembers(room string) {
+	if room == "" {
+		chat.printf("Usage: /members <room>")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	members, err := chat.client.Members(ctx, room)
+	if err != nil {
+		chat.printf("Can't list the members of #%s: %v", room, err)
+		return
+	}
+	for _, member := range members {
+		status := "offline"
+		if member.Online {
+			status = "online"
+		}
+		chat.printf("#%s %s (%s, %s)", room, member.Username, member.Role, status)
+	}
+}
+
+// quit logs out and waits for the pending events to be printed.
+func (chat *chat) quit() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := chat.client.Logout(ctx); err != nil {
+		chat.printf("Can't log out: %v", err)
+		return
+	}
+	select {
+	case <-chat.done:
+	case <-ctx.Done():
+	}
+}
+
+// printf prints a local message stamped with the current time.
+func (chat *chat) printf(format string, args ...any) {
+	chat.printAt(time.Now().Format(time.TimeOnly), format, args...)
+}
+
+func (chat *chat) printAt(timestamp string, format string, args ...any) {
+	fmt.Fprintf(chat.out, "[%s] %s\n", timestamp, fmt.Sprintf(format, args...))
+}
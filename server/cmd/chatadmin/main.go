@@ -0,0 +1,376 @@
+// Command chatadmin operates a running chat room server through its admin API.
+//
+// Usage:
+//
+//	chatadmin [-server url] [-token token] <command> [arguments]
+//
+// Commands:
+//
+//	users                      list the logged in users
+//	logout <username>          forcibly log out a user
+//	kick <username> <reason>   forcibly log out a user, telling it the reason
+//	announce [-room room] <text>
+//	                           broadcast a system announcement
+//	rooms                      list the active rooms and their members
+//	close <room>               close a room, removing all its members
+//	filters <room>             show the message filters of a room
+//	filter [-words w,...] [-action a] [-max-length n] [-block-links] <room>
+//	                           replace the message filters of a room
+//	unfilter <room>            make a room use the default message filters
+//	webhooks <room>            list the webhooks of a room
+//	webhook [-events e,...] [-secret s] <room> <url>
+//	                           register a webhook for a room
+//	unwebhook <room> <id>      delete a webhook of a room
+//	dead-letters               list the webhook deliveries that failed every attempt
+//	hooks <room>               list the incoming webhooks of a room
+//	hook [-username u] <room>  create an incoming webhook posting to a room as a bot
+//	unhook <room> <id>         delete an incoming webhook of a room
+//	bans                       list the bans currently enforced
+//	ban [-ip] [-ip-address ip] [-duration d] <username> [reason]
+//	                           ban a user, and optionally its IP
+//	unban <username>           lift the ban of a user
+//	audit [-user u] [-action a] [-since d] [-limit n]
+//	                           show the audit trail
+//
+// The admin token defaults to the CHAT_ADMIN_TOKEN environment variable.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/client"
+)
+
+func main() {
+	serverURL := flag.String("server", "http://localhost:8080", "URL of the chat server")
+	token := flag.String("token", os.Getenv("CHAT_ADMIN_TOKEN"), "admin token, defaults to $CHAT_ADMIN_TOKEN")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *token == "" {
+		fmt.Fprintln(os.Stderr, "An admin token is required, use -token or set CHAT_ADMIN_TOKEN")
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	admin := client.NewAdmin(*serverURL, *token)
+	if err := run(ctx, admin, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: chatadmin [flags] <command> [arguments]
+
+Commands:
+  users                         list the logged in users
+  logout <username>             forcibly log out a user
+  kick <username> <reason>      forcibly log out a user, telling it the reason
+  announce [-room room] <text>  broadcast a system announcement
+  rooms                         list the active rooms and their members
+  close <room>                  close a room, removing all its members
+  filters <room>                show the message filters of a room
+  filter [-words w,...] [-action a] [-max-length n] [-block-links] <room>
+                                replace the message filters of a room
+  unfilter <room>               make a room use the default message filters
+  webhooks <room>               list the webhooks of a room
+  webhook [-events e,...] [-secret s] <room> <url>
+                                register a webhook for a room
+  unwebhook <room> <id>         delete a webhook of a room
+  dead-letters                  list the webhook deliveries that failed every attempt
+  hooks <room>                  list the incoming webhooks of a room
+  hook [-username u] <room>     create an incoming webhook posting to a room as a bot
+  unhook <room> <id>            delete an incoming webhook of a room
+  bans                          list the bans currently enforced
+  ban [-ip] [-ip-address ip] [-duration d] <username> [reason]
+                                ban a user, and optionally its IP
+  unban <username>              lift the ban of a user
+  audit [-user u] [-action a] [-since d] [-limit n]
+                                show the audit trail
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+// run executes a single admin command.
+func run(ctx context.Context, admin *client.Admin, command string, args []string) error {
+	switch command {
+	case "users":
+		users, err := admin.Users(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tCONNECTED\tROOMS")
+		for _, user := range users {
+			fmt.Fprintf(w, "%s\t%t\t%s\n", user.Username, user.Connected, strings.Join(user.Rooms, ","))
+		}
+		return w.Flush()
+	case "logout":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: logout <username>")
+		}
+		if err := admin.Logout(ctx, args[0], ""); err != nil {
+			return err
+		}
+		fmt.Printf("User %s logged out\n", args[0])
+	case "kick":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: kick <username> <reason>")
+		}
+		if err := admin.Logout(ctx, args[0], strings.Join(args[1:], " ")); err != nil {
+			return err
+		}
+		fmt.Printf("User %s kicked\n", args[0])
+	case "announce":
+		flags := flag.NewFlagSet("announce", flag.ContinueOnError)
+		room := flags.String("room", "", "room to send the announcement to, every connected user if empty")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			return fmt.Errorf("usage: announce [-room room] <text>")
+		}
+		if err := admin.Announce(ctx, *room, strings.Join(flags.Args(), " ")); err != nil {
+			return err
+		}
+		fmt.Println("Announcement sent")
+	case "rooms":
+		rooms, err := admin.Rooms(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ROOM\tMEMBERS")
+		for _, room := range rooms {
+			fmt.Fprintf(w, "%s\t%s\n", room.Name, strings.Join(room.Members, ","))
+		}
+		return w.Flush()
+	case "close":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: close <room>")
+		}
+		if err := admin.CloseRoom(ctx, args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Room %s closed\n", args[0])
+	case "filters":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: filters <room>")
+		}
+		config, err := admin.RoomFilters(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Banned words: %s (%s)\n", strings.Join(config.Wordlist, ", "), config.WordlistAction)
+		fmt.Printf("Max length:   %d\n", config.MaxLength)
+		fmt.Printf("Block links:  %t\n", config.BlockLinks)
+	case "filter":
+		flags := flag.NewFlagSet("filter", flag.ContinueOnError)
+		words := flags.String("words", "", "comma separated list of banned words")
+		action := flags.String("action", "mask", "what to do with banned words: mask, reject or flag")
+		maxLength := flags.Int("max-length", 0, "maximum number of characters of a message, zero for the server limit")
+		blockLinks := flags.Bool("block-links", false, "reject messages containing links")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: filter [-words w,...] [-action a] [-max-length n] [-block-links] <room>")
+		}
+		config := client.FilterConfig{WordlistAction: *action, MaxLength: *maxLength, BlockLinks: *blockLinks}
+		if *words != "" {
+			config.Wordlist = strings.Split(*words, ",")
+		}
+		if err := admin.SetRoomFilters(ctx, flags.Arg(0), config); err != nil {
+			return err
+		}
+		fmt.Printf("Filters of room %s updated\n", flags.Arg(0))
+	case "unfilter":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: unfilter <room>")
+		}
+		if err := admin.ResetRoomFilters(ctx, args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Room %s uses the default filters\n", args[0])
+	case "webhooks":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: webhooks <room>")
+		}
+		webhooks, err := admin.Webhooks(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tURL\tEVENTS\tCREATED")
+		for _, webhook := range webhooks {
+			events := "all"
+			if len(webhook.Events) > 0 {
+				events = strings.Join(webhook.Events, ",")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", webhook.ID, webhook.URL, events, webhook.CreatedAt.Local().Format(time.DateTime))
+		}
+		return w.Flush()
+	case "webhook":
+		flags := flag.NewFlagSet("webhook", flag.ContinueOnError)
+		events := flags.String("events", "", "comma separated list of the events delivered: message, action, joined, left; all of them if empty")
+		secret := flags.String("secret", "", "secret signing the deliveries, generated if empty")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 2 {
+			return fmt.Errorf("usage: webhook [-events e,...] [-secret s] <room> <url>")
+		}
+		webhookRequest := client.WebhookRequest{URL: flags.Arg(1), Secret: *secret}
+		if *events != "" {
+			webhookRequest.Events = strings.Split(*events, ",")
+		}
+		webhook, err := admin.CreateWebhook(ctx, flags.Arg(0), webhookRequest)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Webhook %s registered for room %s\n", webhook.ID, webhook.Room)
+		fmt.Printf("Secret: %s\n", webhook.Secret)
+	case "unwebhook":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: unwebhook <room> <id>")
+		}
+		if err := admin.DeleteWebhook(ctx, args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Webhook %s deleted\n", args[1])
+	case "dead-letters":
+		deadLetters, err := admin.DeadLetters(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "FAILED\tROOM\tWEBHOOK\tEVENT\tATTEMPTS\tERROR")
+		for _, deadLetter := range deadLetters {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", deadLetter.FailedAt.Local().Format(time.DateTime), deadLetter.Room, deadLetter.Webhook, deadLetter.Delivery.Event.Type, deadLetter.Attempts, deadLetter.Error)
+		}
+		return w.Flush()
+	case "hooks":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: hooks <room>")
+		}
+		hooks, err := admin.IncomingWebhooks(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tCREATED")
+		for _, hook := range hooks {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", hook.ID, hook.Username, hook.CreatedAt.Local().Format(time.DateTime))
+		}
+		return w.Flush()
+	case "hook":
+		flags := flag.NewFlagSet("hook", flag.ContinueOnError)
+		username := flags.String("username", "", "name of the bot posting the messages, webhook if empty")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: hook [-username u] <room>")
+		}
+		hook, err := admin.CreateIncomingWebhook(ctx, flags.Arg(0), *username)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Incoming webhook %s created for room %s\n", hook.ID, hook.Room)
+		fmt.Printf("Post messages to /hooks/%s\n", hook.Token)
+	case "unhook":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: unhook <room> <id>")
+		}
+		if err := admin.DeleteIncomingWebhook(ctx, args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Incoming webhook %s deleted\n", args[1])
+	case "bans":
+		bans, err := admin.Bans(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tIP\tBY\tEXPIRES\tREASON")
+		for _, ban := range bans {
+			expires := "never"
+			if ban.ExpiresAt != nil {
+				expires = ban.ExpiresAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ban.Username, ban.IP, ban.By, expires, ban.Reason)
+		}
+		return w.Flush()
+	case "ban":
+		flags := flag.NewFlagSet("ban", flag.ContinueOnError)
+		banIP := flags.Bool("ip", false, "also ban the IP the user logged in from")
+		ipAddress := flags.String("ip-address", "", "IP to ban along with the user")
+		duration := flags.Duration("duration", 0, "duration of the ban, permanent if zero")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			return fmt.Errorf("usage: ban [-ip] [-ip-address ip] [-duration d] <username> [reason]")
+		}
+		ban, err := admin.Ban(ctx, client.BanRequest{
+			Username: flags.Arg(0),
+			BanIP:    *banIP,
+			IP:       *ipAddress,
+			Duration: int(duration.Seconds()),
+			Reason:   strings.Join(flags.Args()[1:], " "),
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("User %s banned\n", ban.Username)
+	case "unban":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: unban <username>")
+		}
+		if err := admin.Unban(ctx, args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Ban of user %s lifted\n", args[0])
+	case "audit":
+		flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+		user := flags.String("user", "", "only events whose actor or target is this user")
+		action := flags.String("action", "", "only events with this action")
+		since := flags.Duration("since", 0, "only events newer than this duration")
+		limit := flags.Int("limit", 100, "maximum number of events")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		filter := client.AuditFilter{User: *user, Action: *action, Limit: *limit}
+		if *since > 0 {
+			filter.From = time.Now().Add(-*since)
+		}
+		events, err := admin.Audit(ctx, filter)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME	ACTION	ACTOR	TARGET	ROOM	IP	DETAILS")
+		for _, event := range events {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", event.Time.Local().Format(time.DateTime), event.Action, event.Actor, event.Target, event.Room, event.IP, event.Details)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown command %q, run chatadmin -h for the list of commands", command)
+	}
+	return nil
+}
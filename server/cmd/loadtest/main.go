@@ -0,0 +1,355 @@
+// Command loadtest simulates many users of a running chat room server, to find out how many it holds.
+//
+// Usage:
+//
+//	loadtest [-server url] [-users n] [-rooms n] [-rate r] [-duration d] [-ramp d] [-prefix p]
+//
+// Every simulated user logs in, opens the websocket stream, joins one of the rooms and sends messages
+// at the given rate until the test ends, then logs out. Users are started evenly over the ramp-up period
+// and the test ends after the duration, counted from the end of the ramp-up.
+//
+// The latency of a message is the time from sending it until the server delivers it back to its sender
+// through the stream. Messages that aren't delivered back within the drain period are counted as lost.
+// At the end, it reports how many users logged in and connected, the latency percentiles of the logins,
+// the stream handshakes and the messages, and the errors by kind.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/client"
+)
+
+// requestTimeout bounds the time of every login, handshake, join and logout.
+const requestTimeout = 10 * time.Second
+
+// messagePrefix starts the text of the messages sent by the simulated users, followed by their sequence number.
+const messagePrefix = "loadtest "
+
+func main() {
+	var config config
+	flag.StringVar(&config.serverURL, "server", "http://localhost:8080", "URL of the chat server")
+	flag.IntVar(&config.users, "users", 100, "number of simulated users")
+	flag.IntVar(&config.rooms, "rooms", 10, "number of rooms the users are spread over")
+	flag.Float64Var(&config.rate, "rate", 1, "messages sent per second by every user, zero to only connect")
+	flag.DurationVar(&config.duration, "duration", 30*time.Second, "time the users keep sending messages after the ramp-up")
+	flag.DurationVar(&config.ramp, "ramp", 5*time.Second, "time over which the users are started")
+	flag.DurationVar(&config.drain, "drain", 5*time.Second, "time to wait for the messages in flight when the test ends")
+	flag.StringVar(&config.prefix, "prefix", "load", "prefix of the usernames and room names")
+	flag.Parse()
+
+	if config.users <= 0 || config.rooms <= 0 || config.rate < 0 {
+		fmt.Fprintln(os.Stderr, "-users and -rooms must be positive, and -rate can't be negative")
+		os.Exit(2)
+	}
+
+	// The client SDK logs reconnection attempts, which would clutter the report
+	log.SetOutput(io.Discard)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Simulating %d users in %d rooms against %s for %s...\n", config.users, config.rooms, config.serverURL, config.ramp+config.duration)
+	stats := run(ctx, config)
+	stats.report(os.Stdout, config)
+}
+
+// config is the configuration of a load test.
+type config struct {
+	serverURL string
+	users     int
+	rooms     int
+	rate      float64
+	duration  time.Duration
+	ramp      time.Duration
+	drain     time.Duration
+	prefix    string
+}
+
+// stats collects the results of the simulated users.
+type stats struct {
+	mu         sync.Mutex
+	logins     []time.Duration
+	handshakes []time.Duration
+	latencies  []time.Duration
+	sent       int
+	lost       int
+	errors     map[string]int
+}
+
+func (stats *stats) record(samples *[]time.Duration, duration time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	*samples = append(*samples, duration)
+}
+
+// fail counts an error of a stage of the simulation, grouping errors of the server by their code.
+func (stats *stats) fail(stage string, err error) {
+	kind := err.Error()
+	var serverError *client.Error
+	if errors.As(err, &serverError) {
+		kind = serverError.Code
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.errors[stage+": "+kind]++
+}
+
+// run starts the simulated users and waits until all of them end.
+func run(ctx context.Context, config config) *stats {
+	stats := &stats{errors: make(map[string]int)}
+	ctx, cancel := context.WithTimeout(ctx, config.ramp+config.duration)
+	defer cancel()
+
+	// Every user keeps its own connection to the HTTP API
+	httpClient := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: config.users}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.users; i++ {
+		delay := config.ramp * time.Duration(i) / time.Duration(config.users)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			user := &user{
+				config:   config,
+				stats:    stats,
+				username: config.prefix + strconv.Itoa(i),
+				room:     config.prefix + "-" + strconv.Itoa(i%config.rooms),
+				client:   client.New(config.serverURL, client.WithHTTPClient(httpClient)),
+				pending:  make(map[int]time.Time),
+				joined:   make(chan struct{}),
+			}
+			user.simulate(ctx)
+		}()
+	}
+	wg.Wait()
+	return stats
+}
+
+// user is a simulated user.
+type user struct {
+	config   config
+	stats    *stats
+	username string
+	room     string
+	client   *client.Client
+
+	mu sync.Mutex
+	// pending are the send times of the messages not delivered back yet, by sequence number
+	pending map[int]time.Time
+	joined  chan struct{}
+}
+
+// simulate logs in, connects to the stream, joins the room of the user and sends messages until the context ends.
+func (user *user) simulate(ctx context.Context) {
+	requestCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := user.client.Login(requestCtx, user.username); err != nil {
+		user.stats.fail("login", err)
+		return
+	}
+	user.stats.record(&user.stats.logins, time.Since(start))
+	defer func() {
+		logoutCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		user.client.Logout(logoutCtx)
+	}()
+
+	start = time.Now()
+	if err := user.client.Connect(requestCtx); err != nil {
+		user.stats.fail("handshake", err)
+		return
+	}
+	user.stats.record(&user.stats.handshakes, time.Since(start))
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		user.receive()
+	}()
+
+	if err := user.client.Subscribe(user.room); err != nil {
+		user.stats.fail("join", err)
+		return
+	}
+	select {
+	case <-user.joined:
+	case <-requestCtx.Done():
+		user.stats.fail("join", errors.New("timeout waiting for the joined event"))
+		return
+	case <-received:
+		user.stats.fail("join", errors.New("stream closed"))
+		return
+	}
+
+	if user.config.rate > 0 {
+		user.send(ctx)
+	} else {
+		<-ctx.Done()
+	}
+	user.drain(received)
+}
+
+// send sends messages at the configured rate until the context ends.
+func (user *user) send(ctx context.Context) {
+	interval := time.Duration(float64(time.Second) / user.config.rate)
+	// A random offset keeps the users from sending in bursts
+	timer := time.NewTimer(rand.N(interval))
+	defer timer.Stop()
+	for sequence := 0; ; sequence++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(interval)
+		}
+		user.mu.Lock()
+		user.pending[sequence] = time.Now()
+		user.mu.Unlock()
+		if err := user.client.Send(user.room, messagePrefix+strconv.Itoa(sequence)); err != nil {
+			user.mu.Lock()
+			delete(user.pending, sequence)
+			user.mu.Unlock()
+			user.stats.fail("send", err)
+			continue
+		}
+		user.stats.mu.Lock()
+		user.stats.sent++
+		user.stats.mu.Unlock()
+	}
+}
+
+// receive reads the events of the stream until it's closed, measuring the latency of the messages of the user.
+func (user *user) receive() {
+	for event := range user.client.Events() {
+		switch event.Type {
+		case client.EventJoined:
+			if event.From == user.username && event.Room == user.room {
+				select {
+				case <-user.joined:
+				default:
+					close(user.joined)
+				}
+			}
+		case client.EventMessage:
+			if event.From != user.username || !strings.HasPrefix(event.Text, messagePrefix) {
+				continue
+			}
+			sequence, err := strconv.Atoi(strings.TrimPrefix(event.Text, messagePrefix))
+			if err != nil {
+				continue
+			}
+			user.mu.Lock()
+			sentAt, ok := user.pending[sequence]
+			delete(user.pending, sequence)
+			user.mu.Unlock()
+			if ok {
+				user.stats.record(&user.stats.latencies, time.Since(sentAt))
+			}
+		case client.EventError:
+			if event.Error != nil {
+				user.stats.fail("stream", &client.Error{Code: event.Error.Code, Message: event.Error.Message})
+			}
+		}
+	}
+}
+
+// drain waits for the messages in flight, counting the ones not delivered back within the drain period as lost.
+func (user *user) drain(received chan struct{}) {
+	deadline := time.After(user.config.drain)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		user.mu.Lock()
+		pending := len(user.pending)
+		user.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+			continue
+		case <-deadline:
+		case <-received:
+		}
+		user.stats.mu.Lock()
+		user.stats.lost += pending
+		user.stats.mu.Unlock()
+		return
+	}
+}
+
+// report prints the results of the test.
+func (stats *stats) report(out io.Writer, config config) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "\nLogins:\t%d ok\t%d failed\n", len(stats.logins), config.users-len(stats.logins))
+	fmt.Fprintf(w, "Streams:\t%d ok\t%d failed\n", len(stats.handshakes), len(stats.logins)-len(stats.handshakes))
+	fmt.Fprintf(w, "Messages:\t%d sent\t%d received\t%d lost\n", stats.sent, len(stats.latencies), stats.lost)
+	if seconds := (config.ramp + config.duration).Seconds(); seconds > 0 {
+		fmt.Fprintf(w, "Throughput:\t%.1f messages/s\n", float64(len(stats.latencies))/seconds)
+	}
+
+	fmt.Fprintln(w, "\nLatency\tcount\tp50\tp90\tp99\tmax")
+	for _, row := range []struct {
+		name    string
+		samples []time.Duration
+	}{
+		{"login", stats.logins},
+		{"handshake", stats.handshakes},
+		{"message", stats.latencies},
+	} {
+		fmt.Fprintf(w, "%s\t%d", row.name, len(row.samples))
+		for _, percentile := range []float64{50, 90, 99, 100} {
+			fmt.Fprintf(w, "\t%s", percentileOf(row.samples, percentile))
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(stats.errors) > 0 {
+		kinds := make([]string, 0, len(stats.errors))
+		for kind := range stats.errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Slice(kinds, func(i, j int) bool { return stats.errors[kinds[i]] > stats.errors[kinds[j]] })
+		fmt.Fprintln(w, "\nErrors\tcount")
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "%s\t%d\n", kind, stats.errors[kind])
+		}
+	}
+	w.Flush()
+}
+
+// percentileOf returns the given percentile of the samples, using the nearest-rank method.
+// It sorts the samples in place.
+func percentileOf(samples []time.Duration, percentile float64) string {
+	if len(samples) == 0 {
+		return "-"
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	rank := int(float64(len(samples))*percentile/100+0.5) - 1
+	rank = max(0, min(rank, len(samples)-1))
+	return samples[rank].Round(time.Microsecond).String()
+}
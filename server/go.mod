@@ -6,4 +6,4 @@ require github.com/google/uuid v1.6.0
 
 require github.com/rs/cors v1.11.1
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
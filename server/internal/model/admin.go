@@ -0,0 +1,39 @@
+package model
+
+// AdminUser describes a logged in user in the admin API.
+type AdminUser struct {
+	Username  string   `json:"username"`
+	Connected bool     `json:"connected"`
+	Rooms     []string `json:"rooms"`
+}
+
+type AdminUsersResponse struct {
+	Users []AdminUser `json:"users"`
+}
+
+// AdminRoom describes an active room in the admin API.
+type AdminRoom struct {
+	Name       string   `json:"name"`
+	Private    bool     `json:"private,omitempty"`
+	InviteOnly bool     `json:"invite_only,omitempty"`
+	Members    []string `json:"members"`
+}
+
+type AdminRoomsResponse struct {
+	Rooms []AdminRoom `json:"rooms"`
+}
+
+// AdminLogoutRequest forcibly logs out a user. The reason, if any, is sent to the user before disconnecting it.
+type AdminLogoutRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// AdminAnnouncementRequest broadcasts a system announcement to a room, or to every connected user if Room is empty.
+type AdminAnnouncementRequest struct {
+	Text string `json:"text"`
+	Room string `json:"room,omitempty"`
+}
+
+type AdminActionResponse struct {
+	Message string `json:"message"`
+}
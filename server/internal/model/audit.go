@@ -0,0 +1,62 @@
+package model
+
+import "time"
+
+// AuditEvent is an entry of the audit log, recording a security relevant action.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Room    string    `json:"room,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Details string    `json:"details,omitempty"`
+}
+
+// Actions recorded in AuditEvent.Action.
+const (
+	AuditActionLogin          = "login"
+	AuditActionLoginFailed    = "login_failed"
+	AuditActionLogout         = "logout"
+	AuditActionTokenRejected  = "token_rejected"
+	AuditActionForcedLogout   = "forced_logout"
+	AuditActionRoomClosed     = "room_closed"
+	AuditActionKick           = "kick"
+	AuditActionBan            = "ban"
+	AuditActionUnban          = "unban"
+	AuditActionMute           = "mute"
+	AuditActionUnmute         = "unmute"
+	AuditActionMessageFlagged = "message_flagged"
+	AuditActionRename         = "rename"
+)
+
+// AuditFilter selects audit events. Zero fields don't filter: From and To bound the time of the events,
+// User matches either the actor or the target, and Limit keeps only the most recent events.
+type AuditFilter struct {
+	From   time.Time
+	To     time.Time
+	User   string
+	Action string
+	Limit  int
+}
+
+// Matches reports whether the event is selected by the filter, ignoring the limit.
+func (filter AuditFilter) Matches(event AuditEvent) bool {
+	if !filter.From.IsZero() && event.Time.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && event.Time.After(filter.To) {
+		return false
+	}
+	if filter.User != "" && event.Actor != filter.User && event.Target != filter.User {
+		return false
+	}
+	if filter.Action != "" && event.Action != filter.Action {
+		return false
+	}
+	return true
+}
+
+type AuditEventsResponse struct {
+	Events []AuditEvent `json:"events"`
+}
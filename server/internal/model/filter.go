@@ -0,0 +1,37 @@
+package model
+
+import "sync"
+
+// FilterConfig configures the filters applied to the messages sent to a room.
+// The zero value doesn't filter anything.
+type FilterConfig struct {
+	// Wordlist is the list of banned words, matched as whole words ignoring case.
+	Wordlist []string `json:"wordlist,omitempty"`
+	// WordlistAction is what happens to messages with banned words, FilterActionMask if empty.
+	WordlistAction string `json:"wordlist_action,omitempty"`
+	// MaxLength rejects messages longer than this number of characters, zero meaning the server limit.
+	MaxLength int `json:"max_length,omitempty"`
+	// BlockLinks rejects messages containing links.
+	BlockLinks bool `json:"block_links,omitempty"`
+}
+
+// Actions taken by a filter on a matching message.
+const (
+	FilterActionMask   = "mask"
+	FilterActionReject = "reject"
+	FilterActionFlag   = "flag"
+)
+
+// RoomFilters is a struct that holds the filter configuration of the rooms.
+// It outlives the rooms, so a room keeps its filters when it's created again.
+// Rooms without a configuration use Default.
+type RoomFilters struct {
+	sync.RWMutex
+	Default FilterConfig
+	Rooms   map[string]FilterConfig
+}
+
+type RoomFiltersResponse struct {
+	Room    string       `json:"room"`
+	Filters FilterConfig `json:"filters"`
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// Ban prevents a user from logging in and connecting to the stream, by username and optionally by IP.
+// A nil ExpiresAt means the ban is permanent.
+type Ban struct {
+	Username  string     `json:"username"`
+	IP        string     `json:"ip,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	By        string     `json:"by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Bans is a map of usernames to their Ban.
+type Bans map[string]Ban
+
+// ActiveBans is a struct that represents the bans currently enforced by the server.
+// It has a mutex to ensure thread safety and a Bans object to store the bans.
+type ActiveBans struct {
+	sync.RWMutex
+	Bans Bans
+}
+
+// BanRequest bans a user. If BanIP is true, the IP the user logged in from is banned too,
+// unless another IP is given. A zero Duration, in seconds, makes the ban permanent.
+type BanRequest struct {
+	Username string `json:"username"`
+	BanIP    bool   `json:"ban_ip,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type BansResponse struct {
+	Bans []Ban `json:"bans"`
+}
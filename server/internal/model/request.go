@@ -2,6 +2,8 @@ package model
 
 type UserLoginRequest struct {
 	Username string `json:"username"`
+	// Secret is only required for the privileged users configured at startup
+	Secret string `json:"secret,omitempty"`
 }
 
 type UserWithTokenRequest struct {
@@ -2,6 +2,11 @@ package model
 
 type UserLoginResponse struct {
 	Token string `json:"token"`
+	Role  Role   `json:"role,omitempty"`
+	// Rooms lists the rooms the user is a member of, which it rejoins when it connects to the stream
+	Rooms []string `json:"rooms,omitempty"`
+	// Unread counts the messages of those rooms the user didn't read
+	Unread []UnreadCount `json:"unread,omitempty"`
 }
 
 type UserLogoutResponse struct {
@@ -11,3 +16,54 @@ type UserLogoutResponse struct {
 type WebsocketWelcomeResponse struct {
 	Welcome string `json:"welcome"`
 }
+
+// ErrorResponse is the body returned by every endpoint when a request can't be fulfilled.
+// Code is a stable, machine readable identifier, Message is a human readable description
+// and Details optionally carries extra information about the failure (e.g. a decoding error).
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+}
+
+// Error codes used in ErrorResponse.Code.
+const (
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeBodyMissing      = "body_missing"
+	ErrorCodeBodyTooLarge     = "body_too_large"
+	ErrorCodeInvalidBody      = "invalid_body"
+	ErrorCodeInvalidUsername  = "invalid_username"
+	ErrorCodeAlreadyLoggedIn  = "already_logged_in"
+	ErrorCodeNotLoggedIn      = "not_logged_in"
+	ErrorCodeInvalidToken     = "invalid_token"
+	ErrorCodeInternal         = "internal_error"
+	ErrorCodeUnauthorized     = "unauthorized"
+	ErrorCodeAdminDisabled    = "admin_disabled"
+	ErrorCodeRoomNotFound     = "room_not_found"
+	ErrorCodeForbidden        = "forbidden"
+	ErrorCodeInvalidSecret    = "invalid_secret"
+	ErrorCodeInvalidRole      = "invalid_role"
+	ErrorCodeBanned           = "banned"
+	ErrorCodeMuted            = "muted"
+	ErrorCodeInvalidDuration  = "invalid_duration"
+	ErrorCodeBanNotFound      = "ban_not_found"
+	ErrorCodeInvalidQuery     = "invalid_query"
+	ErrorCodeInvalidFilter    = "invalid_filter"
+	ErrorCodeInvalidWebhook   = "invalid_webhook"
+	ErrorCodeWebhookNotFound  = "webhook_not_found"
+)
+
+// Error codes used in the error events of the websocket stream.
+const (
+	ErrorCodeUnknownRequest   = "unknown_request"
+	ErrorCodeInvalidRoom      = "invalid_room"
+	ErrorCodeNotInRoom        = "not_in_room"
+	ErrorCodeEmptyMessage     = "empty_message"
+	ErrorCodeMessageRejected  = "message_rejected"
+	ErrorCodeUnknownCommand   = "unknown_command"
+	ErrorCodeInvalidArguments = "invalid_arguments"
+	ErrorCodeNicknameTaken    = "nickname_taken"
+	ErrorCodeInviteRequired   = "invite_required"
+	ErrorCodeInvalidInvite    = "invalid_invite"
+	ErrorCodeNotMuted         = "not_muted"
+)
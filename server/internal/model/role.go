@@ -0,0 +1,27 @@
+package model
+
+// Role is the global role of a user, which applies to every room.
+type Role string
+
+const (
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleUser      Role = "user"
+)
+
+// RoomRole is the role of a member within a single room.
+type RoomRole string
+
+const (
+	RoomRoleOwner     RoomRole = "owner"
+	RoomRoleModerator RoomRole = "moderator"
+	RoomRoleMember    RoomRole = "member"
+	RoomRoleReadOnly  RoomRole = "read_only"
+)
+
+// PrivilegedUser is a user configured at startup with a global role other than RoleUser.
+// Logging in with its username requires the secret, so nobody else can take the role.
+type PrivilegedUser struct {
+	Role   Role
+	Secret string
+}
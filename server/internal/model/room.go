@@ -0,0 +1,113 @@
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// Room is a struct that represents a chat room. It has a name, the set of usernames of its members
+// and the room roles assigned to them. Members without an assigned role have RoomRoleMember.
+// Mutes maps the muted usernames to the end of the mute, the zero time meaning until unmuted.
+// Topic, Description and Metadata are set by the owners of the room.
+// Private rooms are not listed, and invite-only rooms can only be joined by the usernames in Invites
+// or with one of the InviteCodes.
+// LastMessageID is the ID of the last message sent to the room, IDs are assigned in sequence starting at 1.
+type Room struct {
+	Name          string
+	Topic         string
+	Description   string
+	Metadata      map[string]string
+	CreatedAt     time.Time
+	CreatedBy     string
+	Private       bool
+	InviteOnly    bool
+	Members       map[string]struct{}
+	Roles         map[string]RoomRole
+	Mutes         map[string]time.Time
+	Invites       map[string]struct{}
+	InviteCodes   map[string]Invite
+	LastMessageID int64
+}
+
+// Invite is a shareable code to join an invite-only room.
+// It expires at ExpiresAt, if not nil, and after MaxUses joins, if not zero.
+type Invite struct {
+	Code      string     `json:"code"`
+	Room      string     `json:"room"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MaxUses   int        `json:"max_uses,omitempty"`
+	Uses      int        `json:"uses"`
+}
+
+// RoomInfo describes a room to its members.
+type RoomInfo struct {
+	Name        string            `json:"name"`
+	Topic       string            `json:"topic,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	CreatedBy   string            `json:"created_by"`
+	Private     bool              `json:"private,omitempty"`
+	InviteOnly  bool              `json:"invite_only,omitempty"`
+}
+
+// RoomUpdate changes the description and settings of a room. Nil fields are left unchanged,
+// and metadata keys with an empty value are removed.
+type RoomUpdate struct {
+	Topic       *string           `json:"topic,omitempty"`
+	Description *string           `json:"description,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Private     *bool             `json:"private,omitempty"`
+	InviteOnly  *bool             `json:"invite_only,omitempty"`
+}
+
+// RoomListing describes a room in the list of rooms a user can see.
+type RoomListing struct {
+	Name       string `json:"name"`
+	Topic      string `json:"topic,omitempty"`
+	Private    bool   `json:"private,omitempty"`
+	InviteOnly bool   `json:"invite_only,omitempty"`
+	Members    int    `json:"members"`
+}
+
+type RoomsResponse struct {
+	Rooms []RoomListing `json:"rooms"`
+}
+
+// RoomMember is a member of a room. Members that are not connected keep their membership,
+// and rejoin the room when they log in again.
+type RoomMember struct {
+	Username string   `json:"username"`
+	Online   bool     `json:"online"`
+	Role     RoomRole `json:"role"`
+}
+
+type RoomMembersResponse struct {
+	Room    string       `json:"room"`
+	Members []RoomMember `json:"members"`
+}
+
+// UnreadCount is the number of messages of a room sent after the last message read by the user.
+type UnreadCount struct {
+	Room          string `json:"room"`
+	LastReadID    int64  `json:"last_read_id"`
+	LastMessageID int64  `json:"last_message_id"`
+	Unread        int64  `json:"unread"`
+}
+
+type UnreadResponse struct {
+	Rooms []UnreadCount `json:"rooms"`
+}
+
+// Rooms is a map of room names to Room objects. The key is the room name and the value is the Room object.
+type Rooms map[string]Room
+
+// ActiveRooms is a struct that represents the rooms that currently have members.
+// It has a mutex to ensure thread safety and a Rooms object to store the rooms.
+// When both locks are needed, LoggedUsers must be acquired before ActiveRooms.
+type ActiveRooms struct {
+	sync.RWMutex
+	Rooms Rooms
+}
@@ -0,0 +1,134 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Websocket subprotocols of the stream. Frames are JSON text frames, unless the client requests
+// SubprotocolMessagePack, which carries the same frames encoded as MessagePack in binary frames.
+const (
+	SubprotocolJSON        = "chat.json"
+	SubprotocolMessagePack = "chat.msgpack"
+)
+
+// StreamRequest is a frame sent by the client through the websocket once the handshake is done.
+type StreamRequest struct {
+	Type string `json:"type"`
+	Room string `json:"room,omitempty"`
+	Text string `json:"text,omitempty"`
+	// User is the target of the requests that act on another user, such as set_role
+	User string   `json:"user,omitempty"`
+	Role RoomRole `json:"role,omitempty"`
+	// Duration in seconds of a mute or a ban, zero meaning until lifted
+	Duration int `json:"duration,omitempty"`
+	// Update holds the changes of update_room requests
+	Update *RoomUpdate `json:"update,omitempty"`
+	// Code is the invite code used to join an invite-only room
+	Code string `json:"code,omitempty"`
+	// MaxUses is the number of joins allowed by the invite code of create_invite requests, zero meaning unlimited
+	MaxUses int `json:"max_uses,omitempty"`
+	// MessageID is the last message read by mark_read requests, zero meaning the last message of the room
+	MessageID int64 `json:"message_id,omitempty"`
+}
+
+// Types of StreamRequest.
+const (
+	StreamRequestJoin       = "join"
+	StreamRequestLeave      = "leave"
+	StreamRequestMessage    = "message"
+	StreamRequestSetRole    = "set_role"
+	StreamRequestKick       = "kick"
+	StreamRequestMute       = "mute"
+	StreamRequestUnmute     = "unmute"
+	StreamRequestBan        = "ban"
+	StreamRequestUpdateRoom = "update_room"
+	// StreamRequestInvite invites User to an invite-only room
+	StreamRequestInvite = "invite"
+	// StreamRequestCreateInvite creates an invite code for a room, valid for Duration seconds and MaxUses joins
+	StreamRequestCreateInvite = "create_invite"
+	// StreamRequestMembers asks for the members of a room, answered with a members event
+	StreamRequestMembers = "members"
+	// StreamRequestMarkRead advances the read marker of the user in a room, answered with a read event
+	StreamRequestMarkRead = "mark_read"
+)
+
+// StreamRequestResponse acknowledges a StreamRequest sent with POST /messages, whose events are delivered
+// through the stream of the user.
+type StreamRequestResponse struct {
+	Message string `json:"message"`
+}
+
+// PollResponse returns the frames of the stream queued for the user to GET /poll, the welcome frame first.
+// Cursor is the number of the last frame, which the next poll sends back to acknowledge the frames.
+type PollResponse struct {
+	Cursor int64             `json:"cursor"`
+	Events []json.RawMessage `json:"events"`
+}
+
+// StreamEvent is a frame sent by the server through the websocket once the handshake is done.
+type StreamEvent struct {
+	Type      string    `json:"type"`
+	Room      string    `json:"room,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// ID identifies the message and action events within their room.
+	ID int64 `json:"id,omitempty"`
+	// Bot is true for the messages posted to an incoming webhook, From being the name of its bot.
+	Bot bool `json:"bot,omitempty"`
+	// Members lists the members of the room, only sent to the user that joins it.
+	Members []string `json:"members,omitempty"`
+	// RoomInfo describes the room in room_updated events, and in the joined event sent to the user that joins it.
+	RoomInfo *RoomInfo `json:"room_info,omitempty"`
+	// Role is the room role of the user in joined and role_changed events.
+	Role RoomRole `json:"role,omitempty"`
+	// ExpiresAt is the end of a mute or a ban, nil if it lasts until lifted.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// NewName is the new username of the user renamed in renamed events.
+	NewName string `json:"new_name,omitempty"`
+	// Invite is the invite code created by a create_invite request.
+	Invite *Invite `json:"invite,omitempty"`
+	// RoomMembers lists the members of the room, online or not, in members events.
+	RoomMembers []RoomMember `json:"room_members,omitempty"`
+	// Unread is the unread count of the room in read events.
+	Unread *UnreadCount   `json:"unread,omitempty"`
+	Error  *ErrorResponse `json:"error,omitempty"`
+}
+
+// Types of StreamEvent.
+const (
+	StreamEventJoined  = "joined"
+	StreamEventLeft    = "left"
+	StreamEventMessage = "message"
+	StreamEventError   = "error"
+	// StreamEventSystem is an announcement from the server operators
+	StreamEventSystem = "system"
+	// StreamEventRoomClosed is sent to the members of a room closed by the server operators
+	StreamEventRoomClosed = "room_closed"
+	// StreamEventRoleChanged is sent to the members of a room when the room role of a member changes
+	StreamEventRoleChanged = "role_changed"
+	// StreamEventKicked is sent to the members of a room, and to the kicked user, when a user is kicked from it
+	StreamEventKicked = "kicked"
+	// StreamEventMuted and StreamEventUnmuted are sent to the members of a room when a user is muted or unmuted in it
+	StreamEventMuted   = "muted"
+	StreamEventUnmuted = "unmuted"
+	// StreamEventBanned is sent to a user right before it is disconnected by a ban
+	StreamEventBanned = "banned"
+	// StreamEventAction is a message describing what the sender is doing, sent with the /me command
+	StreamEventAction = "action"
+	// StreamEventRoomUpdated is sent to the members of a room when its topic, description or metadata change
+	StreamEventRoomUpdated = "room_updated"
+	// StreamEventReply is the answer to a slash command, only sent to the user that typed it
+	StreamEventReply = "reply"
+	// StreamEventRenamed is sent to the members of the rooms of a user, and to the user, when it changes its username
+	StreamEventRenamed = "renamed"
+	// StreamEventInvited is sent to the invited user, and to the user that invited it, when a user is invited to a room
+	StreamEventInvited = "invited"
+	// StreamEventInviteCreated is sent to the user that created an invite code
+	StreamEventInviteCreated = "invite_created"
+	// StreamEventMembers answers a members request
+	StreamEventMembers = "members"
+	// StreamEventRead answers a mark_read request
+	StreamEventRead = "read"
+)
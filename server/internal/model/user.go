@@ -2,11 +2,14 @@ package model
 
 import "sync"
 
-// User is a struct that represents a user in the system. It has a username and a token.
+// User is a struct that represents a user in the system. It has a username, a token, a global role and the IP it logged in from.
+// An empty Role is the same as RoleUser.
 type User struct {
 	Username string
 	Token    string
-	Channel  chan []byte
+	Role     Role
+	// IP is the address the user logged in from
+	IP string
 }
 
 // Users is a map of usernames to User objects. The key is the username and the value is the User object.
@@ -14,6 +17,7 @@ type Users map[string]User
 
 // LoggedUsers is a struct that represents the users that are currently logged in.
 // It has a mutex to ensure thread safety and a Users object to store the users.
+// The stream connections of the users are kept apart, so delivering events doesn't need this lock.
 type LoggedUsers struct {
 	sync.RWMutex
 	Users Users
@@ -0,0 +1,104 @@
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// Headers of the requests delivering the events of a room to its webhooks.
+const (
+	// WebhookSignatureHeader carries "sha256=" followed by the hex encoded HMAC-SHA256 of the body,
+	// keyed with the secret of the webhook.
+	WebhookSignatureHeader = "X-Chat-Signature"
+	// WebhookEventHeader carries the type of the delivered event.
+	WebhookEventHeader = "X-Chat-Event"
+	// WebhookDeliveryHeader carries the ID of the delivery, which is the same for every attempt.
+	WebhookDeliveryHeader = "X-Chat-Delivery"
+)
+
+// Webhook is a URL receiving the events of a room as signed JSON POST requests.
+type Webhook struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	URL  string `json:"url"`
+	// Events are the types of the events delivered, the messages, actions, joins and leaves if empty.
+	Events []string `json:"events,omitempty"`
+	// Secret is the key of the signature of the deliveries, only returned when the webhook is registered.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookRequest registers a webhook for a room. A random secret is generated if Secret is empty.
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+type WebhooksResponse struct {
+	Room     string    `json:"room"`
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// WebhookDelivery is the body POSTed to a webhook for every event of its room.
+type WebhookDelivery struct {
+	ID      string      `json:"id"`
+	Webhook string      `json:"webhook"`
+	Event   StreamEvent `json:"event"`
+}
+
+// DeadLetter records a delivery given up after failing every attempt.
+type DeadLetter struct {
+	Webhook  string          `json:"webhook"`
+	Room     string          `json:"room"`
+	URL      string          `json:"url"`
+	Delivery WebhookDelivery `json:"delivery"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+// IncomingWebhook is a token allowing to post messages to a room with POST /hooks/{token},
+// without a session. The messages are sent by its bot.
+type IncomingWebhook struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	// Username is the name of the bot sending the messages.
+	Username string `json:"username"`
+	// Token is the secret part of the URL of the webhook, only returned when the webhook is created.
+	Token     string    `json:"token,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IncomingWebhookRequest creates an incoming webhook for a room. The bot is named "webhook" if Username is empty.
+type IncomingWebhookRequest struct {
+	Username string `json:"username,omitempty"`
+}
+
+type IncomingWebhooksResponse struct {
+	Room     string            `json:"room"`
+	Webhooks []IncomingWebhook `json:"webhooks"`
+}
+
+// HookMessage is the body of POST /hooks/{token}, posting the text to the room of the webhook.
+type HookMessage struct {
+	Text string `json:"text"`
+}
+
+// HookMessageResponse acknowledges a message posted to an incoming webhook.
+type HookMessageResponse struct {
+	Message string `json:"message"`
+}
+
+// RoomWebhooks is a struct that holds the webhooks registered for the rooms.
+// Like the filters, it outlives the rooms, so a room keeps its webhooks when it's created again.
+type RoomWebhooks struct {
+	sync.RWMutex
+	Rooms map[string][]Webhook
+	// Incoming maps the tokens of the incoming webhooks to them.
+	Incoming map[string]IncomingWebhook
+}
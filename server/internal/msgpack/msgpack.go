@@ -0,0 +1,344 @@
+// Package msgpack converts the JSON frames of the stream to and from MessagePack, the compact binary
+// encoding selected with the model.SubprotocolMessagePack websocket subprotocol. Both encodings carry
+// the same envelope, with the same field names, so frames are built as JSON and converted when sent.
+//
+// Only the types that JSON can represent are supported: nil, booleans, numbers, strings, arrays and maps
+// with string keys. Binary strings are decoded as strings, and extension types are rejected.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// maxDepth bounds the nesting of the decoded arrays and maps.
+const maxDepth = 64
+
+// ErrTruncated is returned when decoding data that ends in the middle of a value.
+var ErrTruncated = errors.New("msgpack: truncated data")
+
+// FromJSON converts a JSON document to MessagePack.
+func FromJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return Encode(value)
+}
+
+// ToJSON converts a MessagePack document to JSON.
+func ToJSON(data []byte) ([]byte, error) {
+	value, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// Encode encodes a value made of nil, bool, string, json.Number, float64, int64, []any and map[string]any.
+// Map keys are sorted, so the encoding of a value is always the same.
+func Encode(value any) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := encode(&buffer, value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func encode(buffer *bytes.Buffer, value any) error {
+	switch value := value.(type) {
+	case nil:
+		buffer.WriteByte(0xc0)
+	case bool:
+		if value {
+			buffer.WriteByte(0xc3)
+		} else {
+			buffer.WriteByte(0xc2)
+		}
+	case string:
+		encodeString(buffer, value)
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			encodeInt(buffer, integer)
+			return nil
+		}
+		float, err := value.Float64()
+		if err != nil {
+			return err
+		}
+		encodeFloat(buffer, float)
+	case float64:
+		encodeFloat(buffer, value)
+	case int64:
+		encodeInt(buffer, value)
+	case int:
+		encodeInt(buffer, int64(value))
+	case []any:
+		encodeLength(buffer, len(value), 0x90, 15, 0xdc, 0xdd)
+		for _, element := range value {
+			if err := encode(buffer, element); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		encodeLength(buffer, len(value), 0x80, 15, 0xde, 0xdf)
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeString(buffer, key)
+			if err := encode(buffer, value[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", value)
+	}
+	return nil
+}
+
+// encodeLength writes the header of a string, array or map: its fix format holding lengths up to fixMax,
+// or its 16 or 32 bits format.
+func encodeLength(buffer *bytes.Buffer, length int, fix byte, fixMax int, format16 byte, format32 byte) {
+	switch {
+	case length <= fixMax:
+		buffer.WriteByte(fix | byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(format16)
+		buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(length)))
+	default:
+		buffer.WriteByte(format32)
+		buffer.Write(binary.BigEndian.AppendUint32(nil, uint32(length)))
+	}
+}
+
+func encodeString(buffer *bytes.Buffer, value string) {
+	if len(value) > 31 && len(value) <= math.MaxUint8 {
+		buffer.WriteByte(0xd9)
+		buffer.WriteByte(byte(len(value)))
+	} else {
+		encodeLength(buffer, len(value), 0xa0, 31, 0xda, 0xdb)
+	}
+	buffer.WriteString(value)
+}
+
+// encodeInt writes the integer in the smallest format that holds it.
+func encodeInt(buffer *bytes.Buffer, value int64) {
+	switch {
+	case value >= 0 && value <= 0x7f:
+		buffer.WriteByte(byte(value))
+	case value < 0 && value >= -32:
+		buffer.WriteByte(byte(int8(value)))
+	case value >= 0 && value <= math.MaxUint8:
+		buffer.Write([]byte{0xcc, byte(value)})
+	case value >= 0 && value <= math.MaxUint16:
+		buffer.WriteByte(0xcd)
+		buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(value)))
+	case value >= 0 && value <= math.MaxUint32:
+		buffer.WriteByte(0xce)
+		buffer.Write(binary.BigEndian.AppendUint32(nil, uint32(value)))
+	case value >= 0:
+		buffer.WriteByte(0xcf)
+		buffer.Write(binary.BigEndian.AppendUint64(nil, uint64(value)))
+	case value >= math.MinInt8:
+		buffer.Write([]byte{0xd0, byte(int8(value))})
+	case value >= math.MinInt16:
+		buffer.WriteByte(0xd1)
+		buffer.Write(binary.BigEndian.AppendUint16(nil, uint16(int16(value))))
+	case value >= math.MinInt32:
+		buffer.WriteByte(0xd2)
+		buffer.Write(binary.BigEndian.AppendUint32(nil, uint32(int32(value))))
+	default:
+		buffer.WriteByte(0xd3)
+		buffer.Write(binary.BigEndian.AppendUint64(nil, uint64(value)))
+	}
+}
+
+func encodeFloat(buffer *bytes.Buffer, value float64) {
+	buffer.WriteByte(0xcb)
+	buffer.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+// Decode decodes a single MessagePack value. Integers are decoded as int64, or as uint64 when they
+// don't fit, floats as float64, binary strings as strings, arrays as []any and maps as map[string]any.
+func Decode(data []byte) (any, error) {
+	decoder := &decoder{data: data}
+	value, err := decoder.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.offset != len(data) {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	return value, nil
+}
+
+type decoder struct {
+	data   []byte
+	offset int
+}
+
+// next returns the next n bytes.
+func (decoder *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(decoder.data)-decoder.offset < n {
+		return nil, ErrTruncated
+	}
+	bytes := decoder.data[decoder.offset : decoder.offset+n]
+	decoder.offset += n
+	return bytes, nil
+}
+
+// uint reads a big endian unsigned integer of the given size in bytes.
+func (decoder *decoder) uint(size int) (uint64, error) {
+	bytes, err := decoder.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, b := range bytes {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+// length reads a length of the given size in bytes. The length of arrays and maps is at least the number
+// of bytes it takes, so lengths larger than the remaining data are rejected before allocating anything.
+func (decoder *decoder) length(size int) (int, error) {
+	length, err := decoder.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if length > uint64(len(decoder.data)-decoder.offset) {
+		return 0, ErrTruncated
+	}
+	return int(length), nil
+}
+
+func (decoder *decoder) decode(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("msgpack: maximum depth exceeded")
+	}
+	header, err := decoder.next(1)
+	if err != nil {
+		return nil, err
+	}
+	format := header[0]
+
+	switch {
+	case format <= 0x7f:
+		return int64(format), nil
+	case format >= 0xe0:
+		return int64(int8(format)), nil
+	case format&0xe0 == 0xa0:
+		return decoder.string(int(format & 0x1f))
+	case format&0xf0 == 0x90:
+		return decoder.array(int(format&0x0f), depth)
+	case format&0xf0 == 0x80:
+		return decoder.dictionary(int(format&0x0f), depth)
+	}
+
+	switch format {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, err := decoder.uint(1 << (format - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if value > math.MaxInt64 {
+			return value, nil
+		}
+		return int64(value), nil
+	case 0xd0:
+		value, err := decoder.uint(1)
+		return int64(int8(value)), err
+	case 0xd1:
+		value, err := decoder.uint(2)
+		return int64(int16(value)), err
+	case 0xd2:
+		value, err := decoder.uint(4)
+		return int64(int32(value)), err
+	case 0xd3:
+		value, err := decoder.uint(8)
+		return int64(value), err
+	case 0xca:
+		value, err := decoder.uint(4)
+		return float64(math.Float32frombits(uint32(value))), err
+	case 0xcb:
+		value, err := decoder.uint(8)
+		return math.Float64frombits(value), err
+	case 0xd9, 0xda, 0xdb:
+		length, err := decoder.length(1 << (format - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.string(length)
+	case 0xc4, 0xc5, 0xc6:
+		length, err := decoder.length(1 << (format - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.string(length)
+	case 0xdc, 0xdd:
+		length, err := decoder.length(2 << (format - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.array(length, depth)
+	case 0xde, 0xdf:
+		length, err := decoder.length(2 << (format - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.dictionary(length, depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", format)
+}
+
+func (decoder *decoder) string(length int) (string, error) {
+	bytes, err := decoder.next(length)
+	return string(bytes), err
+}
+
+func (decoder *decoder) array(length int, depth int) ([]any, error) {
+	values := make([]any, length)
+	for i := range values {
+		value, err := decoder.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (decoder *decoder) dictionary(length int, depth int) (map[string]any, error) {
+	values := make(map[string]any, length)
+	for i := 0; i < length; i++ {
+		key, err := decoder.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key of type %T", key)
+		}
+		if values[name], err = decoder.decode(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,106 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		expected []byte
+	}{
+		{"nil", `null`, []byte{0xc0}},
+		{"booleans", `[true,false]`, []byte{0x92, 0xc3, 0xc2}},
+		{"positive fixint", `127`, []byte{0x7f}},
+		{"negative fixint", `-32`, []byte{0xe0}},
+		{"uint 16", `256`, []byte{0xcd, 0x01, 0x00}},
+		{"int 8", `-33`, []byte{0xd0, 0xdf}},
+		{"float", `1.5`, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"fixstr", `"hi"`, []byte{0xa2, 'h', 'i'}},
+		{"sorted fixmap", `{"b":1,"a":2}`, []byte{0x82, 0xa1, 'a', 0x02, 0xa1, 'b', 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := FromJSON([]byte(tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encoded, tt.expected) {
+				t.Errorf("Unexpected encoding: got % x want % x", encoded, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	frame := map[string]any{
+		"type":      "message",
+		"room":      "general",
+		"text":      strings.Repeat("long text ", 40),
+		"id":        float64(1 << 40),
+		"negative":  float64(-70000),
+		"ratio":     0.25,
+		"empty":     nil,
+		"flags":     []any{true, false, "", float64(0)},
+		"nested":    map[string]any{"members": []any{"alice", "bob"}},
+		"timestamp": "2026-10-18T12:00:00Z",
+	}
+	for i := 0; i < 20; i++ {
+		frame["key"+strings.Repeat("x", i)] = float64(i)
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := FromJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) >= len(data) {
+		t.Errorf("MessagePack should be smaller than JSON: got %d bytes, JSON has %d", len(encoded), len(data))
+	}
+	decoded, err := ToJSON(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roundTrip map[string]any
+	if err := json.Unmarshal(decoded, &roundTrip); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := json.Marshal(frame)
+	actual, _ := json.Marshal(roundTrip)
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("Unexpected round trip:\ngot  %s\nwant %s", actual, expected)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated string", []byte{0xa4, 't'}},
+		{"length beyond data", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{"trailing data", []byte{0xc0, 0xc0}},
+		{"non-string key", []byte{0x81, 0x01, 0x01}},
+		{"extension", []byte{0xd4, 0x01, 0x00}},
+		{"too deep", bytes.Repeat([]byte{0x91}, maxDepth+2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.data); err == nil {
+				t.Errorf("Decoding % x should fail", tt.data)
+			}
+		})
+	}
+	if _, err := Decode([]byte{0xa4, 't'}); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Unexpected error: got %v want %v", err, ErrTruncated)
+	}
+}
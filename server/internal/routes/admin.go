@@ -0,0 +1,188 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// adminListUsers is a handler function that returns the logged in users, whether they are
+// connected to the stream and the rooms they joined.
+func (handler *Handler) adminListUsers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionListUsers); !ok {
+		return
+	}
+
+	handler.LoggedUsers.RLock()
+	handler.ActiveRooms.RLock()
+	users := make([]model.AdminUser, 0, len(handler.LoggedUsers.Users))
+	for username := range handler.LoggedUsers.Users {
+		rooms := []string{}
+		for roomName, room := range handler.ActiveRooms.Rooms {
+			if _, ok := room.Members[username]; ok {
+				rooms = append(rooms, roomName)
+			}
+		}
+		sort.Strings(rooms)
+		users = append(users, model.AdminUser{
+			Username:  username,
+			Connected: handler.connections.channel(username) != nil,
+			Rooms:     rooms,
+		})
+	}
+	handler.ActiveRooms.RUnlock()
+	handler.LoggedUsers.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	writeJSON(w, http.StatusOK, model.AdminUsersResponse{Users: users})
+}
+
+// adminLogoutUser is a handler function that forcibly logs out a user, running the same cleanup as a logout.
+// If a reason is given, it is sent to the user as a system event before disconnecting it.
+func (handler *Handler) adminLogoutUser(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	actor, ok := handler.authorizeRequest(w, r, actionLogoutUser)
+	if !ok {
+		return
+	}
+	var adminLogoutRequest model.AdminLogoutRequest
+	if !decodeRequest(w, r, &adminLogoutRequest) {
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := authorize(actor, actionLogoutUser, model.Room{}, handler.principalOf(username), ""); err != nil {
+		writeStreamError(w, err)
+		return
+	}
+	handler.LoggedUsers.Lock()
+	if _, ok := handler.LoggedUsers.Users[username]; !ok {
+		handler.LoggedUsers.Unlock()
+		// Users logged in to another node are disconnected by that node when it refreshes their session
+		if !handler.releaseSession(username, "") {
+			writeError(w, http.StatusNotFound, model.ErrorCodeNotLoggedIn, fmt.Sprintf("User %s is not logged in", username), "")
+			return
+		}
+		if adminLogoutRequest.Reason != "" {
+			handler.relay(userTopic(username), newEvent(model.StreamEventSystem, "", "", adminLogoutRequest.Reason))
+		}
+		handler.audit(model.AuditEvent{Action: model.AuditActionForcedLogout, Actor: actorName(actor), Target: username, Details: adminLogoutRequest.Reason})
+		log.Printf("User %s forcibly logged out by an admin from another node", username)
+		writeJSON(w, http.StatusOK, model.AdminActionResponse{Message: fmt.Sprintf("User %s logged out", username)})
+		return
+	}
+
+	if adminLogoutRequest.Reason != "" {
+		handler.broadcast([]string{username}, newEvent(model.StreamEventSystem, "", "", adminLogoutRequest.Reason))
+	}
+	ip := handler.LoggedUsers.Users[username].IP
+	cleanup := CleanupUserData(handler, model.UserWithTokenRequest{Username: username})
+	handler.LoggedUsers.Unlock()
+	handler.finishCleanup(cleanup)
+	handler.releaseSession(username, cleanup.token)
+	handler.audit(model.AuditEvent{Action: model.AuditActionForcedLogout, Actor: actorName(actor), Target: username, IP: ip, Details: adminLogoutRequest.Reason})
+
+	log.Printf("User %s forcibly logged out by an admin", username)
+	writeJSON(w, http.StatusOK, model.AdminActionResponse{Message: fmt.Sprintf("User %s logged out", username)})
+}
+
+// adminAnnounce is a handler function that broadcasts a system announcement to a room, or to every connected user.
+func (handler *Handler) adminAnnounce(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionAnnounce); !ok {
+		return
+	}
+	var adminAnnouncementRequest model.AdminAnnouncementRequest
+	if !decodeRequest(w, r, &adminAnnouncementRequest) {
+		return
+	}
+	if strings.TrimSpace(adminAnnouncementRequest.Text) == "" {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeEmptyMessage, "Announcement can't be empty", "")
+		return
+	}
+
+	var recipients []string
+	if adminAnnouncementRequest.Room != "" {
+		handler.ActiveRooms.RLock()
+		room, ok := handler.ActiveRooms.Rooms[adminAnnouncementRequest.Room]
+		if ok {
+			recipients = members(room)
+		}
+		handler.ActiveRooms.RUnlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, model.ErrorCodeRoomNotFound, fmt.Sprintf("Room %s not found", adminAnnouncementRequest.Room), "")
+			return
+		}
+	} else {
+		handler.LoggedUsers.RLock()
+		for username := range handler.LoggedUsers.Users {
+			recipients = append(recipients, username)
+		}
+		handler.LoggedUsers.RUnlock()
+	}
+
+	handler.broadcast(recipients, newEvent(model.StreamEventSystem, adminAnnouncementRequest.Room, "", adminAnnouncementRequest.Text))
+	log.Printf("Announcement sent to %d users", len(recipients))
+	writeJSON(w, http.StatusOK, model.AdminActionResponse{Message: fmt.Sprintf("Announcement sent to %d users", len(recipients))})
+}
+
+// adminListRooms is a handler function that returns the active rooms and their members.
+func (handler *Handler) adminListRooms(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionListRooms); !ok {
+		return
+	}
+
+	handler.ActiveRooms.RLock()
+	rooms := make([]model.AdminRoom, 0, len(handler.ActiveRooms.Rooms))
+	for roomName, room := range handler.ActiveRooms.Rooms {
+		rooms = append(rooms, model.AdminRoom{Name: roomName, Private: room.Private, InviteOnly: room.InviteOnly, Members: members(room)})
+	}
+	handler.ActiveRooms.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	writeJSON(w, http.StatusOK, model.AdminRoomsResponse{Rooms: rooms})
+}
+
+// adminCloseRoom is a handler function that closes a room, removing all its members.
+func (handler *Handler) adminCloseRoom(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	actor, ok := handler.authorizeRequest(w, r, actionCloseRoom)
+	if !ok {
+		return
+	}
+
+	roomName := r.PathValue("room")
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if ok {
+		delete(handler.ActiveRooms.Rooms, roomName)
+		handler.forgetRoom(roomName)
+	}
+	handler.ActiveRooms.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, model.ErrorCodeRoomNotFound, fmt.Sprintf("Room %s not found", roomName), "")
+		return
+	}
+
+	handler.broadcastRoom(roomName, members(room), newEvent(model.StreamEventRoomClosed, roomName, "", ""))
+	handler.unsubscribeRoom(roomName)
+	handler.audit(model.AuditEvent{Action: model.AuditActionRoomClosed, Actor: actorName(actor), Room: roomName})
+	log.Printf("Room %s closed by an admin", roomName)
+	writeJSON(w, http.StatusOK, model.AdminActionResponse{Message: fmt.Sprintf("Room %s closed", roomName)})
+}
@@ -0,0 +1,180 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	var tests = []struct {
+		name          string
+		adminToken    string
+		authorization string
+		status        int
+		code          string
+	}{
+		{"disabled", "", "Bearer secret", http.StatusForbidden, model.ErrorCodeAdminDisabled},
+		{"missing token", "secret", "", http.StatusUnauthorized, model.ErrorCodeUnauthorized},
+		{"invalid token", "secret", "Bearer other", http.StatusUnauthorized, model.ErrorCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/admin/users", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			rr := httptest.NewRecorder()
+			handlerFixture := NewHandler()
+			handlerFixture.AdminToken = tt.adminToken
+			handlerFixture.NewServeMux().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, tt.status)
+			}
+			var errorResponse model.ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &errorResponse); err != nil || errorResponse.Code != tt.code {
+				t.Errorf("handler returned unexpected body: %v", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminListUsers(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.connections.bind("alice", make(chan []byte, 1))
+	handlerFixture.ActiveRooms.Rooms["general"] = model.Room{Name: "general", Members: map[string]struct{}{"alice": {}}}
+
+	rr := adminRequest(t, handlerFixture, "GET", "/admin/users", "")
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	expected := `{"users":[{"username":"alice","connected":true,"rooms":["general"]},{"username":"bob","connected":false,"rooms":[]}]}`
+	received := strings.TrimSpace(rr.Body.String())
+	if received != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			received, expected)
+	}
+}
+
+func TestAdminLogoutUser(t *testing.T) {
+	channel := make(chan []byte, 1)
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.connections.bind("alice", channel)
+
+	rr := adminRequest(t, handlerFixture, "POST", "/admin/users/alice/logout", `{"reason": "Be nice"}`)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// The reason is queued before the channel is closed
+	var event model.StreamEvent
+	if err := json.Unmarshal(<-channel, &event); err != nil || event.Type != model.StreamEventSystem || event.Text != "Be nice" {
+		t.Errorf("User should receive the reason of the logout, got %+v", event)
+	}
+	if _, ok := <-channel; ok {
+		t.Errorf("Channel of the user should be closed")
+	}
+
+	handlerFixture.LoggedUsers.RLock()
+	defer handlerFixture.LoggedUsers.RUnlock()
+	if _, ok := handlerFixture.LoggedUsers.Users["alice"]; ok {
+		t.Errorf("User should be removed from the list of logged users")
+	}
+}
+
+func TestAdminLogoutUserNotLoggedIn(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+
+	rr := adminRequest(t, handlerFixture, "POST", "/admin/users/alice/logout", `{}`)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+	assertErrorResponse(t, rr, model.ErrorCodeNotLoggedIn, "User alice is not logged in")
+}
+
+func TestAdminAnnounce(t *testing.T) {
+	aliceChannel := make(chan []byte, 1)
+	bobChannel := make(chan []byte, 1)
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.addUserLocked(model.User{Username: "alice"})
+	handlerFixture.connections.bind("alice", aliceChannel)
+	handlerFixture.addUserLocked(model.User{Username: "bob"})
+	handlerFixture.connections.bind("bob", bobChannel)
+
+	rr := adminRequest(t, handlerFixture, "POST", "/admin/announcements", `{"text": "Maintenance at 18:00"}`)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	for _, channel := range []chan []byte{aliceChannel, bobChannel} {
+		var event model.StreamEvent
+		if err := json.Unmarshal(<-channel, &event); err != nil || event.Type != model.StreamEventSystem || event.Text != "Maintenance at 18:00" {
+			t.Errorf("Every user should receive the announcement, got %+v", event)
+		}
+	}
+}
+
+func TestAdminCloseRoom(t *testing.T) {
+	channel := make(chan []byte, 1)
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.addUserLocked(model.User{Username: "alice"})
+	handlerFixture.connections.bind("alice", channel)
+	handlerFixture.ActiveRooms.Rooms["general"] = model.Room{Name: "general", Members: map[string]struct{}{"alice": {}}}
+
+	rr := adminRequest(t, handlerFixture, "POST", "/admin/rooms/general/close", "")
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var event model.StreamEvent
+	if err := json.Unmarshal(<-channel, &event); err != nil || event.Type != model.StreamEventRoomClosed || event.Room != "general" {
+		t.Errorf("Members should be notified that the room was closed, got %+v", event)
+	}
+
+	handlerFixture.ActiveRooms.RLock()
+	defer handlerFixture.ActiveRooms.RUnlock()
+	if _, ok := handlerFixture.ActiveRooms.Rooms["general"]; ok {
+		t.Errorf("Room should be removed from the active rooms")
+	}
+}
+
+// adminRequest serves a request to the admin API authenticated with the admin token of the handler.
+func adminRequest(t *testing.T, handler *Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+handler.AdminToken)
+
+	rr := httptest.NewRecorder()
+	handler.NewServeMux().ServeHTTP(rr, req)
+	return rr
+}
@@ -0,0 +1,237 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+const (
+	// maxAuditEvents is the maximum number of events returned by a single audit query.
+	maxAuditEvents = 1000
+	// maxMemoryAuditEvents is the number of events kept by a MemoryAuditSink, older ones are dropped first.
+	maxMemoryAuditEvents = 10000
+)
+
+// AuditSink is an append-only store of audit events.
+type AuditSink interface {
+	// Write appends an event to the audit trail.
+	Write(event model.AuditEvent) error
+	// Query returns the events selected by the filter, oldest first.
+	Query(filter model.AuditFilter) ([]model.AuditEvent, error)
+}
+
+// MemoryAuditSink keeps the most recent events of the audit trail in memory. It is lost when the server stops.
+type MemoryAuditSink struct {
+	mu    sync.RWMutex
+	limit int
+	// events is a ring buffer, whose oldest event is at start once it holds limit events
+	events []model.AuditEvent
+	start  int
+}
+
+func NewMemoryAuditSink() *MemoryAuditSink {
+	return &MemoryAuditSink{limit: maxMemoryAuditEvents}
+}
+
+func (sink *MemoryAuditSink) Write(event model.AuditEvent) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.events) < sink.limit {
+		sink.events = append(sink.events, event)
+		return nil
+	}
+	sink.events[sink.start] = event
+	sink.start = (sink.start + 1) % len(sink.events)
+	return nil
+}
+
+func (sink *MemoryAuditSink) Query(filter model.AuditFilter) ([]model.AuditEvent, error) {
+	sink.mu.RLock()
+	defer sink.mu.RUnlock()
+	var events []model.AuditEvent
+	for i := range sink.events {
+		event := sink.events[(sink.start+i)%len(sink.events)]
+		if filter.Matches(event) {
+			events = append(events, event)
+		}
+	}
+	return limitEvents(events, filter.Limit), nil
+}
+
+// FileAuditSink appends the audit trail to a file, one JSON encoded event per line.
+type FileAuditSink struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewFileAuditSink opens the file at path for appending, creating it if it doesn't exist.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{path: path, file: file}, nil
+}
+
+func (sink *FileAuditSink) Write(event model.AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err = sink.file.Write(append(line, '\n'))
+	return err
+}
+
+func (sink *FileAuditSink) Query(filter model.AuditFilter) ([]model.AuditEvent, error) {
+	// Events are written whole under the lock, so the file ends with a complete line at the size read under it.
+	// Reading up to that size doesn't block the writers while the file is scanned.
+	sink.mu.Lock()
+	info, err := sink.file.Stat()
+	sink.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(sink.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Only the last filter.Limit matches are kept while scanning, overwriting the oldest one, which is at start
+	var events []model.AuditEvent
+	start := 0
+	scanner := bufio.NewScanner(io.LimitReader(file, info.Size()))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRequestBodyBytes)
+	for scanner.Scan() {
+		var event model.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("corrupted audit file %s: %w", sink.path, err)
+		}
+		if !filter.Matches(event) {
+			continue
+		}
+		if filter.Limit > 0 && len(events) == filter.Limit {
+			events[start] = event
+			start = (start + 1) % filter.Limit
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return slices.Concat(events[start:], events[:start]), nil
+}
+
+// Close closes the audit file.
+func (sink *FileAuditSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.file.Close()
+}
+
+// limitEvents keeps the most recent events, up to limit.
+func limitEvents(events []model.AuditEvent, limit int) []model.AuditEvent {
+	if limit > 0 && len(events) > limit {
+		return events[len(events)-limit:]
+	}
+	return events
+}
+
+// audit records a security relevant action in the audit trail.
+// Failing to write the event is logged, but never stops the action.
+func (handler *Handler) audit(event model.AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	log.Printf("Audit: %s by %s on %s %s %s", event.Action, event.Actor, event.Target, event.Room, event.Details)
+	if handler.Audit == nil {
+		return
+	}
+	if err := handler.Audit.Write(event); err != nil {
+		log.Printf("Can't write audit event: %v", err)
+	}
+}
+
+// actorName returns the name recorded in the audit trail for the principal.
+func actorName(actor principal) string {
+	if actor.Username == "" {
+		return "admin-api"
+	}
+	return actor.Username
+}
+
+// parseAuditFilter reads an AuditFilter from the query string of the request.
+func parseAuditFilter(r *http.Request) (model.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := model.AuditFilter{
+		User:   query.Get("user"),
+		Action: query.Get("action"),
+		Limit:  maxAuditEvents,
+	}
+	var err error
+	if value := query.Get("from"); value != "" {
+		if filter.From, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if filter.To, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxAuditEvents {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxAuditEvents)
+		}
+		filter.Limit = limit
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.To.Before(filter.From) {
+		return filter, errors.New("to can't be before from")
+	}
+	return filter, nil
+}
+
+// adminQueryAudit is a handler function that returns the audit events selected by the query string.
+func (handler *Handler) adminQueryAudit(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionQueryAudit); !ok {
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidQuery, "Invalid audit query", err.Error())
+		return
+	}
+	events := []model.AuditEvent{}
+	if handler.Audit != nil {
+		if events, err = handler.Audit.Query(filter); err != nil {
+			writeError(w, http.StatusInternalServerError, model.ErrorCodeInternal, "Can't query the audit trail", err.Error())
+			return
+		}
+		if events == nil {
+			events = []model.AuditEvent{}
+		}
+	}
+	writeJSON(w, http.StatusOK, model.AuditEventsResponse{Events: events})
+}
@@ -0,0 +1,189 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+func auditFixture() []model.AuditEvent {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	return []model.AuditEvent{
+		{Time: start, Action: model.AuditActionLogin, Actor: "alice", IP: "10.0.0.1"},
+		{Time: start.Add(time.Minute), Action: model.AuditActionLogin, Actor: "bob", IP: "10.0.0.2"},
+		{Time: start.Add(2 * time.Minute), Action: model.AuditActionKick, Actor: "alice", Target: "bob", Room: "general"},
+		{Time: start.Add(3 * time.Minute), Action: model.AuditActionLogout, Actor: "alice"},
+	}
+}
+
+func TestAuditSinks(t *testing.T) {
+	fileSink, err := NewFileAuditSink(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileSink.Close()
+
+	start := auditFixture()[0].Time
+	var tests = []struct {
+		name   string
+		filter model.AuditFilter
+		want   string
+	}{
+		{"all", model.AuditFilter{}, "login:alice,login:bob,kick:alice,logout:alice"},
+		{"actor or target", model.AuditFilter{User: "bob"}, "login:bob,kick:alice"},
+		{"action", model.AuditFilter{Action: model.AuditActionLogin}, "login:alice,login:bob"},
+		{"time range", model.AuditFilter{From: start.Add(time.Minute), To: start.Add(2 * time.Minute)}, "login:bob,kick:alice"},
+		{"limit keeps the latest", model.AuditFilter{Limit: 2}, "kick:alice,logout:alice"},
+		{"limit keeps the latest in order", model.AuditFilter{Limit: 3}, "login:bob,kick:alice,logout:alice"},
+		{"limit keeps the latest matches", model.AuditFilter{User: "alice", Limit: 1}, "logout:alice"},
+		{"limit above the matches", model.AuditFilter{Action: model.AuditActionLogin, Limit: 5}, "login:alice,login:bob"},
+	}
+	for name, sink := range map[string]AuditSink{"memory": NewMemoryAuditSink(), "file": fileSink} {
+		for _, event := range auditFixture() {
+			if err := sink.Write(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				events, err := sink.Query(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, event := range events {
+					got = append(got, event.Action+":"+event.Actor)
+				}
+				if strings.Join(got, ",") != tt.want {
+					t.Errorf("Unexpected events: got %v want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestMemoryAuditSinkDropsOldest(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	sink.limit = 3
+	for _, event := range append(auditFixture(), auditFixture()[:2]...) {
+		if err := sink.Write(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := sink.Query(model.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, event := range events {
+		got = append(got, event.Action+":"+event.Actor)
+	}
+	if want := "logout:alice,login:alice,login:bob"; strings.Join(got, ",") != want {
+		t.Errorf("Unexpected events: got %v want %v", got, want)
+	}
+}
+
+func TestFileAuditSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for _, event := range auditFixture()[:2] {
+		sink, err := NewFileAuditSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Write(event); err != nil {
+			t.Fatal(err)
+		}
+		sink.Close()
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one JSON line per event, got %q", content)
+	}
+	var event model.AuditEvent
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.Actor != "bob" {
+		t.Errorf("Unexpected audit line %q", lines[1])
+	}
+}
+
+func TestLoginIsAudited(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.PrivilegedUsers["root"] = model.PrivilegedUser{Role: model.RoleAdmin, Secret: "s3cret"}
+
+	for _, body := range []string{`{"username":"alice"}`, `{"username":"root","secret":"wrong"}`} {
+		req, err := http.NewRequest("POST", "/login", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+		handlerFixture.NewServeMux().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	token := handlerFixture.LoggedUsers.Users["alice"].Token
+	req, err := http.NewRequest("POST", "/logout", strings.NewReader(`{"username":"alice","token":"wrong"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlerFixture.NewServeMux().ServeHTTP(httptest.NewRecorder(), req)
+	req, err = http.NewRequest("POST", "/logout", strings.NewReader(`{"username":"alice","token":"`+token+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlerFixture.NewServeMux().ServeHTTP(httptest.NewRecorder(), req)
+
+	events, err := handlerFixture.Audit.Query(model.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, event := range events {
+		got = append(got, event.Action+":"+event.Actor+":"+event.Target)
+	}
+	want := "login:alice:,login_failed::root,token_rejected::alice,logout:alice:"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Unexpected audit log: got %v want %v", got, want)
+	}
+	if events[0].IP != "10.0.0.1" {
+		t.Errorf("Login should record the IP, got %q", events[0].IP)
+	}
+}
+
+func TestAdminQueryAudit(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	for _, event := range auditFixture() {
+		handlerFixture.Audit.Write(event)
+	}
+
+	query := url.Values{"user": {"bob"}, "from": {"2024-01-01T12:00:30Z"}}
+	rr := adminRequest(t, handlerFixture, "GET", "/admin/audit?"+query.Encode(), "")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var response model.AuditEventsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 2 || response.Events[0].Actor != "bob" || response.Events[1].Action != model.AuditActionKick {
+		t.Errorf("handler returned unexpected events: %+v", response.Events)
+	}
+
+	for _, invalid := range []string{"from=yesterday", "limit=0", "from=2024-01-02T00:00:00Z&to=2024-01-01T00:00:00Z"} {
+		rr := adminRequest(t, handlerFixture, "GET", "/admin/audit?"+invalid, "")
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v", invalid, status, http.StatusBadRequest)
+		}
+		assertErrorResponse(t, rr, model.ErrorCodeInvalidQuery, "Invalid audit query")
+	}
+}
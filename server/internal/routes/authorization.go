@@ -0,0 +1,267 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// action is an operation that requires a permission, checked by authorize.
+type action string
+
+const (
+	actionJoinRoom          action = "join_room"
+	actionLeaveRoom         action = "leave_room"
+	actionSendMessage       action = "send_message"
+	actionSetRoomRole       action = "set_room_role"
+	actionSetTopic          action = "set_topic"
+	actionUpdateRoom        action = "update_room"
+	actionInvite            action = "invite"
+	actionBrowseRooms       action = "browse_rooms"
+	actionKick              action = "kick"
+	actionMute              action = "mute"
+	actionBan               action = "ban"
+	actionQueryAudit        action = "query_audit"
+	actionConfigureFilters  action = "configure_filters"
+	actionConfigureWebhooks action = "configure_webhooks"
+	actionListUsers         action = "list_users"
+	actionLogoutUser        action = "logout_user"
+	actionAnnounce          action = "announce"
+	actionListRooms         action = "list_rooms"
+	actionCloseRoom         action = "close_room"
+)
+
+// principal is the identity performing an action: a logged in user, or the operator using the admin token.
+type principal struct {
+	Username string
+	Role     model.Role
+}
+
+// adminPrincipal is the principal of the requests authenticated with the admin token.
+var adminPrincipal = principal{Role: model.RoleAdmin}
+
+// roomRole returns the role of the user in the room, RoomRoleMember if none was assigned.
+func roomRole(room model.Room, username string) model.RoomRole {
+	if role, ok := room.Roles[username]; ok {
+		return role
+	}
+	return model.RoomRoleMember
+}
+
+// validRoomRole reports whether the role is one of the known room roles.
+func validRoomRole(role model.RoomRole) bool {
+	switch role {
+	case model.RoomRoleOwner, model.RoomRoleModerator, model.RoomRoleMember, model.RoomRoleReadOnly:
+		return true
+	}
+	return false
+}
+
+// roleRank orders the global roles, from RoleUser to RoleAdmin.
+func roleRank(role model.Role) int {
+	switch role {
+	case model.RoleAdmin:
+		return 2
+	case model.RoleModerator:
+		return 1
+	}
+	return 0
+}
+
+// authorize is the single place where permissions are checked. It returns a forbidden error if the
+// principal can't perform the action on the room, which is the zero Room for actions outside of rooms.
+// target is the user affected by the action, with its global role, and targetRole the room role being
+// granted to it, both empty for actions that don't affect another user.
+//
+// Users with a global role can only be kicked, muted, banned, logged out or given a room role by
+// a user with a higher global role, or by the operator using the admin token.
+// Global admins can do everything else, and global moderators everything but the server operations.
+// Within a room, owners manage every role, moderators can make members read-only and back,
+// members can send messages and read-only members can only read. Owners and moderators can
+// kick and mute the members they could make read-only, and change the topic of the room.
+// Only owners can change the description, metadata and settings of the room.
+// Invite-only rooms can only be joined by invited users and by their owners and moderators,
+// who can invite other users.
+// Muted users can't send messages.
+func authorize(actor principal, act action, room model.Room, target principal, targetRole model.RoomRole) error {
+	switch act {
+	case actionKick, actionMute, actionBan, actionLogoutUser, actionSetRoomRole:
+		if actor != adminPrincipal && target.Username != actor.Username &&
+			roleRank(target.Role) > 0 && roleRank(target.Role) >= roleRank(actor.Role) {
+			return newStreamError(model.ErrorCodeForbidden, fmt.Sprintf("User %s is not allowed to %s user %s, who is a global %s", actor.Username, strings.ReplaceAll(string(act), "_", " "), target.Username, target.Role))
+		}
+	}
+
+	if actor.Role == model.RoleAdmin {
+		return nil
+	}
+
+	if act == actionSendMessage && isMuted(room, actor.Username) {
+		return newStreamError(model.ErrorCodeMuted, fmt.Sprintf("User %s is muted in room %s", actor.Username, room.Name))
+	}
+
+	_, isMember := room.Members[actor.Username]
+	role := roomRole(room, actor.Username)
+	allowed := false
+	switch act {
+	case actionJoinRoom:
+		_, invited := room.Invites[actor.Username]
+		allowed = !room.InviteOnly || invited || actor.Role == model.RoleModerator ||
+			role == model.RoomRoleOwner || role == model.RoomRoleModerator
+	case actionBrowseRooms:
+		allowed = true
+	case actionLeaveRoom:
+		allowed = isMember
+	case actionSendMessage:
+		allowed = isMember && (role != model.RoomRoleReadOnly || actor.Role == model.RoleModerator)
+	case actionSetRoomRole:
+		switch {
+		case actor.Role == model.RoleModerator:
+			allowed = true
+		case !isMember:
+			allowed = false
+		case role == model.RoomRoleOwner:
+			allowed = true
+		case role == model.RoomRoleModerator:
+			currentRole := roomRole(room, target.Username)
+			allowed = (targetRole == model.RoomRoleMember || targetRole == model.RoomRoleReadOnly) &&
+				(currentRole == model.RoomRoleMember || currentRole == model.RoomRoleReadOnly)
+		}
+	case actionSetTopic, actionInvite:
+		allowed = actor.Role == model.RoleModerator ||
+			(isMember && (role == model.RoomRoleOwner || role == model.RoomRoleModerator))
+	case actionUpdateRoom:
+		allowed = actor.Role == model.RoleModerator || (isMember && role == model.RoomRoleOwner)
+	case actionKick, actionMute:
+		currentRole := roomRole(room, target.Username)
+		switch {
+		case actor.Role == model.RoleModerator:
+			allowed = true
+		case !isMember || target.Username == actor.Username:
+			allowed = false
+		case role == model.RoomRoleOwner:
+			allowed = true
+		case role == model.RoomRoleModerator:
+			allowed = currentRole == model.RoomRoleMember || currentRole == model.RoomRoleReadOnly
+		}
+	case actionListUsers, actionListRooms, actionBan:
+		allowed = actor.Role == model.RoleModerator
+	}
+
+	if !allowed {
+		if room.Name != "" {
+			return newStreamError(model.ErrorCodeForbidden, fmt.Sprintf("User %s is not allowed to %s in room %s", actor.Username, strings.ReplaceAll(string(act), "_", " "), room.Name))
+		}
+		return newStreamError(model.ErrorCodeForbidden, fmt.Sprintf("Not allowed to %s", strings.ReplaceAll(string(act), "_", " ")))
+	}
+	return nil
+}
+
+// principalOf returns the principal of a user, with the role it was given at startup if it's not logged in.
+func (handler *Handler) principalOf(username string) principal {
+	handler.LoggedUsers.RLock()
+	defer handler.LoggedUsers.RUnlock()
+	user, ok := handler.LoggedUsers.Users[username]
+	if !ok {
+		return principal{Username: username, Role: handler.privilegedRole(username)}
+	}
+	role := user.Role
+	if role == "" {
+		role = model.RoleUser
+	}
+	return principal{Username: username, Role: role}
+}
+
+// authenticateRequest returns the principal of an HTTP request, which carries either the admin token
+// or the session token of a logged in user as a bearer token.
+// If the request can't be authenticated, it writes the error response and returns false.
+func (handler *Handler) authenticateRequest(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && token != "" {
+		if handler.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(handler.AdminToken)) == 1 {
+			return adminPrincipal, true
+		}
+
+		if actor, ok := handler.sessionPrincipal(token); ok {
+			return actor, true
+		}
+		handler.audit(model.AuditEvent{Action: model.AuditActionTokenRejected, IP: remoteIP(r.RemoteAddr), Details: r.Method + " " + r.URL.Path})
+	}
+
+	if handler.AdminToken == "" {
+		writeError(w, http.StatusForbidden, model.ErrorCodeAdminDisabled, "Admin API is disabled", "")
+		return principal{}, false
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, model.ErrorCodeUnauthorized, "Invalid admin token", "")
+	return principal{}, false
+}
+
+// authenticateSession returns the principal of an HTTP request carrying the session token of a logged in user
+// as a bearer token. If it doesn't, it writes the error response and returns false.
+func (handler *Handler) authenticateSession(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && token != "" {
+		if actor, ok := handler.sessionPrincipal(token); ok {
+			return actor, true
+		}
+		handler.audit(model.AuditEvent{Action: model.AuditActionTokenRejected, IP: remoteIP(r.RemoteAddr), Details: r.Method + " " + r.URL.Path})
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, model.ErrorCodeUnauthorized, "Invalid session token", "")
+	return principal{}, false
+}
+
+// sessionPrincipal returns the principal of the logged in user with the session token.
+func (handler *Handler) sessionPrincipal(token string) (principal, bool) {
+	handler.LoggedUsers.RLock()
+	user, ok := handler.LoggedUsers.Users[handler.tokens[token]]
+	handler.LoggedUsers.RUnlock()
+	if ok && token != "" && user.Token == token {
+		role := user.Role
+		if role == "" {
+			role = model.RoleUser
+		}
+		return principal{Username: user.Username, Role: role}, true
+	}
+	// The session may have been started on another node
+	if handler.Sessions != nil && token != "" {
+		if username, err := handler.Sessions.Lookup(token); err == nil {
+			return principal{Username: username, Role: handler.privilegedRole(username)}, true
+		}
+	}
+	return principal{}, false
+}
+
+// authorizeRequest authenticates an HTTP request and checks that its principal can perform the action.
+// If it can't, it writes the error response and returns false.
+func (handler *Handler) authorizeRequest(w http.ResponseWriter, r *http.Request, act action) (principal, bool) {
+	actor, ok := handler.authenticateRequest(w, r)
+	if !ok {
+		return principal{}, false
+	}
+	if err := authorize(actor, act, model.Room{}, principal{}, ""); err != nil {
+		writeError(w, http.StatusForbidden, model.ErrorCodeForbidden, err.Error(), "")
+		return principal{}, false
+	}
+	return actor, true
+}
+
+// ParsePrivilegedUsers parses a comma separated list of username:secret pairs, giving all of them the role.
+func ParsePrivilegedUsers(value string, role model.Role, privilegedUsers map[string]model.PrivilegedUser) error {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		username, secret, ok := strings.Cut(entry, ":")
+		if !ok || !validUsername(username) || secret == "" {
+			return fmt.Errorf("invalid privileged user %q, expected username:secret", entry)
+		}
+		privilegedUsers[username] = model.PrivilegedUser{Role: role, Secret: secret}
+	}
+	return nil
+}
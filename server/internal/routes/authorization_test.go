@@ -0,0 +1,162 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+func TestAuthorize(t *testing.T) {
+	room := model.Room{
+		Name: "general",
+		Members: map[string]struct{}{
+			"owner": {}, "moderator": {}, "member": {}, "reader": {},
+		},
+		Roles: map[string]model.RoomRole{
+			"owner":     model.RoomRoleOwner,
+			"moderator": model.RoomRoleModerator,
+			"reader":    model.RoomRoleReadOnly,
+		},
+	}
+	user := func(username string) principal {
+		return principal{Username: username, Role: model.RoleUser}
+	}
+
+	var tests = []struct {
+		name       string
+		actor      principal
+		action     action
+		room       model.Room
+		target     principal
+		targetRole model.RoomRole
+		allowed    bool
+	}{
+		{"anyone can join", user("stranger"), actionJoinRoom, room, principal{}, "", true},
+		{"member can send", user("member"), actionSendMessage, room, principal{}, "", true},
+		{"read-only can't send", user("reader"), actionSendMessage, room, principal{}, "", false},
+		{"stranger can't send", user("stranger"), actionSendMessage, room, principal{}, "", false},
+		{"stranger can't leave", user("stranger"), actionLeaveRoom, room, principal{}, "", false},
+		{"global moderator can send while read-only", principal{Username: "reader", Role: model.RoleModerator}, actionSendMessage, room, principal{}, "", true},
+		{"owner can make moderators", user("owner"), actionSetRoomRole, room, user("member"), model.RoomRoleModerator, true},
+		{"moderator can make read-only", user("moderator"), actionSetRoomRole, room, user("member"), model.RoomRoleReadOnly, true},
+		{"moderator can't make moderators", user("moderator"), actionSetRoomRole, room, user("member"), model.RoomRoleModerator, false},
+		{"moderator can't demote the owner", user("moderator"), actionSetRoomRole, room, user("owner"), model.RoomRoleReadOnly, false},
+		{"member can't set roles", user("member"), actionSetRoomRole, room, user("reader"), model.RoomRoleMember, false},
+		{"global moderator can set roles", principal{Username: "stranger", Role: model.RoleModerator}, actionSetRoomRole, room, user("member"), model.RoomRoleOwner, true},
+		{"moderator can set the topic", user("moderator"), actionSetTopic, room, principal{}, "", true},
+		{"member can't set the topic", user("member"), actionSetTopic, room, principal{}, "", false},
+		{"user can't list users", user("member"), actionListUsers, model.Room{}, principal{}, "", false},
+		{"global moderator can list users", principal{Username: "mod", Role: model.RoleModerator}, actionListUsers, model.Room{}, principal{}, "", true},
+		{"global moderator can't close rooms", principal{Username: "mod", Role: model.RoleModerator}, actionCloseRoom, model.Room{}, principal{}, "", false},
+		{"global moderator can't configure webhooks", principal{Username: "mod", Role: model.RoleModerator}, actionConfigureWebhooks, model.Room{}, principal{}, "", false},
+		{"admin can do everything", adminPrincipal, actionCloseRoom, model.Room{}, principal{}, "", true},
+		{"owner can't kick a global moderator", user("owner"), actionKick, room, principal{Username: "moderator", Role: model.RoleModerator}, "", false},
+		{"owner can't mute a global admin", user("owner"), actionMute, room, principal{Username: "member", Role: model.RoleAdmin}, "", false},
+		{"owner can't demote a global moderator", user("owner"), actionSetRoomRole, room, principal{Username: "moderator", Role: model.RoleModerator}, model.RoomRoleReadOnly, false},
+		{"global moderator can kick users", principal{Username: "mod", Role: model.RoleModerator}, actionKick, room, user("member"), "", true},
+		{"global moderator can't kick global moderators", principal{Username: "mod", Role: model.RoleModerator}, actionKick, room, principal{Username: "moderator", Role: model.RoleModerator}, "", false},
+		{"global moderator can't ban global moderators", principal{Username: "mod", Role: model.RoleModerator}, actionBan, model.Room{}, principal{Username: "other", Role: model.RoleModerator}, "", false},
+		{"global moderator can't ban global admins", principal{Username: "mod", Role: model.RoleModerator}, actionBan, model.Room{}, principal{Username: "root", Role: model.RoleAdmin}, "", false},
+		{"global admin can ban global moderators", principal{Username: "root", Role: model.RoleAdmin}, actionBan, model.Room{}, principal{Username: "mod", Role: model.RoleModerator}, "", true},
+		{"global admin can't log out global admins", principal{Username: "root", Role: model.RoleAdmin}, actionLogoutUser, model.Room{}, principal{Username: "other", Role: model.RoleAdmin}, "", false},
+		{"operator can ban global admins", adminPrincipal, actionBan, model.Room{}, principal{Username: "root", Role: model.RoleAdmin}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authorize(tt.actor, tt.action, tt.room, tt.target, tt.targetRole)
+			if tt.allowed && err != nil {
+				t.Errorf("Action should be allowed, got %v", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Errorf("Action should be forbidden")
+			}
+		})
+	}
+}
+
+func TestLoginPrivilegedUser(t *testing.T) {
+	var tests = []struct {
+		name   string
+		body   string
+		status int
+		role   model.Role
+	}{
+		{"valid secret", `{"username": "root", "secret": "s3cret"}`, http.StatusOK, model.RoleAdmin},
+		{"missing secret", `{"username": "root"}`, http.StatusUnauthorized, ""},
+		{"invalid secret", `{"username": "root", "secret": "guess"}`, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/login", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handlerFixture := NewHandler()
+			if err := ParsePrivilegedUsers("root:s3cret", model.RoleAdmin, handlerFixture.PrivilegedUsers); err != nil {
+				t.Fatal(err)
+			}
+			handlerFixture.NewServeMux().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, tt.status)
+			}
+
+			handlerFixture.LoggedUsers.RLock()
+			defer handlerFixture.LoggedUsers.RUnlock()
+			if user, ok := handlerFixture.LoggedUsers.Users["root"]; ok != (tt.role != "") || user.Role != tt.role {
+				t.Errorf("Unexpected logged user: %+v", user)
+			}
+		})
+	}
+}
+
+func TestAdminAPIWithAdminSession(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "root", Token: "root-token", Role: model.RoleAdmin})
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token", Role: model.RoleUser})
+
+	var tests = []struct {
+		token  string
+		status int
+	}{
+		{"root-token", http.StatusOK},
+		{"alice-token", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/admin/rooms", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			rr := httptest.NewRecorder()
+			handlerFixture.NewServeMux().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, tt.status)
+			}
+		})
+	}
+}
+
+func TestParsePrivilegedUsers(t *testing.T) {
+	privilegedUsers := make(map[string]model.PrivilegedUser)
+	if err := ParsePrivilegedUsers("alice:one, bob:two", model.RoleModerator, privilegedUsers); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(privilegedUsers) != 2 || privilegedUsers["bob"].Secret != "two" || privilegedUsers["bob"].Role != model.RoleModerator {
+		t.Errorf("Unexpected privileged users: %+v", privilegedUsers)
+	}
+
+	if err := ParsePrivilegedUsers("alice", model.RoleAdmin, privilegedUsers); err == nil {
+		t.Errorf("A privileged user without secret should be rejected")
+	}
+}
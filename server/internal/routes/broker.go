@@ -0,0 +1,283 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// Broker is a publish/subscribe backplane shared by the nodes of the server, so that the events of a room
+// or a user reach the users connected to other nodes. Payloads published to a topic are delivered to every
+// subscription of that topic, in order, including the subscriptions of the publishing node.
+type Broker interface {
+	// Publish sends the payload to the subscribers of the topic.
+	Publish(topic string, payload []byte) error
+	// Subscribe calls deliver with every payload published to the topic until the subscription is cancelled.
+	// Payloads are delivered from a goroutine of the broker, never from the goroutine calling Publish.
+	Subscribe(topic string, deliver func(payload []byte)) (Subscription, error)
+	// Close cancels every subscription and releases the resources of the broker.
+	Close() error
+}
+
+// Subscription is a subscription to a topic of a Broker.
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// roomTopic and userTopic are the broker topics of the events of a room and of the events sent to a single user.
+func roomTopic(room string) string {
+	return "chat.room." + room
+}
+
+func userTopic(username string) string {
+	return "chat.user." + username
+}
+
+// brokerMessage is the payload published to the broker. Origin is the node that published the event,
+// which already delivered it to its own users.
+type brokerMessage struct {
+	Origin string            `json:"origin"`
+	Event  model.StreamEvent `json:"event"`
+}
+
+// subscriptions keeps the broker subscriptions of a node, by topic.
+type subscriptions struct {
+	sync.Mutex
+	topics map[string]*topicSubscription
+}
+
+// topicSubscription is the subscription of a node to a topic, whose Subscription is nil while the broker subscribes.
+type topicSubscription struct {
+	Subscription
+}
+
+// subscribe subscribes the node to the topic, if it's not subscribed yet, delivering the events published
+// by other nodes with deliver. Subscriptions are only made if a broker is configured.
+// The subscription is recorded before the broker subscribes, which may wait on the network, so the lock
+// of the subscriptions isn't held meanwhile.
+func (handler *Handler) subscribe(topic string, deliver func(event model.StreamEvent)) {
+	if handler.Broker == nil {
+		return
+	}
+	handler.subscriptions.Lock()
+	if _, ok := handler.subscriptions.topics[topic]; ok {
+		handler.subscriptions.Unlock()
+		return
+	}
+	if handler.subscriptions.topics == nil {
+		handler.subscriptions.topics = make(map[string]*topicSubscription)
+	}
+	pending := &topicSubscription{}
+	handler.subscriptions.topics[topic] = pending
+	handler.subscriptions.Unlock()
+
+	subscription, err := handler.Broker.Subscribe(topic, func(payload []byte) {
+		var message brokerMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			log.Printf("Can't decode message from topic %s: %v", topic, err)
+			return
+		}
+		if message.Origin != handler.NodeID {
+			deliver(message.Event)
+		}
+	})
+
+	handler.subscriptions.Lock()
+	current := handler.subscriptions.topics[topic]
+	if current == pending {
+		if err != nil {
+			// The next call subscribes again
+			delete(handler.subscriptions.topics, topic)
+		} else {
+			pending.Subscription = subscription
+		}
+	}
+	handler.subscriptions.Unlock()
+
+	if err != nil {
+		log.Printf("Can't subscribe to topic %s: %v", topic, err)
+		return
+	}
+	if current != pending {
+		// The node unsubscribed while the broker was subscribing
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Can't unsubscribe from topic %s: %v", topic, err)
+		}
+	}
+}
+
+// unsubscribe cancels the subscription of the node to the topic, if any.
+func (handler *Handler) unsubscribe(topic string) {
+	cancelSubscription(topic, handler.removeSubscription(topic))
+}
+
+// removeSubscription removes the subscription of the node to the topic, returning it so that it's cancelled
+// with cancelSubscription once the caller releases its locks, since the broker may wait on the network.
+func (handler *Handler) removeSubscription(topic string) Subscription {
+	handler.subscriptions.Lock()
+	defer handler.subscriptions.Unlock()
+	current, ok := handler.subscriptions.topics[topic]
+	if !ok {
+		return nil
+	}
+	delete(handler.subscriptions.topics, topic)
+	return current.Subscription
+}
+
+// cancelSubscription cancels a subscription returned by removeSubscription.
+// Pending subscriptions are nil, and are cancelled by subscribe once the broker subscribed.
+func cancelSubscription(topic string, subscription Subscription) {
+	if subscription == nil {
+		return
+	}
+	if err := subscription.Unsubscribe(); err != nil {
+		log.Printf("Can't unsubscribe from topic %s: %v", topic, err)
+	}
+}
+
+// unsubscribeRoom cancels the subscription of the node to the events of a room deleted from this node, or whose
+// last webhook was deleted, unless the room is still active on this node or still has webhooks registered on it.
+func (handler *Handler) unsubscribeRoom(roomName string) {
+	var subscription Subscription
+	handler.ActiveRooms.RLock()
+	handler.Webhooks.RLock()
+	if _, ok := handler.ActiveRooms.Rooms[roomName]; !ok && len(handler.Webhooks.Rooms[roomName]) == 0 {
+		subscription = handler.removeSubscription(roomTopic(roomName))
+	}
+	handler.Webhooks.RUnlock()
+	handler.ActiveRooms.RUnlock()
+	cancelSubscription(roomTopic(roomName), subscription)
+}
+
+// unsubscribeUser cancels the subscription of the node to the events of a user removed from this node,
+// unless the user logged in to this node again meanwhile.
+func (handler *Handler) unsubscribeUser(username string) {
+	var subscription Subscription
+	handler.LoggedUsers.RLock()
+	if _, ok := handler.LoggedUsers.Users[username]; !ok {
+		subscription = handler.removeSubscription(userTopic(username))
+	}
+	handler.LoggedUsers.RUnlock()
+	cancelSubscription(userTopic(username), subscription)
+}
+
+// relay publishes the event to the other nodes through the broker, if one is configured.
+func (handler *Handler) relay(topic string, event model.StreamEvent) {
+	if handler.Broker == nil {
+		return
+	}
+	payload, err := json.Marshal(brokerMessage{Origin: handler.NodeID, Event: event})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := handler.Broker.Publish(topic, payload); err != nil {
+		log.Printf("Can't publish %s event to topic %s: %v", event.Type, topic, err)
+	}
+}
+
+// subscribeRoom delivers the events of the room published by other nodes to the members of the room connected to this node,
+// and to the webhooks of the room registered on this node.
+func (handler *Handler) subscribeRoom(roomName string) {
+	handler.subscribe(roomTopic(roomName), func(event model.StreamEvent) {
+		handler.ActiveRooms.RLock()
+		recipients := members(handler.ActiveRooms.Rooms[roomName])
+		handler.ActiveRooms.RUnlock()
+		handler.broadcast(recipients, event)
+		handler.notifyWebhooks(roomName, event)
+	})
+}
+
+// subscribeUser delivers the events sent to the user by other nodes, while the user is connected to this node.
+func (handler *Handler) subscribeUser(username string) {
+	handler.subscribe(userTopic(username), func(event model.StreamEvent) {
+		handler.broadcast([]string{username}, event)
+	})
+}
+
+// broadcastRoom delivers an event of the room to the given users, and to the members of the room connected to other nodes.
+func (handler *Handler) broadcastRoom(roomName string, usernames []string, event model.StreamEvent) {
+	handler.broadcast(usernames, event)
+	handler.relay(roomTopic(roomName), event)
+	handler.notifyWebhooks(roomName, event)
+}
+
+// memoryBrokerBufferSize is the number of payloads queued for a subscription of a MemoryBroker.
+// When the queue is full, new payloads for that subscription are dropped instead of blocking the publisher.
+const memoryBrokerBufferSize = 256
+
+// MemoryBroker is a Broker for the nodes running in the same process.
+type MemoryBroker struct {
+	mu     sync.RWMutex
+	topics map[string]map[*memorySubscription]struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{topics: make(map[string]map[*memorySubscription]struct{})}
+}
+
+// memorySubscription delivers the payloads queued in its channel from its own goroutine.
+type memorySubscription struct {
+	broker   *MemoryBroker
+	topic    string
+	payloads chan []byte
+}
+
+func (broker *MemoryBroker) Publish(topic string, payload []byte) error {
+	broker.mu.RLock()
+	defer broker.mu.RUnlock()
+	for subscription := range broker.topics[topic] {
+		select {
+		case subscription.payloads <- payload:
+		default:
+			log.Printf("Subscription to topic %s is full, dropping message", topic)
+		}
+	}
+	return nil
+}
+
+func (broker *MemoryBroker) Subscribe(topic string, deliver func(payload []byte)) (Subscription, error) {
+	subscription := &memorySubscription{broker: broker, topic: topic, payloads: make(chan []byte, memoryBrokerBufferSize)}
+	go func() {
+		for payload := range subscription.payloads {
+			deliver(payload)
+		}
+	}()
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.topics[topic] == nil {
+		broker.topics[topic] = make(map[*memorySubscription]struct{})
+	}
+	broker.topics[topic][subscription] = struct{}{}
+	return subscription, nil
+}
+
+func (subscription *memorySubscription) Unsubscribe() error {
+	broker := subscription.broker
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if _, ok := broker.topics[subscription.topic][subscription]; !ok {
+		return nil
+	}
+	delete(broker.topics[subscription.topic], subscription)
+	if len(broker.topics[subscription.topic]) == 0 {
+		delete(broker.topics, subscription.topic)
+	}
+	close(subscription.payloads)
+	return nil
+}
+
+func (broker *MemoryBroker) Close() error {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for _, subscriptions := range broker.topics {
+		for subscription := range subscriptions {
+			close(subscription.payloads)
+		}
+	}
+	broker.topics = make(map[string]map[*memorySubscription]struct{})
+	return nil
+}
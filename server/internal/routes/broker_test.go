@@ -0,0 +1,413 @@
+package routes
+
+import (
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// fakeRedis is a local stand-in for a Redis server, implementing the publish/subscribe commands
+// and the string commands used by the session registry.
+type fakeRedis struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	clients     map[*fakeRedisClient]struct{}
+	subscribers map[string]map[*fakeRedisClient]struct{}
+	values      map[string]string
+	expires     map[string]time.Time
+}
+
+type fakeRedisClient struct {
+	mu   sync.Mutex
+	conn *redisConn
+}
+
+// write sends a reply built from the given RESP lines.
+func (client *fakeRedisClient) write(lines ...string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.conn.writer.WriteString(strings.Join(lines, "\r\n") + "\r\n")
+	client.conn.writer.Flush()
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRedis{
+		listener:    listener,
+		clients:     make(map[*fakeRedisClient]struct{}),
+		subscribers: make(map[string]map[*fakeRedisClient]struct{}),
+		values:      make(map[string]string),
+		expires:     make(map[string]time.Time),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			client := &fakeRedisClient{conn: newRedisConn(conn)}
+			server.mu.Lock()
+			server.clients[client] = struct{}{}
+			server.mu.Unlock()
+			go server.serve(client)
+		}
+	}()
+	return server
+}
+
+// bulk encodes a RESP bulk string.
+func bulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value
+}
+
+// valueLocked returns the value of the key, removing it if it expired.
+// This function assumes that the server lock is already acquired by the caller.
+func (server *fakeRedis) valueLocked(key string) (string, bool) {
+	if expiry, ok := server.expires[key]; ok && !time.Now().Before(expiry) {
+		delete(server.values, key)
+		delete(server.expires, key)
+	}
+	value, ok := server.values[key]
+	return value, ok
+}
+
+// expireLocked sets the time to live of the key in milliseconds.
+// This function assumes that the server lock is already acquired by the caller.
+func (server *fakeRedis) expireLocked(key string, milliseconds string) {
+	ttl, _ := strconv.Atoi(milliseconds)
+	server.expires[key] = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+}
+
+// dropConnections closes the connections of every client, as if the server restarted.
+func (server *fakeRedis) dropConnections() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for client := range server.clients {
+		client.conn.Close()
+	}
+}
+
+func (server *fakeRedis) serve(client *fakeRedisClient) {
+	defer client.conn.Close()
+	for {
+		value, err := client.conn.readValue()
+		if err != nil {
+			server.mu.Lock()
+			delete(server.clients, client)
+			for _, clients := range server.subscribers {
+				delete(clients, client)
+			}
+			server.mu.Unlock()
+			return
+		}
+		args, _ := value.([]any)
+		if len(args) == 0 {
+			client.write("-ERR empty command")
+			continue
+		}
+		command, _ := args[0].(string)
+		switch strings.ToUpper(command) {
+		case "PING":
+			client.write("+PONG")
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			for i, arg := range args[1:] {
+				topic := arg.(string)
+				server.mu.Lock()
+				if strings.ToUpper(command) == "SUBSCRIBE" {
+					if server.subscribers[topic] == nil {
+						server.subscribers[topic] = make(map[*fakeRedisClient]struct{})
+					}
+					server.subscribers[topic][client] = struct{}{}
+				} else {
+					delete(server.subscribers[topic], client)
+				}
+				server.mu.Unlock()
+				client.write("*3", bulk(strings.ToLower(command)), bulk(topic), ":"+strconv.Itoa(i+1))
+			}
+		case "PUBLISH":
+			if len(args) != 3 {
+				client.write("-ERR wrong number of arguments for 'publish' command")
+				continue
+			}
+			topic, payload := args[1].(string), args[2].(string)
+			server.mu.Lock()
+			receivers := make([]*fakeRedisClient, 0, len(server.subscribers[topic]))
+			for receiver := range server.subscribers[topic] {
+				receivers = append(receivers, receiver)
+			}
+			server.mu.Unlock()
+			for _, receiver := range receivers {
+				receiver.write("*3", bulk("message"), bulk(topic), bulk(payload))
+			}
+			client.write(":" + strconv.Itoa(len(receivers)))
+		case "SET":
+			// SET key value [NX] [PX milliseconds]
+			key, value := args[1].(string), args[2].(string)
+			server.mu.Lock()
+			_, exists := server.valueLocked(key)
+			options := args[3:]
+			if len(options) > 0 && strings.ToUpper(options[0].(string)) == "NX" {
+				options = options[1:]
+				if exists {
+					server.mu.Unlock()
+					client.write("$-1")
+					continue
+				}
+			}
+			server.values[key] = value
+			delete(server.expires, key)
+			if len(options) == 2 && strings.ToUpper(options[0].(string)) == "PX" {
+				server.expireLocked(key, options[1].(string))
+			}
+			server.mu.Unlock()
+			client.write("+OK")
+		case "GET":
+			server.mu.Lock()
+			value, ok := server.valueLocked(args[1].(string))
+			server.mu.Unlock()
+			if !ok {
+				client.write("$-1")
+				continue
+			}
+			client.write(bulk(value))
+		case "DEL":
+			deleted := 0
+			server.mu.Lock()
+			for _, arg := range args[1:] {
+				if _, ok := server.valueLocked(arg.(string)); ok {
+					delete(server.values, arg.(string))
+					delete(server.expires, arg.(string))
+					deleted++
+				}
+			}
+			server.mu.Unlock()
+			client.write(":" + strconv.Itoa(deleted))
+		case "PEXPIRE":
+			key := args[1].(string)
+			server.mu.Lock()
+			_, ok := server.valueLocked(key)
+			if ok {
+				server.expireLocked(key, args[2].(string))
+			}
+			server.mu.Unlock()
+			if ok {
+				client.write(":1")
+			} else {
+				client.write(":0")
+			}
+		case "EVAL":
+			// Scripts can't run here, so the ones of the session registry are run by evalLocked
+			keys, _ := strconv.Atoi(args[2].(string))
+			strs := make([]string, 0, len(args)-3)
+			for _, arg := range args[3:] {
+				strs = append(strs, arg.(string))
+			}
+			server.mu.Lock()
+			reply := server.evalLocked(args[1].(string), strs[:keys], strs[keys:])
+			server.mu.Unlock()
+			client.write(reply)
+		default:
+			client.write("-ERR unknown command '" + command + "'")
+		}
+	}
+}
+
+// evalLocked runs the script of the session registry with the keys and arguments, returning its reply.
+// This function assumes that the server lock is already acquired by the caller.
+func (server *fakeRedis) evalLocked(script string, keys []string, args []string) string {
+	switch script {
+	case claimSessionScript:
+		if _, ok := server.valueLocked(keys[0]); ok {
+			return ":0"
+		}
+		server.values[keys[0]], server.values[keys[1]] = args[0], args[1]
+		server.expireLocked(keys[0], args[2])
+		server.expireLocked(keys[1], args[2])
+	case refreshSessionScript:
+		if token, ok := server.valueLocked(keys[0]); !ok || token != args[0] {
+			return ":0"
+		}
+		for _, key := range keys {
+			if _, ok := server.valueLocked(key); ok {
+				server.expireLocked(key, args[1])
+			}
+		}
+	case releaseSessionScript:
+		if token, ok := server.valueLocked(keys[0]); !ok || token != args[0] {
+			return ":0"
+		}
+		for _, key := range keys {
+			delete(server.values, key)
+			delete(server.expires, key)
+		}
+	default:
+		return "-NOSCRIPT unknown script"
+	}
+	return ":1"
+}
+
+func TestRedisBroker(t *testing.T) {
+	server := newFakeRedis(t)
+	broker, err := NewRedisBroker(server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	received := make(chan string, 10)
+	subscription, err := broker.Subscribe("topic", func(payload []byte) { received <- string(payload) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := "line one\r\nline two"
+	if err := broker.Publish("topic", []byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-received:
+		if message != payload {
+			t.Errorf("Unexpected payload: got %q want %q", message, payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the published message")
+	}
+
+	subscription.Unsubscribe()
+	if err := broker.Publish("topic", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-received:
+		if message == "after" {
+			t.Errorf("Message delivered after unsubscribing")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRedisBrokerReconnects(t *testing.T) {
+	server := newFakeRedis(t)
+	broker, err := NewRedisBroker(server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	received := make(chan string, 10)
+	if _, err := broker.Subscribe("topic", func(payload []byte) { received <- string(payload) }); err != nil {
+		t.Fatal(err)
+	}
+	server.dropConnections()
+
+	// Both connections are dialed again, and the topics subscribed again
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		broker.Publish("topic", []byte("after reconnecting"))
+		select {
+		case message := <-received:
+			if message != "after reconnecting" {
+				t.Errorf("Unexpected payload: got %q", message)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the subscription to be restored")
+		}
+	}
+}
+
+// clusterNode starts a node of a cluster sharing the broker, with the given logged users.
+func clusterNode(t *testing.T, broker Broker, usernames ...string) *httptest.Server {
+	t.Helper()
+	handler := NewHandler()
+	handler.Broker = broker
+	for _, username := range usernames {
+		handler.addUserLocked(model.User{Username: username, Token: username + "-token"})
+	}
+	server := httptest.NewServer(handler.NewServeMux())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBrokerRelaysEventsBetweenNodes(t *testing.T) {
+	// Nodes in different processes have their own connection to Redis, nodes in the same process share a MemoryBroker
+	clusters := map[string]func(t *testing.T) (Broker, Broker){
+		"memory": func(t *testing.T) (Broker, Broker) {
+			broker := NewMemoryBroker()
+			return broker, broker
+		},
+		"redis": func(t *testing.T) (Broker, Broker) {
+			server := newFakeRedis(t)
+			var brokers [2]Broker
+			for i := range brokers {
+				broker, err := NewRedisBroker(server.listener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				brokers[i] = broker
+			}
+			return brokers[0], brokers[1]
+		},
+	}
+	for name, newCluster := range clusters {
+		t.Run(name, func(t *testing.T) {
+			brokerA, brokerB := newCluster(t)
+			defer brokerA.Close()
+			defer brokerB.Close()
+			nodeA := clusterNode(t, brokerA, "alice")
+			nodeB := clusterNode(t, brokerB, "bob")
+
+			alice := connectToStream(t, nodeA, "alice", "alice-token")
+			defer alice.Close()
+			bob := connectToStream(t, nodeB, "bob", "bob-token")
+			defer bob.Close()
+
+			sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+			expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+			sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+			expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+			expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+
+			sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello from A"})
+			expectEvent(t, alice, model.StreamEventMessage, "general", "alice")
+			if event := expectEvent(t, bob, model.StreamEventMessage, "general", "alice"); event.Text != "hello from A" {
+				t.Errorf("Unexpected message: %+v", event)
+			}
+			sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello from B"})
+			expectEvent(t, bob, model.StreamEventMessage, "general", "bob")
+			expectEvent(t, alice, model.StreamEventMessage, "general", "bob")
+
+			// Events sent to a single user reach it on the node it's connected to
+			sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestInvite, Room: "general", User: "carol"})
+			expectEvent(t, alice, model.StreamEventInvited, "general", "alice")
+			sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestInvite, Room: "general", User: "bob"})
+			if event := expectEvent(t, bob, model.StreamEventInvited, "general", "alice"); event.Text != "bob" {
+				t.Errorf("Unexpected invited event: %+v", event)
+			}
+			expectEvent(t, alice, model.StreamEventInvited, "general", "alice")
+
+			sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestLeave, Room: "general"})
+			expectEvent(t, bob, model.StreamEventLeft, "general", "bob")
+			expectEvent(t, alice, model.StreamEventLeft, "general", "bob")
+
+			// Users disconnecting leave their rooms on every node, even if they were the last member on theirs
+			sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+			expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+			expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+			bob.Close()
+			expectEvent(t, alice, model.StreamEventLeft, "general", "bob")
+		})
+	}
+}
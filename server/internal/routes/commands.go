@@ -0,0 +1,198 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// command is a slash command typed in a message and interpreted by the server instead of being broadcast.
+// The list of commands is the single place where commands are declared, it's also used to build the /help reply.
+type command struct {
+	Name string
+	// Args describes the arguments of the command, empty if it has none.
+	Args string
+	Help string
+	// Permission is checked with authorize before running the command, empty if anyone can run it.
+	Permission action
+	// InRoom is true for the commands that act on the room the message was sent to,
+	// which requires being a member of the room.
+	InRoom bool
+	// MinArgs is the minimum number of words of the arguments.
+	MinArgs int
+	Run     func(call commandCall) error
+}
+
+// commandCall is an invocation of a command.
+type commandCall struct {
+	Actor principal
+	// Room is the room the message was sent to, only loaded for commands with InRoom.
+	Room model.Room
+	Args string
+}
+
+// commands returns the slash commands interpreted by the server.
+func (handler *Handler) commands() []command {
+	return []command{
+		{
+			Name:    "nick",
+			Args:    "<nickname>",
+			Help:    "change your username",
+			MinArgs: 1,
+			Run:     handler.commandNick,
+		},
+		{
+			Name:       "me",
+			Args:       "<action>",
+			Help:       "describe what you are doing",
+			Permission: actionSendMessage,
+			InRoom:     true,
+			MinArgs:    1,
+			Run:        handler.commandMe,
+		},
+		{
+			Name:       "topic",
+			Args:       "<topic>",
+			Help:       "change the topic of the room",
+			Permission: actionSetTopic,
+			InRoom:     true,
+			MinArgs:    1,
+			Run:        handler.commandTopic,
+		},
+		{
+			Name:   "who",
+			Help:   "list the members of the room",
+			InRoom: true,
+			Run:    handler.commandWho,
+		},
+		{
+			Name: "help",
+			Args: "[command]",
+			Help: "show the available commands",
+			Run:  handler.commandHelp,
+		},
+	}
+}
+
+// isCommand reports whether the text of a message is a command. Messages starting with
+// two slashes are not commands, the first slash is dropped and the rest is sent as is.
+func isCommand(text string) bool {
+	return strings.HasPrefix(text, "/") && !strings.HasPrefix(text, "//")
+}
+
+// lookupCommand returns the command with the given name.
+func (handler *Handler) lookupCommand(name string) (command, bool) {
+	for _, command := range handler.commands() {
+		if command.Name == name {
+			return command, true
+		}
+	}
+	return command{}, false
+}
+
+// runCommand parses and runs the command typed by the user in a message sent to the room.
+func (handler *Handler) runCommand(actor principal, roomName string, text string) error {
+	name, args, _ := strings.Cut(strings.TrimPrefix(text, "/"), " ")
+	command, ok := handler.lookupCommand(name)
+	if !ok {
+		return newStreamError(model.ErrorCodeUnknownCommand, fmt.Sprintf("Unknown command /%s, type /help for the list of commands", name))
+	}
+	call := commandCall{Actor: actor, Args: strings.TrimSpace(args)}
+	if len(strings.Fields(call.Args)) < command.MinArgs {
+		return newStreamError(model.ErrorCodeInvalidArguments, "Usage: "+command.usage())
+	}
+
+	if command.InRoom {
+		handler.ActiveRooms.RLock()
+		room, ok := handler.ActiveRooms.Rooms[roomName]
+		if _, isMember := room.Members[actor.Username]; !ok || !isMember {
+			handler.ActiveRooms.RUnlock()
+			return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", actor.Username, roomName))
+		}
+		call.Room = copyRoom(room)
+		handler.ActiveRooms.RUnlock()
+	}
+	if command.Permission != "" {
+		if err := authorize(actor, command.Permission, call.Room, principal{}, ""); err != nil {
+			return err
+		}
+	}
+	return command.Run(call)
+}
+
+// usage returns the name and arguments of the command, as shown in the /help reply.
+func (command command) usage() string {
+	if command.Args == "" {
+		return "/" + command.Name
+	}
+	return "/" + command.Name + " " + command.Args
+}
+
+// copyRoom returns a copy of the room that can be read after releasing the ActiveRooms lock.
+// This function assumes that the ActiveRooms lock is already acquired by the caller.
+func copyRoom(room model.Room) model.Room {
+	copied := room
+	copied.Members = make(map[string]struct{}, len(room.Members))
+	for username := range room.Members {
+		copied.Members[username] = struct{}{}
+	}
+	copied.Roles = make(map[string]model.RoomRole, len(room.Roles))
+	for username, role := range room.Roles {
+		copied.Roles[username] = role
+	}
+	copied.Mutes = make(map[string]time.Time, len(room.Mutes))
+	for username, until := range room.Mutes {
+		copied.Mutes[username] = until
+	}
+	return copied
+}
+
+// reply sends the answer to a command to the user that typed it.
+func (handler *Handler) reply(call commandCall, text string) {
+	handler.sendEvent(call.Actor.Username, newEvent(model.StreamEventReply, call.Room.Name, "", text))
+}
+
+// commandNick renames the user.
+func (handler *Handler) commandNick(call commandCall) error {
+	return handler.renameUser(call.Actor, call.Args)
+}
+
+// commandMe sends an action to the room, as in "* alice waves".
+func (handler *Handler) commandMe(call commandCall) error {
+	message := Message{Room: call.Room.Name, From: call.Actor.Username, Text: call.Args}
+	if err := handler.filterMessage(&message); err != nil {
+		return err
+	}
+	return handler.publishMessage(newEvent(model.StreamEventAction, call.Room.Name, call.Actor.Username, message.Text))
+}
+
+// commandTopic changes the topic of the room.
+func (handler *Handler) commandTopic(call commandCall) error {
+	return handler.updateRoom(call.Actor, call.Room.Name, model.RoomUpdate{Topic: &call.Args})
+}
+
+// commandWho replies with the members of the room.
+func (handler *Handler) commandWho(call commandCall) error {
+	usernames := members(call.Room)
+	event := newEvent(model.StreamEventReply, call.Room.Name, "", fmt.Sprintf("Members of %s: %s", call.Room.Name, strings.Join(usernames, ", ")))
+	event.Members = usernames
+	handler.sendEvent(call.Actor.Username, event)
+	return nil
+}
+
+// commandHelp replies with the usage of every command, or of the given one.
+func (handler *Handler) commandHelp(call commandCall) error {
+	var lines []string
+	for _, command := range handler.commands() {
+		if call.Args == "" || strings.TrimPrefix(call.Args, "/") == command.Name {
+			lines = append(lines, fmt.Sprintf("%s - %s", command.usage(), command.Help))
+		}
+	}
+	if lines == nil {
+		return newStreamError(model.ErrorCodeUnknownCommand, fmt.Sprintf("Unknown command %s, type /help for the list of commands", call.Args))
+	}
+	handler.reply(call, strings.Join(lines, "\n"))
+	return nil
+}
@@ -0,0 +1,170 @@
+package routes
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/gorilla/websocket"
+)
+
+func TestCommands(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	bob := connectToStream(t, server, "bob", "bob-token")
+	defer bob.Close()
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+	expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "/me waves"})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if event := expectEvent(t, conn, model.StreamEventAction, "general", "bob"); event.Text != "waves" {
+			t.Errorf("Unexpected action text: got %v want %v", event.Text, "waves")
+		}
+	}
+
+	// Only owners and moderators can change the topic
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "/topic Bob's room"})
+	if event := expectEvent(t, bob, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeForbidden {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "/topic Welcome to general"})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if event := expectEvent(t, conn, model.StreamEventRoomUpdated, "general", "alice"); event.RoomInfo.Topic != "Welcome to general" {
+			t.Errorf("Unexpected topic: got %v want %v", event.RoomInfo.Topic, "Welcome to general")
+		}
+	}
+
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "/who"})
+	if event := expectEvent(t, bob, model.StreamEventReply, "general", ""); strings.Join(event.Members, ",") != "alice,bob" {
+		t.Errorf("Unexpected members in the /who reply: %v", event.Members)
+	}
+
+	// Commands that don't act on a room work outside of rooms
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Text: "/help topic"})
+	if event := expectEvent(t, bob, model.StreamEventReply, "", ""); event.Text != "/topic <topic> - change the topic of the room" {
+		t.Errorf("Unexpected help: %v", event.Text)
+	}
+
+	// Two slashes send the message as is, without the first slash
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "//me is not a command"})
+	if event := expectEvent(t, alice, model.StreamEventMessage, "general", "bob"); event.Text != "/me is not a command" {
+		t.Errorf("Unexpected message text: %v", event.Text)
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+
+	var tests = []struct {
+		name string
+		room string
+		text string
+		code string
+	}{
+		{"unknown command", "general", "/dance", model.ErrorCodeUnknownCommand},
+		{"missing arguments", "general", "/me", model.ErrorCodeInvalidArguments},
+		{"not in room", "random", "/who", model.ErrorCodeNotInRoom},
+		{"too long", "general", "/me " + strings.Repeat("a", maxMessageLength), model.ErrorCodeInvalidBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: tt.room, Text: tt.text})
+			if event := expectEvent(t, alice, model.StreamEventError, tt.room, ""); event.Error.Code != tt.code {
+				t.Errorf("Unexpected error event: got %+v want code %v", event.Error, tt.code)
+			}
+		})
+	}
+}
+
+func TestCommandNick(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	bob := connectToStream(t, server, "bob", "bob-token")
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+	expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "/nick alice"})
+	if event := expectEvent(t, bob, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeNicknameTaken {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "/nick carol"})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if event := expectEvent(t, conn, model.StreamEventRenamed, "general", "bob"); event.NewName != "carol" {
+			t.Errorf("Unexpected new name: got %v want %v", event.NewName, "carol")
+		}
+	}
+
+	// The session and the stream follow the new username
+	handlerFixture.LoggedUsers.RLock()
+	carol, renamed := handlerFixture.LoggedUsers.Users["carol"]
+	_, stale := handlerFixture.LoggedUsers.Users["bob"]
+	handlerFixture.LoggedUsers.RUnlock()
+	if !renamed || stale || carol.Token != "bob-token" || handlerFixture.connections.channel("carol") == nil {
+		t.Errorf("Session should be moved to the new username, got %+v", carol)
+	}
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hi"})
+	expectEvent(t, alice, model.StreamEventMessage, "general", "carol")
+
+	// Closing the stream cleans up the new username
+	bob.Close()
+	expectEvent(t, alice, model.StreamEventLeft, "general", "carol")
+}
+
+func TestRenameUserCollision(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+
+	errs := make(chan error, 2)
+	for _, username := range []string{"alice", "bob"} {
+		go func(username string) {
+			errs <- handlerFixture.renameUser(principal{Username: username, Role: model.RoleUser}, "carol")
+		}(username)
+	}
+	failed := 0
+	for range 2 {
+		if err := <-errs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Exactly one rename should succeed, %d failed", failed)
+	}
+	if len(handlerFixture.LoggedUsers.Users) != 2 {
+		t.Errorf("Unexpected logged users after the renames: %v", handlerFixture.LoggedUsers.Users)
+	}
+}
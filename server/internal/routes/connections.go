@@ -0,0 +1,157 @@
+package routes
+
+import "sync"
+
+// connectionShards is the number of shards of the connection registry.
+const connectionShards = 64
+
+// connections keeps the channel of every user connected to the stream. Users are spread over the shards
+// by the hash of their username, each shard with its own lock, so that handshakes, disconnections and
+// deliveries to different users don't contend on a single lock.
+//
+// The lock of a shard is never held while acquiring any other lock, except by rename which acquires two shards
+// in order, so the registry can be used while holding the LoggedUsers or ActiveRooms locks.
+// Channels are closed holding the lock of their shard, so a channel is never written after it's closed.
+type connections struct {
+	shards [connectionShards]connectionShard
+	owners connectionOwners
+}
+
+type connectionShard struct {
+	sync.RWMutex
+	channels map[string]chan []byte
+}
+
+// connectionOwners indexes the usernames by their channel, so the user a channel is bound to is found
+// without scanning the shards. Its lock is acquired holding the lock of a shard, and never the other way around.
+type connectionOwners struct {
+	sync.RWMutex
+	usernames map[chan []byte]string
+}
+
+func (owners *connectionOwners) set(channel chan []byte, username string) {
+	owners.Lock()
+	defer owners.Unlock()
+	if owners.usernames == nil {
+		owners.usernames = make(map[chan []byte]string)
+	}
+	owners.usernames[channel] = username
+}
+
+func (owners *connectionOwners) remove(channel chan []byte) {
+	owners.Lock()
+	defer owners.Unlock()
+	delete(owners.usernames, channel)
+}
+
+// connectionShardIndex hashes the username with 32-bit FNV-1a, inlined so that hashing doesn't allocate.
+func connectionShardIndex(username string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(username); i++ {
+		hash ^= uint32(username[i])
+		hash *= 16777619
+	}
+	return int(hash % connectionShards)
+}
+
+func (registry *connections) shard(username string) *connectionShard {
+	return &registry.shards[connectionShardIndex(username)]
+}
+
+// channel returns the channel of the user, or nil if it's not connected.
+func (registry *connections) channel(username string) chan []byte {
+	shard := registry.shard(username)
+	shard.RLock()
+	defer shard.RUnlock()
+	return shard.channels[username]
+}
+
+// bind makes the channel the connection of the user, closing the channel of its previous connection,
+// which ends its writer goroutine. The messages still queued in the previous channel are moved to the new one,
+// so a user reconnecting, or switching to another transport, doesn't lose them.
+func (registry *connections) bind(username string, channel chan []byte) {
+	shard := registry.shard(username)
+	shard.Lock()
+	defer shard.Unlock()
+	if previous, ok := shard.channels[username]; ok {
+		close(previous)
+		registry.owners.remove(previous)
+		for message := range previous {
+			select {
+			case channel <- message:
+			default:
+			}
+		}
+	}
+	if shard.channels == nil {
+		shard.channels = make(map[string]chan []byte)
+	}
+	shard.channels[username] = channel
+	registry.owners.set(channel, username)
+}
+
+// unbind closes the connection of the user. If channel isn't nil, the connection is only closed if it's still
+// bound to that channel. It reports whether a connection was closed.
+func (registry *connections) unbind(username string, channel chan []byte) bool {
+	shard := registry.shard(username)
+	shard.Lock()
+	defer shard.Unlock()
+	current, ok := shard.channels[username]
+	if !ok || (channel != nil && current != channel) {
+		return false
+	}
+	close(current)
+	delete(shard.channels, username)
+	registry.owners.remove(current)
+	return true
+}
+
+// rename moves the connection of the user to its new username.
+func (registry *connections) rename(username string, nickname string) {
+	from, to := connectionShardIndex(username), connectionShardIndex(nickname)
+	// Both shards are locked in order, so concurrent renames can't deadlock
+	first, second := min(from, to), max(from, to)
+	registry.shards[first].Lock()
+	defer registry.shards[first].Unlock()
+	if second != first {
+		registry.shards[second].Lock()
+		defer registry.shards[second].Unlock()
+	}
+
+	channel, ok := registry.shards[from].channels[username]
+	if !ok {
+		return
+	}
+	delete(registry.shards[from].channels, username)
+	if registry.shards[to].channels == nil {
+		registry.shards[to].channels = make(map[string]chan []byte)
+	}
+	registry.shards[to].channels[nickname] = channel
+	registry.owners.set(channel, nickname)
+}
+
+// boundTo returns the username the channel is bound to.
+func (registry *connections) boundTo(channel chan []byte) (string, bool) {
+	registry.owners.RLock()
+	defer registry.owners.RUnlock()
+	username, ok := registry.owners.usernames[channel]
+	return username, ok
+}
+
+// send queues the message in the channel of the user, without blocking. It reports whether the user
+// is connected and whether the message was queued, which fails when the channel is full.
+func (registry *connections) send(username string, message []byte) (connected bool, queued bool) {
+	shard := registry.shard(username)
+	shard.RLock()
+	defer shard.RUnlock()
+	channel, ok := shard.channels[username]
+	if !ok {
+		return false, false
+	}
+	select {
+	case channel <- message:
+		return true, true
+	default:
+		return true, false
+	}
+}
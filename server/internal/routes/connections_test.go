@@ -0,0 +1,227 @@
+package routes
+
+import (
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+func TestConnections(t *testing.T) {
+	var registry connections
+
+	first := make(chan []byte, 1)
+	registry.bind("alice", first)
+	if connected, queued := registry.send("alice", []byte("hello")); !connected || !queued {
+		t.Errorf("Message should be queued, got connected=%v queued=%v", connected, queued)
+	}
+	if connected, queued := registry.send("alice", []byte("full")); !connected || queued {
+		t.Errorf("Message should be dropped when the channel is full, got connected=%v queued=%v", connected, queued)
+	}
+	if connected, _ := registry.send("bob", []byte("hello")); connected {
+		t.Errorf("Users without a connection should not be connected")
+	}
+
+	// Binding a new connection closes the previous one, moving its queued messages to the new one
+	second := make(chan []byte, 1)
+	registry.bind("alice", second)
+	if _, ok := <-first; ok {
+		t.Errorf("Previous channel should be closed")
+	}
+	if message := <-second; string(message) != "hello" {
+		t.Errorf("Queued message should be moved to the new channel, got %q", message)
+	}
+	if registry.unbind("alice", first) {
+		t.Errorf("Stale channel should not unbind the connection")
+	}
+
+	registry.rename("alice", "carol")
+	if registry.channel("alice") != nil || registry.channel("carol") != second {
+		t.Errorf("Connection should be moved to the new username")
+	}
+	if username, ok := registry.boundTo(second); !ok || username != "carol" {
+		t.Errorf("Unexpected username of the channel: got %q", username)
+	}
+	if !registry.unbind("carol", nil) || registry.channel("carol") != nil {
+		t.Errorf("Connection should be unbound")
+	}
+	if _, ok := <-second; ok {
+		t.Errorf("Unbound channel should be closed")
+	}
+}
+
+// connectionRegistry is the part of the connection registry exercised by the benchmarks.
+type connectionRegistry interface {
+	bind(username string, channel chan []byte)
+	unbind(username string, channel chan []byte) bool
+	send(username string, message []byte) (bool, bool)
+}
+
+// globalConnections keeps the channels behind a single lock, as the logged users did before
+// the connection registry was sharded. It's the baseline of the benchmarks.
+type globalConnections struct {
+	sync.RWMutex
+	channels map[string]chan []byte
+}
+
+func (registry *globalConnections) bind(username string, channel chan []byte) {
+	registry.Lock()
+	defer registry.Unlock()
+	if previous, ok := registry.channels[username]; ok {
+		close(previous)
+	}
+	registry.channels[username] = channel
+}
+
+func (registry *globalConnections) unbind(username string, channel chan []byte) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	current, ok := registry.channels[username]
+	if !ok || (channel != nil && current != channel) {
+		return false
+	}
+	close(current)
+	delete(registry.channels, username)
+	return true
+}
+
+func (registry *globalConnections) send(username string, message []byte) (bool, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	channel, ok := registry.channels[username]
+	if !ok {
+		return false, false
+	}
+	select {
+	case channel <- message:
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// drainedChannel returns a channel of a connection whose messages are read and discarded until it's closed,
+// like the writer of a client keeping up with its messages, so that the benchmarks measure queued messages
+// rather than messages dropped from full channels.
+func drainedChannel(channel chan []byte) chan []byte {
+	go func() {
+		for range channel {
+		}
+	}()
+	return channel
+}
+
+// benchmarkConnections runs logins and broadcasts concurrently: every worker reconnects a user one time
+// out of ten, and otherwise broadcasts a message to a room of 50 of the 10000 connected users.
+func benchmarkConnections(b *testing.B, registry connectionRegistry) {
+	const users, roomSize = 10000, 50
+	usernames := make([]string, users)
+	for i := range usernames {
+		usernames[i] = "user" + strconv.Itoa(i)
+		registry.bind(usernames[i], drainedChannel(make(chan []byte, userChannelBufferSize)))
+	}
+	// Closing the channels ends their readers
+	defer func() {
+		for _, username := range usernames {
+			registry.unbind(username, nil)
+		}
+	}()
+	message := []byte(`{"type":"message"}`)
+
+	var workers atomic.Int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		worker := int(workers.Add(1)) * 7919
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				username := usernames[(worker+i)%users]
+				registry.unbind(username, nil)
+				registry.bind(username, drainedChannel(make(chan []byte, userChannelBufferSize)))
+				continue
+			}
+			for j := 0; j < roomSize; j++ {
+				registry.send(usernames[(worker+i+j)%users], message)
+			}
+		}
+	})
+	b.StopTimer()
+}
+
+func BenchmarkConnections(b *testing.B) {
+	b.Run("global", func(b *testing.B) {
+		benchmarkConnections(b, &globalConnections{channels: make(map[string]chan []byte)})
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkConnections(b, &connections{})
+	})
+}
+
+// BenchmarkHandler runs logins and broadcasts concurrently through the handler: every worker logs a new user in
+// and out one time out of ten, and otherwise authenticates a user by its token and broadcasts a message to a room
+// of 50 of the 10000 connected users.
+func BenchmarkHandler(b *testing.B) {
+	const users, roomSize = 10000, 50
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	handler := NewHandler()
+	usernames := make([]string, users)
+	tokens := make([]string, users)
+	for i := range usernames {
+		user, err := handler.startSession(model.UserLoginRequest{Username: "user" + strconv.Itoa(i)}, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		channel, err := handler.bindChannel(model.UserWithTokenRequest{Username: user.Username, Token: user.Token}, "", "stream")
+		if err != nil {
+			b.Fatal(err)
+		}
+		drainedChannel(channel)
+		usernames[i], tokens[i] = user.Username, user.Token
+	}
+	// Disconnecting the users closes their channels, which ends their readers
+	defer func() {
+		for _, username := range usernames {
+			handler.disconnectStream(username, handler.connections.channel(username))
+		}
+	}()
+	event := newEvent(model.StreamEventMessage, "general", "user0", "hello")
+
+	var workers atomic.Int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		worker := int(workers.Add(1))
+		recipients := make([]string, roomSize)
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				username := "worker" + strconv.Itoa(worker) + "-" + strconv.Itoa(i)
+				user, err := handler.startSession(model.UserLoginRequest{Username: username}, "")
+				if err != nil {
+					b.Fatal(err)
+				}
+				channel, err := handler.bindChannel(model.UserWithTokenRequest{Username: username, Token: user.Token}, "", "stream")
+				if err != nil {
+					b.Fatal(err)
+				}
+				handler.disconnectStream(username, channel)
+				continue
+			}
+			sender := (worker*7919 + i) % users
+			if _, ok := handler.sessionPrincipal(tokens[sender]); !ok {
+				b.Fatal("Session not found")
+			}
+			for j := range recipients {
+				recipients[j] = usernames[(sender+j)%users]
+			}
+			handler.broadcast(recipients, event)
+		}
+	})
+	b.StopTimer()
+}
@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// eventsKeepAliveInterval is the time between the comments sent through an idle Server-Sent Events stream,
+// so that proxies don't close it.
+const eventsKeepAliveInterval = 15 * time.Second
+
+// events is a handler function that streams the events of the user as Server-Sent Events, for clients
+// that can't open a websocket. The data of every event is a frame of the websocket stream: the welcome frame
+// first, then the events of the user. Requests are sent with POST /messages.
+//
+// The user is identified by the username query parameter and its session token, given as a bearer token or,
+// since browsers can't set headers on an EventSource, as the token query parameter.
+// If the user can't connect, it returns the error before starting the stream.
+// Like the websocket stream, closing the connection logs out the user.
+func (handler *Handler) events(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	userWithTokenRequest := model.UserWithTokenRequest{
+		Username: r.URL.Query().Get("username"),
+		Token:    r.URL.Query().Get("token"),
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		userWithTokenRequest.Token = token
+	}
+	channel, err := handler.bindChannel(userWithTokenRequest, remoteIP(r.RemoteAddr), "events")
+	if err != nil {
+		writeHandshakeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Proxies that buffer responses would hold the events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+
+	welcome, err := json.Marshal(model.WebsocketWelcomeResponse{Welcome: userWithTokenRequest.Username})
+	if err == nil {
+		err = writeServerSentEvent(w, controller, welcome)
+	}
+	if err != nil {
+		log.Println(err)
+		handler.disconnectStream(userWithTokenRequest.Username, channel)
+		return
+	}
+
+	handler.subscribeUser(userWithTokenRequest.Username)
+	handler.rejoinRooms(userWithTokenRequest.Username)
+
+	// Send the messages of the channel until it's closed, either on logout or when the user reconnects,
+	// or until the client goes away
+	keepAlive := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case message, ok := <-channel:
+			if !ok {
+				log.Printf("Event stream closed for user %s", userWithTokenRequest.Username)
+				return
+			}
+			err = writeServerSentEvent(w, controller, message)
+		case <-keepAlive.C:
+			if _, err = io.WriteString(w, ": keep-alive\n\n"); err == nil {
+				err = controller.Flush()
+			}
+		case <-r.Context().Done():
+			err = r.Context().Err()
+		}
+		if err != nil {
+			log.Printf("Event stream of user %s ended: %v", userWithTokenRequest.Username, err)
+			break
+		}
+	}
+
+	// Remove the user from the logged users, closing the channel if it exists
+	handler.disconnectStream(userWithTokenRequest.Username, channel)
+}
+
+// writeServerSentEvent sends the frame as the data of an event, and flushes it to the client.
+func writeServerSentEvent(w io.Writer, controller *http.ResponseController, message []byte) error {
+	var event bytes.Buffer
+	// Data spanning several lines is sent as several data fields, which the client joins back
+	for _, line := range bytes.Split(message, []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(line)
+		event.WriteByte('\n')
+	}
+	event.WriteByte('\n')
+	if _, err := w.Write(event.Bytes()); err != nil {
+		return err
+	}
+	return controller.Flush()
+}
+
+// postMessage is a handler function that processes a request of the stream sent over HTTP, for clients
+// connected through the Server-Sent Events stream. It accepts the same requests as the websocket stream,
+// authenticated with the session token, and their events are delivered through the stream of the user.
+// If the request fails, it returns the error instead of sending an error event.
+func (handler *Handler) postMessage(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	actor, ok := handler.authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	var streamRequest model.StreamRequest
+	if !decodeRequest(w, r, &streamRequest) {
+		return
+	}
+	if err := handler.handleStreamRequest(actor.Username, streamRequest); err != nil {
+		log.Printf("Request %s from user %s failed: %v", streamRequest.Type, actor.Username, err)
+		writeStreamError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, model.StreamRequestResponse{Message: fmt.Sprintf("Request %s processed", streamRequest.Type)})
+}
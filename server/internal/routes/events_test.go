@@ -0,0 +1,152 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// readServerSentEvent reads the data of the next event of a Server-Sent Events stream, skipping comments.
+func readServerSentEvent(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && data != nil:
+			return strings.Join(data, "\n")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+// expectServerSentEvent reads the next event of the stream and checks its type, room and sender.
+func expectServerSentEvent(t *testing.T, reader *bufio.Reader, eventType string, room string, from string) model.StreamEvent {
+	t.Helper()
+	data := readServerSentEvent(t, reader)
+	var event model.StreamEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatalf("Failed to unmarshal event: %v", err)
+	}
+	if event.Type != eventType || event.Room != room || event.From != from {
+		t.Fatalf("Unexpected event: got %s want type=%s room=%s from=%s", data, eventType, room, from)
+	}
+	return event
+}
+
+// postStreamRequest sends a request of the stream with POST /messages, returning the status code and the error code if any.
+func postStreamRequest(t *testing.T, server *httptest.Server, token string, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/messages", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var errorResponse model.ErrorResponse
+	if resp.StatusCode != http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&errorResponse)
+	}
+	return resp.StatusCode, errorResponse.Code
+}
+
+func TestServerSentEvents(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	// Invalid tokens are rejected before starting the stream
+	resp, err := http.Get(server.URL + "/events?username=alice&token=invalid-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Invalid token returned wrong status code: got %v want %v", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp, err = http.Get(server.URL + "/events?username=alice&token=alice-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Unexpected content type: got %v want %v", contentType, "text/event-stream")
+	}
+	alice := bufio.NewReader(resp.Body)
+	var welcome model.WebsocketWelcomeResponse
+	if err := json.Unmarshal([]byte(readServerSentEvent(t, alice)), &welcome); err != nil || welcome.Welcome != "alice" {
+		t.Fatalf("Unexpected welcome message: %+v", welcome)
+	}
+
+	// Requests sent over HTTP are delivered to the users of both transports
+	if status, code := postStreamRequest(t, server, "alice-token", `{"type": "join", "room": "general"}`); status != http.StatusOK {
+		t.Fatalf("Join returned wrong status code: got %v (%s) want %v", status, code, http.StatusOK)
+	}
+	expectServerSentEvent(t, alice, model.StreamEventJoined, "general", "alice")
+
+	bob := connectToStream(t, server, "bob", "bob-token")
+	defer bob.Close()
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+	expectServerSentEvent(t, alice, model.StreamEventJoined, "general", "bob")
+
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello alice"})
+	expectEvent(t, bob, model.StreamEventMessage, "general", "bob")
+	if event := expectServerSentEvent(t, alice, model.StreamEventMessage, "general", "bob"); event.Text != "hello alice" {
+		t.Errorf("Unexpected message: %+v", event)
+	}
+
+	if status, code := postStreamRequest(t, server, "alice-token", `{"type": "message", "room": "general", "text": "hello bob"}`); status != http.StatusOK {
+		t.Fatalf("Message returned wrong status code: got %v (%s) want %v", status, code, http.StatusOK)
+	}
+	if event := expectEvent(t, bob, model.StreamEventMessage, "general", "alice"); event.Text != "hello bob" {
+		t.Errorf("Unexpected message: %+v", event)
+	}
+	expectServerSentEvent(t, alice, model.StreamEventMessage, "general", "alice")
+
+	// Failed requests are answered with an error response instead of an error event
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+		code   string
+	}{
+		{"no token", "", `{"type": "join", "room": "general"}`, http.StatusUnauthorized, model.ErrorCodeUnauthorized},
+		{"unknown request", "alice-token", `{"type": "dance"}`, http.StatusBadRequest, model.ErrorCodeUnknownRequest},
+		{"not in room", "alice-token", `{"type": "message", "room": "random", "text": "hi"}`, http.StatusNotFound, model.ErrorCodeNotInRoom},
+		{"invalid body", "alice-token", `{"kind": "join"}`, http.StatusBadRequest, model.ErrorCodeInvalidBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, code := postStreamRequest(t, server, tt.token, tt.body)
+			if status != tt.status || code != tt.code {
+				t.Errorf("Unexpected response: got %v %s want %v %s", status, code, tt.status, tt.code)
+			}
+		})
+	}
+
+	// Closing the stream logs out the user, like closing the websocket
+	resp.Body.Close()
+	waitForLogout(t, handlerFixture, "alice")
+	expectEvent(t, bob, model.StreamEventLeft, "general", "alice")
+}
@@ -0,0 +1,281 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// Message is a chat message going through the message pipeline before being delivered to a room.
+type Message struct {
+	Room string
+	From string
+	Text string
+	// Flags holds the reasons why the message was flagged for review by the filters.
+	Flags []string
+}
+
+// MessageFilter processes a message before it is delivered to the members of a room.
+// A filter can rewrite the text or flag the message, and rejects it by returning an error
+// whose text is reported to the sender.
+type MessageFilter interface {
+	Filter(message *Message) error
+}
+
+// MessageFilterFunc adapts an ordinary function to a MessageFilter.
+type MessageFilterFunc func(message *Message) error
+
+func (f MessageFilterFunc) Filter(message *Message) error {
+	return f(message)
+}
+
+// WordlistFilter masks, rejects or flags the messages containing banned words, matched as whole words ignoring case.
+// Words are delimited by any character that isn't a letter, a digit or an underscore, in any script.
+type WordlistFilter struct {
+	pattern *regexp.Regexp
+	action  string
+}
+
+// NewWordlistFilter returns a filter for the words, taking the action on matching messages.
+func NewWordlistFilter(words []string, action string) *WordlistFilter {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if action == "" {
+		action = model.FilterActionMask
+	}
+	filter := &WordlistFilter{action: action}
+	if len(quoted) > 0 {
+		// \b only knows ASCII letters, so the boundaries are matched around the word, which is the first group
+		filter.pattern = regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])(` + strings.Join(quoted, "|") + `)(?:$|[^\p{L}\p{N}_])`)
+	}
+	return filter
+}
+
+// matches returns the start and end of every banned word in the text.
+func (filter *WordlistFilter) matches(text string) [][2]int {
+	var words [][2]int
+	for offset := 0; offset <= len(text); {
+		loc := filter.pattern.FindStringSubmatchIndex(text[offset:])
+		if loc == nil {
+			break
+		}
+		words = append(words, [2]int{offset + loc[2], offset + loc[3]})
+		// The boundary after the word may start the next one
+		offset += loc[3]
+	}
+	return words
+}
+
+func (filter *WordlistFilter) Filter(message *Message) error {
+	if filter.pattern == nil {
+		return nil
+	}
+	words := filter.matches(message.Text)
+	if len(words) == 0 {
+		return nil
+	}
+	switch filter.action {
+	case model.FilterActionReject:
+		return errors.New("message contains banned words")
+	case model.FilterActionFlag:
+		message.Flags = append(message.Flags, "banned words")
+	default:
+		var masked strings.Builder
+		end := 0
+		for _, word := range words {
+			masked.WriteString(message.Text[end:word[0]])
+			masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(message.Text[word[0]:word[1]])))
+			end = word[1]
+		}
+		masked.WriteString(message.Text[end:])
+		message.Text = masked.String()
+	}
+	return nil
+}
+
+// wordlistCache keeps the wordlist filters of the filter configurations, so that their patterns are compiled
+// once rather than for every message. It's emptied whenever the configuration of a room changes.
+type wordlistCache struct {
+	mu      sync.Mutex
+	filters map[string]*WordlistFilter
+}
+
+// filter returns the filter of the words and the action, compiling it if it's not cached.
+func (cache *wordlistCache) filter(words []string, action string) *WordlistFilter {
+	key := action + "\x00" + strings.Join(words, "\x00")
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if filter, ok := cache.filters[key]; ok {
+		return filter
+	}
+	if cache.filters == nil {
+		cache.filters = make(map[string]*WordlistFilter)
+	}
+	filter := NewWordlistFilter(words, action)
+	cache.filters[key] = filter
+	return filter
+}
+
+// reset drops the cached filters.
+func (cache *wordlistCache) reset() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.filters = nil
+}
+
+// MaxLengthFilter rejects the messages longer than a number of characters.
+type MaxLengthFilter int
+
+func (maxLength MaxLengthFilter) Filter(message *Message) error {
+	if utf8.RuneCountInString(message.Text) > int(maxLength) {
+		return fmt.Errorf("message can't be longer than %d characters", maxLength)
+	}
+	return nil
+}
+
+// linkPattern matches the links in the text of a message.
+var linkPattern = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+`)
+
+// LinkFilter rejects the messages containing links.
+type LinkFilter struct{}
+
+func (LinkFilter) Filter(message *Message) error {
+	if linkPattern.MatchString(message.Text) {
+		return errors.New("links are not allowed in this room")
+	}
+	return nil
+}
+
+// validFilterConfig checks the filter configuration of a room.
+func validFilterConfig(config model.FilterConfig) error {
+	switch config.WordlistAction {
+	case "", model.FilterActionMask, model.FilterActionReject, model.FilterActionFlag:
+	default:
+		return fmt.Errorf("invalid wordlist action '%s'", config.WordlistAction)
+	}
+	for _, word := range config.Wordlist {
+		if strings.TrimSpace(word) == "" {
+			return errors.New("wordlist can't contain blank words")
+		}
+	}
+	if config.MaxLength < 0 || config.MaxLength > maxMessageLength {
+		return fmt.Errorf("max length must be between 0 and %d", maxMessageLength)
+	}
+	return nil
+}
+
+// roomFilters returns the filter configuration of the room.
+func (handler *Handler) roomFilters(roomName string) model.FilterConfig {
+	handler.Filters.RLock()
+	defer handler.Filters.RUnlock()
+	if config, ok := handler.Filters.Rooms[roomName]; ok {
+		return config
+	}
+	return handler.Filters.Default
+}
+
+// messagePipeline returns the filters applied to the messages sent to the room:
+// the ones configured for the room followed by the handler's MessageFilters.
+func (handler *Handler) messagePipeline(roomName string) []MessageFilter {
+	config := handler.roomFilters(roomName)
+	var pipeline []MessageFilter
+	if config.MaxLength > 0 {
+		pipeline = append(pipeline, MaxLengthFilter(config.MaxLength))
+	}
+	if config.BlockLinks {
+		pipeline = append(pipeline, LinkFilter{})
+	}
+	if len(config.Wordlist) > 0 {
+		pipeline = append(pipeline, handler.wordlists.filter(config.Wordlist, config.WordlistAction))
+	}
+	return append(pipeline, handler.MessageFilters...)
+}
+
+// filterMessage runs the message through the pipeline of its room, recording flagged messages in the audit trail.
+// It returns an error if a filter rejected the message.
+func (handler *Handler) filterMessage(message *Message) error {
+	for _, filter := range handler.messagePipeline(message.Room) {
+		if err := filter.Filter(message); err != nil {
+			return newStreamError(model.ErrorCodeMessageRejected, err.Error())
+		}
+	}
+	if strings.TrimSpace(message.Text) == "" {
+		return newStreamError(model.ErrorCodeEmptyMessage, "Message can't be empty")
+	}
+	if len(message.Flags) > 0 {
+		handler.audit(model.AuditEvent{Action: model.AuditActionMessageFlagged, Actor: message.From, Room: message.Room, Details: strings.Join(message.Flags, ", ") + ": " + message.Text})
+	}
+	return nil
+}
+
+// adminGetRoomFilters is a handler function that returns the filter configuration of a room.
+func (handler *Handler) adminGetRoomFilters(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureFilters); !ok {
+		return
+	}
+	roomName := r.PathValue("room")
+	writeJSON(w, http.StatusOK, model.RoomFiltersResponse{Room: roomName, Filters: handler.roomFilters(roomName)})
+}
+
+// adminSetRoomFilters is a handler function that replaces the filter configuration of a room.
+func (handler *Handler) adminSetRoomFilters(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureFilters); !ok {
+		return
+	}
+	var config model.FilterConfig
+	if !decodeRequest(w, r, &config) {
+		return
+	}
+	roomName := r.PathValue("room")
+	if !validRoomName(roomName) {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidRoom, fmt.Sprintf("Invalid room name '%s'", roomName), "")
+		return
+	}
+	if err := validFilterConfig(config); err != nil {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidFilter, err.Error(), "")
+		return
+	}
+
+	handler.Filters.Lock()
+	if handler.Filters.Rooms == nil {
+		handler.Filters.Rooms = make(map[string]model.FilterConfig)
+	}
+	handler.Filters.Rooms[roomName] = config
+	handler.Filters.Unlock()
+	handler.wordlists.reset()
+
+	writeJSON(w, http.StatusOK, model.RoomFiltersResponse{Room: roomName, Filters: config})
+}
+
+// adminResetRoomFilters is a handler function that makes a room use the default filter configuration again.
+func (handler *Handler) adminResetRoomFilters(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureFilters); !ok {
+		return
+	}
+	roomName := r.PathValue("room")
+	handler.Filters.Lock()
+	delete(handler.Filters.Rooms, roomName)
+	handler.Filters.Unlock()
+	handler.wordlists.reset()
+
+	writeJSON(w, http.StatusOK, model.RoomFiltersResponse{Room: roomName, Filters: handler.roomFilters(roomName)})
+}
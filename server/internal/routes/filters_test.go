@@ -0,0 +1,152 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+func TestMessageFilters(t *testing.T) {
+	var tests = []struct {
+		name     string
+		filter   MessageFilter
+		text     string
+		want     string
+		flags    int
+		rejected bool
+	}{
+		{"mask whole words ignoring case", NewWordlistFilter([]string{"darn", "heck"}, ""), "Darn it, what the heck", "**** it, what the ****", 0, false},
+		{"mask keeps other words", NewWordlistFilter([]string{"darn"}, model.FilterActionMask), "darned", "darned", 0, false},
+		{"reject banned words", NewWordlistFilter([]string{"darn"}, model.FilterActionReject), "darn", "", 0, true},
+		{"flag banned words", NewWordlistFilter([]string{"darn"}, model.FilterActionFlag), "darn", "darn", 1, false},
+		{"mask words of any script", NewWordlistFilter([]string{"ñoño", "darn"}, ""), "¡Ñoño! darnó ñdarn darn_ darn-darn", "¡****! darnó ñdarn darn_ ****-****", 0, false},
+		{"mask consecutive words", NewWordlistFilter([]string{"darn"}, ""), "darn darn darn", "**** **** ****", 0, false},
+		{"max length counts characters", MaxLengthFilter(5), "héllo", "héllo", 0, false},
+		{"max length rejects", MaxLengthFilter(4), "hello", "", 0, true},
+		{"link with scheme", LinkFilter{}, "see https://example.com", "", 0, true},
+		{"link with www", LinkFilter{}, "see www.example.com", "", 0, true},
+		{"no link", LinkFilter{}, "see you at 5.30", "see you at 5.30", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := Message{Room: "general", From: "alice", Text: tt.text}
+			err := tt.filter.Filter(&message)
+			if tt.rejected {
+				if err == nil {
+					t.Errorf("Message should be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Message rejected: %v", err)
+			}
+			if message.Text != tt.want || len(message.Flags) != tt.flags {
+				t.Errorf("Unexpected message: got %q with flags %v, want %q with %d flags", message.Text, message.Flags, tt.want, tt.flags)
+			}
+		})
+	}
+}
+
+func TestRoomMessagePipeline(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.Filters.Default = model.FilterConfig{Wordlist: []string{"darn"}}
+	handlerFixture.Filters.Rooms = map[string]model.FilterConfig{
+		"strict": {Wordlist: []string{"darn"}, WordlistAction: model.FilterActionFlag, BlockLinks: true},
+	}
+	handlerFixture.MessageFilters = []MessageFilter{MessageFilterFunc(func(message *Message) error {
+		if strings.Contains(message.Text, "spam") {
+			return errors.New("No spam")
+		}
+		return nil
+	})}
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+
+	for _, room := range []string{"general", "strict"} {
+		sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: room})
+		expectEvent(t, alice, model.StreamEventJoined, room, "alice")
+	}
+
+	// Rooms without filters use the default ones
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "darn"})
+	if event := expectEvent(t, alice, model.StreamEventMessage, "general", "alice"); event.Text != "****" {
+		t.Errorf("Banned word should be masked, got %q", event.Text)
+	}
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "spam"})
+	if event := expectEvent(t, alice, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeMessageRejected || event.Error.Message != "No spam" {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "strict", Text: "http://example.com"})
+	if event := expectEvent(t, alice, model.StreamEventError, "strict", ""); event.Error.Code != model.ErrorCodeMessageRejected {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "strict", Text: "darn"})
+	if event := expectEvent(t, alice, model.StreamEventMessage, "strict", "alice"); event.Text != "darn" {
+		t.Errorf("Flagged message should be delivered unchanged, got %q", event.Text)
+	}
+	events, err := handlerFixture.Audit.Query(model.AuditFilter{Action: model.AuditActionMessageFlagged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Actor != "alice" || events[0].Room != "strict" {
+		t.Errorf("Flagged message should be audited, got %+v", events)
+	}
+}
+
+func TestAdminRoomFilters(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.Filters.Default = model.FilterConfig{MaxLength: 100}
+
+	rr := adminRequest(t, handlerFixture, "PUT", "/admin/rooms/general/filters", `{"wordlist":["darn"],"wordlist_action":"reject","block_links":true}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if config := handlerFixture.roomFilters("general"); config.WordlistAction != model.FilterActionReject || !config.BlockLinks {
+		t.Errorf("Filters not stored: %+v", config)
+	}
+
+	rr = adminRequest(t, handlerFixture, "PUT", "/admin/rooms/general/filters", `{"wordlist_action":"delete"}`)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	assertErrorResponse(t, rr, model.ErrorCodeInvalidFilter, "invalid wordlist action 'delete'")
+
+	rr = adminRequest(t, handlerFixture, "DELETE", "/admin/rooms/general/filters", "")
+	var response model.RoomFiltersResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Filters.MaxLength != 100 || response.Filters.BlockLinks {
+		t.Errorf("Room should use the default filters again, got %+v", response.Filters)
+	}
+}
+
+func TestWordlistFiltersAreCached(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.Filters.Default = model.FilterConfig{Wordlist: []string{"darn"}}
+
+	// Rooms sharing a configuration share its compiled filter
+	filter := handlerFixture.messagePipeline("general")[0]
+	if other := handlerFixture.messagePipeline("random")[0]; other != filter {
+		t.Errorf("Wordlist filter should be compiled once")
+	}
+
+	// Changing the configuration of a room compiles its new wordlist
+	adminRequest(t, handlerFixture, "PUT", "/admin/rooms/general/filters", `{"wordlist":["heck"]}`)
+	message := Message{Room: "general", From: "alice", Text: "darn heck"}
+	if err := handlerFixture.filterMessage(&message); err != nil || message.Text != "darn ****" {
+		t.Errorf("Unexpected filtered message: %q (%v)", message.Text, err)
+	}
+}
@@ -1,11 +1,15 @@
 package routes
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/DaniSancas/go-chat-room/server/internal/model"
 	"github.com/google/uuid"
@@ -17,13 +21,67 @@ import (
 // It is used to pass the shared state to the handlers.
 type Handler struct {
 	LoggedUsers model.LoggedUsers
+	ActiveRooms model.ActiveRooms
+	ActiveBans  model.ActiveBans
+	// Audit stores the audit trail, events are only logged if it's nil
+	Audit AuditSink
+	// Filters configures the filters applied to the messages of each room
+	Filters model.RoomFilters
+	// Webhooks are the URLs receiving the events of each room, delivered by the node they are registered on
+	Webhooks model.RoomWebhooks
+	// MessageFilters are applied to the messages of every room, after the filters configured for the room
+	MessageFilters []MessageFilter
+	// Memberships stores the rooms of every user, which it rejoins when it logs in again, memberships are not kept if it's nil
+	Memberships MembershipStore
+	// AdminToken is the bearer token required by the admin API, which is disabled if it's empty
+	AdminToken string
+	// PrivilegedUsers maps the usernames configured at startup to their global role and secret
+	PrivilegedUsers map[string]model.PrivilegedUser
+	// Broker relays the events to the other nodes of the server, the node runs alone if it's nil
+	Broker Broker
+	// NodeID identifies this node among the nodes sharing the Broker
+	NodeID string
+	// Sessions keeps the sessions of the users across the nodes, only the users logged in to this node are known if it's nil
+	Sessions SessionRegistry
+
+	subscriptions subscriptions
+	connections   connections
+	polls         polls
+	deliveries    webhookDeliveries
+	wordlists     wordlistCache
+	// tokens has the usernames of the logged users by their session token, guarded by the LoggedUsers lock
+	tokens map[string]string
+}
+
+// NewHandler returns a Handler with its shared state initialized.
+func NewHandler() *Handler {
+	return &Handler{
+		LoggedUsers: model.LoggedUsers{
+			Users: make(model.Users),
+		},
+		ActiveRooms: model.ActiveRooms{
+			Rooms: make(model.Rooms),
+		},
+		ActiveBans: model.ActiveBans{
+			Bans: make(model.Bans),
+		},
+		PrivilegedUsers: make(map[string]model.PrivilegedUser),
+		Audit:           NewMemoryAuditSink(),
+		Memberships:     NewMemoryMembershipStore(),
+		NodeID:          uuid.NewString(),
+		Sessions:        NewMemorySessionRegistry(),
+		deliveries:      newWebhookDeliveries(),
+	}
 }
 
 // upgrader is a websocket upgrader that is used to upgrade an HTTP
 // connection to a websocket connection.
+// Clients can negotiate permessage-deflate compression, and the encoding of the frames with the subprotocol.
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
+	Subprotocols:      []string{model.SubprotocolMessagePack, model.SubprotocolJSON},
 	CheckOrigin: func(r *http.Request) bool {
 		// Allow all connections by default
 		return true
@@ -39,52 +97,92 @@ var upgrader = websocket.Upgrader{
 // If everything is ok, it returns the token of the user.
 func (handler *Handler) login(w http.ResponseWriter, r *http.Request) {
 	// Only allow POST requests
-	if r.Method != "POST" {
-		responseMessage := "Invalid request method"
-		log.Printf("%s: %s", responseMessage, r.Method)
-		http.Error(w, responseMessage, http.StatusMethodNotAllowed)
-		return
-	}
-	// request body can't be nil
-	if r.Body == nil {
-		responseMessage := "Request body missing"
-		log.Print(responseMessage)
-		http.Error(w, responseMessage, http.StatusBadRequest)
+	if !allowMethod(w, r, http.MethodPost) {
 		return
 	}
 
 	// Parse the request body to get the user data
 	var userLoginRequest model.UserLoginRequest
-	err := json.NewDecoder(r.Body).Decode(&userLoginRequest)
+	if !decodeRequest(w, r, &userLoginRequest) {
+		return
+	}
+
+	user, err := handler.startSession(userLoginRequest, remoteIP(r.RemoteAddr))
 	if err != nil {
-		responseMessage := "Can't decode body"
-		log.Printf("%s: %v", responseMessage, err)
-		http.Error(w, "Can't decode body", http.StatusBadRequest)
+		writeHandshakeError(w, err)
 		return
 	}
 
+	// If everything is ok, finally return the token
+	writeJSON(w, http.StatusOK, model.UserLoginResponse{
+		Token:  user.Token,
+		Role:   user.Role,
+		Rooms:  handler.storedRooms(user.Username),
+		Unread: handler.unreadCounts(user.Username),
+	})
+}
+
+// startSession logs in the user, adding it to the logged users with a new random token,
+// and returns it. Every transport logs users in through it.
+// It returns a *handshakeError if the username is invalid or already logged in, if the user is banned,
+// or if a privileged user doesn't provide its secret.
+func (handler *Handler) startSession(userLoginRequest model.UserLoginRequest, ip string) (model.User, error) {
+	if !validUsername(userLoginRequest.Username) {
+		return model.User{}, &handshakeError{code: model.ErrorCodeInvalidUsername, message: "Invalid username"}
+	}
+	if handler.botName(userLoginRequest.Username) {
+		return model.User{}, &handshakeError{code: model.ErrorCodeInvalidUsername, message: fmt.Sprintf("Username %s is reserved for a bot", userLoginRequest.Username)}
+	}
+
+	// Banned users, or users coming from a banned IP, can't log in
+	if ban, ok := handler.activeBan(userLoginRequest.Username, ip); ok {
+		responseMessage, details := banMessage(userLoginRequest.Username, ban)
+		handler.audit(model.AuditEvent{Action: model.AuditActionLoginFailed, Target: userLoginRequest.Username, IP: ip, Details: "banned"})
+		return model.User{}, &handshakeError{code: model.ErrorCodeBanned, message: responseMessage, details: details}
+	}
+
+	// Privileged users must prove their identity with the secret configured at startup
+	role := model.RoleUser
+	if privilegedUser, ok := handler.PrivilegedUsers[userLoginRequest.Username]; ok {
+		if subtle.ConstantTimeCompare([]byte(userLoginRequest.Secret), []byte(privilegedUser.Secret)) != 1 {
+			handler.audit(model.AuditEvent{Action: model.AuditActionLoginFailed, Target: userLoginRequest.Username, IP: ip, Details: "invalid secret"})
+			return model.User{}, &handshakeError{code: model.ErrorCodeInvalidSecret, message: fmt.Sprintf("Invalid secret for user %s", userLoginRequest.Username)}
+		}
+		role = privilegedUser.Role
+	}
+
+	// Generate a random UUID for the user, and claim the username on every node.
+	// The claim is made before acquiring the lock, so a slow registry doesn't delay other logins.
+	token := uuid.NewString()
+	alreadyLoggedIn := &handshakeError{code: model.ErrorCodeAlreadyLoggedIn, message: fmt.Sprintf("User %s is already logged in", userLoginRequest.Username)}
+	if err := handler.claimSession(userLoginRequest.Username, token); err != nil {
+		if errors.Is(err, ErrSessionExists) {
+			return model.User{}, alreadyLoggedIn
+		}
+		return model.User{}, &handshakeError{code: model.ErrorCodeInternal, message: "Can't start the session", details: err.Error()}
+	}
+
 	// Check if the user is already logged in, in which case return an error
 	// Aquire lock in write mode
 	handler.LoggedUsers.Lock()
-	defer handler.LoggedUsers.Unlock()
 	if _, ok := handler.LoggedUsers.Users[userLoginRequest.Username]; ok {
-		responseMessage := fmt.Sprintf("User %s is already logged in", userLoginRequest.Username)
-		log.Print(responseMessage)
-		http.Error(w, responseMessage, http.StatusConflict)
-		return
+		handler.LoggedUsers.Unlock()
+		handler.releaseSession(userLoginRequest.Username, token)
+		return model.User{}, alreadyLoggedIn
 	}
-
-	// Generate a random UUID for the user
-	token := uuid.NewString()
 	// Add the user to the logged users
-	handler.LoggedUsers.Users[userLoginRequest.Username] = model.User{
+	user := model.User{
 		Username: userLoginRequest.Username,
 		Token:    token,
+		Role:     role,
+		IP:       ip,
 	}
+	handler.addUserLocked(user)
+	handler.LoggedUsers.Unlock()
 
-	// If everything is ok, finally return the token
-	log.Printf("User %s logged in with token %s", userLoginRequest.Username, token)
-	json.NewEncoder(w).Encode(model.UserLoginResponse{Token: token})
+	log.Printf("User %s logged in as %s", userLoginRequest.Username, role)
+	handler.audit(model.AuditEvent{Action: model.AuditActionLogin, Actor: userLoginRequest.Username, IP: ip, Details: string(role)})
+	return user, nil
 }
 
 // logout is a handler function that logs out a user. It receives a POST request with a JSON body containing the username and the token of the user.
@@ -97,73 +195,100 @@ func (handler *Handler) login(w http.ResponseWriter, r *http.Request) {
 // If everything is ok, it returns a message saying that the user was successfully logged out.
 func (handler *Handler) logout(w http.ResponseWriter, r *http.Request) {
 	// Only allow POST requests
-	if r.Method != "POST" {
-		responseMessage := "Invalid request method"
-		log.Printf("%s: %s", responseMessage, r.Method)
-		http.Error(w, responseMessage, http.StatusMethodNotAllowed)
-		return
-	}
-	// request body can't be nil
-	if r.Body == nil {
-		responseMessage := "Request body missing"
-		log.Print(responseMessage)
-		http.Error(w, responseMessage, http.StatusBadRequest)
+	if !allowMethod(w, r, http.MethodPost) {
 		return
 	}
 
 	// Parse the request body to get the user data
 	var userLogoutRequest model.UserWithTokenRequest
-	err := json.NewDecoder(r.Body).Decode(&userLogoutRequest)
-	if err != nil {
-		responseMessage := "Can't decode body"
-		log.Printf("%s: %v", responseMessage, err)
-		http.Error(w, "Can't decode body", http.StatusBadRequest)
+	if !decodeRequest(w, r, &userLogoutRequest) {
 		return
 	}
 
 	// Check if the user is not logged in, in which case return an error
 	// Aquire lock in write mode
 	handler.LoggedUsers.Lock()
-	defer handler.LoggedUsers.Unlock()
 	if _, ok := handler.LoggedUsers.Users[userLogoutRequest.Username]; !ok {
+		handler.LoggedUsers.Unlock()
+		// The user may be logged in to another node, whose session is only released if it has the token
+		if userLogoutRequest.Token != "" && handler.releaseSession(userLogoutRequest.Username, userLogoutRequest.Token) {
+			log.Printf("User %s successfully logged out from another node", userLogoutRequest.Username)
+			handler.audit(model.AuditEvent{Action: model.AuditActionLogout, Actor: userLogoutRequest.Username, IP: remoteIP(r.RemoteAddr)})
+			writeJSON(w, http.StatusOK, model.UserLogoutResponse{Message: "User successfully logged out"})
+			return
+		}
 		responseMessage := fmt.Sprintf("User %s is not logged in", userLogoutRequest.Username)
-		log.Print(responseMessage)
-		http.Error(w, responseMessage, http.StatusConflict)
+		handler.audit(model.AuditEvent{Action: model.AuditActionTokenRejected, Target: userLogoutRequest.Username, IP: remoteIP(r.RemoteAddr), Details: "logout: not logged in"})
+		writeError(w, http.StatusUnauthorized, model.ErrorCodeNotLoggedIn, responseMessage, "")
 		return
 	}
 
 	// In case the user is logged in, check if the token is correct
 	if handler.LoggedUsers.Users[userLogoutRequest.Username].Token != userLogoutRequest.Token {
-		responseMessage := "Invalid token"
-		log.Print(responseMessage)
-		http.Error(w, responseMessage, http.StatusConflict)
+		handler.LoggedUsers.Unlock()
+		handler.audit(model.AuditEvent{Action: model.AuditActionTokenRejected, Target: userLogoutRequest.Username, IP: remoteIP(r.RemoteAddr), Details: "logout: invalid token"})
+		writeError(w, http.StatusUnauthorized, model.ErrorCodeInvalidToken, "Invalid token", "")
 		return
 	}
 
 	// Remove the user from the logged users, closing the channel if it exists
-	CleanupUserData(handler, userLogoutRequest)
+	cleanup := CleanupUserData(handler, userLogoutRequest)
+	handler.LoggedUsers.Unlock()
+	handler.finishCleanup(cleanup)
+	handler.releaseSession(userLogoutRequest.Username, cleanup.token)
 
 	// If everything is ok, finally return the token
 	log.Printf("User %s successfully logged out", userLogoutRequest.Username)
-	json.NewEncoder(w).Encode(model.UserLogoutResponse{Message: "User successfully logged out"})
+	handler.audit(model.AuditEvent{Action: model.AuditActionLogout, Actor: userLogoutRequest.Username, IP: remoteIP(r.RemoteAddr)})
+	writeJSON(w, http.StatusOK, model.UserLogoutResponse{Message: "User successfully logged out"})
+}
+
+// userCleanup is the part of the removal of a user from this node done by finishCleanup once the LoggedUsers lock
+// is released, since it publishes to the broker, and the token whose session the caller ends with releaseSession.
+type userCleanup struct {
+	username string
+	token    string
+	// left are the rooms the user left, deleted the rooms deleted because the user was their last member
+	left    []string
+	deleted []string
 }
 
-// CleanupUserData removes the user from the logged users, closing the channel if it exists.
+// CleanupUserData removes the user from the logged users and from its rooms, closing the channel if it exists.
+// The caller completes the removal with finishCleanup, and ends the session of the user on every node with
+// releaseSession, once it releases the lock, so the broker and the registry aren't called holding it.
 // This function assumes that the LoggedUsers lock is already acquired by the caller.
-func CleanupUserData(handler *Handler, userLogoutRequest model.UserWithTokenRequest) {
+func CleanupUserData(handler *Handler, userLogoutRequest model.UserWithTokenRequest) userCleanup {
+	cleanup := userCleanup{
+		username: userLogoutRequest.Username,
+		token:    handler.LoggedUsers.Users[userLogoutRequest.Username].Token,
+	}
+	handler.dropPoll(cleanup.token)
 	DisconnectChannel(handler, userLogoutRequest)
-	delete(handler.LoggedUsers.Users, userLogoutRequest.Username)
+	cleanup.left, cleanup.deleted = handler.removeUserFromRooms(userLogoutRequest.Username)
+	handler.removeUserLocked(userLogoutRequest.Username)
 	log.Println("User removed from the logged users")
+	return cleanup
+}
+
+// finishCleanup notifies the members of the rooms of the user connected to other nodes, and the webhooks of the rooms,
+// that it left them, and cancels the subscriptions of the node to the user and to the rooms deleted.
+func (handler *Handler) finishCleanup(cleanup userCleanup) {
+	for _, roomName := range cleanup.left {
+		left := newEvent(model.StreamEventLeft, roomName, cleanup.username, "")
+		handler.relay(roomTopic(roomName), left)
+		handler.notifyWebhooks(roomName, left)
+	}
+	handler.unsubscribeUser(cleanup.username)
+	for _, roomName := range cleanup.deleted {
+		handler.unsubscribeRoom(roomName)
+	}
 }
 
 // DisconnectChannel closes the channel of the user if it exists.
 func DisconnectChannel(handler *Handler, userLogoutRequest model.UserWithTokenRequest) {
-	userToLogout := handler.LoggedUsers.Users[userLogoutRequest.Username]
-	if userToLogout.Channel != nil {
-		close(userToLogout.Channel)
+	if handler.connections.unbind(userLogoutRequest.Username, nil) {
 		log.Printf("Channel for user %s closed", userLogoutRequest.Username)
 	}
-	handler.LoggedUsers.Users[userLogoutRequest.Username] = userToLogout
 }
 
 // stream is a handler function that streams messages to the user.
@@ -171,68 +296,44 @@ func DisconnectChannel(handler *Handler, userLogoutRequest model.UserWithTokenRe
 // If the user is not logged in or the token is incorrect, it returns an error.
 // If everything is ok, it starts a goroutine to send messages to the user and handles the rest of the messages in a loop.
 func (handler *Handler) stream(w http.ResponseWriter, r *http.Request) {
+	// Only allow GET requests, as required by the websocket handshake
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
 	websocket, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		// The upgrader already replied to the client with an HTTP error
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer websocket.Close()
+	// Frames larger than a request body are refused before they're read into memory, closing the connection
+	websocket.SetReadLimit(maxRequestBodyBytes)
 
 	// Manage first message which should be the username and token to validate the user
 	// read a message
-	messageType, messageContent, err := websocket.ReadMessage()
+	messageType, messageContent, err := readWebsocketMessage(websocket)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// Parse the request body to get the user data
 	var userWithTokenRequest model.UserWithTokenRequest
-	if err := json.Unmarshal(messageContent, &userWithTokenRequest); err != nil {
-		responseMessage := fmt.Sprintf("%s: %v", "Can't decode body", err)
-		log.Println(responseMessage)
-		http.Error(w, responseMessage, http.StatusBadRequest)
-
-		if err := websocket.WriteMessage(messageType, []byte(responseMessage)); err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if err := decodeWebsocketMessage(messageContent, &userWithTokenRequest); err != nil {
+		writeWebsocketError(websocket, messageType, model.ErrorCodeInvalidBody, "Can't decode body", err.Error())
 		return
 	}
 
 	// Check if the provided username and token are valid
 	// In case the currentUser is logged in and the token is correct, create a channel and add it to the logged users map.
-	// Should return true if the user is not logged in or the token is incorrect, and false otherwise.
-	if err := BindChannelToUserIfExists(handler, userWithTokenRequest, websocket, messageType); err != nil {
-		http.Error(w, err.Error(), http.StatusConflict)
+	channel, err := BindChannelToUserIfExists(handler, userWithTokenRequest, websocket, messageType)
+	if err != nil {
 		return
 	}
 
-	// Start a goroutine to send messages to the user from the channel
-	go func() {
-		// TODO this function should be refactored to handle the case when the user is disconnected
-		//  and the channel is closed. In that case, the goroutine should end.
-		//  This can be done by checking if the channel is closed, and if it is, break the loop.
-		defer websocket.Close()
-		defer log.Printf("Websocket connection closed for user %s", userWithTokenRequest.Username)
-		for {
-			// Check if the channel is closed
-			// Read the message from the channel and send it to the user
-			if message, ok := <-handler.LoggedUsers.Users[userWithTokenRequest.Username].Channel; !ok {
-				break
-			} else {
-				if err := websocket.WriteMessage(messageType, message); err != nil {
-					log.Println(err)
-					break
-				}
-			}
-		}
-	}()
-
-	// Send a welcome message to the user
+	// Send a welcome message to the user, before the writer goroutine starts using the connection
 	welcomeMessage := model.WebsocketWelcomeResponse{
 		Welcome: userWithTokenRequest.Username,
 	}
@@ -240,81 +341,293 @@ func (handler *Handler) stream(w http.ResponseWriter, r *http.Request) {
 	msg, err := json.Marshal(welcomeMessage)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	// Send the welcome message to the user
-	if err := websocket.WriteMessage(messageType, msg); err != nil {
+	if err := writeWebsocketMessage(websocket, messageType, msg); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Handle the rest of the messages in a loop, until the connection is closed
-	handler.listenForMessages(websocket)
+	// Start a goroutine to send messages to the user from the channel.
+	// The goroutine ends when the channel is closed, either on logout or when the user reconnects.
+	go func() {
+		defer websocket.Close()
+		defer log.Printf("Websocket connection closed for user %s", userWithTokenRequest.Username)
+		for message := range channel {
+			if err := writeWebsocketMessage(websocket, messageType, message); err != nil {
+				log.Println(err)
+				break
+			}
+		}
+	}()
+
+	// Receive the events sent to the user from other nodes, then rejoin the rooms the user was a member of in previous sessions
+	handler.subscribeUser(userWithTokenRequest.Username)
+	handler.rejoinRooms(userWithTokenRequest.Username)
+
+	// Handle the rest of the messages in a loop, until the connection is closed.
+	// The user may have been renamed meanwhile, so the loop returns its current username.
+	username := handler.listenForMessages(websocket, channel, userWithTokenRequest.Username)
 
 	// Remove the user from the logged users, closing the channel if it exists
-	handler.LoggedUsers.Lock()
-	defer handler.LoggedUsers.Unlock()
-	CleanupUserData(handler, userWithTokenRequest)
+	handler.disconnectStream(username, channel)
 }
 
 // BindChannelToUserIfExists checks if the user is logged in and if the token is correct.
-// If the user is logged in and the token is correct, it creates a channel for the user and adds it to the logged users map.
-// It returns error if the user is not logged in or the token is incorrect, and nil otherwise.
-func BindChannelToUserIfExists(handler *Handler, userWithTokenRequest model.UserWithTokenRequest, websocket *websocket.Conn, messageType int) error {
-	handler.LoggedUsers.Lock()
-	defer handler.LoggedUsers.Unlock()
-	if _, ok := handler.LoggedUsers.Users[userWithTokenRequest.Username]; !ok {
-		responseMessage := fmt.Sprintf("User %s is not logged in", userWithTokenRequest.Username)
-		log.Println(responseMessage)
-
-		if err := websocket.WriteMessage(messageType, []byte(responseMessage)); err != nil {
-			log.Println(err)
-			return err
+// If the user is logged in and the token is correct, it creates a channel for the user and adds it to the connection registry,
+// closing the channel of a previous connection of the same user.
+// It returns error if the user is not logged in or the token is incorrect, after sending the error through the websocket,
+// and the new channel otherwise.
+func BindChannelToUserIfExists(handler *Handler, userWithTokenRequest model.UserWithTokenRequest, websocket *websocket.Conn, messageType int) (chan []byte, error) {
+	channel, err := handler.bindChannel(userWithTokenRequest, remoteIP(websocket.RemoteAddr().String()), "stream")
+	var rejected *handshakeError
+	if errors.As(err, &rejected) {
+		if err := writeWebsocketError(websocket, messageType, rejected.code, rejected.message, rejected.details); err != nil {
+			return nil, err
 		}
-		return errors.New(responseMessage)
+	}
+	return channel, err
+}
+
+// handshakeError is the reason a user can't log in or connect to the stream, whatever the transport.
+type handshakeError struct {
+	code    string
+	message string
+	details string
+}
+
+func (err *handshakeError) Error() string {
+	return err.message
+}
+
+// bindChannel checks that the user is logged in with the token and isn't banned, and binds a new channel
+// to the user in the connection registry, closing the channel of a previous connection of the same user.
+// Every transport of the stream connects through it, transport names it in the audit trail.
+// It returns a *handshakeError if the user can't connect.
+//
+// Handshakes only hold the LoggedUsers lock in read mode, unless the session was started on another node,
+// so handshakes of different users don't wait for each other.
+func (handler *Handler) bindChannel(userWithTokenRequest model.UserWithTokenRequest, ip string, transport string) (chan []byte, error) {
+	// The user may have logged in through another node
+	handler.LoggedUsers.RLock()
+	user, ok := handler.LoggedUsers.Users[userWithTokenRequest.Username]
+	handler.LoggedUsers.RUnlock()
+	if (!ok || user.Token != userWithTokenRequest.Token) && handler.Sessions != nil {
+		handler.adoptSession(userWithTokenRequest.Username, userWithTokenRequest.Token, ip)
+	}
+
+	// Holding the lock in read mode prevents the user from logging out before its channel is bound
+	handler.LoggedUsers.RLock()
+	defer handler.LoggedUsers.RUnlock()
+	if _, ok := handler.LoggedUsers.Users[userWithTokenRequest.Username]; !ok {
+		handler.audit(model.AuditEvent{Action: model.AuditActionTokenRejected, Target: userWithTokenRequest.Username, IP: ip, Details: transport + ": not logged in"})
+		return nil, &handshakeError{code: model.ErrorCodeNotLoggedIn, message: fmt.Sprintf("User %s is not logged in", userWithTokenRequest.Username)}
 	}
 
 	if handler.LoggedUsers.Users[userWithTokenRequest.Username].Token != userWithTokenRequest.Token {
-		responseMessage := fmt.Sprintf("Invalid token '%s' for user %s", userWithTokenRequest.Token, userWithTokenRequest.Username)
-		log.Println(responseMessage)
+		handler.audit(model.AuditEvent{Action: model.AuditActionTokenRejected, Target: userWithTokenRequest.Username, IP: ip, Details: transport + ": invalid token"})
+		return nil, &handshakeError{code: model.ErrorCodeInvalidToken, message: fmt.Sprintf("Invalid token for user %s", userWithTokenRequest.Username)}
+	}
 
-		if err := websocket.WriteMessage(messageType, []byte(responseMessage)); err != nil {
-			log.Println(err)
-			return err
-		}
-		return errors.New(responseMessage)
+	// A ban issued after the login also prevents connecting to the stream
+	if ban, ok := handler.activeBan(userWithTokenRequest.Username, ip); ok {
+		responseMessage, details := banMessage(userWithTokenRequest.Username, ban)
+		handler.audit(model.AuditEvent{Action: model.AuditActionLoginFailed, Target: userWithTokenRequest.Username, IP: ip, Details: transport + ": banned"})
+		return nil, &handshakeError{code: model.ErrorCodeBanned, message: responseMessage, details: details}
 	}
 
-	currentUser := handler.LoggedUsers.Users[userWithTokenRequest.Username]
-	currentUser.Channel = make(chan []byte)
-	handler.LoggedUsers.Users[userWithTokenRequest.Username] = currentUser
-	log.Printf("User %s is now connected to the stream", userWithTokenRequest.Username)
-	return nil
+	// Binding the channel closes the channel of a previous connection, which ends its writer goroutine
+	channel := make(chan []byte, userChannelBufferSize)
+	handler.connections.bind(userWithTokenRequest.Username, channel)
+	log.Printf("User %s is now connected to the stream through /%s", userWithTokenRequest.Username, transport)
+	return channel, nil
+}
+
+// disconnectStream removes the user from the logged users when its connection to the stream ends,
+// closing the channel if it exists. If the user logged out or reconnected with another connection,
+// the channel is no longer bound to the user and there's nothing to clean up.
+// The user may have been renamed meanwhile, so the channel is looked up by its username and then by itself.
+func (handler *Handler) disconnectStream(username string, channel chan []byte) {
+	handler.LoggedUsers.Lock()
+	username = handler.boundUsername(username, channel)
+	if handler.connections.channel(username) != channel {
+		handler.LoggedUsers.Unlock()
+		return
+	}
+	cleanup := CleanupUserData(handler, model.UserWithTokenRequest{Username: username})
+	handler.LoggedUsers.Unlock()
+	handler.finishCleanup(cleanup)
+	handler.releaseSession(username, cleanup.token)
 }
 
 // listenForMessages is a helper function that listens for messages from the user and parses them.
-func (handler *Handler) listenForMessages(conn *websocket.Conn) {
+// Every frame must be a model.StreamRequest, frames that can't be processed are answered with an error event.
+// It returns the username the channel is bound to when the connection is closed, which changes if the user is renamed.
+func (handler *Handler) listenForMessages(conn *websocket.Conn, channel chan []byte, username string) string {
 	for {
 		// read a message
-		messageType, messageContent, err := conn.ReadMessage()
+		_, messageContent, err := readWebsocketMessage(conn)
 		if err != nil {
 			log.Println(err)
 			break
 		}
 
-		// print out that message
-		fmt.Println(string(messageContent))
+		var streamRequest model.StreamRequest
+		if err := decodeWebsocketMessage(messageContent, &streamRequest); err != nil {
+			log.Printf("Can't decode message from user %s: %v", username, err)
+			handler.sendEvent(username, newErrorEvent("", model.ErrorCodeInvalidBody, "Can't decode message"))
+			continue
+		}
 
-		// reponse message
-		messageResponse := fmt.Sprintf("Your message is: %s", messageContent)
+		if err := handler.handleStreamRequest(username, streamRequest); err != nil {
+			log.Printf("Request %s from user %s failed: %v", streamRequest.Type, username, err)
+			handler.sendEvent(username, newErrorEvent(streamRequest.Room, streamErrorCode(err), err.Error()))
+		}
+		username = handler.boundUsername(username, channel)
+	}
+	return username
+}
 
-		if err := conn.WriteMessage(messageType, []byte(messageResponse)); err != nil {
-			log.Println(err)
-			break
+// boundUsername returns the username of the user the channel is bound to, which is the given one
+// unless the user was renamed. If the channel is no longer bound to any user, it returns the given username.
+func (handler *Handler) boundUsername(username string, channel chan []byte) string {
+	if handler.connections.channel(username) == channel {
+		return username
+	}
+	if bound, ok := handler.connections.boundTo(channel); ok {
+		return bound
+	}
+	return username
+}
+
+// renameUser changes the username of a logged in user, keeping its session, its stream and its rooms,
+// and notifies the members of its rooms. The whole rename is done holding the LoggedUsers lock,
+// so no other request sees the user under both names or under none. The registry is only called
+// without holding it.
+func (handler *Handler) renameUser(actor principal, nickname string) error {
+	nickname = strings.TrimSpace(nickname)
+	if !validUsername(nickname) {
+		return newStreamError(model.ErrorCodeInvalidUsername, "Invalid username")
+	}
+	username := actor.Username
+	if nickname == username {
+		return nil
+	}
+	// Privileged users are identified by their username, so they can't be renamed and nobody can take their names
+	if _, ok := handler.PrivilegedUsers[username]; ok {
+		return newStreamError(model.ErrorCodeForbidden, fmt.Sprintf("User %s can't be renamed", username))
+	}
+	if _, ok := handler.PrivilegedUsers[nickname]; ok || handler.botName(nickname) {
+		return newStreamError(model.ErrorCodeNicknameTaken, fmt.Sprintf("Nickname %s is reserved", nickname))
+	}
+	if ban, ok := handler.activeBan(nickname, ""); ok {
+		responseMessage, _ := banMessage(nickname, ban)
+		return newStreamError(model.ErrorCodeBanned, responseMessage)
+	}
+
+	// The session moves to the nickname, which may be in use on another node.
+	// The nickname is claimed before acquiring the lock, so a slow registry doesn't delay other requests.
+	handler.LoggedUsers.RLock()
+	user, ok := handler.LoggedUsers.Users[username]
+	_, taken := handler.LoggedUsers.Users[nickname]
+	handler.LoggedUsers.RUnlock()
+	if !ok {
+		return newStreamError(model.ErrorCodeNotLoggedIn, fmt.Sprintf("User %s is not logged in", username))
+	}
+	nicknameTaken := newStreamError(model.ErrorCodeNicknameTaken, fmt.Sprintf("Nickname %s is already in use", nickname))
+	if taken {
+		return nicknameTaken
+	}
+	if err := handler.claimSession(nickname, user.Token); err != nil {
+		if errors.Is(err, ErrSessionExists) {
+			return nicknameTaken
+		}
+		return err
+	}
+
+	// The user may have logged out, or another user taken the nickname, while claiming it
+	handler.LoggedUsers.Lock()
+	if current, ok := handler.LoggedUsers.Users[username]; !ok || current.Token != user.Token {
+		handler.LoggedUsers.Unlock()
+		handler.releaseSession(nickname, user.Token)
+		return newStreamError(model.ErrorCodeNotLoggedIn, fmt.Sprintf("User %s is not logged in", username))
+	}
+	if _, ok := handler.LoggedUsers.Users[nickname]; ok {
+		handler.LoggedUsers.Unlock()
+		handler.releaseSession(nickname, user.Token)
+		return nicknameTaken
+	}
+	user = handler.LoggedUsers.Users[username]
+	user.Username = nickname
+	handler.removeUserLocked(username)
+	handler.addUserLocked(user)
+	handler.connections.rename(username, nickname)
+	rooms := handler.renameRoomMember(username, nickname)
+	handler.renameMemberships(username, nickname)
+
+	log.Printf("User %s renamed to %s", username, nickname)
+	handler.audit(model.AuditEvent{Action: model.AuditActionRename, Actor: username, Target: nickname, IP: user.IP})
+
+	renamed := newEvent(model.StreamEventRenamed, "", username, "")
+	renamed.NewName = nickname
+	if len(rooms) == 0 {
+		handler.broadcast([]string{nickname}, renamed)
+	}
+	for roomName, recipients := range rooms {
+		renamed.Room = roomName
+		handler.broadcast(recipients, renamed)
+	}
+	handler.LoggedUsers.Unlock()
+
+	// The other nodes are notified once the lock is released, since the broker may wait on the network
+	for roomName := range rooms {
+		renamed.Room = roomName
+		handler.relay(roomTopic(roomName), renamed)
+	}
+	handler.releaseSession(username, user.Token)
+	handler.unsubscribeUser(username)
+	handler.subscribeUser(nickname)
+	return nil
+}
+
+// handleStreamRequest dispatches a frame received from the user to the matching room operation.
+// Every operation is checked by authorize against the current role of the user.
+func (handler *Handler) handleStreamRequest(username string, streamRequest model.StreamRequest) error {
+	actor := handler.principalOf(username)
+	switch streamRequest.Type {
+	case model.StreamRequestJoin:
+		return handler.joinRoom(actor, streamRequest.Room, streamRequest.Code)
+	case model.StreamRequestLeave:
+		return handler.leaveRoom(actor, streamRequest.Room)
+	case model.StreamRequestMessage:
+		return handler.sendMessage(actor, streamRequest.Room, streamRequest.Text)
+	case model.StreamRequestSetRole:
+		return handler.setRoomRole(actor, streamRequest.Room, streamRequest.User, streamRequest.Role)
+	case model.StreamRequestKick:
+		return handler.kickUser(actor, streamRequest.Room, streamRequest.User, streamRequest.Text)
+	case model.StreamRequestMute:
+		return handler.muteUser(actor, streamRequest.Room, streamRequest.User, streamRequest.Duration, streamRequest.Text)
+	case model.StreamRequestUnmute:
+		return handler.unmuteUser(actor, streamRequest.Room, streamRequest.User)
+	case model.StreamRequestUpdateRoom:
+		if streamRequest.Update == nil {
+			return newStreamError(model.ErrorCodeInvalidBody, "Missing room update")
 		}
+		return handler.updateRoom(actor, streamRequest.Room, *streamRequest.Update)
+	case model.StreamRequestInvite:
+		return handler.inviteUser(actor, streamRequest.Room, streamRequest.User)
+	case model.StreamRequestCreateInvite:
+		return handler.createInvite(actor, streamRequest.Room, streamRequest.Duration, streamRequest.MaxUses)
+	case model.StreamRequestMembers:
+		return handler.listMembers(actor, streamRequest.Room)
+	case model.StreamRequestMarkRead:
+		return handler.markRoomRead(actor, streamRequest.Room, streamRequest.MessageID)
+	case model.StreamRequestBan:
+		_, err := handler.banUser(actor, model.BanRequest{Username: streamRequest.User, Duration: streamRequest.Duration, Reason: streamRequest.Text})
+		return err
 	}
+	return newStreamError(model.ErrorCodeUnknownRequest, fmt.Sprintf("Unknown request type '%s'", streamRequest.Type))
 }
 
 // homepage is a handler function that returns a welcome message to the user.
@@ -322,30 +635,103 @@ func homepage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Welcome to the homepage!")
 }
 
-// HandleRequests is the main function of the routes package. It sets up the routes for the server.
-func HandleRequests() {
+// HandleRequests is the main function of the routes package. It sets up the routes for the server
+// and serves them until the server fails, closing the audit and membership files and the Redis connections before returning the error.
+func HandleRequests() error {
 	// Initialize shared state
-	handler := Handler{
-		LoggedUsers: model.LoggedUsers{
-			Users: make(model.Users),
-		},
+	handler := NewHandler()
+	handler.AdminToken = os.Getenv("CHAT_ADMIN_TOKEN")
+	if handler.AdminToken == "" {
+		log.Println("CHAT_ADMIN_TOKEN is not set, the admin API is only available to admin users")
+	}
+	// Privileged users are configured as comma separated username:secret pairs
+	handler.PrivilegedUsers = make(map[string]model.PrivilegedUser)
+	if err := ParsePrivilegedUsers(os.Getenv("CHAT_ADMINS"), model.RoleAdmin, handler.PrivilegedUsers); err != nil {
+		return fmt.Errorf("invalid CHAT_ADMINS: %w", err)
+	}
+	if err := ParsePrivilegedUsers(os.Getenv("CHAT_MODERATORS"), model.RoleModerator, handler.PrivilegedUsers); err != nil {
+		return fmt.Errorf("invalid CHAT_MODERATORS: %w", err)
+	}
+	// Banned words are masked in every room that doesn't configure its own filters
+	if words := os.Getenv("CHAT_BANNED_WORDS"); words != "" {
+		handler.Filters.Default.Wordlist = strings.Split(words, ",")
+	}
+	// Webhooks can only target public addresses, unless private ones are allowed for webhooks running next to the server
+	if os.Getenv("CHAT_WEBHOOK_ALLOW_PRIVATE") != "" {
+		handler.deliveries.client = newWebhookClient(true)
 	}
+	// The audit trail is kept in memory unless a file is configured
+	if path := os.Getenv("CHAT_AUDIT_FILE"); path != "" {
+		sink, err := NewFileAuditSink(path)
+		if err != nil {
+			return fmt.Errorf("can't open the audit file: %w", err)
+		}
+		defer sink.Close()
+		handler.Audit = sink
+	}
+	// Memberships are kept in memory unless a file is configured
+	if path := os.Getenv("CHAT_MEMBERSHIP_FILE"); path != "" {
+		store, err := NewFileMembershipStore(path)
+		if err != nil {
+			return fmt.Errorf("can't open the membership file: %w", err)
+		}
+		defer store.Close()
+		handler.Memberships = store
+	}
+	// Nodes sharing a Redis server relay their events to each other
+	if nodeID := os.Getenv("CHAT_NODE_ID"); nodeID != "" {
+		handler.NodeID = nodeID
+	}
+	if addr := os.Getenv("CHAT_REDIS_ADDR"); addr != "" {
+		broker, err := NewRedisBroker(addr)
+		if err != nil {
+			return fmt.Errorf("can't connect to Redis: %w", err)
+		}
+		defer broker.Close()
+		handler.Broker = broker
+		log.Printf("Node %s relaying events through Redis at %s", handler.NodeID, addr)
 
-	// Enable CORS
+		sessions, err := NewRedisSessionRegistry(addr)
+		if err != nil {
+			return fmt.Errorf("can't connect to Redis: %w", err)
+		}
+		defer sessions.Close()
+		handler.Sessions = sessions
+		go handler.keepSessionsAlive(sessionRefreshInterval)
+	}
+	// IRC clients can connect to the rooms if a listen address is configured
+	if addr := os.Getenv("CHAT_IRC_ADDR"); addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("can't start the IRC gateway: %w", err)
+		}
+		defer listener.Close()
+		log.Printf("IRC gateway listening on %s", addr)
+		go func() {
+			log.Printf("IRC gateway stopped: %v", handler.ServeIRC(listener))
+		}()
+	}
+
+	// Start server
+	log.Println("Starting server...")
+	return http.ListenAndServe(":8080", withCORS(handler.NewServeMux()))
+}
+
+// withCORS wraps the handler to answer the CORS preflight requests of browsers, for every method used by the routes.
+func withCORS(next http.Handler) http.Handler {
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{
+			http.MethodGet,
+			http.MethodHead,
+			http.MethodPost,
+			http.MethodPut,
+			http.MethodDelete,
+		},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: true,
 		// Enable Debugging for testing, consider disabling in production
 		Debug: false,
 	})
-
-	// Start server
-	log.Println("Starting server...")
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", homepage)
-	mux.HandleFunc("/login", handler.login)
-	mux.HandleFunc("/logout", handler.logout)
-	mux.HandleFunc("/stream", handler.stream)
-	log.Fatal(http.ListenAndServe(":8080", c.Handler(mux)))
+	return c.Handler(next)
 }
@@ -6,8 +6,10 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/DaniSancas/go-chat-room/server/internal/msgpack"
 	"github.com/gorilla/websocket"
 )
 
@@ -66,12 +68,7 @@ func TestLoginRequestInvalidRequestMethod(t *testing.T) {
 					status, http.StatusMethodNotAllowed)
 			}
 
-			expected := "Invalid request method"
-			received := strings.TrimSpace(rr.Body.String())
-			if received != expected {
-				t.Errorf("handler returned unexpected body: got %v want %v",
-					received, expected)
-			}
+			assertErrorResponse(t, rr, model.ErrorCodeMethodNotAllowed, "Invalid request method")
 
 			handlerFixture.LoggedUsers.RLock()
 			defer handlerFixture.LoggedUsers.RUnlock()
@@ -103,12 +100,7 @@ func TestLoginRequestBodyMissing(t *testing.T) {
 			status, http.StatusBadRequest)
 	}
 
-	expected := "Request body missing"
-	received := strings.TrimSpace(rr.Body.String())
-	if received != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			received, expected)
-	}
+	assertErrorResponse(t, rr, model.ErrorCodeBodyMissing, "Request body missing")
 
 	handlerFixture.LoggedUsers.RLock()
 	defer handlerFixture.LoggedUsers.RUnlock()
@@ -138,12 +130,7 @@ func TestLoginRequestCanNotDecodeBody(t *testing.T) {
 			status, http.StatusBadRequest)
 	}
 
-	expected := "Can't decode body"
-	received := strings.TrimSpace(rr.Body.String())
-	if received != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			received, expected)
-	}
+	assertErrorResponse(t, rr, model.ErrorCodeInvalidBody, "Can't decode body")
 
 	handlerFixture.LoggedUsers.RLock()
 	defer handlerFixture.LoggedUsers.RUnlock()
@@ -218,12 +205,7 @@ func TestLoginUserAlreadyLoggedIn(t *testing.T) {
 			status, http.StatusConflict)
 	}
 
-	expected := "User user is already logged in"
-	received := strings.TrimSpace(rr.Body.String())
-	if received != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			received, expected)
-	}
+	assertErrorResponse(t, rr, model.ErrorCodeAlreadyLoggedIn, "User user is already logged in")
 
 	handlerFixture.LoggedUsers.RLock()
 	defer handlerFixture.LoggedUsers.RUnlock()
@@ -268,12 +250,7 @@ func TestLogoutRequestInvalidRequestMethod(t *testing.T) {
 					status, http.StatusMethodNotAllowed)
 			}
 
-			expected := "Invalid request method"
-			received := strings.TrimSpace(rr.Body.String())
-			if received != expected {
-				t.Errorf("handler returned unexpected body: got %v want %v",
-					received, expected)
-			}
+			assertErrorResponse(t, rr, model.ErrorCodeMethodNotAllowed, "Invalid request method")
 
 			handlerFixture.LoggedUsers.RLock()
 			defer handlerFixture.LoggedUsers.RUnlock()
@@ -305,12 +282,7 @@ func TestLogoutRequestBodyMissing(t *testing.T) {
 			status, http.StatusBadRequest)
 	}
 
-	expected := "Request body missing"
-	received := strings.TrimSpace(rr.Body.String())
-	if received != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			received, expected)
-	}
+	assertErrorResponse(t, rr, model.ErrorCodeBodyMissing, "Request body missing")
 
 	handlerFixture.LoggedUsers.RLock()
 	defer handlerFixture.LoggedUsers.RUnlock()
@@ -340,12 +312,7 @@ func TestLogoutRequestCanNotDecodeBody(t *testing.T) {
 			status, http.StatusBadRequest)
 	}
 
-	expected := "Can't decode body"
-	received := strings.TrimSpace(rr.Body.String())
-	if received != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			received, expected)
-	}
+	assertErrorResponse(t, rr, model.ErrorCodeInvalidBody, "Can't decode body")
 
 	handlerFixture.LoggedUsers.RLock()
 	defer handlerFixture.LoggedUsers.RUnlock()
@@ -371,17 +338,12 @@ func TestLogoutUserNotLoggedIn(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusConflict {
+	if status := rr.Code; status != http.StatusUnauthorized {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusConflict)
+			status, http.StatusUnauthorized)
 	}
 
-	expected := "User user is not logged in"
-	received := strings.TrimSpace(rr.Body.String())
-	if received != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			received, expected)
-	}
+	assertErrorResponse(t, rr, model.ErrorCodeNotLoggedIn, "User user is not logged in")
 
 	handlerFixture.LoggedUsers.RLock()
 	defer handlerFixture.LoggedUsers.RUnlock()
@@ -455,17 +417,12 @@ func TestLogoutInvalidToken(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusConflict {
+	if status := rr.Code; status != http.StatusUnauthorized {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusConflict)
+			status, http.StatusUnauthorized)
 	}
 
-	expected := "Invalid token"
-	received := strings.TrimSpace(rr.Body.String())
-	if received != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			received, expected)
-	}
+	assertErrorResponse(t, rr, model.ErrorCodeInvalidToken, "Invalid token")
 
 	handlerFixture.LoggedUsers.RLock()
 	defer handlerFixture.LoggedUsers.RUnlock()
@@ -532,9 +489,297 @@ func TestWebsocketConnection(t *testing.T) {
 	}
 
 	// Evaluate if the logged user has a channel created after the first message is sent
+	if handlerFixture.connections.channel("user") == nil {
+		t.Errorf("User should have a channel created")
+	}
+}
+
+func TestLoginInvalidUsername(t *testing.T) {
+	req, err := http.NewRequest("POST", "/login", strings.NewReader(`{"username": "  "}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handlerFixture := Handler{
+		LoggedUsers: model.LoggedUsers{
+			Users: make(model.Users),
+		},
+	}
+	handler := http.HandlerFunc(handlerFixture.login)
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+
+	assertErrorResponse(t, rr, model.ErrorCodeInvalidUsername, "Invalid username")
+
 	handlerFixture.LoggedUsers.RLock()
 	defer handlerFixture.LoggedUsers.RUnlock()
-	if handlerFixture.LoggedUsers.Users["user"].Channel == nil {
-		t.Errorf("User should have a channel created")
+	if len(handlerFixture.LoggedUsers.Users) != 0 {
+		t.Errorf("The list of logged users should be empty")
+	}
+}
+
+func TestLoginRequestStrictDecoding(t *testing.T) {
+	var tests = []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"unknown field", `{"username": "user", "admin": true}`, http.StatusBadRequest, model.ErrorCodeInvalidBody},
+		{"trailing data", `{"username": "user"} {"username": "other"}`, http.StatusBadRequest, model.ErrorCodeInvalidBody},
+		{"empty body", ``, http.StatusBadRequest, model.ErrorCodeBodyMissing},
+		{"too large", `{"username": "` + strings.Repeat("a", maxRequestBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, model.ErrorCodeBodyTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/login", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handlerFixture := Handler{
+				LoggedUsers: model.LoggedUsers{
+					Users: make(model.Users),
+				},
+			}
+			handler := http.HandlerFunc(handlerFixture.login)
+
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, tt.status)
+			}
+
+			var errorResponse model.ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &errorResponse); err != nil {
+				t.Fatalf("Failed to unmarshal error response: %v", err)
+			}
+			if errorResponse.Code != tt.code {
+				t.Errorf("handler returned unexpected error code: got %v want %v",
+					errorResponse.Code, tt.code)
+			}
+
+			handlerFixture.LoggedUsers.RLock()
+			defer handlerFixture.LoggedUsers.RUnlock()
+			if len(handlerFixture.LoggedUsers.Users) != 0 {
+				t.Errorf("The list of logged users should be empty")
+			}
+		})
+	}
+}
+
+func TestLoginSuccessContentType(t *testing.T) {
+	req, err := http.NewRequest("POST", "/login", strings.NewReader(`{"username": "user"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handlerFixture := Handler{
+		LoggedUsers: model.LoggedUsers{
+			Users: make(model.Users),
+		},
+	}
+	handler := http.HandlerFunc(handlerFixture.login)
+
+	handler.ServeHTTP(rr, req)
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("handler returned wrong content type: got %v want %v",
+			contentType, "application/json")
+	}
+}
+
+func TestWebsocketConnectionInvalidToken(t *testing.T) {
+	handlerFixture := Handler{
+		LoggedUsers: model.LoggedUsers{
+			Users: model.Users{
+				"user": model.User{
+					Username: "user",
+					Token:    "some-token",
+				},
+			},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handlerFixture.stream))
+	defer server.Close()
+
+	url := "ws" + server.URL[4:] + "/stream"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte(`{"username": "user", "token": "invalid-token"}`))
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	_, response, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	var errorResponse model.ErrorResponse
+	if err := json.Unmarshal(response, &errorResponse); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if errorResponse.Code != model.ErrorCodeInvalidToken {
+		t.Errorf("handler returned unexpected error code: got %v want %v",
+			errorResponse.Code, model.ErrorCodeInvalidToken)
+	}
+}
+
+func TestWebsocketConnectionFrameTooLarge(t *testing.T) {
+	handlerFixture := NewHandler()
+	server := httptest.NewServer(http.HandlerFunc(handlerFixture.stream))
+	defer server.Close()
+
+	url := "ws" + server.URL[4:] + "/stream"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	// The server closes the connection instead of reading the whole frame
+	if err := conn.WriteMessage(websocket.TextMessage, make([]byte, maxRequestBodyBytes+1)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("Unexpected result of an oversized frame: got %v want close %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	server := httptest.NewServer(withCORS(NewHandler().NewServeMux()))
+	defer server.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+		t.Run(method, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodOptions, server.URL+"/admin/rooms/general/filters", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Origin", "https://chat.example.com")
+			req.Header.Set("Access-Control-Request-Method", method)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if allowed := resp.Header.Get("Access-Control-Allow-Methods"); allowed != method {
+				t.Errorf("Preflight returned wrong allowed methods: got %q want %q", allowed, method)
+			}
+		})
+	}
+}
+
+// assertErrorResponse checks that the recorded response is a JSON model.ErrorResponse
+// with the expected code and message.
+func assertErrorResponse(t *testing.T, rr *httptest.ResponseRecorder, code string, message string) {
+	t.Helper()
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("handler returned wrong content type: got %v want %v",
+			contentType, "application/json")
+	}
+
+	var errorResponse model.ErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &errorResponse); err != nil {
+		t.Fatalf("handler returned a body that is not an error response: %v", rr.Body.String())
+	}
+	if errorResponse.Code != code {
+		t.Errorf("handler returned unexpected error code: got %v want %v",
+			errorResponse.Code, code)
+	}
+	if errorResponse.Message != message {
+		t.Errorf("handler returned unexpected error message: got %v want %v",
+			errorResponse.Message, message)
+	}
+}
+
+func TestWebsocketMessagePackAndCompression(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{model.SubprotocolMessagePack}, EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+server.URL[4:]+"/stream", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != model.SubprotocolMessagePack {
+		t.Errorf("Unexpected subprotocol: got %q want %q", conn.Subprotocol(), model.SubprotocolMessagePack)
+	}
+	if extensions := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(extensions, "permessage-deflate") {
+		t.Errorf("Compression should be negotiated, got extensions %q", extensions)
+	}
+
+	// readFrame reads a binary frame and decodes it into dst
+	readFrame := func(dst any) {
+		t.Helper()
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("Unexpected message type: got %v want %v", messageType, websocket.BinaryMessage)
+		}
+		decoded, err := msgpack.ToJSON(message)
+		if err != nil {
+			t.Fatalf("Failed to decode MessagePack frame: %v", err)
+		}
+		if err := json.Unmarshal(decoded, dst); err != nil {
+			t.Fatalf("Failed to unmarshal frame: %v", err)
+		}
+	}
+	// writeFrame encodes a JSON frame as MessagePack and sends it
+	writeFrame := func(frame string) {
+		t.Helper()
+		encoded, err := msgpack.FromJSON([]byte(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, encoded); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+
+	writeFrame(`{"username": "alice", "token": "alice-token"}`)
+	var welcome model.WebsocketWelcomeResponse
+	readFrame(&welcome)
+	if welcome.Welcome != "alice" {
+		t.Fatalf("Unexpected welcome message: %+v", welcome)
+	}
+
+	writeFrame(`{"type": "join", "room": "general"}`)
+	var event model.StreamEvent
+	readFrame(&event)
+	if event.Type != model.StreamEventJoined || event.Room != "general" || event.From != "alice" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+
+	// Frames that aren't valid MessagePack are answered with an error event
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0x81, 0xa4, 't'}); err != nil {
+		t.Fatal(err)
+	}
+	event = model.StreamEvent{}
+	readFrame(&event)
+	if event.Type != model.StreamEventError || event.Error == nil || event.Error.Code != model.ErrorCodeInvalidBody {
+		t.Errorf("Unexpected event: %+v", event)
 	}
 }
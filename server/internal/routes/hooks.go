@@ -0,0 +1,220 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/google/uuid"
+)
+
+// defaultHookUsername is the name of the bot of the incoming webhooks created without one.
+const defaultHookUsername = "webhook"
+
+// postHook is a handler function that posts the text of the body to the room of the incoming webhook
+// whose token is in the path, as a message from the bot of the webhook. It lets systems without a session,
+// like CI or monitoring, post to a room.
+// The message goes through the filters of the room like any other, but isn't run as a command.
+//
+// If the token is unknown, it returns an error.
+// If the room isn't active, it returns an error.
+func (handler *Handler) postHook(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	hook, ok := handler.incomingWebhook(r.PathValue("token"))
+	if !ok {
+		handler.audit(model.AuditEvent{Action: model.AuditActionTokenRejected, IP: remoteIP(r.RemoteAddr), Details: r.Method + " /hooks"})
+		writeError(w, http.StatusNotFound, model.ErrorCodeWebhookNotFound, "Webhook not found", "")
+		return
+	}
+	var hookMessage model.HookMessage
+	if !decodeRequest(w, r, &hookMessage) {
+		return
+	}
+	if strings.TrimSpace(hookMessage.Text) == "" {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeEmptyMessage, "Message can't be empty", "")
+		return
+	}
+	if len(hookMessage.Text) > maxMessageLength {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidBody, fmt.Sprintf("Message can't be longer than %d bytes", maxMessageLength), "")
+		return
+	}
+
+	message := Message{Room: hook.Room, From: hook.Username, Text: hookMessage.Text}
+	err := handler.filterMessage(&message)
+	if err == nil {
+		event := newEvent(model.StreamEventMessage, hook.Room, hook.Username, message.Text)
+		event.Bot = true
+		err = handler.publishMessage(event)
+	}
+	if err != nil {
+		log.Printf("Message of webhook %s to room %s failed: %v", hook.ID, hook.Room, err)
+		writeStreamError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, model.HookMessageResponse{Message: fmt.Sprintf("Message posted to room %s", hook.Room)})
+}
+
+// incomingWebhook returns the incoming webhook with the token.
+func (handler *Handler) incomingWebhook(token string) (model.IncomingWebhook, bool) {
+	handler.Webhooks.RLock()
+	defer handler.Webhooks.RUnlock()
+	hook, ok := handler.Webhooks.Incoming[token]
+	return hook, ok
+}
+
+// botName reports whether the username is the name of the bot of an incoming webhook,
+// which users can't take so they can't pass for the bot.
+func (handler *Handler) botName(username string) bool {
+	handler.Webhooks.RLock()
+	defer handler.Webhooks.RUnlock()
+	for _, hook := range handler.Webhooks.Incoming {
+		if hook.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// userName reports whether the username belongs to a user: a privileged user, a logged in user,
+// or a member of a room, either active or stored, so that bots can't pass for it.
+func (handler *Handler) userName(username string) bool {
+	if _, ok := handler.PrivilegedUsers[username]; ok {
+		return true
+	}
+	handler.LoggedUsers.RLock()
+	_, ok := handler.LoggedUsers.Users[username]
+	handler.LoggedUsers.RUnlock()
+	if ok {
+		return true
+	}
+	handler.ActiveRooms.RLock()
+	for _, room := range handler.ActiveRooms.Rooms {
+		_, member := room.Members[username]
+		_, role := room.Roles[username]
+		if member || role {
+			handler.ActiveRooms.RUnlock()
+			return true
+		}
+	}
+	handler.ActiveRooms.RUnlock()
+	if handler.Memberships != nil {
+		if rooms, err := handler.Memberships.Rooms(username); err == nil && len(rooms) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// adminListIncomingWebhooks is a handler function that returns the incoming webhooks of a room, oldest first,
+// without their tokens.
+func (handler *Handler) adminListIncomingWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureWebhooks); !ok {
+		return
+	}
+
+	roomName := r.PathValue("room")
+	hooks := []model.IncomingWebhook{}
+	handler.Webhooks.RLock()
+	for _, hook := range handler.Webhooks.Incoming {
+		if hook.Room == roomName {
+			hook.Token = ""
+			hooks = append(hooks, hook)
+		}
+	}
+	handler.Webhooks.RUnlock()
+
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	writeJSON(w, http.StatusOK, model.IncomingWebhooksResponse{Room: roomName, Webhooks: hooks})
+}
+
+// adminCreateIncomingWebhook is a handler function that creates an incoming webhook for a room.
+// The response is the only time the token of the webhook is returned.
+func (handler *Handler) adminCreateIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureWebhooks); !ok {
+		return
+	}
+	var incomingWebhookRequest model.IncomingWebhookRequest
+	if !decodeRequest(w, r, &incomingWebhookRequest) {
+		return
+	}
+	roomName := r.PathValue("room")
+	if !validRoomName(roomName) {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidRoom, fmt.Sprintf("Invalid room name '%s'", roomName), "")
+		return
+	}
+	username := incomingWebhookRequest.Username
+	if username == "" {
+		username = defaultHookUsername
+	}
+	if !validUsername(username) {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidUsername, "Invalid username", "")
+		return
+	}
+	if handler.userName(username) {
+		writeError(w, http.StatusConflict, model.ErrorCodeNicknameTaken, fmt.Sprintf("Username %s belongs to a user", username), "")
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, model.ErrorCodeInternal, "Can't generate the webhook token", err.Error())
+		return
+	}
+	hook := model.IncomingWebhook{
+		ID:        uuid.NewString(),
+		Room:      roomName,
+		Username:  username,
+		Token:     token,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	handler.Webhooks.Lock()
+	if handler.Webhooks.Incoming == nil {
+		handler.Webhooks.Incoming = make(map[string]model.IncomingWebhook)
+	}
+	handler.Webhooks.Incoming[token] = hook
+	handler.Webhooks.Unlock()
+
+	log.Printf("Incoming webhook %s created for room %s", hook.ID, roomName)
+	writeJSON(w, http.StatusOK, hook)
+}
+
+// adminDeleteIncomingWebhook is a handler function that deletes an incoming webhook of a room, revoking its token.
+func (handler *Handler) adminDeleteIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureWebhooks); !ok {
+		return
+	}
+
+	roomName, id := r.PathValue("room"), r.PathValue("id")
+	handler.Webhooks.Lock()
+	found := false
+	for token, hook := range handler.Webhooks.Incoming {
+		if hook.Room == roomName && hook.ID == id {
+			delete(handler.Webhooks.Incoming, token)
+			found = true
+		}
+	}
+	handler.Webhooks.Unlock()
+	if !found {
+		writeError(w, http.StatusNotFound, model.ErrorCodeWebhookNotFound, fmt.Sprintf("Webhook %s not found in room %s", id, roomName), "")
+		return
+	}
+
+	log.Printf("Incoming webhook %s of room %s deleted", id, roomName)
+	writeJSON(w, http.StatusOK, model.AdminActionResponse{Message: fmt.Sprintf("Webhook %s deleted", id)})
+}
@@ -0,0 +1,138 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// postHookMessage posts the body to the incoming webhook with the token, returning the status code and the error code.
+func postHookMessage(t *testing.T, server *httptest.Server, token string, body string) (int, string) {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/hooks/"+token, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var errorResponse model.ErrorResponse
+	if resp.StatusCode != http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, errorResponse.Code
+}
+
+// createIncomingWebhook creates an incoming webhook through the admin API and returns it.
+func createIncomingWebhook(t *testing.T, handler *Handler, room string, body string) model.IncomingWebhook {
+	t.Helper()
+	rr := adminRequest(t, handler, "POST", "/admin/rooms/"+room+"/incoming-webhooks", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Incoming webhook creation returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var hook model.IncomingWebhook
+	if err := json.Unmarshal(rr.Body.Bytes(), &hook); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func TestIncomingWebhooks(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.Filters.Default.Wordlist = []string{"darn"}
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	ci := createIncomingWebhook(t, handlerFixture, "general", `{"username": "ci"}`)
+	if ci.ID == "" || ci.Room != "general" || ci.Username != "ci" || len(ci.Token) != 64 {
+		t.Errorf("Unexpected incoming webhook: %+v", ci)
+	}
+	monitoring := createIncomingWebhook(t, handlerFixture, "general", `{}`)
+	if monitoring.Username != defaultHookUsername {
+		t.Errorf("Unexpected bot name: got %q want %q", monitoring.Username, defaultHookUsername)
+	}
+
+	// Rooms must be active to get messages
+	if status, code := postHookMessage(t, server, ci.Token, `{"text": "build passed"}`); status != http.StatusNotFound || code != model.ErrorCodeRoomNotFound {
+		t.Errorf("Post to an inactive room returned %v %s, want %v %s", status, code, http.StatusNotFound, model.ErrorCodeRoomNotFound)
+	}
+
+	alice := connectToStream(t, server, "alice", loginUser(t, server, "alice").Token)
+	defer alice.Close()
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+
+	// Messages come from the bot, through the filters of the room, and aren't run as commands
+	if status, code := postHookMessage(t, server, ci.Token, `{"text": "/kick alice darn build failed"}`); status != http.StatusOK {
+		t.Fatalf("Post returned wrong status code: got %v (%s) want %v", status, code, http.StatusOK)
+	}
+	event := expectEvent(t, alice, model.StreamEventMessage, "general", "ci")
+	if !event.Bot || event.ID != 1 || event.Text != "/kick alice **** build failed" {
+		t.Errorf("Unexpected bot message: %+v", event)
+	}
+	postHookMessage(t, server, monitoring.Token, `{"text": "disk almost full"}`)
+	if event := expectEvent(t, alice, model.StreamEventMessage, "general", defaultHookUsername); !event.Bot || event.ID != 2 {
+		t.Errorf("Unexpected bot message: %+v", event)
+	}
+
+	// Tokens are only returned when the webhook is created
+	rr := adminRequest(t, handlerFixture, "GET", "/admin/rooms/general/incoming-webhooks", "")
+	var hooksResponse model.IncomingWebhooksResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &hooksResponse); err != nil {
+		t.Fatal(err)
+	}
+	if len(hooksResponse.Webhooks) != 2 || hooksResponse.Webhooks[0].ID != ci.ID || hooksResponse.Webhooks[0].Token != "" {
+		t.Errorf("Unexpected incoming webhooks: %+v", hooksResponse)
+	}
+
+	// Deleting the webhook revokes its token
+	if rr := adminRequest(t, handlerFixture, "DELETE", "/admin/rooms/general/incoming-webhooks/"+ci.ID, ""); rr.Code != http.StatusOK {
+		t.Errorf("Incoming webhook deletion returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := adminRequest(t, handlerFixture, "DELETE", "/admin/rooms/general/incoming-webhooks/"+ci.ID, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Deletion of an unknown incoming webhook returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+		code   string
+	}{
+		{"revoked token", ci.Token, `{"text": "hello"}`, http.StatusNotFound, model.ErrorCodeWebhookNotFound},
+		{"unknown token", "invalid-token", `{"text": "hello"}`, http.StatusNotFound, model.ErrorCodeWebhookNotFound},
+		{"empty message", monitoring.Token, `{"text": "  "}`, http.StatusBadRequest, model.ErrorCodeEmptyMessage},
+		{"unknown field", monitoring.Token, `{"text": "hello", "channel": "general"}`, http.StatusBadRequest, model.ErrorCodeInvalidBody},
+		{"too long", monitoring.Token, `{"text": "` + strings.Repeat("a", maxMessageLength+1) + `"}`, http.StatusBadRequest, model.ErrorCodeInvalidBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, code := postHookMessage(t, server, tt.token, tt.body); status != tt.status || code != tt.code {
+				t.Errorf("Post returned %v %s, want %v %s", status, code, tt.status, tt.code)
+			}
+		})
+	}
+
+	if rr := adminRequest(t, handlerFixture, "POST", "/admin/rooms/general/incoming-webhooks", `{"username": " "}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Creation with an invalid bot name returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Bots can't take the names of users, nor users the names of bots
+	if rr := adminRequest(t, handlerFixture, "POST", "/admin/rooms/random/incoming-webhooks", `{"username": "alice"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Creation with the name of a user returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	resp, err := http.Post(server.URL+"/login", "application/json", strings.NewReader(`{"username": "`+defaultHookUsername+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Login with the name of a bot returned wrong status code: got %v want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
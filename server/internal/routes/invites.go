@@ -0,0 +1,159 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/google/uuid"
+)
+
+// redeemInviteLocked checks the invite code of the room and, if it's valid, counts a use and invites the user.
+// The caller must store the room back in ActiveRooms.
+// This function assumes that the ActiveRooms lock is already acquired by the caller.
+func redeemInviteLocked(room *model.Room, code string, username string) error {
+	invite, ok := room.InviteCodes[code]
+	if !ok {
+		return newStreamError(model.ErrorCodeInvalidInvite, fmt.Sprintf("Invalid invite code for room %s", room.Name))
+	}
+	if invite.ExpiresAt != nil && time.Now().After(*invite.ExpiresAt) {
+		delete(room.InviteCodes, code)
+		return newStreamError(model.ErrorCodeInvalidInvite, fmt.Sprintf("Invite code for room %s expired", room.Name))
+	}
+	if _, invited := room.Invites[username]; invited {
+		return nil
+	}
+	invite.Uses++
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		delete(room.InviteCodes, code)
+	} else {
+		room.InviteCodes[code] = invite
+	}
+	if room.Invites == nil {
+		room.Invites = make(map[string]struct{})
+	}
+	room.Invites[username] = struct{}{}
+	log.Printf("User %s redeemed an invite code of room %s", username, room.Name)
+	return nil
+}
+
+// inviteUser invites a user to the room and notifies it, if it's connected.
+func (handler *Handler) inviteUser(actor principal, roomName string, target string) error {
+	if !validUsername(target) {
+		return newStreamError(model.ErrorCodeInvalidUsername, "Invalid username")
+	}
+
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if !ok {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeRoomNotFound, fmt.Sprintf("Room %s not found", roomName))
+	}
+	if err := authorize(actor, actionInvite, room, principal{Username: target}, ""); err != nil {
+		handler.ActiveRooms.Unlock()
+		return err
+	}
+	if room.Invites == nil {
+		room.Invites = make(map[string]struct{})
+		handler.ActiveRooms.Rooms[roomName] = room
+	}
+	room.Invites[target] = struct{}{}
+	handler.ActiveRooms.Unlock()
+
+	log.Printf("User %s invited %s to room %s", actor.Username, target, roomName)
+	invited := newEvent(model.StreamEventInvited, roomName, actor.Username, target)
+	handler.sendEvent(target, invited)
+	handler.sendEvent(actor.Username, invited)
+	return nil
+}
+
+// createInvite creates an invite code for the room, valid for the given seconds and number of uses,
+// zero meaning unlimited, and sends it to the user that created it.
+func (handler *Handler) createInvite(actor principal, roomName string, duration int, maxUses int) error {
+	expiresAt, err := expiry(duration)
+	if err != nil {
+		return err
+	}
+	if maxUses < 0 {
+		return newStreamError(model.ErrorCodeInvalidBody, "Max uses can't be negative")
+	}
+
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if !ok {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeRoomNotFound, fmt.Sprintf("Room %s not found", roomName))
+	}
+	if err := authorize(actor, actionInvite, room, principal{}, ""); err != nil {
+		handler.ActiveRooms.Unlock()
+		return err
+	}
+	invite := model.Invite{
+		Code:      uuid.NewString(),
+		Room:      roomName,
+		CreatedBy: actor.Username,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+		MaxUses:   maxUses,
+	}
+	if room.InviteCodes == nil {
+		room.InviteCodes = make(map[string]model.Invite)
+		handler.ActiveRooms.Rooms[roomName] = room
+	}
+	room.InviteCodes[invite.Code] = invite
+	handler.ActiveRooms.Unlock()
+
+	log.Printf("User %s created an invite code for room %s", actor.Username, roomName)
+	created := newEvent(model.StreamEventInviteCreated, roomName, actor.Username, "")
+	created.Invite = &invite
+	handler.sendEvent(actor.Username, created)
+	return nil
+}
+
+// canSeeRoom reports whether the room is listed to the principal: private rooms are only listed
+// to their members, to the invited users and to global moderators and admins.
+func canSeeRoom(actor principal, room model.Room) bool {
+	if !room.Private || actor.Role != model.RoleUser {
+		return true
+	}
+	_, isMember := room.Members[actor.Username]
+	_, invited := room.Invites[actor.Username]
+	return isMember || invited
+}
+
+// listRooms is a handler function that returns the rooms the user can see.
+func (handler *Handler) listRooms(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	actor, ok := handler.authenticateSession(w, r)
+	if !ok {
+		return
+	}
+	if err := authorize(actor, actionBrowseRooms, model.Room{}, principal{}, ""); err != nil {
+		writeError(w, http.StatusForbidden, model.ErrorCodeForbidden, err.Error(), "")
+		return
+	}
+
+	rooms := []model.RoomListing{}
+	handler.ActiveRooms.RLock()
+	for _, room := range handler.ActiveRooms.Rooms {
+		if !canSeeRoom(actor, room) {
+			continue
+		}
+		rooms = append(rooms, model.RoomListing{
+			Name:       room.Name,
+			Topic:      room.Topic,
+			Private:    room.Private,
+			InviteOnly: room.InviteOnly,
+			Members:    len(room.Members),
+		})
+	}
+	handler.ActiveRooms.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	writeJSON(w, http.StatusOK, model.RoomsResponse{Rooms: rooms})
+}
@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+func TestInviteOnlyRoom(t *testing.T) {
+	handlerFixture := NewHandler()
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		handlerFixture.addUserLocked(model.User{Username: username, Token: username + "-token"})
+	}
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	bob := connectToStream(t, server, "bob", "bob-token")
+	defer bob.Close()
+	carol := connectToStream(t, server, "carol", "carol-token")
+	defer carol.Close()
+	dave := connectToStream(t, server, "dave", "dave-token")
+	defer dave.Close()
+
+	inviteOnly := true
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "secret"})
+	expectEvent(t, alice, model.StreamEventJoined, "secret", "alice")
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestUpdateRoom, Room: "secret", Update: &model.RoomUpdate{InviteOnly: &inviteOnly}})
+	if event := expectEvent(t, alice, model.StreamEventRoomUpdated, "secret", "alice"); !event.RoomInfo.InviteOnly {
+		t.Errorf("Room should be invite-only: %+v", event.RoomInfo)
+	}
+
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "secret"})
+	if event := expectEvent(t, bob, model.StreamEventError, "secret", ""); event.Error.Code != model.ErrorCodeInviteRequired {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	// Invitations by username
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestInvite, Room: "secret", User: "bob"})
+	expectEvent(t, alice, model.StreamEventInvited, "secret", "alice")
+	if event := expectEvent(t, bob, model.StreamEventInvited, "secret", "alice"); event.Text != "bob" {
+		t.Errorf("Unexpected invited event: %+v", event)
+	}
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "secret"})
+	expectEvent(t, alice, model.StreamEventJoined, "secret", "bob")
+	expectEvent(t, bob, model.StreamEventJoined, "secret", "bob")
+
+	// Members can't invite
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestInvite, Room: "secret", User: "carol"})
+	if event := expectEvent(t, bob, model.StreamEventError, "secret", ""); event.Error.Code != model.ErrorCodeForbidden {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	// Invite codes with a maximum number of uses
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestCreateInvite, Room: "secret", MaxUses: 1, Duration: 3600})
+	created := expectEvent(t, alice, model.StreamEventInviteCreated, "secret", "alice")
+	if created.Invite == nil || created.Invite.Code == "" || created.Invite.ExpiresAt == nil {
+		t.Fatalf("Unexpected invite: %+v", created.Invite)
+	}
+	sendRequest(t, carol, model.StreamRequest{Type: model.StreamRequestJoin, Room: "secret", Code: created.Invite.Code})
+	expectEvent(t, carol, model.StreamEventJoined, "secret", "carol")
+	sendRequest(t, dave, model.StreamRequest{Type: model.StreamRequestJoin, Room: "secret", Code: created.Invite.Code})
+	if event := expectEvent(t, dave, model.StreamEventError, "secret", ""); event.Error.Code != model.ErrorCodeInvalidInvite {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	// Invite-only rooms are kept when they become empty
+	for _, username := range []string{"alice", "bob"} {
+		handlerFixture.LoggedUsers.Lock()
+		handlerFixture.removeUserFromRooms(username)
+		handlerFixture.LoggedUsers.Unlock()
+		expectEvent(t, carol, model.StreamEventLeft, "secret", username)
+	}
+	sendRequest(t, carol, model.StreamRequest{Type: model.StreamRequestLeave, Room: "secret"})
+	expectEvent(t, carol, model.StreamEventLeft, "secret", "carol")
+	handlerFixture.ActiveRooms.RLock()
+	room, ok := handlerFixture.ActiveRooms.Rooms["secret"]
+	handlerFixture.ActiveRooms.RUnlock()
+	if !ok || !room.InviteOnly {
+		t.Errorf("Empty invite-only room should be kept")
+	}
+	// Invited users can join again
+	sendRequest(t, carol, model.StreamRequest{Type: model.StreamRequestJoin, Room: "secret"})
+	expectEvent(t, carol, model.StreamEventJoined, "secret", "carol")
+}
+
+func TestListRoomsHidesPrivateRooms(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+	handlerFixture.ActiveRooms.Rooms["general"] = model.Room{Name: "general", Members: map[string]struct{}{"alice": {}, "bob": {}}}
+	handlerFixture.ActiveRooms.Rooms["hideout"] = model.Room{Name: "hideout", Private: true, Members: map[string]struct{}{"alice": {}}}
+
+	var tests = []struct {
+		name   string
+		token  string
+		status int
+		rooms  int
+	}{
+		{"member sees private room", "alice-token", http.StatusOK, 2},
+		{"others don't", "bob-token", http.StatusOK, 1},
+		{"invalid token", "other", http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/rooms", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rr := httptest.NewRecorder()
+			handlerFixture.NewServeMux().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var response model.RoomsResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Rooms) != tt.rooms {
+				t.Errorf("handler returned unexpected rooms: %+v", response.Rooms)
+			}
+		})
+	}
+}
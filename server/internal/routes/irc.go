@@ -0,0 +1,694 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+const (
+	// ircServerName is the name of the server in the prefix of the IRC messages it sends.
+	ircServerName = "chat"
+	// ircMaxLineLength is the longest line read from an IRC client, the 512 bytes of RFC 1459 plus room for message tags.
+	ircMaxLineLength = 4096
+	// ircMaxTextLength is the longest text sent in a single IRC message, longer texts are split in several messages.
+	ircMaxTextLength = 400
+	// ircChannelPrefix starts the names of the IRC channels, which are the rooms.
+	ircChannelPrefix = "#"
+	// ircUnregisteredNickname is the nickname of the replies sent to clients that haven't registered yet.
+	ircUnregisteredNickname = "*"
+	// ircCTCPActionPrefix and ircCTCPDelimiter enclose the actions sent with /me.
+	ircCTCPActionPrefix = "\x01ACTION "
+	ircCTCPDelimiter    = "\x01"
+	// ircClosingLinkMessage is the error sent to the client when its connection is closed.
+	ircClosingLinkMessage = "Closing link"
+	// ircRegistrationTimeout is the time a client has to register after connecting.
+	ircRegistrationTimeout = 30 * time.Second
+	// ircPingInterval is the time between the PINGs sent to registered clients. Registered clients that send nothing,
+	// not even the PONG of a PING, for ircIdleTimeout are disconnected.
+	ircPingInterval = 60 * time.Second
+	ircIdleTimeout  = ircPingInterval + 30*time.Second
+	// ircWriteTimeout is the longest a write to a client can take, its connection is closed if it can't keep up.
+	ircWriteTimeout = 10 * time.Second
+)
+
+// IRC numeric replies used by the gateway.
+const (
+	ircReplyWelcome         = "001"
+	ircReplyYourHost        = "002"
+	ircReplyMyInfo          = "004"
+	ircReplyNoTopic         = "331"
+	ircReplyTopic           = "332"
+	ircReplyNames           = "353"
+	ircReplyEndOfNames      = "366"
+	ircErrNoSuchNick        = "401"
+	ircErrNoSuchChannel     = "403"
+	ircErrCannotSendToChan  = "404"
+	ircErrUnknownCommand    = "421"
+	ircErrNoMOTD            = "422"
+	ircErrNoNicknameGiven   = "431"
+	ircErrErroneousNickname = "432"
+	ircErrNicknameInUse     = "433"
+	ircErrNotOnChannel      = "442"
+	ircErrNotRegistered     = "451"
+	ircErrNeedMoreParams    = "461"
+	ircErrAlreadyRegistered = "462"
+	ircErrPasswordMismatch  = "464"
+	ircErrInviteOnlyChan    = "473"
+	ircErrBannedFromChan    = "474"
+	ircErrBadChannelKey     = "475"
+	ircErrChanOPrivsNeeded  = "482"
+)
+
+// ServeIRC accepts IRC clients on the listener until it's closed, returning the error that stopped it.
+//
+// The gateway speaks the subset of IRC needed to chat: NICK, USER and PASS to log in, JOIN, PART, PRIVMSG,
+// NAMES and TOPIC on the rooms, which are the channels named after them with a # prefix, PING and PONG,
+// and QUIT. IRC users are logged in like the users of the other transports, and are logged out when
+// their connection is closed. Privileged users send their secret with PASS. Clients that don't register in time,
+// or stop answering the PINGs of the server, are disconnected.
+func (handler *Handler) ServeIRC(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handler.serveIRCConn(conn)
+	}
+}
+
+// ircConn is the connection of an IRC client. Its reading goroutine handles the commands of the client,
+// and once the user is registered, a writing goroutine translates the events of its channel to IRC messages.
+type ircConn struct {
+	handler *Handler
+	conn    net.Conn
+	ip      string
+
+	// mu serializes the writes to the connection, and guards the nickname
+	mu       sync.Mutex
+	nickname string
+
+	// The registration, only used by the reading goroutine
+	password string
+	user     bool
+	channel  chan []byte
+
+	// topics are the topics of the rooms of the user, only used by the writing goroutine
+	// to tell topic changes from other room updates
+	topics map[string]string
+	// lastRename is the last renamed event sent, only used by the writing goroutine, as renames are
+	// sent once for every room the user shares with the renamed user
+	lastRename [2]string
+}
+
+// serveIRCConn handles the commands of an IRC client until it quits or its connection is closed,
+// then logs out its user.
+func (handler *Handler) serveIRCConn(conn net.Conn) {
+	client := &ircConn{
+		handler:  handler,
+		conn:     conn,
+		ip:       remoteIP(conn.RemoteAddr().String()),
+		nickname: ircUnregisteredNickname,
+		topics:   make(map[string]string),
+	}
+	log.Printf("IRC client connected from %s", client.ip)
+
+	// Clients must register in time, and once registered, send something at least as often as they're pinged
+	conn.SetReadDeadline(time.Now().Add(ircRegistrationTimeout))
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 512), ircMaxLineLength)
+	for scanner.Scan() {
+		if client.channel != nil {
+			conn.SetReadDeadline(time.Now().Add(ircIdleTimeout))
+		}
+		command, params := parseIRCLine(scanner.Text())
+		if command == "" {
+			continue
+		}
+		if !client.handle(command, params) {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("IRC connection of %s ended: %v", client.nick(), err)
+		if errors.Is(err, os.ErrDeadlineExceeded) && client.channel == nil {
+			client.send("ERROR :Registration timed out")
+		}
+	}
+
+	// Remove the user from the logged users, closing the channel if it exists.
+	// The writing goroutine of registered clients closes the connection once the channel is closed.
+	if client.channel == nil {
+		conn.Close()
+		return
+	}
+	handler.disconnectStream(client.nick(), client.channel)
+}
+
+// parseIRCLine splits an IRC message into its command, in upper case, and its parameters,
+// dropping its tags and prefix. The trailing parameter, after " :", can contain spaces.
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	params := strings.Fields(line)
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+func (client *ircConn) nick() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.nickname
+}
+
+func (client *ircConn) setNick(nickname string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.nickname = nickname
+}
+
+// send writes a line to the client. Its parameters must be made safe with ircParam and ircTrailing,
+// any line break left is replaced so that the line can't be split into several messages.
+// The connection is closed if the client doesn't read the line in time.
+func (client *ircConn) send(format string, args ...any) {
+	line := ircTrailing(fmt.Sprintf(format, args...))
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	if _, err := io.WriteString(client.conn, line+"\r\n"); err != nil {
+		log.Printf("Can't write to IRC client %s: %v", client.nickname, err)
+		client.conn.Close()
+	}
+}
+
+// reply sends a numeric reply to the client. The last parameter is sent as the trailing parameter.
+func (client *ircConn) reply(numeric string, params ...string) {
+	for i := range params[:len(params)-1] {
+		params[i] = ircParam(params[i])
+	}
+	params[len(params)-1] = ":" + ircTrailing(params[len(params)-1])
+	client.send(":%s %s %s %s", ircServerName, numeric, ircParam(client.nick()), strings.Join(params, " "))
+}
+
+// ircParam makes the value safe to send as a middle parameter of an IRC message, replacing the spaces,
+// line breaks and NUL characters that would end it with underscores.
+func ircParam(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r == ' ' || strings.ContainsRune(lineBreakCharacters, r) {
+			return '_'
+		}
+		return r
+	}, value)
+	// Middle parameters can't be empty or start with a colon, which would make them the trailing parameter
+	if value == "" || strings.HasPrefix(value, ":") {
+		value = "_" + value
+	}
+	return value
+}
+
+// ircTrailing makes the value safe to send as the trailing parameter of an IRC message, replacing the line breaks
+// and NUL characters that would end it with spaces.
+func ircTrailing(value string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(lineBreakCharacters, r) {
+			return ' '
+		}
+		return r
+	}, value)
+}
+
+// ircSource returns the prefix of the messages sent on behalf of a user.
+func ircSource(username string) string {
+	username = ircParam(username)
+	return username + "!" + username + "@" + ircServerName
+}
+
+// ircChannel returns the IRC channel of a room.
+func ircChannel(room string) string {
+	return ircChannelPrefix + ircParam(room)
+}
+
+// handle runs a command of the client. It returns false if the connection must be closed.
+func (client *ircConn) handle(command string, params []string) bool {
+	switch command {
+	case "CAP":
+		// Capabilities aren't supported, clients go on with the registration
+		return true
+	case "PING":
+		client.send(":%s PONG %s :%s", ircServerName, ircServerName, strings.Join(params, " "))
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		// Registered clients get the error when their channel is closed
+		if client.channel == nil {
+			client.send("ERROR :%s", ircClosingLinkMessage)
+		}
+		return false
+	case "PASS":
+		if client.channel != nil {
+			client.reply(ircErrAlreadyRegistered, "You may not reregister")
+		} else if len(params) < 1 {
+			client.reply(ircErrNeedMoreParams, command, "Not enough parameters")
+		} else {
+			client.password = params[0]
+		}
+		return true
+	case "USER":
+		if client.channel != nil {
+			client.reply(ircErrAlreadyRegistered, "You may not reregister")
+			return true
+		}
+		if len(params) < 4 {
+			client.reply(ircErrNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		client.user = true
+		return client.register()
+	case "NICK":
+		if len(params) < 1 {
+			client.reply(ircErrNoNicknameGiven, "No nickname given")
+			return true
+		}
+		if !validIRCNickname(params[0]) {
+			client.reply(ircErrErroneousNickname, params[0], "Erroneous nickname")
+			return true
+		}
+		if client.channel == nil {
+			client.setNick(params[0])
+			return client.register()
+		}
+		err := client.handler.renameUser(client.handler.principalOf(client.nick()), params[0])
+		client.fail(command, params[0], err)
+		client.setNick(client.handler.boundUsername(client.nick(), client.channel))
+		return true
+	}
+
+	if client.channel == nil {
+		client.reply(ircErrNotRegistered, "You have not registered")
+		return true
+	}
+	switch command {
+	case "JOIN":
+		if len(params) < 1 {
+			client.reply(ircErrNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		var keys []string
+		if len(params) > 1 {
+			keys = strings.Split(params[1], ",")
+		}
+		for i, channel := range strings.Split(params[0], ",") {
+			request := model.StreamRequest{Type: model.StreamRequestJoin}
+			if i < len(keys) {
+				request.Code = keys[i]
+			}
+			client.request(command, channel, request)
+		}
+	case "PART":
+		if len(params) < 1 {
+			client.reply(ircErrNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			client.request(command, channel, model.StreamRequest{Type: model.StreamRequestLeave})
+		}
+	case "PRIVMSG":
+		if len(params) < 2 {
+			client.reply(ircErrNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		text := params[1]
+		if action, ok := strings.CutPrefix(text, ircCTCPActionPrefix); ok {
+			text = "/me " + strings.TrimSuffix(action, ircCTCPDelimiter)
+		} else if strings.HasPrefix(text, "/") {
+			// IRC clients already interpreted the slash commands, so the text is sent as is
+			text = "/" + text
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			if !strings.HasPrefix(target, ircChannelPrefix) {
+				client.reply(ircErrNoSuchNick, target, "No such nick/channel")
+				continue
+			}
+			client.request(command, target, model.StreamRequest{Type: model.StreamRequestMessage, Text: text})
+		}
+	case "NAMES":
+		if len(params) < 1 {
+			client.reply(ircErrNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			client.names(channel)
+		}
+	case "TOPIC":
+		if len(params) < 1 {
+			client.reply(ircErrNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		if len(params) == 1 {
+			client.topic(params[0])
+			return true
+		}
+		topic := params[1]
+		client.request(command, params[0], model.StreamRequest{Type: model.StreamRequestUpdateRoom, Update: &model.RoomUpdate{Topic: &topic}})
+	default:
+		client.reply(ircErrUnknownCommand, command, "Unknown command")
+	}
+	return true
+}
+
+// validIRCNickname reports whether the nickname can be used in IRC messages, on top of being a valid username.
+func validIRCNickname(nickname string) bool {
+	return validUsername(nickname) && !strings.ContainsAny(nickname, " ,*?!@") &&
+		!strings.HasPrefix(nickname, ircChannelPrefix) && !strings.HasPrefix(nickname, ":")
+}
+
+// register logs in the user once the client sent both NICK and USER, connects it to the stream
+// and starts the writing goroutine. It returns false if the connection must be closed.
+func (client *ircConn) register() bool {
+	nickname := client.nick()
+	if !client.user || nickname == ircUnregisteredNickname {
+		return true
+	}
+	handler := client.handler
+	user, err := handler.startSession(model.UserLoginRequest{Username: nickname, Secret: client.password}, client.ip)
+	if err == nil {
+		client.channel, err = handler.bindChannel(model.UserWithTokenRequest{Username: user.Username, Token: user.Token}, client.ip, "irc")
+		if err != nil {
+			handler.LoggedUsers.Lock()
+			cleanup := CleanupUserData(handler, model.UserWithTokenRequest{Username: user.Username})
+			handler.LoggedUsers.Unlock()
+			handler.finishCleanup(cleanup)
+			handler.releaseSession(user.Username, cleanup.token)
+		}
+	}
+	var rejected *handshakeError
+	if errors.As(err, &rejected) {
+		switch rejected.code {
+		case model.ErrorCodeAlreadyLoggedIn:
+			// The client can try another nickname
+			client.setNick(ircUnregisteredNickname)
+			client.send(":%s %s %s %s :Nickname is already in use", ircServerName, ircErrNicknameInUse, ircUnregisteredNickname, nickname)
+			return true
+		case model.ErrorCodeInvalidUsername:
+			client.setNick(ircUnregisteredNickname)
+			client.send(":%s %s %s %s :Erroneous nickname", ircServerName, ircErrErroneousNickname, ircUnregisteredNickname, nickname)
+			return true
+		case model.ErrorCodeInvalidSecret:
+			client.reply(ircErrPasswordMismatch, "Password incorrect")
+		}
+	}
+	if err != nil {
+		client.send("ERROR :%s", err.Error())
+		return false
+	}
+
+	client.reply(ircReplyWelcome, fmt.Sprintf("Welcome to the chat, %s", nickname))
+	client.reply(ircReplyYourHost, fmt.Sprintf("Your host is %s, running version %s", ircServerName, apiVersion))
+	client.send(":%s %s %s %s %s o o", ircServerName, ircReplyMyInfo, nickname, ircServerName, apiVersion)
+	client.reply(ircErrNoMOTD, "MOTD File is missing")
+
+	// Start a goroutine to send the events to the client from the channel, pinging it when idle.
+	// The goroutine ends when the channel is closed, either on logout or when the user connects with another transport,
+	// closing the connection.
+	client.conn.SetReadDeadline(time.Now().Add(ircIdleTimeout))
+	go func(channel chan []byte) {
+		ping := time.NewTicker(ircPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case message, ok := <-channel:
+				if !ok {
+					client.send("ERROR :%s", ircClosingLinkMessage)
+					client.conn.Close()
+					return
+				}
+				client.deliver(message)
+			case <-ping.C:
+				client.send("PING :%s", ircServerName)
+			}
+		}
+	}(client.channel)
+
+	handler.subscribeUser(nickname)
+	handler.rejoinRooms(nickname)
+	return true
+}
+
+// request runs a request of the stream on the room of the IRC channel, answering errors with the matching numeric reply.
+func (client *ircConn) request(command string, channel string, request model.StreamRequest) {
+	room, ok := strings.CutPrefix(channel, ircChannelPrefix)
+	if !ok {
+		client.reply(ircErrNoSuchChannel, channel, "No such channel")
+		return
+	}
+	request.Room = room
+	client.fail(command, channel, client.handler.handleStreamRequest(client.nick(), request))
+}
+
+// fail answers the error of a command with the matching numeric reply, or with a notice if there is none.
+// target is the channel or the nickname the command was about.
+func (client *ircConn) fail(command string, target string, err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("IRC command %s from user %s failed: %v", command, client.nick(), err)
+	switch code := streamErrorCode(err); {
+	case code == model.ErrorCodeNotInRoom && command == "PRIVMSG":
+		client.reply(ircErrCannotSendToChan, target, err.Error())
+	case code == model.ErrorCodeNotInRoom:
+		client.reply(ircErrNotOnChannel, target, "You're not on that channel")
+	case code == model.ErrorCodeInvalidRoom, code == model.ErrorCodeRoomNotFound:
+		client.reply(ircErrNoSuchChannel, target, "No such channel")
+	case code == model.ErrorCodeInviteRequired:
+		client.reply(ircErrInviteOnlyChan, target, "Cannot join channel (+i)")
+	case code == model.ErrorCodeInvalidInvite:
+		client.reply(ircErrBadChannelKey, target, "Cannot join channel (+k)")
+	case code == model.ErrorCodeBanned:
+		client.reply(ircErrBannedFromChan, target, err.Error())
+	case code == model.ErrorCodeMuted, code == model.ErrorCodeForbidden && command == "PRIVMSG":
+		client.reply(ircErrCannotSendToChan, target, err.Error())
+	case code == model.ErrorCodeForbidden:
+		client.reply(ircErrChanOPrivsNeeded, target, "You're not channel operator")
+	case code == model.ErrorCodeNicknameTaken:
+		client.reply(ircErrNicknameInUse, target, "Nickname is already in use")
+	case code == model.ErrorCodeInvalidUsername:
+		client.reply(ircErrErroneousNickname, target, "Erroneous nickname")
+	default:
+		client.notice(client.nick(), err.Error())
+	}
+}
+
+// notice sends a notice from the server to the target.
+func (client *ircConn) notice(target string, text string) {
+	for _, line := range splitIRCText(text) {
+		client.send(":%s NOTICE %s :%s", ircServerName, ircParam(target), line)
+	}
+}
+
+// visibleRoom returns the room of the channel if it's active and the user can see it, like the rooms listed to it.
+func (client *ircConn) visibleRoom(channel string) (model.Room, bool) {
+	roomName, ok := strings.CutPrefix(channel, ircChannelPrefix)
+	if !ok {
+		return model.Room{}, false
+	}
+	actor := client.handler.principalOf(client.nick())
+	client.handler.ActiveRooms.RLock()
+	defer client.handler.ActiveRooms.RUnlock()
+	room, exists := client.handler.ActiveRooms.Rooms[roomName]
+	if !exists || !canSeeRoom(actor, room) {
+		return model.Room{}, false
+	}
+	return room, true
+}
+
+// names sends the online members of the room, owners and moderators marked as channel operators.
+// Rooms the user can't see are answered as if they didn't exist.
+func (client *ircConn) names(channel string) {
+	room, ok := client.visibleRoom(channel)
+	if !ok {
+		client.reply(ircErrNoSuchChannel, channel, "No such channel")
+		return
+	}
+	var names []string
+	for _, username := range members(room) {
+		names = append(names, ircMemberName(room, username))
+	}
+	client.sendNames(channel, names)
+	client.reply(ircReplyEndOfNames, channel, "End of /NAMES list")
+}
+
+// ircMemberName returns the name of a member in a names reply, prefixed with @ for the owners and moderators of the room.
+func ircMemberName(room model.Room, username string) string {
+	switch roomRole(room, username) {
+	case model.RoomRoleOwner, model.RoomRoleModerator:
+		return "@" + username
+	}
+	return username
+}
+
+// sendNames sends the names of the members of the channel, in as many replies as needed.
+func (client *ircConn) sendNames(channel string, names []string) {
+	for len(names) > 0 {
+		line, length := []string{}, 0
+		for len(names) > 0 && (length == 0 || length+len(names[0]) < ircMaxTextLength) {
+			line = append(line, ircParam(names[0]))
+			length += len(names[0]) + 1
+			names = names[1:]
+		}
+		client.reply(ircReplyNames, "=", channel, strings.Join(line, " "))
+	}
+}
+
+// topic sends the topic of the room. Rooms the user can't see are answered as if they didn't exist.
+func (client *ircConn) topic(channel string) {
+	current, ok := client.visibleRoom(channel)
+	switch {
+	case !ok:
+		client.reply(ircErrNoSuchChannel, channel, "No such channel")
+	case current.Topic == "":
+		client.reply(ircReplyNoTopic, channel, "No topic is set")
+	default:
+		client.reply(ircReplyTopic, channel, current.Topic)
+	}
+}
+
+// deliver translates a frame of the stream to IRC messages and sends them to the client.
+// Events without an IRC equivalent are sent as notices.
+func (client *ircConn) deliver(message []byte) {
+	var event model.StreamEvent
+	if err := json.Unmarshal(message, &event); err != nil || event.Type == "" {
+		return
+	}
+	nickname := client.nick()
+	channel := ircChannel(event.Room)
+	switch event.Type {
+	case model.StreamEventJoined:
+		client.send(":%s JOIN %s", ircSource(event.From), channel)
+		// The user that joins also gets the topic and the members of the room
+		if event.From == nickname && event.Members != nil {
+			if event.RoomInfo != nil {
+				client.topics[event.Room] = event.RoomInfo.Topic
+				if event.RoomInfo.Topic != "" {
+					client.reply(ircReplyTopic, channel, event.RoomInfo.Topic)
+				}
+			}
+			client.sendNames(channel, event.Members)
+			client.reply(ircReplyEndOfNames, channel, "End of /NAMES list")
+		}
+	case model.StreamEventLeft:
+		client.send(":%s PART %s", ircSource(event.From), channel)
+		if event.From == nickname {
+			delete(client.topics, event.Room)
+		}
+	case model.StreamEventRoomClosed:
+		client.send(":%s PART %s :Room closed", ircSource(nickname), channel)
+		delete(client.topics, event.Room)
+	case model.StreamEventKicked:
+		client.send(":%s KICK %s %s :%s", ircServerName, channel, ircParam(event.From), ircTrailing(event.Text))
+	case model.StreamEventMessage, model.StreamEventAction:
+		// IRC clients show their own messages when they send them
+		if event.From == nickname && !event.Bot {
+			return
+		}
+		for _, line := range splitIRCText(event.Text) {
+			if event.Type == model.StreamEventAction {
+				line = ircCTCPActionPrefix + line + ircCTCPDelimiter
+			}
+			client.send(":%s PRIVMSG %s :%s", ircSource(event.From), channel, line)
+		}
+	case model.StreamEventRenamed:
+		if rename := [2]string{event.From, event.NewName}; rename != client.lastRename {
+			client.lastRename = rename
+			client.send(":%s NICK :%s", ircSource(event.From), ircParam(event.NewName))
+		}
+		if event.From == nickname {
+			client.setNick(event.NewName)
+		}
+	case model.StreamEventRoomUpdated:
+		if event.RoomInfo != nil && event.RoomInfo.Topic != client.topics[event.Room] {
+			client.topics[event.Room] = event.RoomInfo.Topic
+			client.send(":%s TOPIC %s :%s", ircSource(event.From), channel, ircTrailing(event.RoomInfo.Topic))
+		}
+	case model.StreamEventError:
+		if event.Error != nil {
+			client.notice(nickname, event.Error.Message)
+		}
+	default:
+		if text := describeEvent(event); text != "" {
+			target := nickname
+			if event.Room != "" {
+				target = channel
+			}
+			client.notice(target, text)
+		}
+	}
+}
+
+// describeEvent describes the events that have no IRC equivalent, empty if the event isn't worth a notice.
+func describeEvent(event model.StreamEvent) string {
+	switch event.Type {
+	case model.StreamEventSystem, model.StreamEventReply:
+		return event.Text
+	case model.StreamEventMuted:
+		return strings.TrimSuffix(fmt.Sprintf("%s was muted: %s", event.From, event.Text), ": ")
+	case model.StreamEventUnmuted:
+		return fmt.Sprintf("%s was unmuted", event.From)
+	case model.StreamEventRoleChanged:
+		return fmt.Sprintf("%s is now %s", event.From, event.Role)
+	case model.StreamEventBanned:
+		return strings.TrimSuffix(fmt.Sprintf("You are banned: %s", event.Text), ": ")
+	case model.StreamEventInvited:
+		return fmt.Sprintf("%s invited %s to %s", event.From, event.Text, event.Room)
+	case model.StreamEventInviteCreated:
+		if event.Invite != nil {
+			return fmt.Sprintf("Invite code for %s: %s", event.Room, event.Invite.Code)
+		}
+	}
+	return ""
+}
+
+// ircLineBreaks turns every line break into a newline, and drops NUL characters.
+var ircLineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x00", "")
+
+// splitIRCText splits a text in lines that fit in IRC messages, breaking it at its line breaks
+// and at ircMaxTextLength bytes, without splitting UTF-8 characters.
+func splitIRCText(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(ircLineBreaks.Replace(text), "\n") {
+		for len(line) > ircMaxTextLength {
+			cut := ircMaxTextLength
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			lines = append(lines, line[:cut])
+			line = line[cut:]
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
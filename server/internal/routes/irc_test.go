@@ -0,0 +1,256 @@
+package routes
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// ircTestClient is a raw IRC connection to the gateway.
+type ircTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// connectToIRC opens a connection to the IRC gateway.
+func connectToIRC(t *testing.T, addr string) *ircTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &ircTestClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// sendIRC sends a line to the gateway.
+func (client *ircTestClient) sendIRC(t *testing.T, format string, args ...any) {
+	t.Helper()
+	if _, err := fmt.Fprintf(client.conn, format+"\r\n", args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectIRC reads lines until one containing the expected text, failing if a line contains unexpected first.
+func (client *ircTestClient) expectIRC(t *testing.T, expected string) string {
+	t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := client.reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read %q: %v", expected, err)
+		}
+		if strings.Contains(line, expected) {
+			return strings.TrimRight(line, "\r\n")
+		}
+	}
+}
+
+func TestIRCGateway(t *testing.T) {
+	handlerFixture := NewHandler()
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go handlerFixture.ServeIRC(listener)
+
+	alice := connectToStream(t, server, "alice", loginUser(t, server, "alice").Token)
+	defer alice.Close()
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+
+	// Commands other than the registration need a registered client
+	bob := connectToIRC(t, listener.Addr().String())
+	bob.sendIRC(t, "JOIN #general")
+	bob.expectIRC(t, " 451 * :You have not registered")
+
+	// Nicknames in use are rejected, and the client can try another one
+	bob.sendIRC(t, "NICK alice")
+	bob.sendIRC(t, "USER bob 0 * :Bob")
+	bob.expectIRC(t, " 433 * alice :Nickname is already in use")
+	bob.sendIRC(t, "NICK bob")
+	bob.expectIRC(t, ":chat 001 bob :Welcome to the chat, bob")
+	bob.expectIRC(t, ":chat 422 bob")
+
+	bob.sendIRC(t, "PING :12345")
+	bob.expectIRC(t, ":chat PONG chat :12345")
+	bob.sendIRC(t, "WHOIS alice")
+	bob.expectIRC(t, ":chat 421 bob WHOIS :Unknown command")
+
+	// Channels are the rooms
+	bob.sendIRC(t, "PRIVMSG #general :hello")
+	bob.expectIRC(t, " 404 bob #general")
+	bob.sendIRC(t, "JOIN #general")
+	bob.expectIRC(t, ":bob!bob@chat JOIN #general")
+	if line := bob.expectIRC(t, " 353 bob = #general :"); !strings.Contains(line, "alice") || !strings.Contains(line, "bob") {
+		t.Errorf("Unexpected names: %s", line)
+	}
+	bob.expectIRC(t, ":chat 366 bob #general :End of /NAMES list")
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+	bob.sendIRC(t, "NAMES #general")
+	if line := bob.expectIRC(t, " 353 bob = #general :"); !strings.Contains(line, "@alice") {
+		t.Errorf("The owner should be a channel operator: %s", line)
+	}
+
+	// Messages are relayed both ways, actions as CTCP ACTION
+	bob.sendIRC(t, "PRIVMSG #general :hello alice")
+	if event := expectEvent(t, alice, model.StreamEventMessage, "general", "bob"); event.Text != "hello alice" {
+		t.Errorf("Unexpected message: %+v", event)
+	}
+	bob.sendIRC(t, "PRIVMSG #general :\x01ACTION waves\x01")
+	if event := expectEvent(t, alice, model.StreamEventAction, "general", "bob"); event.Text != "waves" {
+		t.Errorf("Unexpected action: %+v", event)
+	}
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hi bob\nhow are you?"})
+	expectEvent(t, alice, model.StreamEventMessage, "general", "alice")
+	bob.expectIRC(t, ":alice!alice@chat PRIVMSG #general :hi bob")
+	bob.expectIRC(t, ":alice!alice@chat PRIVMSG #general :how are you?")
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "/me smiles"})
+	expectEvent(t, alice, model.StreamEventAction, "general", "alice")
+	bob.expectIRC(t, ":alice!alice@chat PRIVMSG #general :\x01ACTION smiles\x01")
+	bob.sendIRC(t, "PRIVMSG alice :psst")
+	bob.expectIRC(t, " 401 bob alice :No such nick/channel")
+
+	// Only channel operators can change the topic
+	bob.sendIRC(t, "TOPIC #general :Bob's room")
+	bob.expectIRC(t, " 482 bob #general")
+	bob.sendIRC(t, "TOPIC #general")
+	bob.expectIRC(t, " 331 bob #general :No topic is set")
+	topic := "Welcome to general"
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestUpdateRoom, Room: "general", Update: &model.RoomUpdate{Topic: &topic}})
+	expectEvent(t, alice, model.StreamEventRoomUpdated, "general", "alice")
+	bob.expectIRC(t, ":alice!alice@chat TOPIC #general :Welcome to general")
+	bob.sendIRC(t, "TOPIC #general")
+	bob.expectIRC(t, ":chat 332 bob #general :Welcome to general")
+
+	// Renames change the nickname
+	bob.sendIRC(t, "NICK alice")
+	bob.expectIRC(t, " 433 bob alice :Nickname is already in use")
+	bob.sendIRC(t, "NICK robert")
+	bob.expectIRC(t, ":bob!bob@chat NICK :robert")
+	expectEvent(t, alice, model.StreamEventRenamed, "general", "bob")
+
+	bob.sendIRC(t, "PART #general")
+	bob.expectIRC(t, ":robert!robert@chat PART #general")
+	expectEvent(t, alice, model.StreamEventLeft, "general", "robert")
+
+	// Quitting logs out the user
+	bob.sendIRC(t, "QUIT :bye")
+	bob.expectIRC(t, "ERROR :"+ircClosingLinkMessage)
+	waitForLogout(t, handlerFixture, "robert")
+}
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"NICK bob", "NICK", []string{"bob"}},
+		{"privmsg #general :hello there\r\n", "PRIVMSG", []string{"#general", "hello there"}},
+		{"@time=now :bob!bob@host PRIVMSG #general ::)", "PRIVMSG", []string{"#general", ":)"}},
+		{"USER bob 0 *  :Bob Smith", "USER", []string{"bob", "0", "*", "Bob Smith"}},
+		{"", "", nil},
+	}
+	for _, tt := range tests {
+		command, params := parseIRCLine(tt.line)
+		if command != tt.command || strings.Join(params, "|") != strings.Join(tt.params, "|") {
+			t.Errorf("parseIRCLine(%q) = %q %q, want %q %q", tt.line, command, params, tt.command, tt.params)
+		}
+	}
+}
+
+func TestIRCPrivateRooms(t *testing.T) {
+	handlerFixture := NewHandler()
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go handlerFixture.ServeIRC(listener)
+
+	alice := connectToStream(t, server, "alice", loginUser(t, server, "alice").Token)
+	defer alice.Close()
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "secret"})
+	expectEvent(t, alice, model.StreamEventJoined, "secret", "alice")
+	private, topic := true, "Secret plans"
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestUpdateRoom, Room: "secret", Update: &model.RoomUpdate{Private: &private, Topic: &topic}})
+	expectEvent(t, alice, model.StreamEventRoomUpdated, "secret", "alice")
+
+	// Users that aren't members of a private room can't see its members nor its topic
+	carol := connectToIRC(t, listener.Addr().String())
+	carol.sendIRC(t, "NICK carol")
+	carol.sendIRC(t, "USER carol 0 * :Carol")
+	carol.expectIRC(t, ":chat 422 carol")
+	carol.sendIRC(t, "NAMES #secret")
+	carol.expectIRC(t, ":chat 403 carol #secret :No such channel")
+	carol.sendIRC(t, "TOPIC #secret")
+	carol.expectIRC(t, ":chat 403 carol #secret :No such channel")
+}
+
+func TestSplitIRCText(t *testing.T) {
+	long := strings.Repeat("é", ircMaxTextLength)
+	lines := splitIRCText("first\r\nsecond\n" + long)
+	if len(lines) != 4 || lines[0] != "first" || lines[1] != "second" {
+		t.Fatalf("Unexpected lines: %q", lines)
+	}
+	if len(lines[2]) > ircMaxTextLength || lines[2]+lines[3] != long {
+		t.Errorf("Long lines should be split on rune boundaries: %d %d", len(lines[2]), len(lines[3]))
+	}
+
+	// Lone carriage returns also break lines, so texts can't smuggle commands in a message
+	if lines := splitIRCText("hi\rQUIT\x00"); len(lines) != 2 || lines[0] != "hi" || lines[1] != "QUIT" {
+		t.Errorf("Unexpected lines: %q", lines)
+	}
+}
+
+func TestValidNames(t *testing.T) {
+	for _, name := range []string{"alice\r\nQUIT", "alice\n", "alice\x00"} {
+		if validUsername(name) {
+			t.Errorf("Username %q should be invalid", name)
+		}
+		if validRoomName(name) {
+			t.Errorf("Room name %q should be invalid", name)
+		}
+	}
+	if !validUsername("alice smith") || !validRoomName("general") {
+		t.Errorf("Names without line breaks should be valid")
+	}
+}
+
+func TestIRCParameters(t *testing.T) {
+	var tests = []struct {
+		value    string
+		param    string
+		trailing string
+	}{
+		{"alice", "alice", "alice"},
+		{"alice smith", "alice_smith", "alice smith"},
+		{"x\r\nQUIT", "x__QUIT", "x  QUIT"},
+		{"nul\x00", "nul_", "nul "},
+		{":op", "_:op", ":op"},
+		{"", "_", ""},
+	}
+	for _, tt := range tests {
+		if param := ircParam(tt.value); param != tt.param {
+			t.Errorf("ircParam(%q) = %q, want %q", tt.value, param, tt.param)
+		}
+		if trailing := ircTrailing(tt.value); trailing != tt.trailing {
+			t.Errorf("ircTrailing(%q) = %q, want %q", tt.value, trailing, tt.trailing)
+		}
+	}
+	if source := ircSource("bad name"); source != "bad_name!bad_name@chat" {
+		t.Errorf("Unexpected source: %q", source)
+	}
+}
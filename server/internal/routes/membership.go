@@ -0,0 +1,520 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// MembershipStore keeps the rooms joined by each user across sessions, so that a user that logs in
+// again is rejoined to its rooms. Memberships are only removed when the user leaves the room,
+// is kicked from it or the room is closed.
+// Every membership has a read marker, the ID of the last message of the room read by the user.
+// The store is used while the rooms are locked, so it shouldn't wait on I/O.
+type MembershipStore interface {
+	// Add records that the user is a member of the room, having read up to the lastRead message.
+	// The read marker of an existing membership is kept.
+	Add(username string, room string, lastRead int64) error
+	// Remove forgets that the user is a member of the room.
+	Remove(username string, room string) error
+	// RemoveRoom forgets every membership of the room.
+	RemoveRoom(room string) error
+	// Rename moves the memberships of the user to its new username.
+	Rename(username string, nickname string) error
+	// MarkRead advances the read marker of the user in the room to the given message.
+	// Markers never move back, and users that are not members of the room are ignored.
+	MarkRead(username string, room string, messageID int64) error
+	// ResetReadMarkers moves the read markers of the room past the lastMessageID message back to it.
+	// It's used when a room is created again, since its messages are numbered from the start.
+	ResetReadMarkers(room string, lastMessageID int64) error
+	// Rooms returns the sorted rooms the user is a member of.
+	Rooms(username string) ([]string, error)
+	// ReadMarkers maps the rooms the user is a member of to the ID of the last message it read.
+	ReadMarkers(username string) (map[string]int64, error)
+	// Members returns the sorted members of the room.
+	Members(room string) ([]string, error)
+}
+
+// MemoryMembershipStore keeps the memberships in memory. They are lost when the server stops.
+type MemoryMembershipStore struct {
+	mu sync.RWMutex
+	// rooms maps every room to the read markers of its members
+	rooms map[string]map[string]int64
+}
+
+func NewMemoryMembershipStore() *MemoryMembershipStore {
+	return &MemoryMembershipStore{rooms: make(map[string]map[string]int64)}
+}
+
+func (store *MemoryMembershipStore) Add(username string, room string, lastRead int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.addLocked(username, room, lastRead)
+	return nil
+}
+
+// addLocked adds the membership and reports whether it's new.
+func (store *MemoryMembershipStore) addLocked(username string, room string, lastRead int64) bool {
+	if _, ok := store.rooms[room][username]; ok {
+		return false
+	}
+	if store.rooms[room] == nil {
+		store.rooms[room] = make(map[string]int64)
+	}
+	store.rooms[room][username] = lastRead
+	return true
+}
+
+func (store *MemoryMembershipStore) Remove(username string, room string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.removeLocked(username, room)
+	return nil
+}
+
+// removeLocked removes the membership and reports whether it existed.
+func (store *MemoryMembershipStore) removeLocked(username string, room string) bool {
+	if _, ok := store.rooms[room][username]; !ok {
+		return false
+	}
+	delete(store.rooms[room], username)
+	if len(store.rooms[room]) == 0 {
+		delete(store.rooms, room)
+	}
+	return true
+}
+
+func (store *MemoryMembershipStore) RemoveRoom(room string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.rooms, room)
+	return nil
+}
+
+func (store *MemoryMembershipStore) Rename(username string, nickname string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.renameLocked(username, nickname)
+	return nil
+}
+
+func (store *MemoryMembershipStore) renameLocked(username string, nickname string) {
+	for _, members := range store.rooms {
+		if lastRead, ok := members[username]; ok {
+			delete(members, username)
+			members[nickname] = lastRead
+		}
+	}
+}
+
+func (store *MemoryMembershipStore) MarkRead(username string, room string, messageID int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.markReadLocked(username, room, messageID)
+	return nil
+}
+
+// markReadLocked advances the read marker and reports whether it moved.
+func (store *MemoryMembershipStore) markReadLocked(username string, room string, messageID int64) bool {
+	lastRead, ok := store.rooms[room][username]
+	if !ok || messageID <= lastRead {
+		return false
+	}
+	store.rooms[room][username] = messageID
+	return true
+}
+
+func (store *MemoryMembershipStore) ResetReadMarkers(room string, lastMessageID int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.resetReadMarkersLocked(room, lastMessageID)
+	return nil
+}
+
+// resetReadMarkersLocked moves back the read markers past the message and reports whether any moved.
+func (store *MemoryMembershipStore) resetReadMarkersLocked(room string, lastMessageID int64) bool {
+	reset := false
+	for username, lastRead := range store.rooms[room] {
+		if lastRead > lastMessageID {
+			store.rooms[room][username] = lastMessageID
+			reset = true
+		}
+	}
+	return reset
+}
+
+func (store *MemoryMembershipStore) Rooms(username string) ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var rooms []string
+	for room, members := range store.rooms {
+		if _, ok := members[username]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+func (store *MemoryMembershipStore) ReadMarkers(username string) (map[string]int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	markers := make(map[string]int64)
+	for room, members := range store.rooms {
+		if lastRead, ok := members[username]; ok {
+			markers[room] = lastRead
+		}
+	}
+	return markers, nil
+}
+
+func (store *MemoryMembershipStore) Members(room string) ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	usernames := make([]string, 0, len(store.rooms[room]))
+	for username := range store.rooms[room] {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+// membershipSaveInterval is the time the changes to the memberships are batched for before being saved.
+const membershipSaveInterval = time.Second
+
+// FileMembershipStore keeps the memberships in memory and saves them to a JSON file in the background,
+// at most once per interval, so they survive a restart of the server.
+// Changes made since the last save are lost if the server stops without closing the store.
+type FileMembershipStore struct {
+	MemoryMembershipStore
+	path string
+	// changed reports whether the memberships changed since they were last saved, guarded by mu
+	changed bool
+	// saving serializes the writes of the file
+	saving sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewFileMembershipStore loads the memberships saved in the file at path, if it exists,
+// and starts saving their changes to it until the store is closed.
+func NewFileMembershipStore(path string) (*FileMembershipStore, error) {
+	store := &FileMembershipStore{
+		MemoryMembershipStore: *NewMemoryMembershipStore(),
+		path:                  path,
+		stop:                  make(chan struct{}),
+		done:                  make(chan struct{}),
+	}
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &store.rooms); err != nil {
+			return nil, fmt.Errorf("corrupted membership file %s: %w", path, err)
+		}
+		if store.rooms == nil {
+			store.rooms = make(map[string]map[string]int64)
+		}
+	}
+	go store.saveChanges(membershipSaveInterval)
+	return store, nil
+}
+
+func (store *FileMembershipStore) Add(username string, room string, lastRead int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.addLocked(username, room, lastRead) {
+		store.changed = true
+	}
+	return nil
+}
+
+func (store *FileMembershipStore) Remove(username string, room string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.removeLocked(username, room) {
+		store.changed = true
+	}
+	return nil
+}
+
+func (store *FileMembershipStore) RemoveRoom(room string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.rooms, room)
+	store.changed = true
+	return nil
+}
+
+func (store *FileMembershipStore) Rename(username string, nickname string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.renameLocked(username, nickname)
+	store.changed = true
+	return nil
+}
+
+func (store *FileMembershipStore) MarkRead(username string, room string, messageID int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.markReadLocked(username, room, messageID) {
+		store.changed = true
+	}
+	return nil
+}
+
+func (store *FileMembershipStore) ResetReadMarkers(room string, lastMessageID int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.resetReadMarkersLocked(room, lastMessageID) {
+		store.changed = true
+	}
+	return nil
+}
+
+// saveChanges saves the memberships every interval if they changed, until the store is closed.
+func (store *FileMembershipStore) saveChanges(interval time.Duration) {
+	defer close(store.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.Flush(); err != nil {
+				log.Printf("Can't save the memberships to %s: %v", store.path, err)
+			}
+		case <-store.stop:
+			return
+		}
+	}
+}
+
+// Flush saves the memberships if they changed since they were last saved.
+// The file is written without holding the lock of the memberships, so the store can be used meanwhile.
+func (store *FileMembershipStore) Flush() error {
+	store.saving.Lock()
+	defer store.saving.Unlock()
+
+	store.mu.Lock()
+	if !store.changed {
+		store.mu.Unlock()
+		return nil
+	}
+	content, err := json.Marshal(store.rooms)
+	store.changed = false
+	store.mu.Unlock()
+	if err == nil {
+		err = store.save(content)
+	}
+	if err != nil {
+		// Try again with the next save
+		store.mu.Lock()
+		store.changed = true
+		store.mu.Unlock()
+	}
+	return err
+}
+
+// Close stops saving the changes in the background and saves the last ones.
+func (store *FileMembershipStore) Close() error {
+	close(store.stop)
+	<-store.done
+	return store.Flush()
+}
+
+// save writes the content to a temporary file and renames it over the membership file,
+// so the file is never left half written.
+func (store *FileMembershipStore) save(content []byte) error {
+	temporary, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(content); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), store.path)
+}
+
+// remember records a membership, having read up to the lastRead message, logging the failures of the store.
+func (handler *Handler) remember(username string, room string, lastRead int64) {
+	if handler.Memberships == nil {
+		return
+	}
+	if err := handler.Memberships.Add(username, room, lastRead); err != nil {
+		log.Printf("Can't store the membership of %s in room %s: %v", username, room, err)
+	}
+}
+
+// forget removes a membership, logging the failures of the store.
+func (handler *Handler) forget(username string, room string) {
+	if handler.Memberships == nil {
+		return
+	}
+	if err := handler.Memberships.Remove(username, room); err != nil {
+		log.Printf("Can't remove the membership of %s in room %s: %v", username, room, err)
+	}
+}
+
+// markRead advances a read marker, logging the failures of the store.
+func (handler *Handler) markRead(username string, room string, messageID int64) {
+	if handler.Memberships == nil {
+		return
+	}
+	if err := handler.Memberships.MarkRead(username, room, messageID); err != nil {
+		log.Printf("Can't mark room %s read up to %d for %s: %v", room, messageID, username, err)
+	}
+}
+
+// resetReadMarkers moves back the read markers past the last message of a room created again,
+// logging the failures of the store.
+func (handler *Handler) resetReadMarkers(room string, lastMessageID int64) {
+	if handler.Memberships == nil {
+		return
+	}
+	if err := handler.Memberships.ResetReadMarkers(room, lastMessageID); err != nil {
+		log.Printf("Can't reset the read markers of room %s: %v", room, err)
+	}
+}
+
+// forgetRoom removes the memberships of a closed room, logging the failures of the store.
+func (handler *Handler) forgetRoom(room string) {
+	if handler.Memberships == nil {
+		return
+	}
+	if err := handler.Memberships.RemoveRoom(room); err != nil {
+		log.Printf("Can't remove the memberships of room %s: %v", room, err)
+	}
+}
+
+// renameMemberships moves the memberships of a renamed user, logging the failures of the store.
+func (handler *Handler) renameMemberships(username string, nickname string) {
+	if handler.Memberships == nil {
+		return
+	}
+	if err := handler.Memberships.Rename(username, nickname); err != nil {
+		log.Printf("Can't rename the memberships of %s to %s: %v", username, nickname, err)
+	}
+}
+
+// storedRooms returns the rooms the user is a member of, logging the failures of the store.
+func (handler *Handler) storedRooms(username string) []string {
+	if handler.Memberships == nil {
+		return nil
+	}
+	rooms, err := handler.Memberships.Rooms(username)
+	if err != nil {
+		log.Printf("Can't load the memberships of %s: %v", username, err)
+	}
+	return rooms
+}
+
+// storedMembers returns the members of the room, logging the failures of the store.
+func (handler *Handler) storedMembers(room string) ([]string, error) {
+	if handler.Memberships == nil {
+		return nil, nil
+	}
+	usernames, err := handler.Memberships.Members(room)
+	if err != nil {
+		log.Printf("Can't load the members of room %s: %v", room, err)
+	}
+	return usernames, err
+}
+
+// hasStoredMembers reports whether the room has stored members, treating the failures of the store as members
+// so that rooms are not lost while the store is unavailable.
+func (handler *Handler) hasStoredMembers(room string) bool {
+	usernames, err := handler.storedMembers(room)
+	return err != nil || len(usernames) > 0
+}
+
+// rejoinRooms joins the user to the rooms it's a member of, when its stream is connected.
+// Memberships of rooms the user can no longer join, for example because its invitation was revoked, are removed.
+func (handler *Handler) rejoinRooms(username string) {
+	actor := handler.principalOf(username)
+	for _, roomName := range handler.storedRooms(username) {
+		if err := handler.joinRoom(actor, roomName, ""); err != nil {
+			log.Printf("Can't rejoin %s to room %s: %v", username, roomName, err)
+			handler.forget(username, roomName)
+			handler.sendEvent(username, newErrorEvent(roomName, streamErrorCode(err), err.Error()))
+		}
+	}
+}
+
+// roomMembers returns the members of the room, including the offline ones, with their role.
+// This function assumes that the ActiveRooms lock is already acquired by the caller.
+func (handler *Handler) roomMembers(room model.Room) []model.RoomMember {
+	stored, _ := handler.storedMembers(room.Name)
+	usernames := make(map[string]struct{}, len(stored)+len(room.Members))
+	for _, username := range stored {
+		usernames[username] = struct{}{}
+	}
+	for username := range room.Members {
+		usernames[username] = struct{}{}
+	}
+
+	roomMembers := make([]model.RoomMember, 0, len(usernames))
+	for username := range usernames {
+		_, online := room.Members[username]
+		roomMembers = append(roomMembers, model.RoomMember{Username: username, Online: online, Role: roomRole(room, username)})
+	}
+	sort.Slice(roomMembers, func(i, j int) bool { return roomMembers[i].Username < roomMembers[j].Username })
+	return roomMembers
+}
+
+// membersOf returns the members of the room as seen by the actor.
+// Private rooms are only visible to their members and invited users, as if they didn't exist.
+func (handler *Handler) membersOf(actor principal, roomName string) ([]model.RoomMember, error) {
+	handler.ActiveRooms.RLock()
+	defer handler.ActiveRooms.RUnlock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if !ok || !canSeeRoom(actor, room) {
+		return nil, newStreamError(model.ErrorCodeRoomNotFound, fmt.Sprintf("Room %s not found", roomName))
+	}
+	return handler.roomMembers(room), nil
+}
+
+// listMembers sends the members of the room to the user.
+func (handler *Handler) listMembers(actor principal, roomName string) error {
+	roomMembers, err := handler.membersOf(actor, roomName)
+	if err != nil {
+		return err
+	}
+	event := newEvent(model.StreamEventMembers, roomName, "", "")
+	event.RoomMembers = roomMembers
+	handler.sendEvent(actor.Username, event)
+	return nil
+}
+
+// getRoomMembers is a handler function that returns the members of a room, with their online status and role.
+func (handler *Handler) getRoomMembers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	actor, ok := handler.authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	roomName := r.PathValue("room")
+	roomMembers, err := handler.membersOf(actor, roomName)
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, model.RoomMembersResponse{Room: roomName, Members: roomMembers})
+}
@@ -0,0 +1,240 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// loginUser logs in the user through the server and returns the login response.
+func loginUser(t *testing.T, server *httptest.Server, username string) model.UserLoginResponse {
+	t.Helper()
+	body, _ := json.Marshal(model.UserLoginRequest{Username: username})
+	resp, err := http.Post(server.URL+"/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	var response model.UserLoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// waitForLogout waits until the server cleans up the session of the user.
+func waitForLogout(t *testing.T, handler *Handler, username string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		handler.LoggedUsers.RLock()
+		_, ok := handler.LoggedUsers.Users[username]
+		handler.LoggedUsers.RUnlock()
+		if !ok {
+			return
+		}
+	}
+	t.Fatalf("User %s is still logged in", username)
+}
+
+func TestRejoinRoomsAfterLogin(t *testing.T) {
+	handlerFixture := NewHandler()
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	login := loginUser(t, server, "alice")
+	if login.Rooms != nil {
+		t.Errorf("New user should have no rooms: %v", login.Rooms)
+	}
+	alice := connectToStream(t, server, "alice", login.Token)
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "random"})
+	expectEvent(t, alice, model.StreamEventJoined, "random", "alice")
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestLeave, Room: "random"})
+	expectEvent(t, alice, model.StreamEventLeft, "random", "alice")
+	alice.Close()
+	waitForLogout(t, handlerFixture, "alice")
+
+	// The room is kept while it has members, even if none of them is online
+	handlerFixture.ActiveRooms.RLock()
+	_, general := handlerFixture.ActiveRooms.Rooms["general"]
+	_, random := handlerFixture.ActiveRooms.Rooms["random"]
+	handlerFixture.ActiveRooms.RUnlock()
+	if !general || random {
+		t.Errorf("Unexpected rooms: general %v, random %v", general, random)
+	}
+
+	login = loginUser(t, server, "alice")
+	if !reflect.DeepEqual(login.Rooms, []string{"general"}) {
+		t.Errorf("Unexpected rooms in login response: %v", login.Rooms)
+	}
+	alice = connectToStream(t, server, "alice", login.Token)
+	defer alice.Close()
+	event := expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	if event.Role != model.RoomRoleOwner {
+		t.Errorf("Owner should keep its role after rejoining: %+v", event)
+	}
+
+	// Joining again is harmless
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	if event := expectEvent(t, alice, model.StreamEventJoined, "general", "alice"); !reflect.DeepEqual(event.Members, []string{"alice"}) {
+		t.Errorf("Unexpected members: %v", event.Members)
+	}
+}
+
+func TestRoomMembers(t *testing.T) {
+	handlerFixture := NewHandler()
+	for _, username := range []string{"alice", "bob", "carol"} {
+		handlerFixture.addUserLocked(model.User{Username: username, Token: username + "-token"})
+	}
+	handlerFixture.ActiveRooms.Rooms["general"] = model.Room{
+		Name:    "general",
+		Members: map[string]struct{}{"alice": {}, "bob": {}},
+		Roles:   map[string]model.RoomRole{"alice": model.RoomRoleOwner, "dave": model.RoomRoleModerator},
+	}
+	handlerFixture.ActiveRooms.Rooms["hideout"] = model.Room{Name: "hideout", Private: true, Members: map[string]struct{}{"alice": {}}}
+	for _, username := range []string{"alice", "bob", "dave"} {
+		handlerFixture.Memberships.Add(username, "general", 0)
+	}
+	handlerFixture.Memberships.Add("alice", "hideout", 0)
+
+	var tests = []struct {
+		name    string
+		room    string
+		token   string
+		status  int
+		members []model.RoomMember
+	}{
+		{"online and offline members", "general", "carol-token", http.StatusOK, []model.RoomMember{
+			{Username: "alice", Online: true, Role: model.RoomRoleOwner},
+			{Username: "bob", Online: true, Role: model.RoomRoleMember},
+			{Username: "dave", Online: false, Role: model.RoomRoleModerator},
+		}},
+		{"member of private room", "hideout", "alice-token", http.StatusOK, []model.RoomMember{
+			{Username: "alice", Online: true, Role: model.RoomRoleMember},
+		}},
+		{"private room is hidden", "hideout", "bob-token", http.StatusNotFound, nil},
+		{"unknown room", "nowhere", "alice-token", http.StatusNotFound, nil},
+		{"invalid token", "general", "other", http.StatusUnauthorized, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/rooms/"+tt.room+"/members", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rr := httptest.NewRecorder()
+			handlerFixture.NewServeMux().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var response model.RoomMembersResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Room != tt.room || !reflect.DeepEqual(response.Members, tt.members) {
+				t.Errorf("handler returned unexpected members: got %+v want %+v", response.Members, tt.members)
+			}
+		})
+	}
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+	carol := connectToStream(t, server, "carol", "carol-token")
+	defer carol.Close()
+	sendRequest(t, carol, model.StreamRequest{Type: model.StreamRequestMembers, Room: "general"})
+	if event := expectEvent(t, carol, model.StreamEventMembers, "general", ""); len(event.RoomMembers) != 3 {
+		t.Errorf("Unexpected members event: %+v", event.RoomMembers)
+	}
+	sendRequest(t, carol, model.StreamRequest{Type: model.StreamRequestMembers, Room: "hideout"})
+	if event := expectEvent(t, carol, model.StreamEventError, "hideout", ""); event.Error.Code != model.ErrorCodeRoomNotFound {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+}
+
+func TestFileMembershipStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memberships.json")
+	store, err := NewFileMembershipStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("alice", "general", 0)
+	store.Add("bob", "general", 0)
+	store.Add("alice", "random", 0)
+	store.Add("carol", "closed", 0)
+	store.Remove("bob", "general")
+	store.MarkRead("alice", "general", 5)
+	store.MarkRead("alice", "general", 3)
+	store.Add("alice", "general", 1)
+	store.Rename("alice", "alicia")
+	store.RemoveRoom("closed")
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileMembershipStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if rooms, _ := reopened.Rooms("alicia"); !reflect.DeepEqual(rooms, []string{"general", "random"}) {
+		t.Errorf("Unexpected rooms: %v", rooms)
+	}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if rooms, _ := reopened.Rooms(username); len(rooms) != 0 {
+			t.Errorf("User %s should have no rooms: %v", username, rooms)
+		}
+	}
+	if members, _ := reopened.Members("general"); !reflect.DeepEqual(members, []string{"alicia"}) {
+		t.Errorf("Unexpected members: %v", members)
+	}
+	// Read markers only move forward
+	if markers, _ := reopened.ReadMarkers("alicia"); !reflect.DeepEqual(markers, map[string]int64{"general": 5, "random": 0}) {
+		t.Errorf("Unexpected read markers: %v", markers)
+	}
+}
+
+func TestFileMembershipStoreBatchesSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memberships.json")
+	store, err := NewFileMembershipStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.Add("alice", "general", 0)
+	for messageID := int64(1); messageID <= 100; messageID++ {
+		store.MarkRead("alice", "general", messageID)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Changes should be saved in the background, got %v", err)
+	}
+
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != `{"general":{"alice":100}}` {
+		t.Errorf("Unexpected membership file: %s", content)
+	}
+}
@@ -0,0 +1,296 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// remoteIP returns the IP of a remote address in host:port form.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// expiry returns the end of a mute or a ban lasting the given seconds, nil if it lasts until lifted.
+func expiry(duration int) (*time.Time, error) {
+	if duration < 0 {
+		return nil, newStreamError(model.ErrorCodeInvalidDuration, "Duration can't be negative")
+	}
+	if duration == 0 {
+		return nil, nil
+	}
+	expiresAt := time.Now().UTC().Add(time.Duration(duration) * time.Second)
+	return &expiresAt, nil
+}
+
+// isMuted reports whether the user is muted in the room.
+func isMuted(room model.Room, username string) bool {
+	until, ok := room.Mutes[username]
+	return ok && (until.IsZero() || time.Now().Before(until))
+}
+
+// activeBan returns the ban that applies to the username or the IP, if any. Expired bans are removed.
+func (handler *Handler) activeBan(username string, ip string) (model.Ban, bool) {
+	handler.ActiveBans.Lock()
+	defer handler.ActiveBans.Unlock()
+	now := time.Now()
+	for bannedUsername, ban := range handler.ActiveBans.Bans {
+		if ban.ExpiresAt != nil && now.After(*ban.ExpiresAt) {
+			delete(handler.ActiveBans.Bans, bannedUsername)
+			continue
+		}
+		if ban.Username == username || (ban.IP != "" && ban.IP == ip) {
+			return ban, true
+		}
+	}
+	return model.Ban{}, false
+}
+
+// banMessage describes a ban for the error returned to the banned user.
+func banMessage(username string, ban model.Ban) (string, string) {
+	message := fmt.Sprintf("User %s is banned", username)
+	if ban.ExpiresAt != nil {
+		return message, fmt.Sprintf("until %s", ban.ExpiresAt.Format(time.RFC3339))
+	}
+	return message, "permanently"
+}
+
+// kickUser removes a user from a room and notifies the members and the kicked user.
+func (handler *Handler) kickUser(actor principal, roomName string, target string, reason string) error {
+	targetPrincipal := handler.principalOf(target)
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if _, isMember := room.Members[target]; !ok || !isMember {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", target, roomName))
+	}
+	if err := authorize(actor, actionKick, room, targetPrincipal, ""); err != nil {
+		handler.ActiveRooms.Unlock()
+		return err
+	}
+	// Kicked users lose their invitation to invite-only rooms
+	delete(room.Invites, target)
+	handler.forget(target, roomName)
+	deleted := handler.removeMemberLocked(room, target)
+	recipients := append(members(room), target)
+	handler.ActiveRooms.Unlock()
+
+	handler.audit(model.AuditEvent{Action: model.AuditActionKick, Actor: actorName(actor), Target: target, Room: roomName, Details: reason})
+	handler.broadcastRoom(roomName, recipients, newEvent(model.StreamEventKicked, roomName, target, reason))
+	if deleted {
+		handler.unsubscribeRoom(roomName)
+	}
+	return nil
+}
+
+// muteUser mutes a member of a room for the given seconds, zero meaning until unmuted, and notifies the members.
+func (handler *Handler) muteUser(actor principal, roomName string, target string, duration int, reason string) error {
+	expiresAt, err := expiry(duration)
+	if err != nil {
+		return err
+	}
+
+	targetPrincipal := handler.principalOf(target)
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if _, isMember := room.Members[target]; !ok || !isMember {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", target, roomName))
+	}
+	if err := authorize(actor, actionMute, room, targetPrincipal, ""); err != nil {
+		handler.ActiveRooms.Unlock()
+		return err
+	}
+	if room.Mutes == nil {
+		room.Mutes = make(map[string]time.Time)
+		handler.ActiveRooms.Rooms[roomName] = room
+	}
+	var until time.Time
+	if expiresAt != nil {
+		until = *expiresAt
+	}
+	room.Mutes[target] = until
+	recipients := members(room)
+	handler.ActiveRooms.Unlock()
+
+	handler.audit(model.AuditEvent{Action: model.AuditActionMute, Actor: actorName(actor), Target: target, Room: roomName, Details: reason})
+	muted := newEvent(model.StreamEventMuted, roomName, target, reason)
+	muted.ExpiresAt = expiresAt
+	handler.broadcastRoom(roomName, recipients, muted)
+	return nil
+}
+
+// unmuteUser lifts the mute of a user in a room and notifies the members.
+func (handler *Handler) unmuteUser(actor principal, roomName string, target string) error {
+	targetPrincipal := handler.principalOf(target)
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if !ok {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", target, roomName))
+	}
+	if _, muted := room.Mutes[target]; !muted {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeNotMuted, fmt.Sprintf("User %s is not muted in room %s", target, roomName))
+	}
+	if err := authorize(actor, actionMute, room, targetPrincipal, ""); err != nil {
+		handler.ActiveRooms.Unlock()
+		return err
+	}
+	delete(room.Mutes, target)
+	recipients := members(room)
+	handler.ActiveRooms.Unlock()
+
+	handler.audit(model.AuditEvent{Action: model.AuditActionUnmute, Actor: actorName(actor), Target: target, Room: roomName})
+	handler.broadcastRoom(roomName, recipients, newEvent(model.StreamEventUnmuted, roomName, target, ""))
+	return nil
+}
+
+// banUser bans a user, disconnecting it if it's logged in.
+func (handler *Handler) banUser(actor principal, banRequest model.BanRequest) (model.Ban, error) {
+	if !validUsername(banRequest.Username) {
+		return model.Ban{}, newStreamError(model.ErrorCodeInvalidUsername, "Invalid username")
+	}
+	expiresAt, err := expiry(banRequest.Duration)
+	if err != nil {
+		return model.Ban{}, err
+	}
+	if err := authorize(actor, actionBan, model.Room{}, handler.principalOf(banRequest.Username), ""); err != nil {
+		return model.Ban{}, err
+	}
+
+	ban := model.Ban{
+		Username:  banRequest.Username,
+		IP:        banRequest.IP,
+		Reason:    banRequest.Reason,
+		By:        actorName(actor),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	if banRequest.BanIP && ban.IP == "" {
+		handler.LoggedUsers.RLock()
+		ban.IP = handler.LoggedUsers.Users[banRequest.Username].IP
+		handler.LoggedUsers.RUnlock()
+	}
+
+	handler.ActiveBans.Lock()
+	if handler.ActiveBans.Bans == nil {
+		handler.ActiveBans.Bans = make(model.Bans)
+	}
+	handler.ActiveBans.Bans[ban.Username] = ban
+	handler.ActiveBans.Unlock()
+	handler.audit(model.AuditEvent{Action: model.AuditActionBan, Actor: ban.By, Target: ban.Username, IP: ban.IP, Details: ban.Reason})
+
+	// Disconnect the banned user, and any other user logged in from the banned IP
+	handler.LoggedUsers.Lock()
+	var cleanups []userCleanup
+	for username, user := range handler.LoggedUsers.Users {
+		if username != ban.Username && (ban.IP == "" || user.IP != ban.IP) {
+			continue
+		}
+		banned := newEvent(model.StreamEventBanned, "", username, ban.Reason)
+		banned.ExpiresAt = ban.ExpiresAt
+		handler.broadcast([]string{username}, banned)
+		cleanups = append(cleanups, CleanupUserData(handler, model.UserWithTokenRequest{Username: username}))
+		handler.audit(model.AuditEvent{Action: model.AuditActionForcedLogout, Actor: ban.By, Target: username, IP: user.IP, Details: "banned"})
+	}
+	handler.LoggedUsers.Unlock()
+	for _, cleanup := range cleanups {
+		handler.finishCleanup(cleanup)
+		handler.releaseSession(cleanup.username, cleanup.token)
+	}
+	// The banned user may be logged in to another node, which disconnects it when it refreshes the session
+	if handler.releaseSession(ban.Username, "") {
+		banned := newEvent(model.StreamEventBanned, "", ban.Username, ban.Reason)
+		banned.ExpiresAt = ban.ExpiresAt
+		handler.relay(userTopic(ban.Username), banned)
+	}
+	return ban, nil
+}
+
+// liftBan removes the ban of a user.
+func (handler *Handler) liftBan(actor principal, username string) error {
+	if err := authorize(actor, actionBan, model.Room{}, handler.principalOf(username), ""); err != nil {
+		return err
+	}
+	handler.ActiveBans.Lock()
+	_, ok := handler.ActiveBans.Bans[username]
+	delete(handler.ActiveBans.Bans, username)
+	handler.ActiveBans.Unlock()
+	if !ok {
+		return newStreamError(model.ErrorCodeBanNotFound, fmt.Sprintf("User %s is not banned", username))
+	}
+	handler.audit(model.AuditEvent{Action: model.AuditActionUnban, Actor: actorName(actor), Target: username})
+	return nil
+}
+
+// adminListBans is a handler function that returns the bans currently enforced.
+func (handler *Handler) adminListBans(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionBan); !ok {
+		return
+	}
+
+	now := time.Now()
+	handler.ActiveBans.RLock()
+	bans := make([]model.Ban, 0, len(handler.ActiveBans.Bans))
+	for _, ban := range handler.ActiveBans.Bans {
+		if ban.ExpiresAt == nil || now.Before(*ban.ExpiresAt) {
+			bans = append(bans, ban)
+		}
+	}
+	handler.ActiveBans.RUnlock()
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Username < bans[j].Username })
+	writeJSON(w, http.StatusOK, model.BansResponse{Bans: bans})
+}
+
+// adminBan is a handler function that bans a user by username and optionally by IP, disconnecting it.
+func (handler *Handler) adminBan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	actor, ok := handler.authorizeRequest(w, r, actionBan)
+	if !ok {
+		return
+	}
+	var banRequest model.BanRequest
+	if !decodeRequest(w, r, &banRequest) {
+		return
+	}
+
+	ban, err := handler.banUser(actor, banRequest)
+	if err != nil {
+		writeStreamError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ban)
+}
+
+// adminUnban is a handler function that lifts the ban of a user.
+func (handler *Handler) adminUnban(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	actor, ok := handler.authorizeRequest(w, r, actionBan)
+	if !ok {
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := handler.liftBan(actor, username); err != nil {
+		writeStreamError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, model.AdminActionResponse{Message: fmt.Sprintf("Ban of user %s lifted", username)})
+}
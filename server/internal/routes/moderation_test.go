@@ -0,0 +1,250 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/gorilla/websocket"
+)
+
+func TestLoginBannedUser(t *testing.T) {
+	var tests = []struct {
+		name string
+		ban  model.Ban
+	}{
+		{"by username", model.Ban{Username: "alice"}},
+		{"by IP", model.Ban{Username: "someone-else", IP: "192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/login", strings.NewReader(`{"username": "alice"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = "192.0.2.1:1234"
+
+			rr := httptest.NewRecorder()
+			handlerFixture := NewHandler()
+			handlerFixture.ActiveBans.Bans[tt.ban.Username] = tt.ban
+			handler := http.HandlerFunc(handlerFixture.login)
+
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusForbidden {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, http.StatusForbidden)
+			}
+			assertErrorResponse(t, rr, model.ErrorCodeBanned, "User alice is banned")
+		})
+	}
+}
+
+func TestLoginExpiredBan(t *testing.T) {
+	req, err := http.NewRequest("POST", "/login", strings.NewReader(`{"username": "alice"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	expired := time.Now().Add(-time.Minute)
+	handlerFixture := NewHandler()
+	handlerFixture.ActiveBans.Bans["alice"] = model.Ban{Username: "alice", ExpiresAt: &expired}
+	handler := http.HandlerFunc(handlerFixture.login)
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	handlerFixture.ActiveBans.RLock()
+	defer handlerFixture.ActiveBans.RUnlock()
+	if _, ok := handlerFixture.ActiveBans.Bans["alice"]; ok {
+		t.Errorf("Expired ban should be removed")
+	}
+}
+
+func TestWebsocketConnectionBannedUser(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.ActiveBans.Bans["alice"] = model.Ban{Username: "alice"}
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	url := "ws" + server.URL[4:] + "/stream"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"username": "alice", "token": "alice-token"}`)); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	_, response, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	var errorResponse model.ErrorResponse
+	if err := json.Unmarshal(response, &errorResponse); err != nil || errorResponse.Code != model.ErrorCodeBanned {
+		t.Errorf("Unexpected handshake response: %s", response)
+	}
+}
+
+func TestModerationKickAndMute(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	bob := connectToStream(t, server, "bob", "bob-token")
+	defer bob.Close()
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+	expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+
+	// Muted users get a typed error when sending messages
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMute, Room: "general", User: "bob", Duration: 60, Text: "calm down"})
+	expectEvent(t, alice, model.StreamEventMuted, "general", "bob")
+	if muted := expectEvent(t, bob, model.StreamEventMuted, "general", "bob"); muted.ExpiresAt == nil {
+		t.Errorf("Muted event should carry the end of the mute")
+	}
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello"})
+	if event := expectEvent(t, bob, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeMuted {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	// Only muted users can be unmuted
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestUnmute, Room: "general", User: "alice"})
+	if event := expectEvent(t, alice, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeNotMuted {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	// Members can't kick the owner
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestKick, Room: "general", User: "alice"})
+	if event := expectEvent(t, bob, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeForbidden {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestKick, Room: "general", User: "bob", Text: "bye"})
+	expectEvent(t, alice, model.StreamEventKicked, "general", "bob")
+	if kicked := expectEvent(t, bob, model.StreamEventKicked, "general", "bob"); kicked.Text != "bye" {
+		t.Errorf("Kicked event should carry the reason, got %v", kicked.Text)
+	}
+
+	events, err := handlerFixture.Audit.Query(model.AuditFilter{User: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action+":"+event.Actor+":"+event.Target)
+	}
+	if strings.Join(actions, ",") != "mute:alice:bob,kick:alice:bob" {
+		t.Errorf("Unexpected audit log: %v", actions)
+	}
+}
+
+func TestModerationPrivilegedTarget(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.PrivilegedUsers = map[string]model.PrivilegedUser{"root": {Role: model.RoleAdmin, Secret: "s3cret"}}
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "mod", Token: "mod-token", Role: model.RoleModerator})
+	handlerFixture.addUserLocked(model.User{Username: "other", Token: "other-token", Role: model.RoleModerator})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	mod := connectToStream(t, server, "mod", "mod-token")
+	defer mod.Close()
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	sendRequest(t, mod, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "mod")
+	expectEvent(t, mod, model.StreamEventJoined, "general", "mod")
+
+	// The owner of the room can't moderate a global moderator
+	for _, requestType := range []string{model.StreamRequestKick, model.StreamRequestMute} {
+		sendRequest(t, alice, model.StreamRequest{Type: requestType, Room: "general", User: "mod"})
+		if event := expectEvent(t, alice, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeForbidden {
+			t.Errorf("Unexpected error event of %s: %+v", requestType, event.Error)
+		}
+	}
+
+	// Global moderators can't ban other global moderators, nor admins who aren't logged in
+	for _, target := range []string{"other", "root"} {
+		if _, err := handlerFixture.banUser(handlerFixture.principalOf("mod"), model.BanRequest{Username: target}); streamErrorCode(err) != model.ErrorCodeForbidden {
+			t.Errorf("Ban of %s returned %v, want a forbidden error", target, err)
+		}
+	}
+	handlerFixture.ActiveBans.RLock()
+	bans := len(handlerFixture.ActiveBans.Bans)
+	handlerFixture.ActiveBans.RUnlock()
+	if bans != 0 {
+		t.Errorf("Unexpected bans: got %d want 0", bans)
+	}
+
+	// But they can ban users
+	if _, err := handlerFixture.banUser(handlerFixture.principalOf("mod"), model.BanRequest{Username: "alice"}); err != nil {
+		t.Errorf("Ban of alice failed: %v", err)
+	}
+}
+
+func TestAdminBanDisconnectsUser(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token", IP: "127.0.0.1"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+
+	rr := adminRequest(t, handlerFixture, "POST", "/admin/bans", `{"username": "alice", "ban_ip": true, "duration": 3600, "reason": "spam"}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var ban model.Ban
+	if err := json.Unmarshal(rr.Body.Bytes(), &ban); err != nil || ban.IP != "127.0.0.1" || ban.ExpiresAt == nil {
+		t.Errorf("handler returned unexpected ban: %v", rr.Body.String())
+	}
+
+	if banned := expectEvent(t, alice, model.StreamEventBanned, "", "alice"); banned.Text != "spam" {
+		t.Errorf("Banned event should carry the reason, got %v", banned.Text)
+	}
+	handlerFixture.LoggedUsers.RLock()
+	_, loggedIn := handlerFixture.LoggedUsers.Users["alice"]
+	handlerFixture.LoggedUsers.RUnlock()
+	if loggedIn {
+		t.Errorf("Banned user should be logged out")
+	}
+
+	rr = adminRequest(t, handlerFixture, "DELETE", "/admin/bans/alice", "")
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	rr = adminRequest(t, handlerFixture, "DELETE", "/admin/bans/alice", "")
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
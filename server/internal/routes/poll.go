@@ -0,0 +1,241 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+const (
+	// defaultPollTimeout is the time a poll waits for events when the client doesn't set it.
+	defaultPollTimeout = 25 * time.Second
+	// maxPollTimeout is the longest time a poll can wait for events.
+	maxPollTimeout = 60 * time.Second
+	// pollSessionTimeout is the time after the end of a poll after which the user is disconnected, like
+	// when a websocket is closed, unless it polls again.
+	pollSessionTimeout = 2 * maxPollTimeout
+	// maxPollEvents is the largest number of events returned by a poll.
+	maxPollEvents = 100
+)
+
+// polls keeps the queues of the users connected through long polling, by session token,
+// which doesn't change when the user is renamed.
+type polls struct {
+	sync.Mutex
+	queues map[string]*pollQueue
+}
+
+// pollQueue reads the channel of a user connected through long polling. Events are numbered in the order they are
+// taken from the channel and kept until the client acknowledges them with the cursor of a later poll, so that
+// the events of a response lost on its way to the client are returned again.
+//
+// Only one poll of the user is served at a time, holding the lock of its queue.
+type pollQueue struct {
+	mu       sync.Mutex
+	username string
+	channel  chan []byte
+	// sequence is the number of the last event taken from the channel
+	sequence int64
+	// pending are the events returned but not acknowledged yet, the last one numbered sequence
+	pending [][]byte
+	// expiry disconnects the user when it stops polling
+	expiry *time.Timer
+	// dropped is set when the queue expires, when the user logs out or when it's replaced by a new queue of the session,
+	// so that neither the polls still holding the queue nor its expiry use it again
+	dropped atomic.Bool
+}
+
+// poll is a handler function that returns the frames of the stream queued for the user, waiting until some arrive
+// or the timeout elapses. The first poll connects the user to the stream like the websocket handshake does,
+// and its first frame is the welcome frame. Later polls send the cursor of the previous response back,
+// which acknowledges its events. Requests are sent with POST /messages.
+//
+// The events are taken from the same channel as the websocket writer, so connecting through another transport
+// moves the events still queued to it. The user is disconnected, and logged out, when it stops polling.
+func (handler *Handler) poll(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	actor, ok := handler.authenticateSession(w, r)
+	if !ok {
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	cursor, timeout, err := parsePollQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidQuery, "Invalid poll query", err.Error())
+		return
+	}
+
+	queue, err := handler.pollQueueOf(model.UserWithTokenRequest{Username: actor.Username, Token: token}, remoteIP(r.RemoteAddr))
+	if err != nil {
+		writeHandshakeError(w, err)
+		return
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	// The queue may have expired, or been dropped, while waiting for a previous poll of the user
+	if !queue.expiry.Stop() || queue.dropped.Load() {
+		writeHandshakeError(w, &handshakeError{code: model.ErrorCodeNotLoggedIn, message: fmt.Sprintf("User %s is not logged in", actor.Username)})
+		return
+	}
+	defer func() {
+		if !queue.dropped.Load() {
+			queue.expiry.Reset(pollSessionTimeout)
+		}
+	}()
+
+	queue.acknowledge(cursor)
+	queue.receive(r, timeout)
+
+	events := make([]json.RawMessage, len(queue.pending))
+	for i, event := range queue.pending {
+		events[i] = event
+	}
+	writeJSON(w, http.StatusOK, model.PollResponse{Cursor: queue.sequence, Events: events})
+}
+
+// parsePollQuery reads the cursor and the timeout of a poll from the query string of the request.
+func parsePollQuery(r *http.Request) (int64, time.Duration, error) {
+	query := r.URL.Query()
+	var cursor int64
+	if value := query.Get("cursor"); value != "" {
+		var err error
+		if cursor, err = strconv.ParseInt(value, 10, 64); err != nil || cursor < 0 {
+			return 0, 0, fmt.Errorf("invalid cursor %q", value)
+		}
+	}
+	timeout := defaultPollTimeout
+	if value := query.Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxPollTimeout {
+			return 0, 0, fmt.Errorf("timeout must be between 0 and %d seconds", int(maxPollTimeout.Seconds()))
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	return cursor, timeout, nil
+}
+
+// pollQueueOf returns the queue of the session, connecting the user to the stream if the session isn't polling yet,
+// or if the user connected through another transport since its last poll.
+func (handler *Handler) pollQueueOf(userWithTokenRequest model.UserWithTokenRequest, ip string) (*pollQueue, error) {
+	handler.polls.Lock()
+	queue, ok := handler.polls.queues[userWithTokenRequest.Token]
+	handler.polls.Unlock()
+	if ok {
+		if handler.connections.channel(userWithTokenRequest.Username) == queue.channel {
+			return queue, nil
+		}
+		queue.dropped.Store(true)
+		queue.expiry.Stop()
+	}
+
+	channel, err := handler.bindChannel(userWithTokenRequest, ip, "poll")
+	if err != nil {
+		return nil, err
+	}
+	welcome, err := json.Marshal(model.WebsocketWelcomeResponse{Welcome: userWithTokenRequest.Username})
+	if err != nil {
+		handler.disconnectStream(userWithTokenRequest.Username, channel)
+		return nil, err
+	}
+	queue = &pollQueue{username: userWithTokenRequest.Username, channel: channel}
+	queue.push(welcome)
+	queue.expiry = time.AfterFunc(pollSessionTimeout, func() {
+		handler.expirePoll(userWithTokenRequest.Token, queue)
+	})
+
+	handler.polls.Lock()
+	if handler.polls.queues == nil {
+		handler.polls.queues = make(map[string]*pollQueue)
+	}
+	handler.polls.queues[userWithTokenRequest.Token] = queue
+	handler.polls.Unlock()
+
+	handler.subscribeUser(userWithTokenRequest.Username)
+	handler.rejoinRooms(userWithTokenRequest.Username)
+	return queue, nil
+}
+
+// expirePoll disconnects the user of the queue when it stopped polling, unless it connected again since.
+func (handler *Handler) expirePoll(token string, queue *pollQueue) {
+	if queue.dropped.Swap(true) {
+		return
+	}
+	handler.polls.Lock()
+	if handler.polls.queues[token] == queue {
+		delete(handler.polls.queues, token)
+	}
+	handler.polls.Unlock()
+	log.Printf("User %s stopped polling", queue.username)
+	handler.disconnectStream(queue.username, queue.channel)
+}
+
+// dropPoll removes the queue of the session when the user logs out, instead of keeping it until it expires.
+func (handler *Handler) dropPoll(token string) {
+	handler.polls.Lock()
+	queue, ok := handler.polls.queues[token]
+	delete(handler.polls.queues, token)
+	handler.polls.Unlock()
+	if ok {
+		queue.dropped.Store(true)
+		queue.expiry.Stop()
+	}
+}
+
+// push numbers the event and adds it to the pending events.
+// This function assumes that the lock of the queue is already acquired by the caller.
+func (queue *pollQueue) push(event []byte) {
+	queue.sequence++
+	queue.pending = append(queue.pending, event)
+}
+
+// acknowledge drops the pending events numbered up to the cursor.
+// This function assumes that the lock of the queue is already acquired by the caller.
+func (queue *pollQueue) acknowledge(cursor int64) {
+	first := queue.sequence - int64(len(queue.pending)) + 1
+	if cursor >= first {
+		queue.pending = queue.pending[min(cursor-first+1, int64(len(queue.pending))):]
+	}
+}
+
+// receive takes the events queued in the channel, up to maxPollEvents pending events. If there are none,
+// it waits until an event arrives, the timeout elapses, the client goes away or the channel is closed.
+// This function assumes that the lock of the queue is already acquired by the caller.
+func (queue *pollQueue) receive(r *http.Request, timeout time.Duration) {
+	if len(queue.pending) == 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case event, ok := <-queue.channel:
+			if !ok {
+				return
+			}
+			queue.push(event)
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	for len(queue.pending) < maxPollEvents {
+		select {
+		case event, ok := <-queue.channel:
+			if !ok {
+				return
+			}
+			queue.push(event)
+		default:
+			return
+		}
+	}
+}
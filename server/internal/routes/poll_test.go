@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// pollEvents polls the events of the user, returning the status code and the response.
+func pollEvents(t *testing.T, server *httptest.Server, token string, query string) (int, model.PollResponse) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/poll?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response model.PollResponse
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, response
+}
+
+// expectPolledEvents polls from the cursor and checks the types and senders of the returned events.
+func expectPolledEvents(t *testing.T, server *httptest.Server, token string, cursor int64, expected ...model.StreamEvent) model.PollResponse {
+	t.Helper()
+	status, response := pollEvents(t, server, token, fmt.Sprintf("cursor=%d&timeout=5", cursor))
+	if status != http.StatusOK {
+		t.Fatalf("Poll returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if len(response.Events) != len(expected) {
+		t.Fatalf("Unexpected number of events: got %d want %d: %s", len(response.Events), len(expected), response.Events)
+	}
+	for i, data := range response.Events {
+		var event model.StreamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != expected[i].Type || event.From != expected[i].From {
+			t.Errorf("Unexpected event: got %s want type=%s from=%s", data, expected[i].Type, expected[i].From)
+		}
+	}
+	return response
+}
+
+func TestLongPolling(t *testing.T) {
+	handlerFixture := NewHandler()
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+	alice := loginUser(t, server, "alice")
+	bob := connectToStream(t, server, "bob", loginUser(t, server, "bob").Token)
+	defer bob.Close()
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+
+	// The first poll connects the user, starting with the welcome frame
+	status, response := pollEvents(t, server, alice.Token, "")
+	if status != http.StatusOK || response.Cursor != 1 || len(response.Events) != 1 {
+		t.Fatalf("Unexpected first poll: %v %+v", status, response)
+	}
+	var welcome model.WebsocketWelcomeResponse
+	if err := json.Unmarshal(response.Events[0], &welcome); err != nil || welcome.Welcome != "alice" {
+		t.Fatalf("Unexpected welcome message: %s", response.Events[0])
+	}
+
+	if status, code := postStreamRequest(t, server, alice.Token, `{"type": "join", "room": "general"}`); status != http.StatusOK {
+		t.Fatalf("Join returned wrong status code: got %v (%s) want %v", status, code, http.StatusOK)
+	}
+	expectEvent(t, bob, model.StreamEventJoined, "general", "alice")
+	joined := model.StreamEvent{Type: model.StreamEventJoined, From: "alice"}
+	response = expectPolledEvents(t, server, alice.Token, response.Cursor, joined)
+	if response.Cursor != 2 {
+		t.Errorf("Unexpected cursor: got %d want %d", response.Cursor, 2)
+	}
+	// Events are returned again until they are acknowledged
+	expectPolledEvents(t, server, alice.Token, 1, joined)
+
+	// Polls wait until an event arrives
+	polled := make(chan model.PollResponse)
+	go func() {
+		_, response := pollEvents(t, server, alice.Token, "cursor=2&timeout=5")
+		polled <- response
+	}()
+	time.Sleep(50 * time.Millisecond)
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello alice"})
+	expectEvent(t, bob, model.StreamEventMessage, "general", "bob")
+	select {
+	case response = <-polled:
+		if response.Cursor != 3 || len(response.Events) != 1 {
+			t.Errorf("Unexpected poll: %+v", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Poll didn't return the message")
+	}
+	// Or return no events once the timeout elapses
+	if status, response := pollEvents(t, server, alice.Token, "cursor=3&timeout=0"); status != http.StatusOK || response.Cursor != 3 || len(response.Events) != 0 {
+		t.Errorf("Unexpected empty poll: %v %+v", status, response)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		query  string
+		status int
+	}{
+		{"invalid cursor", alice.Token, "cursor=abc", http.StatusBadRequest},
+		{"negative cursor", alice.Token, "cursor=-1", http.StatusBadRequest},
+		{"invalid timeout", alice.Token, "timeout=3600", http.StatusBadRequest},
+		{"invalid token", "invalid-token", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := pollEvents(t, server, tt.token, tt.query); status != tt.status {
+				t.Errorf("Poll returned wrong status code: got %v want %v", status, tt.status)
+			}
+		})
+	}
+
+	// Switching to the websocket keeps the events queued for the polls
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "are you there?"})
+	expectEvent(t, bob, model.StreamEventMessage, "general", "bob")
+	conn := connectToStream(t, server, "alice", alice.Token)
+	defer conn.Close()
+	if event := expectEvent(t, conn, model.StreamEventMessage, "general", "bob"); event.Text != "are you there?" {
+		t.Errorf("Unexpected message: %+v", event)
+	}
+}
+
+func TestLongPollingExpiry(t *testing.T) {
+	handlerFixture := NewHandler()
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+	alice := loginUser(t, server, "alice")
+
+	if status, _ := pollEvents(t, server, alice.Token, "timeout=0"); status != http.StatusOK {
+		t.Fatalf("Poll returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	handlerFixture.polls.Lock()
+	queue := handlerFixture.polls.queues[alice.Token]
+	handlerFixture.polls.Unlock()
+	if queue == nil {
+		t.Fatal("Poll should start a poll queue")
+	}
+
+	// Users that stop polling are disconnected, like when their websocket is closed
+	handlerFixture.expirePoll(alice.Token, queue)
+	waitForLogout(t, handlerFixture, "alice")
+	if status, _ := pollEvents(t, server, alice.Token, "timeout=0"); status != http.StatusUnauthorized {
+		t.Errorf("Poll after expiry returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
+
+func TestLongPollingLogout(t *testing.T) {
+	handlerFixture := NewHandler()
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+	alice := loginUser(t, server, "alice")
+
+	if status, _ := pollEvents(t, server, alice.Token, "timeout=0"); status != http.StatusOK {
+		t.Fatalf("Poll returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	handlerFixture.polls.Lock()
+	queue := handlerFixture.polls.queues[alice.Token]
+	handlerFixture.polls.Unlock()
+
+	// Logging out drops the queue instead of waiting for it to expire
+	resp, err := http.Post(server.URL+"/logout", "application/json", strings.NewReader(`{"username":"alice","token":"`+alice.Token+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	handlerFixture.polls.Lock()
+	queues := len(handlerFixture.polls.queues)
+	handlerFixture.polls.Unlock()
+	if queues != 0 || !queue.dropped.Load() || queue.expiry.Stop() {
+		t.Errorf("Poll queue should be dropped on logout")
+	}
+}
@@ -0,0 +1,626 @@
+package routes
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// redisTimeout bounds the time to connect to the Redis server, to send a command and read its reply,
+	// and to get the confirmation of a subscription.
+	redisTimeout = 5 * time.Second
+	// redisPingInterval is the time between the PINGs sent over the subscription connection, which is idle otherwise.
+	// The connection is considered lost if nothing is received for longer than the interval and redisTimeout.
+	redisPingInterval = 15 * time.Second
+	// redisReconnectDelay is the time before reconnecting a lost subscription connection, doubled after every failed
+	// attempt up to redisMaxReconnectDelay.
+	redisReconnectDelay    = 100 * time.Millisecond
+	redisMaxReconnectDelay = 10 * time.Second
+)
+
+// redisDeliveryBufferSize is the number of received messages queued for delivery to the subscriptions.
+const redisDeliveryBufferSize = 256
+
+// RedisBroker is a Broker backed by the publish/subscribe commands of a Redis server.
+// It uses a connection to publish and another one, in subscribe mode, to receive the messages.
+// The subscription connection is reconnected when it's lost, subscribing again to every topic,
+// and new subscriptions fail until it is.
+type RedisBroker struct {
+	addr      string
+	publisher *redisClient
+
+	mu sync.Mutex
+	// subscriber is nil while the subscription connection is lost, and err is the reason
+	subscriber *redisConn
+	err        error
+	topics     map[string]map[*redisSubscription]struct{}
+	// confirmations are closed when the server confirms the subscription to their topic,
+	// or when the connection is lost
+	confirmations map[string]*redisConfirmation
+	closed        bool
+	stop          chan struct{}
+
+	// deliveries are run in order by a goroutine of their own, so that slow subscribers don't delay
+	// the confirmations read by the receiving goroutine
+	deliveries chan func()
+}
+
+// redisConfirmation is a pending SUBSCRIBE command, done once it's confirmed or failed with err.
+type redisConfirmation struct {
+	done chan struct{}
+	err  error
+}
+
+type redisSubscription struct {
+	broker  *RedisBroker
+	topic   string
+	deliver func(payload []byte)
+}
+
+// NewRedisBroker connects to the Redis server at addr, in host:port form.
+func NewRedisBroker(addr string) (*RedisBroker, error) {
+	publisher, err := dialRedisClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	subscriber, err := dialRedis(addr)
+	if err != nil {
+		publisher.Close()
+		return nil, err
+	}
+	broker := &RedisBroker{
+		addr:          addr,
+		publisher:     publisher,
+		subscriber:    subscriber,
+		topics:        make(map[string]map[*redisSubscription]struct{}),
+		confirmations: make(map[string]*redisConfirmation),
+		stop:          make(chan struct{}),
+		deliveries:    make(chan func(), redisDeliveryBufferSize),
+	}
+	go broker.receive(subscriber)
+	go broker.keepAlive()
+	go func() {
+		for deliver := range broker.deliveries {
+			deliver()
+		}
+	}()
+	return broker, nil
+}
+
+func (broker *RedisBroker) Publish(topic string, payload []byte) error {
+	_, err := broker.publisher.do("PUBLISH", topic, string(payload))
+	return err
+}
+
+// Subscribe sends the SUBSCRIBE command for the first subscription of a topic, and waits until the server
+// confirms it, so that the messages published afterwards are delivered.
+// It fails if the subscription connection is lost.
+func (broker *RedisBroker) Subscribe(topic string, deliver func(payload []byte)) (Subscription, error) {
+	broker.mu.Lock()
+	if broker.closed {
+		broker.mu.Unlock()
+		return nil, errors.New("broker closed")
+	}
+	if broker.subscriber == nil {
+		err := broker.err
+		broker.mu.Unlock()
+		return nil, fmt.Errorf("redis: subscription connection lost: %w", err)
+	}
+	confirmation, pending := broker.confirmations[topic]
+	if len(broker.topics[topic]) == 0 && !pending {
+		if err := broker.writeLocked("SUBSCRIBE", topic); err != nil {
+			broker.mu.Unlock()
+			return nil, err
+		}
+		confirmation = &redisConfirmation{done: make(chan struct{})}
+		broker.confirmations[topic] = confirmation
+		pending = true
+	}
+	if broker.topics[topic] == nil {
+		broker.topics[topic] = make(map[*redisSubscription]struct{})
+	}
+	subscription := &redisSubscription{broker: broker, topic: topic, deliver: deliver}
+	broker.topics[topic][subscription] = struct{}{}
+	broker.mu.Unlock()
+
+	if pending {
+		select {
+		case <-confirmation.done:
+			if confirmation.err != nil {
+				subscription.Unsubscribe()
+				return nil, fmt.Errorf("redis: subscription to %s failed: %w", topic, confirmation.err)
+			}
+		case <-time.After(redisTimeout):
+			subscription.Unsubscribe()
+			return nil, fmt.Errorf("redis: subscription to %s not confirmed", topic)
+		}
+	}
+	return subscription, nil
+}
+
+// Unsubscribe sends the UNSUBSCRIBE command when the last subscription of a topic is cancelled.
+func (subscription *redisSubscription) Unsubscribe() error {
+	broker := subscription.broker
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	subscriptions, ok := broker.topics[subscription.topic]
+	if _, subscribed := subscriptions[subscription]; !ok || !subscribed {
+		return nil
+	}
+	delete(subscriptions, subscription)
+	if len(subscriptions) > 0 || broker.closed {
+		return nil
+	}
+	delete(broker.topics, subscription.topic)
+	if broker.subscriber == nil {
+		// The topic isn't subscribed again when reconnecting
+		return nil
+	}
+	return broker.writeLocked("UNSUBSCRIBE", subscription.topic)
+}
+
+// writeLocked sends a command over the subscription connection, closing it if it fails so that receive reconnects it.
+// This function assumes that the broker lock is already acquired by the caller.
+func (broker *RedisBroker) writeLocked(args ...string) error {
+	err := broker.subscriber.writeCommand(args...)
+	if err != nil {
+		broker.subscriber.Close()
+	}
+	return err
+}
+
+func (broker *RedisBroker) Close() error {
+	broker.mu.Lock()
+	if broker.closed {
+		broker.mu.Unlock()
+		return nil
+	}
+	broker.closed = true
+	close(broker.stop)
+	broker.topics = make(map[string]map[*redisSubscription]struct{})
+	broker.failConfirmationsLocked(errors.New("broker closed"))
+	subscriber := broker.subscriber
+	broker.mu.Unlock()
+	var err error
+	if subscriber != nil {
+		err = subscriber.Close()
+	}
+	return errors.Join(err, broker.publisher.Close())
+}
+
+// receive queues the messages pushed by the server to the subscription connection for delivery,
+// reconnecting it when it's lost, until the broker is closed.
+func (broker *RedisBroker) receive(subscriber *redisConn) {
+	defer close(broker.deliveries)
+	for {
+		err := broker.receiveFrom(subscriber)
+		if !broker.disconnect(err) {
+			return
+		}
+		log.Printf("Redis subscription connection lost: %v", err)
+		if subscriber = broker.reconnect(); subscriber == nil {
+			return
+		}
+		log.Printf("Redis subscription connection restored")
+	}
+}
+
+// receiveFrom reads the messages pushed by the server to the subscription connection until it fails.
+func (broker *RedisBroker) receiveFrom(subscriber *redisConn) error {
+	for {
+		// The server answers the PINGs of keepAlive, so a silent connection is lost
+		subscriber.conn.SetReadDeadline(time.Now().Add(redisPingInterval + redisTimeout))
+		value, err := subscriber.readValue()
+		if err != nil {
+			return err
+		}
+		// Messages are pushed as ["message", topic, payload] and confirmations as ["subscribe", topic, count]
+		push, ok := value.([]any)
+		if !ok || len(push) != 3 {
+			continue
+		}
+		topic, _ := push[1].(string)
+		if push[0] == "subscribe" {
+			broker.mu.Lock()
+			if confirmation, ok := broker.confirmations[topic]; ok {
+				close(confirmation.done)
+				delete(broker.confirmations, topic)
+			}
+			broker.mu.Unlock()
+			continue
+		}
+		if push[0] != "message" {
+			continue
+		}
+		payload, _ := push[2].(string)
+
+		broker.mu.Lock()
+		delivers := make([]func([]byte), 0, len(broker.topics[topic]))
+		for subscription := range broker.topics[topic] {
+			delivers = append(delivers, subscription.deliver)
+		}
+		broker.mu.Unlock()
+		broker.deliveries <- func() {
+			for _, deliver := range delivers {
+				deliver([]byte(payload))
+			}
+		}
+	}
+}
+
+// disconnect records that the subscription connection was lost with err, failing the pending subscriptions.
+// It returns false if the broker was closed instead.
+func (broker *RedisBroker) disconnect(err error) bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.closed {
+		return false
+	}
+	broker.subscriber.Close()
+	broker.subscriber = nil
+	broker.err = err
+	broker.failConfirmationsLocked(err)
+	return true
+}
+
+// failConfirmationsLocked fails the pending subscriptions with err.
+// This function assumes that the broker lock is already acquired by the caller.
+func (broker *RedisBroker) failConfirmationsLocked(err error) {
+	for topic, confirmation := range broker.confirmations {
+		confirmation.err = err
+		close(confirmation.done)
+		delete(broker.confirmations, topic)
+	}
+}
+
+// reconnect connects the subscription connection again, waiting longer after every failed attempt,
+// and subscribes it to the topics of the current subscriptions. It returns nil if the broker is closed meanwhile.
+func (broker *RedisBroker) reconnect() *redisConn {
+	delay := redisReconnectDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-broker.stop:
+			return nil
+		}
+		delay = min(delay*2, redisMaxReconnectDelay)
+
+		subscriber, err := dialRedis(broker.addr)
+		if err != nil {
+			log.Printf("Can't reconnect to Redis: %v", err)
+			continue
+		}
+		broker.mu.Lock()
+		if broker.closed {
+			broker.mu.Unlock()
+			subscriber.Close()
+			return nil
+		}
+		topics := []string{"SUBSCRIBE"}
+		for topic := range broker.topics {
+			topics = append(topics, topic)
+		}
+		if len(topics) > 1 {
+			err = subscriber.writeCommand(topics...)
+		}
+		if err == nil {
+			broker.subscriber = subscriber
+			broker.err = nil
+		}
+		broker.mu.Unlock()
+		if err != nil {
+			log.Printf("Can't subscribe again to the topics: %v", err)
+			subscriber.Close()
+			continue
+		}
+		return subscriber
+	}
+}
+
+// keepAlive PINGs the server over the subscription connection, so that receive notices when it's lost.
+func (broker *RedisBroker) keepAlive() {
+	ticker := time.NewTicker(redisPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-broker.stop:
+			return
+		}
+		broker.mu.Lock()
+		if broker.subscriber != nil {
+			// A failed PING closes the connection, which is noticed by receive
+			broker.writeLocked("PING")
+		}
+		broker.mu.Unlock()
+	}
+}
+
+// RedisSessionRegistry is a SessionRegistry backed by a Redis server. Sessions are leases that expire
+// after TTL unless refreshed, so that the sessions of a node that stops are eventually released.
+// Each session is stored under a key of its username holding its token, and a key of its token holding its username.
+type RedisSessionRegistry struct {
+	client *redisClient
+	TTL    time.Duration
+}
+
+// NewRedisSessionRegistry connects to the Redis server at addr, in host:port form.
+func NewRedisSessionRegistry(addr string) (*RedisSessionRegistry, error) {
+	client, err := dialRedisClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisSessionRegistry{client: client, TTL: sessionLeaseTTL}, nil
+}
+
+func sessionKey(username string) string {
+	return "chat.session." + username
+}
+
+func tokenKey(token string) string {
+	return "chat.token." + token
+}
+
+func (registry *RedisSessionRegistry) ttl() string {
+	return strconv.FormatInt(registry.TTL.Milliseconds(), 10)
+}
+
+// get returns the string value of the key, or an empty string if it doesn't exist.
+func (registry *RedisSessionRegistry) get(key string) (string, error) {
+	value, err := registry.client.do("GET", key)
+	if err != nil {
+		return "", err
+	}
+	text, _ := value.(string)
+	return text, nil
+}
+
+// The scripts of the registry run atomically on the Redis server, so a session can't change between
+// checking its token and extending or deleting it. They reply 1 when they change the session, and 0 otherwise.
+const (
+	// claimSessionScript sets the session key with SET NX PX, and the token key if the session didn't exist.
+	// KEYS are the session and token keys, ARGV the token, the username and the TTL in milliseconds.
+	claimSessionScript = `if not redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[3]) then return 0 end
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+return 1`
+	// refreshSessionScript extends both keys if the session key holds the token.
+	// KEYS are the session and token keys, ARGV the token and the TTL in milliseconds.
+	refreshSessionScript = `if redis.call('GET', KEYS[1]) ~= ARGV[1] then return 0 end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1`
+	// releaseSessionScript deletes both keys if the session key holds the token.
+	// KEYS are the session and token keys, ARGV the token.
+	releaseSessionScript = `if redis.call('GET', KEYS[1]) ~= ARGV[1] then return 0 end
+redis.call('DEL', KEYS[1], KEYS[2])
+return 1`
+)
+
+// eval runs the script with the keys and the arguments, and reports whether it replied 1.
+func (registry *RedisSessionRegistry) eval(script string, keys []string, args ...string) (bool, error) {
+	command := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	value, err := registry.client.do(append(command, args...)...)
+	if err != nil {
+		return false, err
+	}
+	return value == int64(1), nil
+}
+
+func (registry *RedisSessionRegistry) Claim(username string, token string) error {
+	claimed, err := registry.eval(claimSessionScript, []string{sessionKey(username), tokenKey(token)}, token, username, registry.ttl())
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrSessionExists
+	}
+	return nil
+}
+
+func (registry *RedisSessionRegistry) Lookup(token string) (string, error) {
+	username, err := registry.get(tokenKey(token))
+	if err != nil {
+		return "", err
+	}
+	if username == "" {
+		return "", ErrSessionNotFound
+	}
+	// The token key may outlive a session released by a forced logout
+	if sessionToken, err := registry.get(sessionKey(username)); err != nil || sessionToken != token {
+		if err == nil {
+			err = ErrSessionNotFound
+		}
+		return "", err
+	}
+	return username, nil
+}
+
+func (registry *RedisSessionRegistry) Refresh(username string, token string) error {
+	refreshed, err := registry.eval(refreshSessionScript, []string{sessionKey(username), tokenKey(token)}, token, registry.ttl())
+	if err != nil {
+		return err
+	}
+	if !refreshed {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// Release declares both keys to the script, so the token of the session is read first if it's not given.
+// If the session changes meanwhile, it's read again, until the session is released or doesn't exist.
+func (registry *RedisSessionRegistry) Release(username string, token string) error {
+	for {
+		current := token
+		if current == "" {
+			var err error
+			if current, err = registry.get(sessionKey(username)); err != nil {
+				return err
+			}
+			if current == "" {
+				return ErrSessionNotFound
+			}
+		}
+		released, err := registry.eval(releaseSessionScript, []string{sessionKey(username), tokenKey(current)}, current)
+		if err != nil {
+			return err
+		}
+		if released {
+			return nil
+		}
+		if token != "" {
+			return ErrSessionNotFound
+		}
+	}
+}
+
+func (registry *RedisSessionRegistry) Close() error {
+	return registry.client.Close()
+}
+
+// redisClient sends commands over a single connection, one at a time.
+// The connection is dialed again by the next command after it fails.
+type redisClient struct {
+	addr   string
+	mu     sync.Mutex
+	conn   *redisConn
+	closed bool
+}
+
+func dialRedisClient(addr string) (*redisClient, error) {
+	conn, err := dialRedis(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &redisClient{addr: addr, conn: conn}, nil
+}
+
+// do sends a command and returns its reply, waiting up to redisTimeout for it.
+func (client *redisClient) do(args ...string) (any, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closed {
+		return nil, errors.New("redis: client closed")
+	}
+	if client.conn == nil {
+		conn, err := dialRedis(client.addr)
+		if err != nil {
+			return nil, err
+		}
+		client.conn = conn
+	}
+	client.conn.conn.SetReadDeadline(time.Now().Add(redisTimeout))
+	err := client.conn.writeCommand(args...)
+	var value any
+	if err == nil {
+		value, err = client.conn.readValue()
+	}
+	var replyError redisError
+	if err != nil && !errors.As(err, &replyError) {
+		// The reply may still arrive, so the connection can't be used for the next command
+		client.conn.Close()
+		client.conn = nil
+	}
+	return value, err
+}
+
+func (client *redisClient) Close() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.closed = true
+	if client.conn == nil {
+		return nil
+	}
+	return client.conn.Close()
+}
+
+// redisConn is a connection speaking the Redis serialization protocol (RESP).
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func dialRedis(addr string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return newRedisConn(conn), nil
+}
+
+func newRedisConn(conn net.Conn) *redisConn {
+	return &redisConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+}
+
+func (conn *redisConn) Close() error {
+	return conn.conn.Close()
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// writeCommand sends a command as an array of bulk strings, waiting up to redisTimeout for the server to take it.
+func (conn *redisConn) writeCommand(args ...string) error {
+	conn.conn.SetWriteDeadline(time.Now().Add(redisTimeout))
+	fmt.Fprintf(conn.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(conn.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return conn.writer.Flush()
+}
+
+// readValue reads a reply: simple and bulk strings are returned as strings, integers as int64 and arrays as []any.
+// Null bulk strings and arrays are returned as nil, and error replies as a redisError.
+func (conn *redisConn) readValue() (any, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed line %q", line)
+	}
+	kind, content := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return content, nil
+	case '-':
+		return nil, redisError(content)
+	case ':':
+		return strconv.ParseInt(content, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(content)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(conn.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(content)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		values := make([]any, length)
+		for i := range values {
+			if values[i], err = conn.readValue(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
@@ -0,0 +1,227 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/DaniSancas/go-chat-room/server/internal/msgpack"
+	"github.com/gorilla/websocket"
+)
+
+// maxRequestBodyBytes is the maximum size accepted for a JSON request body.
+const maxRequestBodyBytes = 1 << 20
+
+// errBodyMissing is returned by decodeJSONBody when the request has no body at all.
+var errBodyMissing = errors.New("request body missing")
+
+// errBodyTooLarge is returned by decodeJSONBody when the body exceeds maxRequestBodyBytes.
+var errBodyTooLarge = errors.New("request body too large")
+
+// writeJSON writes the given value as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Can't encode response: %v", err)
+	}
+}
+
+// writeError logs the failure and writes a model.ErrorResponse with the given status code.
+func writeError(w http.ResponseWriter, status int, code string, message string, details string) {
+	if details != "" {
+		log.Printf("%s: %s", message, details)
+	} else {
+		log.Print(message)
+	}
+	writeJSON(w, status, model.ErrorResponse{
+		Code:    code,
+		Message: message,
+		Details: details,
+	})
+}
+
+// allowMethod checks that the request uses the given method.
+// If it doesn't, it writes a 405 error response and returns false.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, model.ErrorCodeMethodNotAllowed, "Invalid request method", r.Method)
+	return false
+}
+
+// decodeJSONBody strictly decodes the JSON body of the request into dst.
+// The body is limited to maxRequestBodyBytes, unknown fields are rejected and
+// only a single JSON value is allowed.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return errBodyMissing
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			return errBodyTooLarge
+		case errors.Is(err, io.EOF):
+			return errBodyMissing
+		}
+		return err
+	}
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errors.New("body must contain a single JSON object")
+	}
+	return nil
+}
+
+// decodeRequest decodes the JSON body of the request into dst, writing the matching
+// error response if it fails. It returns false if the handler should stop processing.
+func decodeRequest(w http.ResponseWriter, r *http.Request, dst any) bool {
+	err := decodeJSONBody(w, r, dst)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errBodyMissing):
+		writeError(w, http.StatusBadRequest, model.ErrorCodeBodyMissing, "Request body missing", "")
+	case errors.Is(err, errBodyTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, model.ErrorCodeBodyTooLarge, "Request body too large",
+			fmt.Sprintf("maximum size is %d bytes", maxRequestBodyBytes))
+	default:
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidBody, "Can't decode body", err.Error())
+	}
+	return false
+}
+
+// writeStreamError writes the error of a room or moderation operation as an error response,
+// with the status code matching its error code.
+func writeStreamError(w http.ResponseWriter, err error) {
+	var requestError *streamError
+	if !errors.As(err, &requestError) {
+		writeError(w, http.StatusInternalServerError, model.ErrorCodeInternal, "Internal error", err.Error())
+		return
+	}
+	status := http.StatusBadRequest
+	switch requestError.code {
+	case model.ErrorCodeForbidden:
+		status = http.StatusForbidden
+	case model.ErrorCodeNotInRoom, model.ErrorCodeNotMuted, model.ErrorCodeRoomNotFound, model.ErrorCodeBanNotFound:
+		status = http.StatusNotFound
+	}
+	writeError(w, status, requestError.code, requestError.message, "")
+}
+
+// writeHandshakeError writes the reason the user can't log in or connect to the stream as an error response,
+// with the status code matching its error code.
+func writeHandshakeError(w http.ResponseWriter, err error) {
+	var rejected *handshakeError
+	if !errors.As(err, &rejected) {
+		writeError(w, http.StatusInternalServerError, model.ErrorCodeInternal, "Internal error", err.Error())
+		return
+	}
+	status := http.StatusUnauthorized
+	switch rejected.code {
+	case model.ErrorCodeInvalidUsername:
+		status = http.StatusBadRequest
+	case model.ErrorCodeBanned:
+		status = http.StatusForbidden
+	case model.ErrorCodeAlreadyLoggedIn:
+		status = http.StatusConflict
+	case model.ErrorCodeInternal:
+		status = http.StatusInternalServerError
+	}
+	writeError(w, status, rejected.code, rejected.message, rejected.details)
+}
+
+// lineBreakCharacters are the characters that usernames, room names and topics can't contain,
+// as they would end the messages of line based transports like IRC.
+const lineBreakCharacters = "\r\n\x00"
+
+// validUsername reports whether the username can be used to log in.
+func validUsername(username string) bool {
+	return strings.TrimSpace(username) != "" && len(username) <= 64 && !strings.ContainsAny(username, lineBreakCharacters)
+}
+
+// decodeWebsocketMessage strictly decodes a JSON websocket message into dst, rejecting unknown fields.
+func decodeWebsocketMessage(messageContent []byte, dst any) error {
+	if len(messageContent) > maxRequestBodyBytes {
+		return errBodyTooLarge
+	}
+	decoder := json.NewDecoder(bytes.NewReader(messageContent))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		return err
+	}
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errors.New("message must contain a single JSON object")
+	}
+	return nil
+}
+
+// writeWebsocketError logs the failure and sends a model.ErrorResponse through the websocket.
+func writeWebsocketError(conn *websocket.Conn, messageType int, code string, message string, details string) error {
+	if details != "" {
+		log.Printf("%s: %s", message, details)
+	} else {
+		log.Print(message)
+	}
+	msg, err := json.Marshal(model.ErrorResponse{
+		Code:    code,
+		Message: message,
+		Details: details,
+	})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := writeWebsocketMessage(conn, messageType, msg); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// compressionThreshold is the size of the smallest frame compressed when the client negotiated permessage-deflate.
+// Smaller frames, like most chat events, barely shrink and aren't worth the time.
+const compressionThreshold = 256
+
+// readWebsocketMessage reads a frame from the websocket, converting it to JSON if the client negotiated
+// the MessagePack subprotocol.
+func readWebsocketMessage(conn *websocket.Conn) (int, []byte, error) {
+	messageType, message, err := conn.ReadMessage()
+	if err != nil || conn.Subprotocol() != model.SubprotocolMessagePack {
+		return messageType, message, err
+	}
+	if len(message) > maxRequestBodyBytes {
+		return messageType, nil, errBodyTooLarge
+	}
+	message, err = msgpack.ToJSON(message)
+	if err != nil {
+		// Frames that can't be converted are answered like invalid JSON
+		return messageType, []byte{}, nil
+	}
+	return messageType, message, nil
+}
+
+// writeWebsocketMessage sends a JSON frame through the websocket, with the message type the client used in the handshake,
+// or as a binary MessagePack frame if the client negotiated the MessagePack subprotocol.
+func writeWebsocketMessage(conn *websocket.Conn, messageType int, message []byte) error {
+	if conn.Subprotocol() == model.SubprotocolMessagePack {
+		encoded, err := msgpack.FromJSON(message)
+		if err != nil {
+			return err
+		}
+		message, messageType = encoded, websocket.BinaryMessage
+	}
+	conn.EnableWriteCompression(len(message) >= compressionThreshold)
+	return conn.WriteMessage(messageType, message)
+}
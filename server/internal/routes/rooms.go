@@ -0,0 +1,493 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// userChannelBufferSize is the number of outgoing messages queued for a user.
+// When the queue is full, new messages for that user are dropped instead of blocking the sender.
+const userChannelBufferSize = 64
+
+// maxRoomNameLength is the maximum length of a room name.
+const maxRoomNameLength = 64
+
+// maxMessageLength is the maximum length of the text of a message.
+const maxMessageLength = 4096
+
+// maxTopicLength is the maximum length of the topic of a room.
+const maxTopicLength = 512
+
+// maxDescriptionLength is the maximum length of the description of a room.
+const maxDescriptionLength = 4096
+
+// maxMetadataKeys, maxMetadataKeyLength and maxMetadataValueLength limit the metadata of a room.
+const (
+	maxMetadataKeys        = 32
+	maxMetadataKeyLength   = 64
+	maxMetadataValueLength = 1024
+)
+
+// validRoomName reports whether the name can be used for a room.
+func validRoomName(name string) bool {
+	return strings.TrimSpace(name) != "" && len(name) <= maxRoomNameLength && !strings.ContainsAny(name, lineBreakCharacters)
+}
+
+// newEvent returns a StreamEvent of the given type stamped with the current time.
+func newEvent(eventType string, room string, from string, text string) model.StreamEvent {
+	return model.StreamEvent{
+		Type:      eventType,
+		Room:      room,
+		From:      from,
+		Text:      text,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// newErrorEvent returns an error StreamEvent with the given code and message.
+func newErrorEvent(room string, code string, message string) model.StreamEvent {
+	event := newEvent(model.StreamEventError, room, "", "")
+	event.Error = &model.ErrorResponse{Code: code, Message: message}
+	return event
+}
+
+// members returns the sorted usernames of the members of the room.
+func members(room model.Room) []string {
+	usernames := make([]string, 0, len(room.Members))
+	for username := range room.Members {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// joinRoom adds the user to the room, creating the room if it doesn't exist, and notifies its members.
+// The user that creates a room becomes its owner. Joining an invite-only room requires an invitation,
+// or a valid invite code which invites the user for good.
+func (handler *Handler) joinRoom(actor principal, roomName string, code string) error {
+	if !validRoomName(roomName) {
+		return newStreamError(model.ErrorCodeInvalidRoom, fmt.Sprintf("Invalid room name '%s'", roomName))
+	}
+	username := actor.Username
+
+	handler.ActiveRooms.Lock()
+	if handler.ActiveRooms.Rooms == nil {
+		handler.ActiveRooms.Rooms = make(model.Rooms)
+	}
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if !ok {
+		room = model.Room{
+			Name:      roomName,
+			CreatedAt: time.Now().UTC(),
+			CreatedBy: username,
+			Members:   make(map[string]struct{}),
+			Roles:     map[string]model.RoomRole{username: model.RoomRoleOwner},
+		}
+		log.Printf("Room %s created by %s", roomName, username)
+	}
+	if code != "" {
+		if err := redeemInviteLocked(&room, code, username); err != nil {
+			handler.ActiveRooms.Unlock()
+			return err
+		}
+	}
+	// Joining a room the user is already in only sends it the members and the description of the room again
+	_, alreadyMember := room.Members[username]
+	if !alreadyMember {
+		if err := authorize(actor, actionJoinRoom, room, principal{}, ""); err != nil {
+			handler.ActiveRooms.Unlock()
+			if room.InviteOnly {
+				return newStreamError(model.ErrorCodeInviteRequired, fmt.Sprintf("Room %s is invite-only", roomName))
+			}
+			return err
+		}
+		room.Members[username] = struct{}{}
+		handler.ActiveRooms.Rooms[roomName] = room
+		if !ok {
+			// The stored members of a room that existed before a restart read messages that are numbered again
+			handler.resetReadMarkers(roomName, room.LastMessageID)
+		}
+		handler.remember(username, roomName, room.LastMessageID)
+	}
+	recipients := members(room)
+	role := roomRole(room, username)
+	info := roomInfo(room)
+	handler.ActiveRooms.Unlock()
+
+	joined := newEvent(model.StreamEventJoined, roomName, username, "")
+	joined.Role = role
+	if !alreadyMember {
+		log.Printf("User %s joined room %s", username, roomName)
+		others := make([]string, 0, len(recipients))
+		for _, member := range recipients {
+			if member != username {
+				others = append(others, member)
+			}
+		}
+		handler.broadcastRoom(roomName, others, joined)
+	}
+	handler.subscribeRoom(roomName)
+
+	// The user that joins also gets the list of members and the description of the room
+	joined.Members = recipients
+	joined.RoomInfo = &info
+	handler.sendEvent(username, joined)
+	return nil
+}
+
+// removeMemberLocked removes the user from the online members of the room, deleting the room if it becomes empty.
+// Private and invite-only rooms are kept, so that their settings and invitations are not lost, and so are rooms
+// with stored members that will rejoin them.
+// It reports whether the room was deleted, in which case the caller cancels the subscription of the node
+// to the room with unsubscribeRoom once it releases the lock.
+// This function assumes that the ActiveRooms lock is already acquired by the caller.
+func (handler *Handler) removeMemberLocked(room model.Room, username string) bool {
+	delete(room.Members, username)
+	if len(room.Members) == 0 && !room.Private && !room.InviteOnly && !handler.hasStoredMembers(room.Name) {
+		delete(handler.ActiveRooms.Rooms, room.Name)
+		log.Printf("Room %s deleted", room.Name)
+		return true
+	}
+	return false
+}
+
+// leaveRoom removes the user from the room, deleting the room if it becomes empty, and notifies its members.
+func (handler *Handler) leaveRoom(actor principal, roomName string) error {
+	username := actor.Username
+
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if _, isMember := room.Members[username]; !ok || !isMember {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", username, roomName))
+	}
+	if err := authorize(actor, actionLeaveRoom, room, principal{}, ""); err != nil {
+		handler.ActiveRooms.Unlock()
+		return err
+	}
+	handler.forget(username, roomName)
+	deleted := handler.removeMemberLocked(room, username)
+	// The user that leaves is notified too, so the client knows the request succeeded
+	recipients := append(members(room), username)
+	handler.ActiveRooms.Unlock()
+
+	log.Printf("User %s left room %s", username, roomName)
+	handler.broadcastRoom(roomName, recipients, newEvent(model.StreamEventLeft, roomName, username, ""))
+	if deleted {
+		handler.unsubscribeRoom(roomName)
+	}
+	return nil
+}
+
+// sendMessage sends a message from the user to all the members of the room.
+// Messages starting with a slash are commands, run instead of being sent.
+// Commands are limited to the length of a message too, since some of them, like /me, send their text to the room.
+func (handler *Handler) sendMessage(actor principal, roomName string, text string) error {
+	if len(text) > maxMessageLength {
+		return newStreamError(model.ErrorCodeInvalidBody, fmt.Sprintf("Message can't be longer than %d bytes", maxMessageLength))
+	}
+	if isCommand(text) {
+		return handler.runCommand(actor, roomName, text)
+	}
+	text = strings.TrimPrefix(text, "/")
+	if strings.TrimSpace(text) == "" {
+		return newStreamError(model.ErrorCodeEmptyMessage, "Message can't be empty")
+	}
+	username := actor.Username
+
+	handler.ActiveRooms.RLock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if _, isMember := room.Members[username]; !ok || !isMember {
+		handler.ActiveRooms.RUnlock()
+		return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", username, roomName))
+	}
+	if err := authorize(actor, actionSendMessage, room, principal{}, ""); err != nil {
+		handler.ActiveRooms.RUnlock()
+		return err
+	}
+	handler.ActiveRooms.RUnlock()
+
+	message := Message{Room: roomName, From: username, Text: text}
+	if err := handler.filterMessage(&message); err != nil {
+		return err
+	}
+	return handler.publishMessage(newEvent(model.StreamEventMessage, roomName, username, message.Text))
+}
+
+// publishMessage assigns the next message ID of the room to the event and sends it to the members of the room.
+// The read marker of the sender moves to its own message.
+func (handler *Handler) publishMessage(event model.StreamEvent) error {
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[event.Room]
+	if !ok {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeRoomNotFound, fmt.Sprintf("Room %s not found", event.Room))
+	}
+	room.LastMessageID++
+	handler.ActiveRooms.Rooms[event.Room] = room
+	event.ID = room.LastMessageID
+	recipients := members(room)
+	handler.ActiveRooms.Unlock()
+
+	// Bots aren't members, but could be named after one
+	if !event.Bot {
+		handler.markRead(event.From, event.Room, event.ID)
+	}
+	handler.broadcastRoom(event.Room, recipients, event)
+	return nil
+}
+
+// roomInfo returns the description of the room sent to its members.
+// This function assumes that the ActiveRooms lock is already acquired by the caller.
+func roomInfo(room model.Room) model.RoomInfo {
+	info := model.RoomInfo{
+		Name:        room.Name,
+		Topic:       room.Topic,
+		Description: room.Description,
+		CreatedAt:   room.CreatedAt,
+		CreatedBy:   room.CreatedBy,
+		Private:     room.Private,
+		InviteOnly:  room.InviteOnly,
+	}
+	if len(room.Metadata) > 0 {
+		info.Metadata = make(map[string]string, len(room.Metadata))
+		for key, value := range room.Metadata {
+			info.Metadata[key] = value
+		}
+	}
+	return info
+}
+
+// validRoomUpdate checks the changes of a room update.
+func validRoomUpdate(update model.RoomUpdate) error {
+	if update.Topic != nil && len(*update.Topic) > maxTopicLength {
+		return newStreamError(model.ErrorCodeInvalidBody, fmt.Sprintf("Topic can't be longer than %d bytes", maxTopicLength))
+	}
+	if update.Topic != nil && strings.ContainsAny(*update.Topic, lineBreakCharacters) {
+		return newStreamError(model.ErrorCodeInvalidBody, "Topic can't contain line breaks")
+	}
+	if update.Description != nil && len(*update.Description) > maxDescriptionLength {
+		return newStreamError(model.ErrorCodeInvalidBody, fmt.Sprintf("Description can't be longer than %d bytes", maxDescriptionLength))
+	}
+	for key, value := range update.Metadata {
+		if strings.TrimSpace(key) == "" || len(key) > maxMetadataKeyLength {
+			return newStreamError(model.ErrorCodeInvalidBody, fmt.Sprintf("Metadata keys can't be blank or longer than %d bytes", maxMetadataKeyLength))
+		}
+		if len(value) > maxMetadataValueLength {
+			return newStreamError(model.ErrorCodeInvalidBody, fmt.Sprintf("Metadata values can't be longer than %d bytes", maxMetadataValueLength))
+		}
+	}
+	return nil
+}
+
+// updateRoom changes the topic, description or metadata of the room and notifies its members.
+// Owners and moderators of the room can change the topic, only owners can change the rest.
+func (handler *Handler) updateRoom(actor principal, roomName string, update model.RoomUpdate) error {
+	if err := validRoomUpdate(update); err != nil {
+		return err
+	}
+	act := actionUpdateRoom
+	if update.Description == nil && update.Metadata == nil && update.Private == nil && update.InviteOnly == nil {
+		act = actionSetTopic
+	}
+
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if _, isMember := room.Members[actor.Username]; !ok || (!isMember && actor.Role == model.RoleUser) {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", actor.Username, roomName))
+	}
+	if err := authorize(actor, act, room, principal{}, ""); err != nil {
+		handler.ActiveRooms.Unlock()
+		return err
+	}
+	if update.Topic != nil {
+		room.Topic = *update.Topic
+	}
+	if update.Description != nil {
+		room.Description = *update.Description
+	}
+	if update.Private != nil {
+		room.Private = *update.Private
+	}
+	if update.InviteOnly != nil {
+		room.InviteOnly = *update.InviteOnly
+	}
+	if len(update.Metadata) > 0 {
+		metadata := make(map[string]string, len(room.Metadata)+len(update.Metadata))
+		for key, value := range room.Metadata {
+			metadata[key] = value
+		}
+		for key, value := range update.Metadata {
+			if value == "" {
+				delete(metadata, key)
+			} else {
+				metadata[key] = value
+			}
+		}
+		if len(metadata) > maxMetadataKeys {
+			handler.ActiveRooms.Unlock()
+			return newStreamError(model.ErrorCodeInvalidBody, fmt.Sprintf("Rooms can't have more than %d metadata keys", maxMetadataKeys))
+		}
+		room.Metadata = metadata
+	}
+	handler.ActiveRooms.Rooms[roomName] = room
+	recipients := members(room)
+	info := roomInfo(room)
+	handler.ActiveRooms.Unlock()
+
+	log.Printf("User %s updated room %s", actor.Username, roomName)
+	updated := newEvent(model.StreamEventRoomUpdated, roomName, actor.Username, "")
+	updated.RoomInfo = &info
+	handler.broadcastRoom(roomName, recipients, updated)
+	return nil
+}
+
+// setRoomRole changes the room role of a member of the room and notifies the members.
+func (handler *Handler) setRoomRole(actor principal, roomName string, target string, role model.RoomRole) error {
+	if !validRoomRole(role) {
+		return newStreamError(model.ErrorCodeInvalidRole, fmt.Sprintf("Invalid room role '%s'", role))
+	}
+
+	targetPrincipal := handler.principalOf(target)
+	handler.ActiveRooms.Lock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if _, isMember := room.Members[target]; !ok || !isMember {
+		handler.ActiveRooms.Unlock()
+		return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", target, roomName))
+	}
+	if err := authorize(actor, actionSetRoomRole, room, targetPrincipal, role); err != nil {
+		handler.ActiveRooms.Unlock()
+		return err
+	}
+	if room.Roles == nil {
+		room.Roles = make(map[string]model.RoomRole)
+		handler.ActiveRooms.Rooms[roomName] = room
+	}
+	room.Roles[target] = role
+	recipients := members(room)
+	handler.ActiveRooms.Unlock()
+
+	log.Printf("User %s set the role of %s in room %s to %s", actor.Username, target, roomName, role)
+	roleChanged := newEvent(model.StreamEventRoleChanged, roomName, target, "")
+	roleChanged.Role = role
+	handler.broadcastRoom(roomName, recipients, roleChanged)
+	return nil
+}
+
+// removeUserFromRooms removes the user from every room it joined, notifying the remaining members on this node.
+// It returns the rooms the user left, whose members on other nodes the caller notifies, and the rooms deleted
+// because the user was their last member, so that the caller publishes and unsubscribes once it releases the locks.
+// This function assumes that the LoggedUsers lock is already acquired by the caller.
+func (handler *Handler) removeUserFromRooms(username string) (left []string, deleted []string) {
+	type departure struct {
+		room       string
+		recipients []string
+	}
+	var departures []departure
+
+	handler.ActiveRooms.Lock()
+	for roomName, room := range handler.ActiveRooms.Rooms {
+		if _, ok := room.Members[username]; !ok {
+			continue
+		}
+		left = append(left, roomName)
+		if handler.removeMemberLocked(room, username) {
+			deleted = append(deleted, roomName)
+		}
+		if len(room.Members) == 0 {
+			continue
+		}
+		departures = append(departures, departure{room: roomName, recipients: members(room)})
+	}
+	handler.ActiveRooms.Unlock()
+
+	for _, departure := range departures {
+		handler.broadcast(departure.recipients, newEvent(model.StreamEventLeft, departure.room, username, ""))
+	}
+	return left, deleted
+}
+
+// renameRoomMember moves the membership, role and mute of the user in every room to its new username.
+// It returns the members of every room of the user.
+// This function assumes that the LoggedUsers lock is already acquired by the caller.
+func (handler *Handler) renameRoomMember(username string, nickname string) map[string][]string {
+	rooms := make(map[string][]string)
+
+	handler.ActiveRooms.Lock()
+	defer handler.ActiveRooms.Unlock()
+	for roomName, room := range handler.ActiveRooms.Rooms {
+		if _, ok := room.Members[username]; !ok {
+			continue
+		}
+		delete(room.Members, username)
+		room.Members[nickname] = struct{}{}
+		if role, ok := room.Roles[username]; ok {
+			delete(room.Roles, username)
+			room.Roles[nickname] = role
+		}
+		if until, ok := room.Mutes[username]; ok {
+			delete(room.Mutes, username)
+			room.Mutes[nickname] = until
+		}
+		rooms[roomName] = members(room)
+	}
+	return rooms
+}
+
+// broadcast queues the event in the channel of every one of the given users that is connected to the stream.
+// It only acquires the locks of the connection registry, so it can be called holding the LoggedUsers or ActiveRooms locks.
+func (handler *Handler) broadcast(usernames []string, event model.StreamEvent) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, username := range usernames {
+		if connected, queued := handler.connections.send(username, message); connected && !queued {
+			log.Printf("Channel for user %s is full, dropping %s event", username, event.Type)
+		}
+	}
+}
+
+// sendEvent delivers the event to a single user, if it is connected to the stream.
+// Users that are not logged in to this node get the event through the broker, in case they are connected to another node.
+func (handler *Handler) sendEvent(username string, event model.StreamEvent) {
+	handler.LoggedUsers.RLock()
+	_, local := handler.LoggedUsers.Users[username]
+	handler.LoggedUsers.RUnlock()
+	handler.broadcast([]string{username}, event)
+	if !local {
+		handler.relay(userTopic(username), event)
+	}
+}
+
+// streamError is an error caused by a frame sent through the stream, reported back to the user as an error event.
+type streamError struct {
+	code    string
+	message string
+}
+
+func newStreamError(code string, message string) *streamError {
+	return &streamError{code: code, message: message}
+}
+
+func (err *streamError) Error() string {
+	return err.message
+}
+
+// streamErrorCode returns the error code of a request error, or the internal error code for unexpected errors.
+func streamErrorCode(err error) string {
+	var requestError *streamError
+	if errors.As(err, &requestError) {
+		return requestError.code
+	}
+	return model.ErrorCodeInternal
+}
@@ -0,0 +1,279 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomJoinMessageAndLeave(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	bob := connectToStream(t, server, "bob", "bob-token")
+	defer bob.Close()
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+	joined := expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+	if strings.Join(joined.Members, ",") != "alice,bob" {
+		t.Errorf("Unexpected members in the join response: %v", joined.Members)
+	}
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello"})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		event := expectEvent(t, conn, model.StreamEventMessage, "general", "alice")
+		if event.Text != "hello" {
+			t.Errorf("Unexpected message text: got %v want %v", event.Text, "hello")
+		}
+	}
+
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestLeave, Room: "general"})
+	expectEvent(t, bob, model.StreamEventLeft, "general", "bob")
+	expectEvent(t, alice, model.StreamEventLeft, "general", "bob")
+
+	handlerFixture.ActiveRooms.RLock()
+	defer handlerFixture.ActiveRooms.RUnlock()
+	if _, ok := handlerFixture.ActiveRooms.Rooms["general"].Members["bob"]; ok {
+		t.Errorf("User should be removed from the room members")
+	}
+}
+
+func TestRoomMessageNotInRoom(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello"})
+	event := expectEvent(t, alice, model.StreamEventError, "general", "")
+	if event.Error == nil || event.Error.Code != model.ErrorCodeNotInRoom {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+}
+
+func TestRoomUnknownRequest(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+
+	sendRequest(t, alice, model.StreamRequest{Type: "dance"})
+	event := expectEvent(t, alice, model.StreamEventError, "", "")
+	if event.Error == nil || event.Error.Code != model.ErrorCodeUnknownRequest {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+}
+
+func TestRoomMembersNotifiedOnDisconnect(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	bob := connectToStream(t, server, "bob", "bob-token")
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+
+	bob.Close()
+	expectEvent(t, alice, model.StreamEventLeft, "general", "bob")
+
+	handlerFixture.LoggedUsers.RLock()
+	defer handlerFixture.LoggedUsers.RUnlock()
+	if _, ok := handlerFixture.LoggedUsers.Users["bob"]; ok {
+		t.Errorf("User should be removed from the list of logged users")
+	}
+}
+
+// connectToStream opens a websocket to the test server and completes the handshake for the user.
+func connectToStream(t *testing.T, server *httptest.Server, username string, token string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + server.URL[4:] + "/stream"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+
+	msg, err := json.Marshal(model.UserWithTokenRequest{Username: username, Token: token})
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	_, response, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	var welcome model.WebsocketWelcomeResponse
+	if err := json.Unmarshal(response, &welcome); err != nil || welcome.Welcome != username {
+		t.Fatalf("Unexpected welcome message: %s", response)
+	}
+	return conn
+}
+
+// sendRequest sends a StreamRequest through the websocket.
+func sendRequest(t *testing.T, conn *websocket.Conn, request model.StreamRequest) {
+	t.Helper()
+
+	msg, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+}
+
+// expectEvent reads the next StreamEvent from the websocket and checks its type, room and sender.
+func expectEvent(t *testing.T, conn *websocket.Conn, eventType string, room string, from string) model.StreamEvent {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, response, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	var event model.StreamEvent
+	if err := json.Unmarshal(response, &event); err != nil {
+		t.Fatalf("Failed to unmarshal event: %v", err)
+	}
+	if event.Type != eventType || event.Room != room || event.From != from {
+		t.Fatalf("Unexpected event: got %s want type=%s room=%s from=%s", response, eventType, room, from)
+	}
+	return event
+}
+
+func TestRoomSetRole(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	bob := connectToStream(t, server, "bob", "bob-token")
+	defer bob.Close()
+
+	// The user that creates the room owns it
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	if joined := expectEvent(t, alice, model.StreamEventJoined, "general", "alice"); joined.Role != model.RoomRoleOwner {
+		t.Errorf("Creator of the room should be its owner, got %v", joined.Role)
+	}
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+	if joined := expectEvent(t, bob, model.StreamEventJoined, "general", "bob"); joined.Role != model.RoomRoleMember {
+		t.Errorf("Other users should join as members, got %v", joined.Role)
+	}
+
+	// Members can't change roles
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestSetRole, Room: "general", User: "alice", Role: model.RoomRoleReadOnly})
+	if event := expectEvent(t, bob, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeForbidden {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	// Read-only members can't send messages
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestSetRole, Room: "general", User: "bob", Role: model.RoomRoleReadOnly})
+	expectEvent(t, alice, model.StreamEventRoleChanged, "general", "bob")
+	if event := expectEvent(t, bob, model.StreamEventRoleChanged, "general", "bob"); event.Role != model.RoomRoleReadOnly {
+		t.Errorf("Unexpected role in role_changed event: %v", event.Role)
+	}
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello"})
+	if event := expectEvent(t, bob, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeForbidden {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+}
+
+func TestRoomUpdate(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.addUserLocked(model.User{Username: "alice", Token: "alice-token"})
+	handlerFixture.addUserLocked(model.User{Username: "bob", Token: "bob-token"})
+
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	alice := connectToStream(t, server, "alice", "alice-token")
+	defer alice.Close()
+	bob := connectToStream(t, server, "bob", "bob-token")
+	defer bob.Close()
+
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	created := expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	if created.RoomInfo == nil || created.RoomInfo.CreatedBy != "alice" || created.RoomInfo.CreatedAt.IsZero() {
+		t.Fatalf("Unexpected room info in the join response: %+v", created.RoomInfo)
+	}
+
+	topic, description := "Welcome", "The general room"
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestUpdateRoom, Room: "general", Update: &model.RoomUpdate{
+		Topic:       &topic,
+		Description: &description,
+		Metadata:    map[string]string{"lang": "en", "rules": "be nice"},
+	}})
+	updated := expectEvent(t, alice, model.StreamEventRoomUpdated, "general", "alice")
+	if updated.RoomInfo.Topic != topic || updated.RoomInfo.Description != description || len(updated.RoomInfo.Metadata) != 2 {
+		t.Errorf("Unexpected room info in the update: %+v", updated.RoomInfo)
+	}
+
+	// Members joining later get the description of the room
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+	joined := expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+	if joined.RoomInfo.Topic != topic || joined.RoomInfo.Metadata["lang"] != "en" || joined.RoomInfo.CreatedBy != "alice" {
+		t.Errorf("Unexpected room info in the join response: %+v", joined.RoomInfo)
+	}
+
+	// Only owners can change the description and metadata
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestUpdateRoom, Room: "general", Update: &model.RoomUpdate{Description: &topic}})
+	if event := expectEvent(t, bob, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeForbidden {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	// Topics can't contain line breaks, which would inject commands in the IRC gateway
+	injected := "Welcome\r\nQUIT"
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestUpdateRoom, Room: "general", Update: &model.RoomUpdate{Topic: &injected}})
+	if event := expectEvent(t, alice, model.StreamEventError, "general", ""); event.Error.Code != model.ErrorCodeInvalidBody {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+
+	// Empty values remove metadata keys
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestUpdateRoom, Room: "general", Update: &model.RoomUpdate{Metadata: map[string]string{"rules": ""}}})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		event := expectEvent(t, conn, model.StreamEventRoomUpdated, "general", "alice")
+		if _, ok := event.RoomInfo.Metadata["rules"]; ok || event.RoomInfo.Topic != topic {
+			t.Errorf("Unexpected room info in the update: %+v", event.RoomInfo)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package routes
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// route describes an HTTP endpoint of the server.
+// The list of routes is used both to build the ServeMux and to generate the OpenAPI document,
+// so every endpoint must be declared here. Several routes can share a pattern with different methods.
+type route struct {
+	// Pattern is the ServeMux pattern, path parameters use the {name} syntax.
+	Pattern string
+	// Method is the only HTTP method accepted by the handler.
+	Method  string
+	Summary string
+	Handler http.HandlerFunc
+	// Query lists the optional query string parameters accepted by the endpoint.
+	Query []queryParameter
+	// Request is the model type of the JSON body, nil if the endpoint has no body.
+	Request any
+	// Responses maps each status code to the model type of the returned body.
+	Responses map[int]any
+	// Admin is true for the endpoints that require the admin token, or the session token of a privileged user.
+	Admin bool
+	// Session is true for the endpoints that require the session token of a logged in user.
+	Session bool
+}
+
+// queryParameter describes an optional query string parameter of a route.
+type queryParameter struct {
+	Name        string
+	Description string
+	// Format is the OpenAPI format of the string value, if any.
+	Format string
+}
+
+// textResponse marks a response that is returned as plain text instead of JSON.
+type textResponse string
+
+// eventStream marks a response that is a stream of Server-Sent Events.
+type eventStream string
+
+// jsonDocument marks a response that is an arbitrary JSON document.
+type jsonDocument map[string]any
+
+// routes returns the list of HTTP endpoints served by the handler.
+func (handler *Handler) routes() []route {
+	return []route{
+		{
+			Pattern: "/",
+			Method:  http.MethodGet,
+			Summary: "Welcome message",
+			Handler: homepage,
+			Responses: map[int]any{
+				http.StatusOK: textResponse(""),
+			},
+		},
+		{
+			Pattern: "/login",
+			Method:  http.MethodPost,
+			Summary: "Log in with a username and get a session token",
+			Handler: handler.login,
+			Request: model.UserLoginRequest{},
+			Responses: map[int]any{
+				http.StatusOK:                    model.UserLoginResponse{},
+				http.StatusBadRequest:            model.ErrorResponse{},
+				http.StatusUnauthorized:          model.ErrorResponse{},
+				http.StatusMethodNotAllowed:      model.ErrorResponse{},
+				http.StatusForbidden:             model.ErrorResponse{},
+				http.StatusConflict:              model.ErrorResponse{},
+				http.StatusRequestEntityTooLarge: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/logout",
+			Method:  http.MethodPost,
+			Summary: "Log out, closing the websocket stream of the user",
+			Handler: handler.logout,
+			Request: model.UserWithTokenRequest{},
+			Responses: map[int]any{
+				http.StatusOK:                    model.UserLogoutResponse{},
+				http.StatusBadRequest:            model.ErrorResponse{},
+				http.StatusUnauthorized:          model.ErrorResponse{},
+				http.StatusMethodNotAllowed:      model.ErrorResponse{},
+				http.StatusRequestEntityTooLarge: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/stream",
+			Method:  http.MethodGet,
+			Summary: "Upgrade to the websocket stream described in the AsyncAPI document",
+			Handler: handler.stream,
+			Responses: map[int]any{
+				http.StatusSwitchingProtocols: nil,
+				http.StatusBadRequest:         textResponse(""),
+				http.StatusMethodNotAllowed:   model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/events",
+			Method:  http.MethodGet,
+			Summary: "Receive the stream as Server-Sent Events, for clients that can't open a websocket",
+			Handler: handler.events,
+			Query: []queryParameter{
+				{Name: "username", Description: "Username of the logged in user"},
+				{Name: "token", Description: "Session token of the user, unless it's sent as a bearer token"},
+			},
+			Responses: map[int]any{
+				http.StatusOK:               eventStream(""),
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/poll",
+			Method:  http.MethodGet,
+			Summary: "Receive the frames of the stream queued for the user, waiting until some arrive, for clients that can't keep a connection open",
+			Handler: handler.poll,
+			Session: true,
+			Query: []queryParameter{
+				{Name: "cursor", Description: "Cursor of the previous response, acknowledging its frames"},
+				{Name: "timeout", Description: "Seconds to wait for frames, between 0 and 60, 25 by default"},
+			},
+			Responses: map[int]any{
+				http.StatusOK:               model.PollResponse{},
+				http.StatusBadRequest:       model.ErrorResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/messages",
+			Method:  http.MethodPost,
+			Summary: "Send a request of the stream, for clients receiving it as Server-Sent Events",
+			Handler: handler.postMessage,
+			Request: model.StreamRequest{},
+			Session: true,
+			Responses: map[int]any{
+				http.StatusOK:                    model.StreamRequestResponse{},
+				http.StatusBadRequest:            model.ErrorResponse{},
+				http.StatusUnauthorized:          model.ErrorResponse{},
+				http.StatusForbidden:             model.ErrorResponse{},
+				http.StatusNotFound:              model.ErrorResponse{},
+				http.StatusMethodNotAllowed:      model.ErrorResponse{},
+				http.StatusRequestEntityTooLarge: model.ErrorResponse{},
+				http.StatusInternalServerError:   model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/rooms",
+			Method:  http.MethodGet,
+			Summary: "List the rooms, except the private rooms the user is not in or invited to",
+			Handler: handler.listRooms,
+			Session: true,
+			Responses: map[int]any{
+				http.StatusOK:               model.RoomsResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/me/unread",
+			Method:  http.MethodGet,
+			Summary: "Count the unread messages of the rooms of the user",
+			Handler: handler.getUnread,
+			Session: true,
+			Responses: map[int]any{
+				http.StatusOK:               model.UnreadResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/rooms/{room}/members",
+			Method:  http.MethodGet,
+			Summary: "List the members of a room, online or not, with their room role",
+			Handler: handler.getRoomMembers,
+			Session: true,
+			Responses: map[int]any{
+				http.StatusOK:               model.RoomMembersResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusNotFound:         model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/hooks/{token}",
+			Method:  http.MethodPost,
+			Summary: "Post a message to the room of an incoming webhook, as its bot",
+			Handler: handler.postHook,
+			Request: model.HookMessage{},
+			Responses: map[int]any{
+				http.StatusOK:                    model.HookMessageResponse{},
+				http.StatusBadRequest:            model.ErrorResponse{},
+				http.StatusNotFound:              model.ErrorResponse{},
+				http.StatusMethodNotAllowed:      model.ErrorResponse{},
+				http.StatusRequestEntityTooLarge: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/users",
+			Method:  http.MethodGet,
+			Summary: "List the logged in users",
+			Handler: handler.adminListUsers,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.AdminUsersResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/users/{username}/logout",
+			Method:  http.MethodPost,
+			Summary: "Forcibly log out a user, optionally telling it the reason",
+			Handler: handler.adminLogoutUser,
+			Request: model.AdminLogoutRequest{},
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.AdminActionResponse{},
+				http.StatusBadRequest:       model.ErrorResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusNotFound:         model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/announcements",
+			Method:  http.MethodPost,
+			Summary: "Broadcast a system announcement to a room or to every connected user",
+			Handler: handler.adminAnnounce,
+			Request: model.AdminAnnouncementRequest{},
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.AdminActionResponse{},
+				http.StatusBadRequest:       model.ErrorResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusNotFound:         model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms",
+			Method:  http.MethodGet,
+			Summary: "List the active rooms and their members",
+			Handler: handler.adminListRooms,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.AdminRoomsResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/close",
+			Method:  http.MethodPost,
+			Summary: "Close a room, removing all its members",
+			Handler: handler.adminCloseRoom,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.AdminActionResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusNotFound:         model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/filters",
+			Method:  http.MethodGet,
+			Summary: "Get the message filters of a room",
+			Handler: handler.adminGetRoomFilters,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.RoomFiltersResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/filters",
+			Method:  http.MethodPut,
+			Summary: "Replace the message filters of a room",
+			Handler: handler.adminSetRoomFilters,
+			Request: model.FilterConfig{},
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:                    model.RoomFiltersResponse{},
+				http.StatusBadRequest:            model.ErrorResponse{},
+				http.StatusUnauthorized:          model.ErrorResponse{},
+				http.StatusForbidden:             model.ErrorResponse{},
+				http.StatusMethodNotAllowed:      model.ErrorResponse{},
+				http.StatusRequestEntityTooLarge: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/filters",
+			Method:  http.MethodDelete,
+			Summary: "Make a room use the default message filters",
+			Handler: handler.adminResetRoomFilters,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.RoomFiltersResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/webhooks",
+			Method:  http.MethodGet,
+			Summary: "List the webhooks of a room, without their secrets",
+			Handler: handler.adminListWebhooks,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.WebhooksResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/webhooks",
+			Method:  http.MethodPost,
+			Summary: "Register a webhook receiving the messages, joins and leaves of a room as signed POST requests",
+			Handler: handler.adminCreateWebhook,
+			Request: model.WebhookRequest{},
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:                    model.Webhook{},
+				http.StatusBadRequest:            model.ErrorResponse{},
+				http.StatusUnauthorized:          model.ErrorResponse{},
+				http.StatusForbidden:             model.ErrorResponse{},
+				http.StatusMethodNotAllowed:      model.ErrorResponse{},
+				http.StatusRequestEntityTooLarge: model.ErrorResponse{},
+				http.StatusInternalServerError:   model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/webhooks/{id}",
+			Method:  http.MethodDelete,
+			Summary: "Delete a webhook of a room",
+			Handler: handler.adminDeleteWebhook,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.AdminActionResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusNotFound:         model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/incoming-webhooks",
+			Method:  http.MethodGet,
+			Summary: "List the incoming webhooks of a room, without their tokens",
+			Handler: handler.adminListIncomingWebhooks,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.IncomingWebhooksResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/incoming-webhooks",
+			Method:  http.MethodPost,
+			Summary: "Create an incoming webhook whose token posts messages to a room as a bot",
+			Handler: handler.adminCreateIncomingWebhook,
+			Request: model.IncomingWebhookRequest{},
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:                    model.IncomingWebhook{},
+				http.StatusBadRequest:            model.ErrorResponse{},
+				http.StatusUnauthorized:          model.ErrorResponse{},
+				http.StatusForbidden:             model.ErrorResponse{},
+				http.StatusMethodNotAllowed:      model.ErrorResponse{},
+				http.StatusConflict:              model.ErrorResponse{},
+				http.StatusRequestEntityTooLarge: model.ErrorResponse{},
+				http.StatusInternalServerError:   model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/rooms/{room}/incoming-webhooks/{id}",
+			Method:  http.MethodDelete,
+			Summary: "Delete an incoming webhook of a room, revoking its token",
+			Handler: handler.adminDeleteIncomingWebhook,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.AdminActionResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusNotFound:         model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/webhooks/dead-letters",
+			Method:  http.MethodGet,
+			Summary: "List the webhook deliveries given up after failing every attempt",
+			Handler: handler.adminListDeadLetters,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.DeadLettersResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/bans",
+			Method:  http.MethodGet,
+			Summary: "List the bans currently enforced",
+			Handler: handler.adminListBans,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.BansResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/bans",
+			Method:  http.MethodPost,
+			Summary: "Ban a user by username and optionally by IP, disconnecting it",
+			Handler: handler.adminBan,
+			Request: model.BanRequest{},
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.Ban{},
+				http.StatusBadRequest:       model.ErrorResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/bans/{username}",
+			Method:  http.MethodDelete,
+			Summary: "Lift the ban of a user",
+			Handler: handler.adminUnban,
+			Admin:   true,
+			Responses: map[int]any{
+				http.StatusOK:               model.AdminActionResponse{},
+				http.StatusUnauthorized:     model.ErrorResponse{},
+				http.StatusForbidden:        model.ErrorResponse{},
+				http.StatusNotFound:         model.ErrorResponse{},
+				http.StatusMethodNotAllowed: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/admin/audit",
+			Method:  http.MethodGet,
+			Summary: "Query the audit trail, most recent events last",
+			Handler: handler.adminQueryAudit,
+			Admin:   true,
+			Query: []queryParameter{
+				{Name: "from", Description: "Only events at or after this time", Format: "date-time"},
+				{Name: "to", Description: "Only events at or before this time", Format: "date-time"},
+				{Name: "user", Description: "Only events whose actor or target is this user"},
+				{Name: "action", Description: "Only events with this action"},
+				{Name: "limit", Description: "Maximum number of events, between 1 and 1000"},
+			},
+			Responses: map[int]any{
+				http.StatusOK:                  model.AuditEventsResponse{},
+				http.StatusBadRequest:          model.ErrorResponse{},
+				http.StatusUnauthorized:        model.ErrorResponse{},
+				http.StatusForbidden:           model.ErrorResponse{},
+				http.StatusMethodNotAllowed:    model.ErrorResponse{},
+				http.StatusInternalServerError: model.ErrorResponse{},
+			},
+		},
+		{
+			Pattern: "/openapi.json",
+			Method:  http.MethodGet,
+			Summary: "OpenAPI document of the HTTP endpoints",
+			Handler: serveDocument(openAPIDocument),
+			Responses: map[int]any{
+				http.StatusOK: jsonDocument{},
+			},
+		},
+		{
+			Pattern: "/asyncapi.json",
+			Method:  http.MethodGet,
+			Summary: "AsyncAPI document of the websocket stream",
+			Handler: serveDocument(asyncAPIDocument),
+			Responses: map[int]any{
+				http.StatusOK: jsonDocument{},
+			},
+		},
+	}
+}
+
+// NewServeMux returns a ServeMux with all the routes of the handler registered.
+// Routes sharing a pattern are dispatched by method, answering with an error if none matches.
+func (handler *Handler) NewServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	var patterns []string
+	byPattern := make(map[string][]route)
+	for _, route := range handler.routes() {
+		if _, ok := byPattern[route.Pattern]; !ok {
+			patterns = append(patterns, route.Pattern)
+		}
+		byPattern[route.Pattern] = append(byPattern[route.Pattern], route)
+	}
+
+	for _, pattern := range patterns {
+		routes := byPattern[pattern]
+		if len(routes) == 1 {
+			mux.HandleFunc(pattern, routes[0].Handler)
+			continue
+		}
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			methods := make([]string, 0, len(routes))
+			for _, route := range routes {
+				if route.Method == r.Method {
+					route.Handler(w, r)
+					return
+				}
+				methods = append(methods, route.Method)
+			}
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			writeError(w, http.StatusMethodNotAllowed, model.ErrorCodeMethodNotAllowed, "Invalid request method", r.Method)
+		})
+	}
+	return mux
+}
@@ -0,0 +1,228 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// sessionLeaseTTL is the time a session lasts in a shared SessionRegistry without being refreshed,
+// so that the sessions of a node that stops are released. Nodes refresh their sessions every sessionRefreshInterval.
+const (
+	sessionLeaseTTL        = time.Minute
+	sessionRefreshInterval = sessionLeaseTTL / 3
+)
+
+var (
+	// ErrSessionExists is returned when claiming a username that already has a session.
+	ErrSessionExists = errors.New("session already exists")
+	// ErrSessionNotFound is returned when the session doesn't exist, or has another token.
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// SessionRegistry keeps the sessions of the users, shared by the nodes of the server, so that a username
+// has a single session across the nodes and its token is accepted by all of them.
+type SessionRegistry interface {
+	// Claim starts a session of the username with the token, failing with ErrSessionExists if it already has one.
+	Claim(username string, token string) error
+	// Lookup returns the username of the session with the token, failing with ErrSessionNotFound if there's none.
+	Lookup(token string) (string, error)
+	// Refresh checks that the username has a session with the token and extends it,
+	// failing with ErrSessionNotFound if the session ended.
+	Refresh(username string, token string) error
+	// Release ends the session of the username with the token, whatever its token if it's empty,
+	// failing with ErrSessionNotFound if there's none.
+	Release(username string, token string) error
+}
+
+// MemorySessionRegistry keeps the sessions in memory, for a server running a single node.
+// Its sessions don't expire.
+type MemorySessionRegistry struct {
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func NewMemorySessionRegistry() *MemorySessionRegistry {
+	return &MemorySessionRegistry{tokens: make(map[string]string)}
+}
+
+func (registry *MemorySessionRegistry) Claim(username string, token string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.tokens[username]; ok {
+		return ErrSessionExists
+	}
+	registry.tokens[username] = token
+	return nil
+}
+
+func (registry *MemorySessionRegistry) Lookup(token string) (string, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for username, sessionToken := range registry.tokens {
+		if sessionToken == token {
+			return username, nil
+		}
+	}
+	return "", ErrSessionNotFound
+}
+
+func (registry *MemorySessionRegistry) Refresh(username string, token string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if sessionToken, ok := registry.tokens[username]; !ok || sessionToken != token {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (registry *MemorySessionRegistry) Release(username string, token string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if sessionToken, ok := registry.tokens[username]; !ok || (token != "" && sessionToken != token) {
+		return ErrSessionNotFound
+	}
+	delete(registry.tokens, username)
+	return nil
+}
+
+// addUserLocked adds the user to the logged users, indexing it by its token.
+// This function assumes that the LoggedUsers lock is already acquired by the caller in write mode.
+func (handler *Handler) addUserLocked(user model.User) {
+	handler.LoggedUsers.Users[user.Username] = user
+	if handler.tokens == nil {
+		handler.tokens = make(map[string]string)
+	}
+	handler.tokens[user.Token] = user.Username
+}
+
+// removeUserLocked removes the user from the logged users and from the index of tokens.
+// This function assumes that the LoggedUsers lock is already acquired by the caller in write mode.
+func (handler *Handler) removeUserLocked(username string) {
+	if user, ok := handler.LoggedUsers.Users[username]; ok && handler.tokens[user.Token] == username {
+		delete(handler.tokens, user.Token)
+	}
+	delete(handler.LoggedUsers.Users, username)
+}
+
+// privilegedRole returns the global role of the user, as configured at startup.
+func (handler *Handler) privilegedRole(username string) model.Role {
+	if privilegedUser, ok := handler.PrivilegedUsers[username]; ok {
+		return privilegedUser.Role
+	}
+	return model.RoleUser
+}
+
+// claimSession starts the session of the user in the registry, if one is configured.
+func (handler *Handler) claimSession(username string, token string) error {
+	if handler.Sessions == nil {
+		return nil
+	}
+	return handler.Sessions.Claim(username, token)
+}
+
+// validSession reports whether the registry has a session of the user with the token, started by any node.
+func (handler *Handler) validSession(username string, token string) bool {
+	if handler.Sessions == nil || token == "" {
+		return false
+	}
+	err := handler.Sessions.Refresh(username, token)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		log.Printf("Can't validate the session of %s: %v", username, err)
+	}
+	return err == nil
+}
+
+// releaseSession ends the session of the user in the registry, whatever its token if it's empty.
+// It reports whether the session existed.
+func (handler *Handler) releaseSession(username string, token string) bool {
+	if handler.Sessions == nil {
+		return false
+	}
+	err := handler.Sessions.Release(username, token)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		log.Printf("Can't release the session of %s: %v", username, err)
+	}
+	return err == nil
+}
+
+// adoptSession binds to this node the session of the user started by another node, replacing
+// any previous session of the user on this node. It reports whether the registry has a session with the token.
+// The registry is checked before acquiring the LoggedUsers lock, so a slow registry doesn't delay other requests.
+func (handler *Handler) adoptSession(username string, token string, ip string) bool {
+	if !handler.validSession(username, token) {
+		return false
+	}
+	handler.LoggedUsers.Lock()
+	// The session may have been adopted by another connection meanwhile
+	user, ok := handler.LoggedUsers.Users[username]
+	if ok && user.Token == token {
+		handler.LoggedUsers.Unlock()
+		return true
+	}
+	var cleanup userCleanup
+	if ok {
+		// The registry no longer has the previous token, so its session doesn't need to be released
+		cleanup = CleanupUserData(handler, model.UserWithTokenRequest{Username: username})
+	}
+	handler.addUserLocked(model.User{Username: username, Token: token, Role: handler.privilegedRole(username), IP: ip})
+	handler.LoggedUsers.Unlock()
+
+	if ok {
+		handler.finishCleanup(cleanup)
+	}
+	log.Printf("User %s joined this node with a session started on another node", username)
+	return true
+}
+
+// refreshSessions extends the sessions of the users logged in to this node. Users whose session ended,
+// because it expired or was ended by another node, are disconnected.
+func (handler *Handler) refreshSessions() {
+	if handler.Sessions == nil {
+		return
+	}
+	handler.LoggedUsers.RLock()
+	tokens := make(map[string]string, len(handler.LoggedUsers.Users))
+	for username, user := range handler.LoggedUsers.Users {
+		tokens[username] = user.Token
+	}
+	handler.LoggedUsers.RUnlock()
+
+	for username, token := range tokens {
+		err := handler.Sessions.Refresh(username, token)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrSessionNotFound) {
+			log.Printf("Can't refresh the session of %s: %v", username, err)
+			continue
+		}
+
+		handler.LoggedUsers.Lock()
+		user, ok := handler.LoggedUsers.Users[username]
+		ended := ok && user.Token == token
+		var cleanup userCleanup
+		if ended {
+			handler.broadcast([]string{username}, newEvent(model.StreamEventSystem, "", "", "Session ended"))
+			// The session already ended, so it doesn't need to be released
+			cleanup = CleanupUserData(handler, model.UserWithTokenRequest{Username: username})
+			log.Printf("Session of user %s ended on another node", username)
+		}
+		handler.LoggedUsers.Unlock()
+		if ended {
+			handler.finishCleanup(cleanup)
+		}
+	}
+}
+
+// keepSessionsAlive refreshes the sessions of the users logged in to this node every interval.
+func (handler *Handler) keepSessionsAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		handler.refreshSessions()
+	}
+}
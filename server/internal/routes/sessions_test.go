@@ -0,0 +1,154 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+func TestRedisSessionRegistry(t *testing.T) {
+	server := newFakeRedis(t)
+	registry, err := NewRedisSessionRegistry(server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+
+	if err := registry.Claim("alice", "alice-token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Claim("alice", "other-token"); !errors.Is(err, ErrSessionExists) {
+		t.Errorf("Claiming a username with a session should fail, got %v", err)
+	}
+	if username, err := registry.Lookup("alice-token"); err != nil || username != "alice" {
+		t.Errorf("Unexpected lookup: got %q, %v", username, err)
+	}
+	if err := registry.Refresh("alice", "other-token"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Refreshing with another token should fail, got %v", err)
+	}
+	if err := registry.Release("alice", "other-token"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Releasing with another token should fail, got %v", err)
+	}
+	if err := registry.Refresh("alice", "alice-token"); err != nil {
+		t.Errorf("Session should survive a release with another token: %v", err)
+	}
+	if err := registry.Release("alice", ""); err != nil {
+		t.Errorf("Forced release failed: %v", err)
+	}
+	if _, err := registry.Lookup("alice-token"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Released token should not be found, got %v", err)
+	}
+	if err := registry.Release("alice", ""); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Releasing a released session should fail, got %v", err)
+	}
+
+	// Sessions that are not refreshed expire
+	registry.TTL = 50 * time.Millisecond
+	if err := registry.Claim("bob", "bob-token"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := registry.Refresh("bob", "bob-token"); err != nil {
+		t.Errorf("Refresh failed: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if username, err := registry.Lookup("bob-token"); err != nil || username != "bob" {
+		t.Errorf("Refreshed session should not expire: got %q, %v", username, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := registry.Refresh("bob", "bob-token"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Session should expire, got %v", err)
+	}
+	if err := registry.Claim("bob", "new-token"); err != nil {
+		t.Errorf("Username of an expired session should be free: %v", err)
+	}
+}
+
+// sessionNode starts a node of a cluster sharing the session registry.
+func sessionNode(t *testing.T, sessions SessionRegistry) (*Handler, *httptest.Server) {
+	t.Helper()
+	handler := NewHandler()
+	handler.Sessions = sessions
+	handler.AdminToken = "admin-token"
+	server := httptest.NewServer(handler.NewServeMux())
+	t.Cleanup(server.Close)
+	return handler, server
+}
+
+func TestSessionsAcrossNodes(t *testing.T) {
+	clusters := map[string]func(t *testing.T) (SessionRegistry, SessionRegistry){
+		"memory": func(t *testing.T) (SessionRegistry, SessionRegistry) {
+			registry := NewMemorySessionRegistry()
+			return registry, registry
+		},
+		"redis": func(t *testing.T) (SessionRegistry, SessionRegistry) {
+			server := newFakeRedis(t)
+			var registries [2]SessionRegistry
+			for i := range registries {
+				registry, err := NewRedisSessionRegistry(server.listener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { registry.Close() })
+				registries[i] = registry
+			}
+			return registries[0], registries[1]
+		},
+	}
+	for name, newCluster := range clusters {
+		t.Run(name, func(t *testing.T) {
+			sessionsA, sessionsB := newCluster(t)
+			handlerA, nodeA := sessionNode(t, sessionsA)
+			handlerB, nodeB := sessionNode(t, sessionsB)
+
+			// A username has a single session across the nodes
+			alice := loginUser(t, nodeA, "alice")
+			resp, err := http.Post(nodeB.URL+"/login", "application/json", strings.NewReader(`{"username":"alice"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusConflict {
+				t.Errorf("Login on another node returned wrong status code: got %v want %v", resp.StatusCode, http.StatusConflict)
+			}
+
+			// The token is accepted by every node
+			conn := connectToStream(t, nodeB, "alice", alice.Token)
+			defer conn.Close()
+			bob := loginUser(t, nodeA, "bob")
+			req, _ := http.NewRequest(http.MethodGet, nodeB.URL+"/rooms", nil)
+			req.Header.Set("Authorization", "Bearer "+bob.Token)
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Request with a token of another node returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+			}
+
+			// A forced logout on a node disconnects the user from the others
+			if rr := adminRequest(t, handlerA, http.MethodPost, "/admin/users/alice/logout", `{}`); rr.Code != http.StatusOK {
+				t.Fatalf("Forced logout returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			handlerB.refreshSessions()
+			if event := expectEvent(t, conn, model.StreamEventSystem, "", ""); event.Text != "Session ended" {
+				t.Errorf("Unexpected event: %+v", event)
+			}
+			waitForLogout(t, handlerB, "alice")
+			loginUser(t, nodeB, "alice")
+
+			// Users only logged in to another node can be logged out too
+			if rr := adminRequest(t, handlerB, http.MethodPost, "/admin/users/bob/logout", `{}`); rr.Code != http.StatusOK {
+				t.Fatalf("Forced logout from another node returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			handlerA.refreshSessions()
+			waitForLogout(t, handlerA, "bob")
+		})
+	}
+}
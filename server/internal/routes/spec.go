@@ -0,0 +1,360 @@
+package routes
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// openAPIDocument is the committed OpenAPI document, kept in sync with the routes by the tests.
+//
+//go:embed spec/openapi.json
+var openAPIDocument []byte
+
+// asyncAPIDocument is the committed AsyncAPI document, kept in sync with streamMessages by the tests.
+//
+//go:embed spec/asyncapi.json
+var asyncAPIDocument []byte
+
+// apiVersion is the version reported by both API documents.
+const apiVersion = "1.0.0"
+
+// streamMessage describes a frame exchanged through the websocket stream.
+type streamMessage struct {
+	Name    string
+	Summary string
+	// Send is true for frames sent by the client and false for frames sent by the server.
+	Send bool
+	// Events is true for the frames also sent as the data of the Server-Sent Events stream.
+	Events  bool
+	Payload any
+}
+
+// streamMessages returns the frames of the websocket stream, in the order they are exchanged.
+func streamMessages() []streamMessage {
+	return []streamMessage{
+		{
+			Name:    "handshake",
+			Summary: "First frame sent by the client to bind the connection to a logged in user",
+			Send:    true,
+			Payload: model.UserWithTokenRequest{},
+		},
+		{
+			Name:    "welcome",
+			Summary: "Sent by the server once the handshake succeeds",
+			Events:  true,
+			Payload: model.WebsocketWelcomeResponse{},
+		},
+		{
+			Name:    "error",
+			Summary: "Sent by the server when the handshake is rejected",
+			Payload: model.ErrorResponse{},
+		},
+		{
+			Name:    "request",
+			Summary: "Frame sent by the client after the handshake to join or leave a room, or to send a message to a room",
+			Send:    true,
+			Payload: model.StreamRequest{},
+		},
+		{
+			Name:    "event",
+			Summary: "Frame sent by the server after the handshake, for room activity and errors caused by a request",
+			Events:  true,
+			Payload: model.StreamEvent{},
+		},
+	}
+}
+
+// serveDocument returns a handler function that serves the given JSON document.
+func serveDocument(document []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	}
+}
+
+// pathParameter matches the {name} path parameters of a route pattern.
+var pathParameter = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\.*\}`)
+
+// generateOpenAPI builds the OpenAPI document for the given routes.
+func generateOpenAPI(routes []route) ([]byte, error) {
+	schemas := schemaRegistry{}
+	paths := map[string]any{}
+	for _, route := range routes {
+		operation := map[string]any{
+			"summary":     route.Summary,
+			"operationId": operationID(route),
+		}
+
+		var parameters []any
+		for _, match := range pathParameter.FindAllStringSubmatch(route.Pattern, -1) {
+			parameters = append(parameters, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		for _, query := range route.Query {
+			schema := map[string]any{"type": "string"}
+			if query.Format != "" {
+				schema["format"] = query.Format
+			}
+			parameters = append(parameters, map[string]any{
+				"name":        query.Name,
+				"in":          "query",
+				"description": query.Description,
+				"schema":      schema,
+			})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+
+		if route.Admin {
+			operation["security"] = []any{map[string]any{"adminToken": []any{}}}
+		}
+		if route.Session {
+			operation["security"] = []any{map[string]any{"sessionToken": []any{}}}
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemas.schemaFor(reflect.TypeOf(route.Request))},
+				},
+			}
+		}
+
+		responses := map[string]any{}
+		for status, body := range route.Responses {
+			response := map[string]any{"description": http.StatusText(status)}
+			if content := contentFor(schemas, body); content != nil {
+				response["content"] = content
+			}
+			responses[strconv.Itoa(status)] = response
+		}
+		operation["responses"] = responses
+
+		path := pathParameter.ReplaceAllString(route.Pattern, "{$1}")
+		if _, ok := paths[path]; !ok {
+			paths[path] = map[string]any{}
+		}
+		paths[path].(map[string]any)[strings.ToLower(route.Method)] = operation
+	}
+
+	return marshalDocument(map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Go chat room API",
+			"version": apiVersion,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Admin token configured with the CHAT_ADMIN_TOKEN environment variable, or the session token of a privileged user",
+				},
+				"sessionToken": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Session token returned by the login endpoint",
+				},
+			},
+		},
+	})
+}
+
+// generateAsyncAPI builds the AsyncAPI document for the given websocket frames.
+func generateAsyncAPI(messages []streamMessage) ([]byte, error) {
+	schemas := schemaRegistry{}
+	var sent, received, events []any
+	for _, message := range messages {
+		definition := map[string]any{
+			"name":    message.Name,
+			"summary": message.Summary,
+		}
+		if _, ok := message.Payload.(textResponse); ok {
+			definition["contentType"] = "text/plain"
+			definition["payload"] = map[string]any{"type": "string"}
+		} else {
+			definition["contentType"] = "application/json"
+			definition["payload"] = schemas.schemaFor(reflect.TypeOf(message.Payload))
+		}
+		if message.Send {
+			sent = append(sent, definition)
+		} else {
+			received = append(received, definition)
+		}
+		if message.Events {
+			events = append(events, definition)
+		}
+	}
+
+	return marshalDocument(map[string]any{
+		"asyncapi": "2.6.0",
+		"info": map[string]any{
+			"title":   "Go chat room stream",
+			"version": apiVersion,
+		},
+		"defaultContentType": "application/json",
+		"channels": map[string]any{
+			"/stream": map[string]any{
+				"description": "Websocket stream. The first frame must be the handshake, answered with a welcome or an error frame. " +
+					"Frames are JSON unless the client requests the " + model.SubprotocolMessagePack + " subprotocol, which sends the same frames " +
+					"encoded as MessagePack in binary frames. Clients can negotiate permessage-deflate compression.",
+				"publish": map[string]any{
+					"summary": "Frames sent by the client",
+					"message": map[string]any{"oneOf": sent},
+				},
+				"subscribe": map[string]any{
+					"summary": "Frames sent by the server",
+					"message": map[string]any{"oneOf": received},
+				},
+			},
+			"/events": map[string]any{
+				"description": "Server-Sent Events fallback of the websocket stream, authenticated with the username and token query parameters. " +
+					"The data of every event is a JSON frame, the welcome frame first. Requests are sent with POST /messages.",
+				"subscribe": map[string]any{
+					"summary": "Frames sent by the server",
+					"message": map[string]any{"oneOf": events},
+				},
+			},
+		},
+		"components": map[string]any{
+			"schemas": schemas,
+		},
+	})
+}
+
+// marshalDocument marshals an API document with a stable, human friendly layout.
+func marshalDocument(document map[string]any) ([]byte, error) {
+	out, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// operationID derives a unique operation identifier from the method and pattern of a route.
+func operationID(route route) string {
+	name := strings.ToLower(route.Method)
+	for _, part := range strings.FieldsFunc(route.Pattern, func(r rune) bool {
+		return r == '/' || r == '.' || r == '{' || r == '}' || r == '_' || r == '-'
+	}) {
+		name += strings.ToUpper(part[:1]) + part[1:]
+	}
+	if name == strings.ToLower(route.Method) {
+		name += "Root"
+	}
+	return name
+}
+
+// contentFor returns the OpenAPI content object for a response body, nil if there is no body.
+func contentFor(schemas schemaRegistry, body any) map[string]any {
+	switch body.(type) {
+	case nil:
+		return nil
+	case textResponse:
+		return map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+	case eventStream:
+		return map[string]any{"text/event-stream": map[string]any{"schema": map[string]any{"type": "string"}}}
+	case jsonDocument:
+		return map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object"}}}
+	}
+	return map[string]any{"application/json": map[string]any{"schema": schemas.schemaFor(reflect.TypeOf(body))}}
+}
+
+// schemaRegistry collects the JSON schemas of the named struct types referenced by a document.
+type schemaRegistry map[string]any
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// rawMessageType is the type of the JSON values of any shape, such as the frames returned by a poll.
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// schemaFor returns the JSON schema of the given type, registering named structs as components.
+func (schemas schemaRegistry) schemaFor(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	if t == rawMessageType {
+		return map[string]any{"type": "object"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemas.schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemas.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemas.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return schemas.structSchema(t)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Register a placeholder first so recursive types terminate
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = schemas.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// structSchema returns the JSON schema of a struct, following its json tags.
+func (schemas schemaRegistry) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemas.schemaFor(field.Type)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if required != nil {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// update regenerates the committed API documents: go test ./internal/routes -run Spec -update
+var update = flag.Bool("update", false, "regenerate the API documents in the spec directory")
+
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	handlerFixture := Handler{
+		LoggedUsers: model.LoggedUsers{
+			Users: make(model.Users),
+		},
+	}
+	generated, err := generateOpenAPI(handlerFixture.routes())
+	if err != nil {
+		t.Fatalf("Failed to generate OpenAPI document: %v", err)
+	}
+	compareDocument(t, "spec/openapi.json", openAPIDocument, generated)
+}
+
+func TestAsyncAPISpecMatchesStreamMessages(t *testing.T) {
+	generated, err := generateAsyncAPI(streamMessages())
+	if err != nil {
+		t.Fatalf("Failed to generate AsyncAPI document: %v", err)
+	}
+	compareDocument(t, "spec/asyncapi.json", asyncAPIDocument, generated)
+}
+
+func TestSpecRoutesOnlyAcceptDocumentedMethod(t *testing.T) {
+	handlerFixture := Handler{
+		LoggedUsers: model.LoggedUsers{
+			Users: make(model.Users),
+		},
+	}
+	mux := handlerFixture.NewServeMux()
+	for _, route := range handlerFixture.routes() {
+		// The homepage is the catch-all route and answers to any method
+		if route.Pattern == "/" {
+			continue
+		}
+		t.Run(route.Pattern, func(t *testing.T) {
+			method := http.MethodPatch
+			path := pathParameter.ReplaceAllString(route.Pattern, "test")
+			req, err := http.NewRequest(method, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusMethodNotAllowed {
+				t.Errorf("handler returned wrong status code: got %v want %v",
+					status, http.StatusMethodNotAllowed)
+			}
+			if allow := rr.Header().Get("Allow"); !strings.Contains(allow, route.Method) {
+				t.Errorf("handler allows a method that is not documented: got %v want %v",
+					allow, route.Method)
+			}
+		})
+	}
+}
+
+func TestServeOpenAPIDocument(t *testing.T) {
+	req, err := http.NewRequest("GET", "/openapi.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handlerFixture := Handler{
+		LoggedUsers: model.LoggedUsers{
+			Users: make(model.Users),
+		},
+	}
+	handlerFixture.NewServeMux().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	if !strings.Contains(rr.Body.String(), `"openapi": "3.0.3"`) {
+		t.Errorf("handler returned unexpected body: %v", rr.Body.String())
+	}
+}
+
+// compareDocument fails the test if the committed document differs from the generated one,
+// or rewrites the committed document when the -update flag is set.
+func compareDocument(t *testing.T, path string, committed []byte, generated []byte) {
+	t.Helper()
+
+	if *update {
+		if err := os.WriteFile(path, generated, 0o644); err != nil {
+			t.Fatalf("Failed to update %s: %v", path, err)
+		}
+		return
+	}
+	if !bytes.Equal(committed, generated) {
+		t.Errorf("%s is out of date, regenerate it with: go test ./internal/routes -run Spec -update", path)
+	}
+}
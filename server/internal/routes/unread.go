@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// unreadCounts returns the unread counts of the rooms the user is a member of, sorted by room.
+// Rooms that no longer exist, for example after a restart of the server, have no unread messages.
+func (handler *Handler) unreadCounts(username string) []model.UnreadCount {
+	if handler.Memberships == nil {
+		return nil
+	}
+	markers, err := handler.Memberships.ReadMarkers(username)
+	if err != nil {
+		log.Printf("Can't load the read markers of %s: %v", username, err)
+		return nil
+	}
+
+	counts := make([]model.UnreadCount, 0, len(markers))
+	handler.ActiveRooms.RLock()
+	for roomName, lastRead := range markers {
+		counts = append(counts, unreadCount(handler.ActiveRooms.Rooms[roomName], roomName, lastRead))
+	}
+	handler.ActiveRooms.RUnlock()
+
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Room < counts[j].Room })
+	return counts
+}
+
+// unreadCount counts the messages of the room sent after the lastRead message.
+func unreadCount(room model.Room, roomName string, lastRead int64) model.UnreadCount {
+	return model.UnreadCount{
+		Room:          roomName,
+		LastReadID:    lastRead,
+		LastMessageID: room.LastMessageID,
+		Unread:        max(room.LastMessageID-lastRead, 0),
+	}
+}
+
+// markRoomRead advances the read marker of the user in the room to the given message, zero meaning the last one,
+// and sends the resulting unread count to the user.
+func (handler *Handler) markRoomRead(actor principal, roomName string, messageID int64) error {
+	username := actor.Username
+	if messageID < 0 {
+		return newStreamError(model.ErrorCodeInvalidBody, "Message ID can't be negative")
+	}
+
+	handler.ActiveRooms.RLock()
+	room, ok := handler.ActiveRooms.Rooms[roomName]
+	if _, isMember := room.Members[username]; !ok || !isMember {
+		handler.ActiveRooms.RUnlock()
+		return newStreamError(model.ErrorCodeNotInRoom, fmt.Sprintf("User %s is not in room %s", username, roomName))
+	}
+	if messageID == 0 || messageID > room.LastMessageID {
+		messageID = room.LastMessageID
+	}
+	handler.markRead(username, roomName, messageID)
+	handler.ActiveRooms.RUnlock()
+
+	// The marker may already be past the given message, in which case it didn't move
+	for _, count := range handler.unreadCounts(username) {
+		if count.Room == roomName {
+			read := newEvent(model.StreamEventRead, roomName, "", "")
+			read.Unread = &count
+			handler.sendEvent(username, read)
+		}
+	}
+	return nil
+}
+
+// getUnread is a handler function that returns the unread counts of the rooms of the user.
+func (handler *Handler) getUnread(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	actor, ok := handler.authenticateSession(w, r)
+	if !ok {
+		return
+	}
+
+	counts := handler.unreadCounts(actor.Username)
+	if counts == nil {
+		counts = []model.UnreadCount{}
+	}
+	writeJSON(w, http.StatusOK, model.UnreadResponse{Rooms: counts})
+}
@@ -0,0 +1,117 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+func TestUnreadCounts(t *testing.T) {
+	handlerFixture := NewHandler()
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	aliceLogin := loginUser(t, server, "alice")
+	alice := connectToStream(t, server, "alice", aliceLogin.Token)
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "before bob"})
+	if event := expectEvent(t, alice, model.StreamEventMessage, "general", "alice"); event.ID != 1 {
+		t.Errorf("Unexpected message ID: %+v", event)
+	}
+
+	// Messages sent before joining are not unread
+	bobLogin := loginUser(t, server, "bob")
+	bob := connectToStream(t, server, "bob", bobLogin.Token)
+	defer bob.Close()
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+	expectEvent(t, alice, model.StreamEventJoined, "general", "bob")
+	alice.Close()
+	waitForLogout(t, handlerFixture, "alice")
+	expectEvent(t, bob, model.StreamEventLeft, "general", "alice")
+
+	for _, text := range []string{"one", "two", "three"} {
+		sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: text})
+		expectEvent(t, bob, model.StreamEventMessage, "general", "bob")
+	}
+
+	aliceLogin = loginUser(t, server, "alice")
+	expected := []model.UnreadCount{{Room: "general", LastReadID: 1, LastMessageID: 4, Unread: 3}}
+	if !reflect.DeepEqual(aliceLogin.Unread, expected) {
+		t.Errorf("Unexpected unread counts on login: got %+v want %+v", aliceLogin.Unread, expected)
+	}
+
+	// The sender has read its own messages
+	req, err := http.NewRequest("GET", "/me/unread", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bobLogin.Token)
+	rr := httptest.NewRecorder()
+	handlerFixture.NewServeMux().ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var response model.UnreadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	expected = []model.UnreadCount{{Room: "general", LastReadID: 4, LastMessageID: 4, Unread: 0}}
+	if !reflect.DeepEqual(response.Rooms, expected) {
+		t.Errorf("Unexpected unread counts: got %+v want %+v", response.Rooms, expected)
+	}
+
+	alice = connectToStream(t, server, "alice", aliceLogin.Token)
+	defer alice.Close()
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMarkRead, Room: "general", MessageID: 2})
+	if event := expectEvent(t, alice, model.StreamEventRead, "general", ""); event.Unread == nil || event.Unread.Unread != 2 {
+		t.Errorf("Unexpected read event: %+v", event.Unread)
+	}
+	// Markers don't move back
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMarkRead, Room: "general", MessageID: 1})
+	if event := expectEvent(t, alice, model.StreamEventRead, "general", ""); event.Unread.LastReadID != 2 {
+		t.Errorf("Unexpected read event: %+v", event.Unread)
+	}
+	// Zero marks every message as read
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMarkRead, Room: "general"})
+	if event := expectEvent(t, alice, model.StreamEventRead, "general", ""); event.Unread.Unread != 0 || event.Unread.LastReadID != 4 {
+		t.Errorf("Unexpected read event: %+v", event.Unread)
+	}
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMarkRead, Room: "random"})
+	if event := expectEvent(t, alice, model.StreamEventError, "random", ""); event.Error.Code != model.ErrorCodeNotInRoom {
+		t.Errorf("Unexpected error event: %+v", event.Error)
+	}
+}
+
+func TestUnreadCountsAfterRestart(t *testing.T) {
+	// alice read 50 messages of the room before the server restarted
+	store := NewMemoryMembershipStore()
+	store.Add("alice", "general", 0)
+	store.MarkRead("alice", "general", 50)
+	handlerFixture := NewHandler()
+	handlerFixture.Memberships = store
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	// The messages of the room created again are numbered from the start
+	bob := connectToStream(t, server, "bob", loginUser(t, server, "bob").Token)
+	defer bob.Close()
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+	for _, text := range []string{"one", "two", "three"} {
+		sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: text})
+		expectEvent(t, bob, model.StreamEventMessage, "general", "bob")
+	}
+
+	aliceLogin := loginUser(t, server, "alice")
+	expected := []model.UnreadCount{{Room: "general", LastReadID: 0, LastMessageID: 3, Unread: 3}}
+	if !reflect.DeepEqual(aliceLogin.Unread, expected) {
+		t.Errorf("Unexpected unread counts on login: got %+v want %+v", aliceLogin.Unread, expected)
+	}
+}
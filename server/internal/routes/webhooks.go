@@ -0,0 +1,411 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+	"github.com/google/uuid"
+)
+
+const (
+	// webhookMaxAttempts is the number of times a delivery is attempted before it's recorded as a dead letter.
+	webhookMaxAttempts = 5
+	// webhookRetryDelay is the time before the first retry of a delivery, doubled after every failed retry.
+	webhookRetryDelay = time.Second
+	// webhookTimeout is the time a webhook has to answer a delivery.
+	webhookTimeout = 10 * time.Second
+	// maxDeadLetters is the number of dead letters kept, older ones are dropped first.
+	maxDeadLetters = 1000
+	// webhookQueueSize is the number of deliveries waiting for each webhook, deliveries that don't fit
+	// are recorded as dead letters without being attempted.
+	webhookQueueSize = 100
+	// webhookWorkers is the number of deliveries attempted at the same time for each webhook.
+	webhookWorkers = 2
+)
+
+// errWebhookQueueFull is the error of the dead letters of the deliveries dropped because the queue of their webhook was full.
+var errWebhookQueueFull = errors.New("delivery queue full")
+
+// webhookEvents are the types of the events of a room that can be delivered to its webhooks.
+var webhookEvents = []string{model.StreamEventMessage, model.StreamEventAction, model.StreamEventJoined, model.StreamEventLeft}
+
+// webhookDeliveries sends the events to the webhooks, retrying the failed deliveries with exponential backoff,
+// and keeps the dead letters of the deliveries that never succeeded.
+//
+// Every webhook has a queue of up to webhookQueueSize deliveries, attempted by webhookWorkers goroutines,
+// so a slow or failing webhook only delays its own deliveries and can't pile up goroutines.
+type webhookDeliveries struct {
+	client      *http.Client
+	maxAttempts int
+	retryDelay  time.Duration
+
+	mu sync.Mutex
+	// queues are the deliveries waiting for each webhook, by its ID
+	queues      map[string]chan webhookDelivery
+	deadLetters []model.DeadLetter
+}
+
+// webhookDelivery is a delivery waiting in the queue of its webhook.
+type webhookDelivery struct {
+	webhook  model.Webhook
+	delivery model.WebhookDelivery
+}
+
+// newWebhookDeliveries returns the webhookDeliveries with the default attempts and timeouts,
+// which refuse to deliver to private addresses.
+func newWebhookDeliveries() webhookDeliveries {
+	return webhookDeliveries{
+		client:      newWebhookClient(false),
+		maxAttempts: webhookMaxAttempts,
+		retryDelay:  webhookRetryDelay,
+	}
+}
+
+// newWebhookClient returns the HTTP client of the deliveries. It doesn't follow redirects, and unless allowPrivate
+// is set, it doesn't connect to loopback, private or link-local addresses, so webhooks can't be used to reach
+// the services of the network of the server. Addresses are checked once resolved, when connecting,
+// so a public host name can't resolve to a private address either.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network string, address string, conn syscall.RawConn) error {
+			target, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := target.Addr().Unmap(); ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+				return fmt.Errorf("webhook address %s is not public", ip)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		// Requests go straight to the webhook, a proxy would dial the address instead of the dialer
+		Transport: &http.Transport{DialContext: dialer.DialContext, ForceAttemptHTTP2: true},
+		// Redirects are answered as they are, which fails the attempt
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// notifyWebhooks delivers the event to the webhooks of the room subscribed to its type.
+// Deliveries are queued and run in the background, so slow webhooks don't delay the room, and aren't ordered.
+//
+// Webhooks are only kept by the node they are registered on, which owns their deliveries: it's called with the events
+// of the room happening on this node by broadcastRoom, and with the events relayed by the other nodes by the
+// subscription to the room, kept while the room has webhooks. Every event is delivered once, by the node of the webhook.
+func (handler *Handler) notifyWebhooks(roomName string, event model.StreamEvent) {
+	if !slices.Contains(webhookEvents, event.Type) {
+		return
+	}
+	// Deliveries are queued holding the lock, so a webhook being deleted doesn't get its queue started again
+	handler.Webhooks.RLock()
+	defer handler.Webhooks.RUnlock()
+	for _, webhook := range handler.Webhooks.Rooms[roomName] {
+		if len(webhook.Events) > 0 && !slices.Contains(webhook.Events, event.Type) {
+			continue
+		}
+		handler.deliveries.enqueue(webhook, model.WebhookDelivery{ID: uuid.NewString(), Webhook: webhook.ID, Event: event})
+	}
+}
+
+// enqueue adds the delivery to the queue of the webhook, starting its workers if it's the first one.
+// If the queue is full, the delivery is recorded as a dead letter.
+func (deliveries *webhookDeliveries) enqueue(webhook model.Webhook, delivery model.WebhookDelivery) {
+	deliveries.mu.Lock()
+	defer deliveries.mu.Unlock()
+	queue, ok := deliveries.queues[webhook.ID]
+	if !ok {
+		if deliveries.queues == nil {
+			deliveries.queues = make(map[string]chan webhookDelivery)
+		}
+		deliveries.defaultsLocked()
+		queue = make(chan webhookDelivery, webhookQueueSize)
+		deliveries.queues[webhook.ID] = queue
+		for range webhookWorkers {
+			go deliveries.work(queue)
+		}
+	}
+	select {
+	case queue <- webhookDelivery{webhook: webhook, delivery: delivery}:
+	default:
+		log.Printf("Queue of webhook %s of room %s is full, dropping delivery %s", webhook.ID, webhook.Room, delivery.ID)
+		deliveries.deadLetterLocked(webhook, delivery, 0, errWebhookQueueFull)
+	}
+}
+
+// defaultsLocked falls back to the default client, attempts and retry delay for the ones left unset,
+// as they are in a Handler not created by NewHandler. They are set before the first workers start,
+// which read them without the lock.
+// This function assumes that the lock of the deliveries is already acquired by the caller.
+func (deliveries *webhookDeliveries) defaultsLocked() {
+	if deliveries.client == nil {
+		deliveries.client = newWebhookClient(false)
+	}
+	if deliveries.maxAttempts == 0 {
+		deliveries.maxAttempts = webhookMaxAttempts
+	}
+	if deliveries.retryDelay == 0 {
+		deliveries.retryDelay = webhookRetryDelay
+	}
+}
+
+// work attempts the deliveries of the queue until it's closed.
+func (deliveries *webhookDeliveries) work(queue chan webhookDelivery) {
+	for queued := range queue {
+		deliveries.deliver(queued.webhook, queued.delivery)
+	}
+}
+
+// remove closes the queue of the webhook when it's deleted. Deliveries already queued are still attempted.
+func (deliveries *webhookDeliveries) remove(webhookID string) {
+	deliveries.mu.Lock()
+	defer deliveries.mu.Unlock()
+	if queue, ok := deliveries.queues[webhookID]; ok {
+		close(queue)
+		delete(deliveries.queues, webhookID)
+	}
+}
+
+// deliver posts the delivery to the webhook until it succeeds, waiting twice as long after every failure.
+// Once every attempt failed, the delivery is recorded as a dead letter.
+func (deliveries *webhookDeliveries) deliver(webhook model.Webhook, delivery model.WebhookDelivery) {
+	body, err := json.Marshal(delivery)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	delay := deliveries.retryDelay
+	for attempt := 1; ; attempt++ {
+		err = deliveries.post(webhook, delivery, body)
+		if err == nil {
+			return
+		}
+		log.Printf("Delivery %s to webhook %s of room %s failed, attempt %d of %d: %v", delivery.ID, webhook.ID, webhook.Room, attempt, deliveries.maxAttempts, err)
+		if attempt >= deliveries.maxAttempts {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	deliveries.mu.Lock()
+	defer deliveries.mu.Unlock()
+	deliveries.deadLetterLocked(webhook, delivery, deliveries.maxAttempts, err)
+}
+
+// deadLetterLocked records the delivery as a dead letter after the attempts, dropping the oldest one if there are too many.
+// This function assumes that the lock of the deliveries is already acquired by the caller.
+func (deliveries *webhookDeliveries) deadLetterLocked(webhook model.Webhook, delivery model.WebhookDelivery, attempts int, err error) {
+	if len(deliveries.deadLetters) >= maxDeadLetters {
+		deliveries.deadLetters = deliveries.deadLetters[1:]
+	}
+	deliveries.deadLetters = append(deliveries.deadLetters, model.DeadLetter{
+		Webhook:  webhook.ID,
+		Room:     webhook.Room,
+		URL:      webhook.URL,
+		Delivery: delivery,
+		Attempts: attempts,
+		Error:    err.Error(),
+		FailedAt: time.Now().UTC(),
+	})
+}
+
+// post sends a single attempt of the delivery, which succeeds if the webhook answers with a 2xx status code.
+func (deliveries *webhookDeliveries) post(webhook model.Webhook, delivery model.WebhookDelivery, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(model.WebhookEventHeader, delivery.Event.Type)
+	req.Header.Set(model.WebhookDeliveryHeader, delivery.ID)
+	req.Header.Set(model.WebhookSignatureHeader, signWebhook(webhook.Secret, body))
+
+	resp, err := deliveries.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxRequestBodyBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the value of the signature header of a delivery: the HMAC-SHA256 of the body keyed with the secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// randomToken returns 32 random bytes, hex encoded, for the secrets and tokens of the webhooks.
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// validWebhookRequest returns an error describing why the webhook can't be registered, nil if it can.
+func validWebhookRequest(webhookRequest model.WebhookRequest) error {
+	target, err := url.Parse(webhookRequest.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("Invalid webhook URL '%s'", webhookRequest.URL)
+	}
+	for _, eventType := range webhookRequest.Events {
+		if !slices.Contains(webhookEvents, eventType) {
+			return fmt.Errorf("Unknown webhook event '%s', expected one of %v", eventType, webhookEvents)
+		}
+	}
+	return nil
+}
+
+// adminListWebhooks is a handler function that returns the webhooks of a room, without their secrets.
+func (handler *Handler) adminListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureWebhooks); !ok {
+		return
+	}
+
+	roomName := r.PathValue("room")
+	handler.Webhooks.RLock()
+	webhooks := make([]model.Webhook, 0, len(handler.Webhooks.Rooms[roomName]))
+	for _, webhook := range handler.Webhooks.Rooms[roomName] {
+		webhook.Secret = ""
+		webhooks = append(webhooks, webhook)
+	}
+	handler.Webhooks.RUnlock()
+
+	writeJSON(w, http.StatusOK, model.WebhooksResponse{Room: roomName, Webhooks: webhooks})
+}
+
+// adminCreateWebhook is a handler function that registers a webhook for a room.
+// The response is the only time the secret of the webhook is returned.
+func (handler *Handler) adminCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureWebhooks); !ok {
+		return
+	}
+	var webhookRequest model.WebhookRequest
+	if !decodeRequest(w, r, &webhookRequest) {
+		return
+	}
+	roomName := r.PathValue("room")
+	if !validRoomName(roomName) {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidRoom, fmt.Sprintf("Invalid room name '%s'", roomName), "")
+		return
+	}
+	if err := validWebhookRequest(webhookRequest); err != nil {
+		writeError(w, http.StatusBadRequest, model.ErrorCodeInvalidWebhook, err.Error(), "")
+		return
+	}
+
+	webhook := model.Webhook{
+		ID:        uuid.NewString(),
+		Room:      roomName,
+		URL:       webhookRequest.URL,
+		Events:    webhookRequest.Events,
+		Secret:    webhookRequest.Secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	if webhook.Secret == "" {
+		secret, err := randomToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, model.ErrorCodeInternal, "Can't generate the webhook secret", err.Error())
+			return
+		}
+		webhook.Secret = secret
+	}
+
+	handler.Webhooks.Lock()
+	if handler.Webhooks.Rooms == nil {
+		handler.Webhooks.Rooms = make(map[string][]model.Webhook)
+	}
+	handler.Webhooks.Rooms[roomName] = append(handler.Webhooks.Rooms[roomName], webhook)
+	handler.Webhooks.Unlock()
+	// The events of the room happening on other nodes are delivered by this node too
+	handler.subscribeRoom(roomName)
+
+	log.Printf("Webhook %s registered for room %s", webhook.ID, roomName)
+	writeJSON(w, http.StatusOK, webhook)
+}
+
+// adminDeleteWebhook is a handler function that removes a webhook of a room.
+// Deliveries already in progress are still attempted.
+func (handler *Handler) adminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureWebhooks); !ok {
+		return
+	}
+
+	roomName, id := r.PathValue("room"), r.PathValue("id")
+	handler.Webhooks.Lock()
+	webhooks := handler.Webhooks.Rooms[roomName]
+	index := slices.IndexFunc(webhooks, func(webhook model.Webhook) bool { return webhook.ID == id })
+	if index >= 0 {
+		// The slice is copied, since notifyWebhooks may be reading the current one
+		handler.Webhooks.Rooms[roomName] = slices.Delete(slices.Clone(webhooks), index, index+1)
+		if len(handler.Webhooks.Rooms[roomName]) == 0 {
+			delete(handler.Webhooks.Rooms, roomName)
+		}
+		handler.deliveries.remove(id)
+	}
+	handler.Webhooks.Unlock()
+	if index < 0 {
+		writeError(w, http.StatusNotFound, model.ErrorCodeWebhookNotFound, fmt.Sprintf("Webhook %s not found in room %s", id, roomName), "")
+		return
+	}
+	handler.unsubscribeRoom(roomName)
+
+	log.Printf("Webhook %s of room %s deleted", id, roomName)
+	writeJSON(w, http.StatusOK, model.AdminActionResponse{Message: fmt.Sprintf("Webhook %s deleted", id)})
+}
+
+// adminListDeadLetters is a handler function that returns the deliveries given up after failing every attempt, oldest first.
+func (handler *Handler) adminListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, ok := handler.authorizeRequest(w, r, actionConfigureWebhooks); !ok {
+		return
+	}
+
+	handler.deliveries.mu.Lock()
+	deadLetters := slices.Clone(handler.deliveries.deadLetters)
+	handler.deliveries.mu.Unlock()
+	if deadLetters == nil {
+		deadLetters = []model.DeadLetter{}
+	}
+	writeJSON(w, http.StatusOK, model.DeadLettersResponse{DeadLetters: deadLetters})
+}
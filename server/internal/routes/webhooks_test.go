@@ -0,0 +1,330 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DaniSancas/go-chat-room/server/internal/model"
+)
+
+// webhookReceiver is a webhook answering with the status codes of its responses, then with 200.
+// It checks the signatures with the secrets of the webhooks at each path, and sends the deliveries it accepts through its channel.
+type webhookReceiver struct {
+	t          *testing.T
+	mu         sync.Mutex
+	secrets    map[string]string
+	responses  []int
+	requests   atomic.Int32
+	deliveries chan model.WebhookDelivery
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		receiver.t.Error(err)
+	}
+	receiver.mu.Lock()
+	secret := receiver.secrets[r.URL.Path]
+	receiver.mu.Unlock()
+	if signature := r.Header.Get(model.WebhookSignatureHeader); signature != signWebhook(secret, body) {
+		receiver.t.Errorf("Unexpected signature %q of delivery %s", signature, body)
+	}
+	if n := int(receiver.requests.Add(1)); n <= len(receiver.responses) {
+		w.WriteHeader(receiver.responses[n-1])
+		return
+	}
+	var delivery model.WebhookDelivery
+	if err := json.Unmarshal(body, &delivery); err != nil {
+		receiver.t.Error(err)
+	}
+	if r.Header.Get(model.WebhookEventHeader) != delivery.Event.Type || r.Header.Get(model.WebhookDeliveryHeader) != delivery.ID {
+		receiver.t.Errorf("Unexpected headers of delivery %s: %v", body, r.Header)
+	}
+	receiver.deliveries <- delivery
+}
+
+// expectDelivery waits for the receiver to accept a delivery of the event.
+func (receiver *webhookReceiver) expectDelivery(t *testing.T, eventType string, from string) model.WebhookDelivery {
+	t.Helper()
+	select {
+	case delivery := <-receiver.deliveries:
+		if delivery.Event.Type != eventType || delivery.Event.From != from {
+			t.Fatalf("Unexpected delivery: got %+v want type=%s from=%s", delivery, eventType, from)
+		}
+		return delivery
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Webhook didn't get the %s event from %s", eventType, from)
+	}
+	return model.WebhookDelivery{}
+}
+
+// createWebhook registers a webhook through the admin API and returns it.
+func createWebhook(t *testing.T, handler *Handler, room string, body string) model.Webhook {
+	t.Helper()
+	rr := adminRequest(t, handler, "POST", "/admin/rooms/"+room+"/webhooks", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Webhook creation returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var webhook model.Webhook
+	if err := json.Unmarshal(rr.Body.Bytes(), &webhook); err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+func TestWebhooks(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.deliveries.retryDelay = time.Millisecond
+	handlerFixture.deliveries.client = newWebhookClient(true)
+	server := httptest.NewServer(handlerFixture.NewServeMux())
+	defer server.Close()
+
+	// The first delivery fails twice before it's accepted
+	receiver := &webhookReceiver{t: t, secrets: map[string]string{"/": "webhook-secret"}, responses: []int{http.StatusInternalServerError, http.StatusBadGateway}, deliveries: make(chan model.WebhookDelivery, 10)}
+	target := httptest.NewServer(receiver)
+	defer target.Close()
+	webhook := createWebhook(t, handlerFixture, "general", fmt.Sprintf(`{"url": %q, "secret": "webhook-secret"}`, target.URL+"/"))
+	if webhook.ID == "" || webhook.Room != "general" || webhook.Secret != "webhook-secret" {
+		t.Errorf("Unexpected webhook: %+v", webhook)
+	}
+	messagesOnly := createWebhook(t, handlerFixture, "general", fmt.Sprintf(`{"url": %q, "events": ["message"]}`, target.URL+"/messages"))
+	if len(messagesOnly.Secret) != 64 {
+		t.Errorf("A random secret should be generated: %q", messagesOnly.Secret)
+	}
+	receiver.mu.Lock()
+	receiver.secrets["/messages"] = messagesOnly.Secret
+	receiver.mu.Unlock()
+
+	alice := connectToStream(t, server, "alice", loginUser(t, server, "alice").Token)
+	defer alice.Close()
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, alice, model.StreamEventJoined, "general", "alice")
+	delivery := receiver.expectDelivery(t, model.StreamEventJoined, "alice")
+	if delivery.Webhook != webhook.ID || delivery.Event.Room != "general" {
+		t.Errorf("Unexpected delivery: %+v", delivery)
+	}
+	if requests := receiver.requests.Load(); requests != 3 {
+		t.Errorf("Unexpected number of attempts: got %d want %d", requests, 3)
+	}
+
+	// Both webhooks get the messages, each signed with its own secret
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello"})
+	expectEvent(t, alice, model.StreamEventMessage, "general", "alice")
+	delivered := map[string]string{}
+	for range 2 {
+		delivery := receiver.expectDelivery(t, model.StreamEventMessage, "alice")
+		delivered[delivery.Webhook] = delivery.Event.Text
+	}
+	if delivered[webhook.ID] != "hello" || delivered[messagesOnly.ID] != "hello" {
+		t.Errorf("Unexpected deliveries: %v", delivered)
+	}
+
+	// Secrets are only returned when the webhook is registered
+	rr := adminRequest(t, handlerFixture, "GET", "/admin/rooms/general/webhooks", "")
+	var webhooksResponse model.WebhooksResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &webhooksResponse); err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooksResponse.Webhooks) != 2 || webhooksResponse.Webhooks[0].Secret != "" || webhooksResponse.Webhooks[1].ID != messagesOnly.ID {
+		t.Errorf("Unexpected webhooks: %+v", webhooksResponse)
+	}
+
+	if rr := adminRequest(t, handlerFixture, "DELETE", "/admin/rooms/general/webhooks/"+messagesOnly.ID, ""); rr.Code != http.StatusOK {
+		t.Errorf("Webhook deletion returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := adminRequest(t, handlerFixture, "DELETE", "/admin/rooms/general/webhooks/"+messagesOnly.ID, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Deletion of an unknown webhook returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	sendRequest(t, alice, model.StreamRequest{Type: model.StreamRequestLeave, Room: "general"})
+	expectEvent(t, alice, model.StreamEventLeft, "general", "alice")
+	receiver.expectDelivery(t, model.StreamEventLeft, "alice")
+	select {
+	case delivery := <-receiver.deliveries:
+		t.Errorf("Deleted webhook got a delivery: %+v", delivery)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tests := []struct {
+		name string
+		room string
+		body string
+	}{
+		{"invalid url", "general", `{"url": "ftp://example.com"}`},
+		{"relative url", "general", `{"url": "/hooks"}`},
+		{"unknown event", "general", `{"url": "http://example.com", "events": ["kicked"]}`},
+		{"invalid room", "%20", `{"url": "http://example.com"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr := adminRequest(t, handlerFixture, "POST", "/admin/rooms/"+tt.room+"/webhooks", tt.body); rr.Code != http.StatusBadRequest {
+				t.Errorf("Webhook creation returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	handlerFixture := NewHandler()
+	handlerFixture.AdminToken = "secret"
+	handlerFixture.deliveries.retryDelay = time.Millisecond
+	handlerFixture.deliveries.client = newWebhookClient(true)
+	handlerFixture.deliveries.maxAttempts = 3
+
+	var requests atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+	webhook := createWebhook(t, handlerFixture, "general", fmt.Sprintf(`{"url": %q}`, target.URL))
+
+	handlerFixture.broadcastRoom("general", nil, newEvent(model.StreamEventJoined, "general", "alice", ""))
+	// Events that aren't delivered to webhooks don't add dead letters
+	handlerFixture.broadcastRoom("general", nil, newEvent(model.StreamEventKicked, "general", "bob", ""))
+
+	var deadLetters model.DeadLettersResponse
+	for deadline := time.Now().Add(5 * time.Second); len(deadLetters.DeadLetters) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rr := adminRequest(t, handlerFixture, "GET", "/admin/webhooks/dead-letters", "")
+		if err := json.Unmarshal(rr.Body.Bytes(), &deadLetters); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deadLetters.DeadLetters) != 1 {
+		t.Fatalf("Unexpected dead letters: %+v", deadLetters)
+	}
+	deadLetter := deadLetters.DeadLetters[0]
+	if deadLetter.Webhook != webhook.ID || deadLetter.Attempts != 3 || deadLetter.Delivery.Event.Type != model.StreamEventJoined || deadLetter.Error == "" {
+		t.Errorf("Unexpected dead letter: %+v", deadLetter)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("Unexpected number of attempts: got %d want %d", requests.Load(), 3)
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	var redirected atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/elsewhere" {
+			redirected.Add(1)
+			return
+		}
+		http.Redirect(w, r, "/elsewhere", http.StatusTemporaryRedirect)
+	}))
+	defer target.Close()
+
+	// Private addresses are refused unless allowed
+	if _, err := newWebhookClient(false).Post(target.URL, "application/json", nil); err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("Delivery to a loopback address should be refused, got %v", err)
+	}
+
+	// Redirects aren't followed
+	resp, err := newWebhookClient(true).Post(target.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || redirected.Load() != 0 {
+		t.Errorf("Redirect should not be followed: got %v after %d redirects", resp.Status, redirected.Load())
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer target.Close()
+	defer close(release)
+
+	deliveries := newWebhookDeliveries()
+	deliveries.client = newWebhookClient(true)
+	webhook := model.Webhook{ID: "hook", Room: "general", URL: target.URL}
+	// The workers wait for the target, so the queue fills up
+	for i := 0; i < webhookWorkers+webhookQueueSize+1; i++ {
+		deliveries.enqueue(webhook, model.WebhookDelivery{ID: strconv.Itoa(i), Webhook: webhook.ID})
+	}
+
+	deliveries.mu.Lock()
+	deadLetters := slices.Clone(deliveries.deadLetters)
+	deliveries.mu.Unlock()
+	if len(deadLetters) == 0 || deadLetters[0].Error != errWebhookQueueFull.Error() || deadLetters[0].Attempts != 0 {
+		t.Errorf("Deliveries that don't fit in the queue should be dead letters, got %+v", deadLetters)
+	}
+	deliveries.remove(webhook.ID)
+}
+
+func TestWebhooksBetweenNodes(t *testing.T) {
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	// The webhook is registered on a node without members of the room, which delivers the events of the other node
+	nodeA := NewHandler()
+	nodeA.Broker = broker
+	nodeA.AdminToken = "secret"
+	nodeA.deliveries.client = newWebhookClient(true)
+	nodeB := clusterNode(t, broker, "bob")
+
+	receiver := &webhookReceiver{t: t, secrets: map[string]string{"/": "webhook-secret"}, deliveries: make(chan model.WebhookDelivery, 10)}
+	target := httptest.NewServer(receiver)
+	defer target.Close()
+	webhook := createWebhook(t, nodeA, "general", fmt.Sprintf(`{"url": %q, "secret": "webhook-secret"}`, target.URL+"/"))
+
+	bob := connectToStream(t, nodeB, "bob", "bob-token")
+	defer bob.Close()
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestJoin, Room: "general"})
+	expectEvent(t, bob, model.StreamEventJoined, "general", "bob")
+	receiver.expectDelivery(t, model.StreamEventJoined, "bob")
+	sendRequest(t, bob, model.StreamRequest{Type: model.StreamRequestMessage, Room: "general", Text: "hello"})
+	expectEvent(t, bob, model.StreamEventMessage, "general", "bob")
+	if delivery := receiver.expectDelivery(t, model.StreamEventMessage, "bob"); delivery.Webhook != webhook.ID || delivery.Event.Text != "hello" {
+		t.Errorf("Unexpected delivery: %+v", delivery)
+	}
+	// Every event is delivered once, by the node of the webhook
+	select {
+	case delivery := <-receiver.deliveries:
+		t.Errorf("Unexpected delivery: %+v", delivery)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The node stops following the room once its last webhook is deleted
+	if rr := adminRequest(t, nodeA, "DELETE", "/admin/rooms/general/webhooks/"+webhook.ID, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Webhook deletion returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	nodeA.subscriptions.Lock()
+	_, subscribed := nodeA.subscriptions.topics[roomTopic("general")]
+	nodeA.subscriptions.Unlock()
+	if subscribed {
+		t.Errorf("Node should unsubscribe from a room without members nor webhooks")
+	}
+}
+
+func TestWebhookDeliveriesDefaults(t *testing.T) {
+	// The deliveries of a Handler not created by NewHandler fall back to the defaults
+	handlerFixture := &Handler{}
+	handlerFixture.deliveries.mu.Lock()
+	handlerFixture.deliveries.defaultsLocked()
+	handlerFixture.deliveries.mu.Unlock()
+	if deliveries := &handlerFixture.deliveries; deliveries.client == nil || deliveries.maxAttempts != webhookMaxAttempts || deliveries.retryDelay != webhookRetryDelay {
+		t.Errorf("Unexpected defaults: client=%v maxAttempts=%d retryDelay=%v", deliveries.client, deliveries.maxAttempts, deliveries.retryDelay)
+	}
+
+	// Fields already set are kept
+	configured := &Handler{}
+	configured.deliveries.maxAttempts = 1
+	configured.deliveries.mu.Lock()
+	configured.deliveries.defaultsLocked()
+	configured.deliveries.mu.Unlock()
+	if configured.deliveries.maxAttempts != 1 {
+		t.Errorf("Attempts should be kept: got %d", configured.deliveries.maxAttempts)
+	}
+}